@@ -0,0 +1,118 @@
+/* vi: set ts=4 sw=4 noexpandtab : */
+
+/*
+ * Copyright contributors to the IBM Security Verify Directory Operator project
+ */
+
+package v1
+
+/*
+ * This file contains the types and reasons of the standard conditions which
+ * are maintained in the status of an IBMSecurityVerifyDirectory document.
+ *
+ *   Ready:       Whether the directory service is currently available, i.e.
+ *                whether the proxy and the requested replicas are ready.
+ *   Progressing: Whether the operator is currently processing the document.
+ *   Degraded:    Whether the most recent processing of the document failed.
+ *
+ * The availability of the service is reported separately to any failure
+ * in processing the document, as the existing replicas and the proxy will
+ * typically continue to serve requests when a single step fails.
+ *
+ * The same condition types are maintained in the status of an
+ * IBMSecurityVerifyDirectoryBackup document, where Progressing indicates
+ * whether a backup is currently running.
+ */
+
+/*****************************************************************************/
+
+/*
+ * The condition types.
+ */
+
+const (
+	ConditionReady       = "Ready"
+	ConditionProgressing = "Progressing"
+	ConditionDegraded    = "Degraded"
+)
+
+/*
+ * The reasons for the Ready condition.
+ */
+
+const (
+	ReasonReplicasReady    = "ReplicasReady"
+	ReasonReplicasNotReady = "ReplicasNotReady"
+	ReasonProxyNotReady    = "ProxyNotReady"
+)
+
+/*
+ * The reasons for the Progressing condition.
+ */
+
+const (
+	ReasonReconciling       = "Reconciling"
+	ReasonReconcileComplete = "ReconcileComplete"
+	ReasonReconcileFailed   = "ReconcileFailed"
+)
+
+/*
+ * The reasons for the Degraded condition.  Each of the failure reasons
+ * identifies the step of the processing which failed.
+ */
+
+const (
+	ReasonAsExpected                = "AsExpected"
+	ReasonPodListFailed             = "PodListFailed"
+	ReasonServerConfigInvalid       = "ServerConfigInvalid"
+	ReasonCredentialsFailed         = "CredentialsFailed"
+	ReasonCredentialRotationFailed  = "CredentialRotationFailed"
+	ReasonReplicaCreationFailed     = "ReplicaCreationFailed"
+	ReasonReplicaAdditionRolledBack = "ReplicaAdditionRolledBack"
+	ReasonServiceUpdateFailed       = "ServiceUpdateFailed"
+	ReasonCertificateRollFailed     = "CertificateRollFailed"
+	ReasonPrimaryFailoverFailed     = "PrimaryFailoverFailed"
+	ReasonProxyDeploymentFailed     = "ProxyDeploymentFailed"
+	ReasonReplicaDeletionFailed     = "ReplicaDeletionFailed"
+)
+
+/*****************************************************************************/
+
+/*
+ * The conditions which report whether each of the secrets which are
+ * referenced from the server and proxy ConfigMaps can be resolved.  The
+ * server and proxy ConfigMaps are reported separately, so that the result
+ * for one ConfigMap doesn't hide the result for the other.
+ */
+
+const (
+	ConditionServerSecretsResolved = "ServerSecretsResolved"
+	ConditionProxySecretsResolved  = "ProxySecretsResolved"
+)
+
+const (
+	ReasonSecretsResolved   = "SecretsResolved"
+	ReasonSecretNotResolved = "SecretNotResolved"
+)
+
+/*****************************************************************************/
+
+/*
+ * The reasons for the conditions of an IBMSecurityVerifyDirectoryBackup
+ * document.
+ */
+
+const (
+	ReasonBackupCreated      = "BackupCreated"
+	ReasonBackupScheduled    = "BackupScheduled"
+	ReasonBackupRunning      = "BackupRunning"
+	ReasonBackupIdle         = "BackupIdle"
+	ReasonDirectoryNotFound  = "DirectoryNotFound"
+	ReasonReplicaInvalid     = "ReplicaInvalid"
+	ReasonBackupJobFailed    = "BackupJobFailed"
+	ReasonSourceVolumeFailed = "SourceVolumeFailed"
+	ReasonBackupStatusFailed = "BackupStatusFailed"
+)
+
+/*****************************************************************************/
+
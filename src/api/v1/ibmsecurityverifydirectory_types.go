@@ -18,6 +18,76 @@ type IBMSecurityVerifyDirectoryReplica struct {
 	// replica.  Each replica must have its own PVC, and the PVC must be 
 	// pre-created.
 	PVCs []string `json:"pvcs"`
+
+	//+kubebuilder:validation:Enum=offline;online;snapshot
+	// The mode which is used to seed new replicas.  In the offline mode the
+	// principal is stopped while its data volume is copied to the new 
+	// replicas.  In the online mode the principal remains running and the
+	// data is exported from the principal and imported into the new 
+	// replicas using LDAP.  In the snapshot mode the PVC of each new replica
+	// is provisioned from a CSI VolumeSnapshot of the PVC of the principal.
+	// Defaults to online if more than one replica currently exists, 
+	// otherwise offline.  The offline mode is always used if the LDAP port
+	// has not been enabled.
+	// +optional
+	SeedMode string `json:"seedMode,omitempty"`
+
+	// The name of the VolumeSnapshotClass which is used when seeding new
+	// replicas in the snapshot mode.  Defaults to the default 
+	// VolumeSnapshotClass of the cluster.
+	// +optional
+	VolumeSnapshotClassName string `json:"volumeSnapshotClassName,omitempty"`
+
+	// The settings of the job which is used to seed new replicas.
+	// +optional
+	SeedJob *IBMSecurityVerifyDirectorySeedJob `json:"seedJob,omitempty"`
+
+	// The settings of the periodic replication health check.
+	// +optional
+	HealthCheck *IBMSecurityVerifyDirectoryHealthCheck `json:"healthCheck,omitempty"`
+}
+
+// IBMSecurityVerifyDirectoryHealthCheck defines the settings of the periodic
+// check of the health of the replication agreements.
+type IBMSecurityVerifyDirectoryHealthCheck struct {
+	//+kubebuilder:validation:Minimum=0
+	//+kubebuilder:default=300
+	// The interval, in seconds, at which the replication agreements are
+	// checked.  A value of 0 will disable the health check.  Defaults to
+	// 300 seconds.
+	// +optional
+	IntervalSeconds *int32 `json:"intervalSeconds,omitempty"`
+
+	//+kubebuilder:validation:Minimum=1
+	//+kubebuilder:default=1000
+	// The number of pending changes above which a replication agreement
+	// is considered to be unhealthy.  Defaults to 1000.
+	// +optional
+	PendingChangeThreshold *int64 `json:"pendingChangeThreshold,omitempty"`
+}
+
+// IBMSecurityVerifyDirectorySeedJob defines the settings of the job which
+// is used to seed new replicas.
+type IBMSecurityVerifyDirectorySeedJob struct {
+	//+kubebuilder:validation:Minimum=0
+	//+kubebuilder:default=60
+	// The number of seconds for which a finished seed job, and its pod, 
+	// will be retained before it is deleted.  Defaults to 60 seconds.
+	// +optional
+	TTLSecondsAfterFinished *int32 `json:"ttlSecondsAfterFinished,omitempty"`
+
+	//+kubebuilder:validation:Minimum=0
+	//+kubebuilder:default=1
+	// The number of times that a failed seed job will be retried before
+	// the job is marked as failed.  Defaults to 1.
+	// +optional
+	BackoffLimit *int32 `json:"backoffLimit,omitempty"`
+
+	//+kubebuilder:validation:Minimum=1
+	// The maximum number of seconds for which the seed job is allowed to
+	// run before it is terminated.  By default no deadline is applied.
+	// +optional
+	ActiveDeadlineSeconds *int64 `json:"activeDeadlineSeconds,omitempty"`
 }
 
 // IBMSecurityVerifyDirectoryImage defines the details associated with the
@@ -73,8 +143,11 @@ type IBMSecurityVerifyDirectoryConfigMapEntry struct {
 	// The name of the ConfigMap which contains the configuration data.
 	Name string `json:"name"`
 
+	//+kubebuilder:default=config.yaml
 	// The key within the ConfigMap which contains the configuration data.
-	Key string `json:"key"`
+	// Defaults to config.yaml.
+	// +optional
+	Key string `json:"key,omitempty"`
 }
 
 // IBMSecurityVerifyDirectoryConfigMap defines the ConfigMaps which are used
@@ -128,13 +201,115 @@ type IBMSecurityVerifyDirectoryPods struct {
     Env []corev1.EnvVar `json:"env,omitempty" patchStrategy:"merge" patchMergeKey:"name" protobuf:"bytes,7,rep,name=env"`
 
     // ServiceAccountName is the name of the ServiceAccount to use to run this
-	// pod.
+	// pod.  Defaults to default.
     // More info: 
     // https://kubernetes.io/docs/tasks/configure-pod-container/configure-service-account/
     // +optional
     ServiceAccountName string `json:"serviceAccountName,omitempty" protobuf:"bytes,8,opt,name=serviceAccountName"`
 }
 
+// IBMSecurityVerifyDirectoryCredentials defines the details associated with
+// the admin and replication credentials which can be generated by the 
+// operator.
+type IBMSecurityVerifyDirectoryCredentials struct {
+	//+kubebuilder:default=false
+	// Whether the operator should generate the admin and replication 
+	// credentials.  The generated credentials will be stored in a secret 
+	// which is owned by this resource, and will take precedence over the
+	// general.admin.pwd and server.replication.admin.pwd entries from the
+	// server and proxy configuration.
+	// +optional
+	Generate bool `json:"generate,omitempty"`
+
+	// The name of the secret which will be used to store the generated 
+	// credentials.  The secret will contain the admin_password and 
+	// replication_password keys.  Defaults to <name>-credentials.
+	// +optional
+	SecretName string `json:"secretName,omitempty"`
+}
+
+// IBMSecurityVerifyDirectoryIssuerRef defines a reference to the 
+// cert-manager issuer which will be used to issue the TLS certificates.
+type IBMSecurityVerifyDirectoryIssuerRef struct {
+	// The name of the issuer.
+	Name string `json:"name"`
+
+	//+kubebuilder:default=Issuer
+	//+kubebuilder:validation:Enum=Issuer;ClusterIssuer
+	// The kind of the issuer, either Issuer or ClusterIssuer.
+	// +optional
+	Kind string `json:"kind,omitempty"`
+
+	//+kubebuilder:default=cert-manager.io
+	// The API group of the issuer.
+	// +optional
+	Group string `json:"group,omitempty"`
+}
+
+// IBMSecurityVerifyDirectoryTLS defines the details associated with the
+// TLS certificates which are requested by the operator.
+type IBMSecurityVerifyDirectoryTLS struct {
+	// A reference to the cert-manager issuer which will be used to issue
+	// a certificate for each replica service and for the proxy service.
+	// If this is not specified the TLS certificates must be provided 
+	// within the server and proxy configuration.
+	// +optional
+	IssuerRef *IBMSecurityVerifyDirectoryIssuerRef `json:"issuerRef,omitempty"`
+
+	// The PEM encoded CA certificates which are used by the operator to 
+	// verify the certificates presented by the proxy and the replicas.  The
+	// certificates can also be referenced from a secret (secret:<name>/<key>)
+	// or a ConfigMap (configmap:<name>/<key>).  If this is not specified the
+	// trusted certificates from the proxy configuration are used.
+	// +optional
+	CABundle string `json:"caBundle,omitempty"`
+}
+
+// IBMSecurityVerifyDirectoryProtocols defines the protocols which are used
+// for the connections between the replicas, and between the proxy and the
+// replicas.  This is only required if both the LDAP and LDAPS ports have 
+// been enabled in the server configuration.
+type IBMSecurityVerifyDirectoryProtocols struct {
+	//+kubebuilder:validation:Enum=ldap;ldaps
+	// The protocol which is used by the replication agreements.  Defaults to
+	// ldap, unless the LDAP port has been disabled.
+	// +optional
+	Replication string `json:"replication,omitempty"`
+
+	//+kubebuilder:validation:Enum=ldap;ldaps
+	// The protocol which is used by the proxy when connecting to the 
+	// replicas.  Defaults to ldap, unless the LDAP port has been disabled.
+	// +optional
+	ProxyBackend string `json:"proxyBackend,omitempty"`
+}
+
+// IBMSecurityVerifyDirectoryRestoreFrom defines the backup which is used to
+// initialize the principal replica of a new environment.
+type IBMSecurityVerifyDirectoryRestoreFrom struct {
+	// The name of the IBMSecurityVerifyDirectoryBackup resource, in the same
+	// namespace, which contains the backup.
+	Backup string `json:"backup"`
+
+	// The name of the backup, from the status of the 
+	// IBMSecurityVerifyDirectoryBackup resource, which is to be restored.  
+	// Defaults to the most recent completed backup.
+	// +optional
+	Name string `json:"name,omitempty"`
+}
+
+// IBMSecurityVerifyDirectoryInitialData defines a source of the LDIF data
+// which is loaded into a new environment.  Exactly one of the ConfigMap or
+// Secret fields should be specified.
+type IBMSecurityVerifyDirectoryInitialData struct {
+	// The key of a ConfigMap, in the same namespace, which contains the LDIF.
+	// +optional
+	ConfigMap *corev1.ConfigMapKeySelector `json:"configMap,omitempty"`
+
+	// The key of a Secret, in the same namespace, which contains the LDIF.
+	// +optional
+	Secret *corev1.SecretKeySelector `json:"secret,omitempty"`
+}
+
 // IBMSecurityVerifyDirectorySpec defines the desired state of 
 // IBMSecurityVerifyDirectory
 type IBMSecurityVerifyDirectorySpec struct {
@@ -143,16 +318,261 @@ type IBMSecurityVerifyDirectorySpec struct {
 
 	// Details which are used when creating the server pods.
 	Pods IBMSecurityVerifyDirectoryPods `json:"pods"`
+
+	// Details of the admin and replication credentials which are generated
+	// by the operator.
+	// +optional
+	Credentials IBMSecurityVerifyDirectoryCredentials `json:"credentials,omitempty"`
+
+	// Details of the TLS certificates which are requested by the operator.
+	// +optional
+	TLS IBMSecurityVerifyDirectoryTLS `json:"tls,omitempty"`
+
+	// The protocols which are used for replication and by the proxy.
+	// +optional
+	Protocols IBMSecurityVerifyDirectoryProtocols `json:"protocols,omitempty"`
+
+	// The backup which is used to initialize the principal replica when the
+	// environment is first created.  The remaining replicas are then seeded
+	// from the principal.
+	// +optional
+	RestoreFrom *IBMSecurityVerifyDirectoryRestoreFrom `json:"restoreFrom,omitempty"`
+
+	// The LDIF data which is loaded, in order, into the principal replica 
+	// after it has first been started, and before any other replicas are 
+	// seeded.  
+	// +optional
+	InitialData []IBMSecurityVerifyDirectoryInitialData `json:"initialData,omitempty"`
+}
+
+// IBMSecurityVerifyDirectoryRotationStatus defines the observed state of
+// the rotation of the generated admin and replication credentials.
+type IBMSecurityVerifyDirectoryRotationStatus struct {
+	// The current phase of the rotation.  One of InProgress, Completed or
+	// RolledBack.
+	// +optional
+	Phase string `json:"phase,omitempty"`
+
+	// The list of replicas (PVC names) which have been restarted with the
+	// new credentials.
+	// +optional
+	UpdatedReplicas []string `json:"updatedReplicas,omitempty"`
+
+	// A human readable message which describes the state of the rotation.
+	// +optional
+	Message string `json:"message,omitempty"`
+
+	// The value of the rotation annotation which was last processed.
+	// +optional
+	LastRequest string `json:"lastRequest,omitempty"`
+
+	// The time at which the rotation last changed phase.
+	// +optional
+	LastTransitionTime *metav1.Time `json:"lastTransitionTime,omitempty"`
+}
+
+// IBMSecurityVerifyDirectoryRestoreStatus defines the details of the backup
+// which was used to initialize the principal replica.
+type IBMSecurityVerifyDirectoryRestoreStatus struct {
+	// The name of the IBMSecurityVerifyDirectoryBackup resource.
+	Backup string `json:"backup"`
+
+	// The name of the backup which was restored.
+	Name string `json:"name"`
+
+	// The format of the backup which was restored.
+	Format string `json:"format"`
+
+	// The replica (PVC name) into which the backup was restored.
+	Replica string `json:"replica"`
+
+	// The time at which the restore completed.
+	// +optional
+	CompletionTime *metav1.Time `json:"completionTime,omitempty"`
+}
+
+// IBMSecurityVerifyDirectoryInitialDataStatus defines the details of the
+// initial LDIF data which was loaded into the principal replica.
+type IBMSecurityVerifyDirectoryInitialDataStatus struct {
+	// The replica (PVC name) into which the LDIF data was loaded.
+	Replica string `json:"replica"`
+
+	// The sources of the LDIF data which was loaded, in the form 
+	// configmap:<name>/<key> or secret:<name>/<key>.
+	Sources []string `json:"sources"`
+
+	// The time at which the LDIF data was loaded.
+	// +optional
+	CompletionTime *metav1.Time `json:"completionTime,omitempty"`
+}
+
+// IBMSecurityVerifyDirectoryAgreementStatus defines the status of a single
+// replication agreement.
+type IBMSecurityVerifyDirectoryAgreementStatus struct {
+	// The replica (PVC name) which supplies the changes.
+	Supplier string `json:"supplier"`
+
+	// The replica (PVC name) which consumes the changes.
+	Consumer string `json:"consumer"`
+
+	// The replication context (suffix) of the agreement.
+	Context string `json:"context"`
+
+	// The state of the agreement, as reported by the supplier.
+	// +optional
+	State string `json:"state,omitempty"`
+
+	// The number of changes which are waiting to be replicated.
+	// +optional
+	PendingChanges int64 `json:"pendingChanges,omitempty"`
+
+	// The number of changes which have failed to be replicated.
+	// +optional
+	FailedChanges int64 `json:"failedChanges,omitempty"`
+
+	// The identifier of the last change which was replicated.
+	// +optional
+	LastChangeId string `json:"lastChangeId,omitempty"`
+
+	// The result of the last change which was replicated.
+	// +optional
+	LastResult string `json:"lastResult,omitempty"`
+
+	// Whether the agreement is considered to be healthy.
+	Healthy bool `json:"healthy"`
+
+	// The reason why the agreement is considered to be unhealthy.
+	// +optional
+	Message string `json:"message,omitempty"`
+}
+
+// IBMSecurityVerifyDirectoryReplicationStatus defines the status of the
+// replication between the replicas.
+type IBMSecurityVerifyDirectoryReplicationStatus struct {
+	// The status of each of the replication agreements.
+	// +optional
+	Agreements []IBMSecurityVerifyDirectoryAgreementStatus `json:"agreements,omitempty"`
+
+	// The time at which the replication agreements were last checked.
+	// +optional
+	LastCheckTime *metav1.Time `json:"lastCheckTime,omitempty"`
+}
+
+// IBMSecurityVerifyDirectoryReplicaStatus defines the observed state of a
+// single replica.
+type IBMSecurityVerifyDirectoryReplicaStatus struct {
+	// The name of the PVC which is used by the replica.
+	PVC string `json:"pvc"`
+
+	// The name of the pod of the replica.
+	Pod string `json:"pod"`
+
+	// The name of the service of the replica.
+	// +optional
+	Service string `json:"service,omitempty"`
+
+	//+kubebuilder:validation:Enum=principal;master;read-only
+	// The role of the replica.  The principal is the replica which is used
+	// as the source of the data for new replicas.
+	// +optional
+	Role string `json:"role,omitempty"`
+
+	//+kubebuilder:validation:Enum=Pending;Seeding;Starting;Ready;Deleting
+	// The current phase of the replica.
+	// +optional
+	Phase string `json:"phase,omitempty"`
+
+	// Whether the pod of the replica is ready.
+	Ready bool `json:"ready"`
+
+	// The image which is being used by the replica.
+	// +optional
+	Image string `json:"image,omitempty"`
+
+	// The time at which the replica last changed phase.
+	// +optional
+	LastTransitionTime *metav1.Time `json:"lastTransitionTime,omitempty"`
+
+	// The number of changes which are waiting to be replicated to the 
+	// replica, as determined by the most recent replication health check.
+	// +optional
+	ReplicationBacklog int64 `json:"replicationBacklog,omitempty"`
+}
+
+// IBMSecurityVerifyDirectoryProxyStatus defines the observed state of the
+// proxy.
+type IBMSecurityVerifyDirectoryProxyStatus struct {
+	// The number of proxy replicas which have been requested.
+	// +optional
+	Replicas int32 `json:"replicas,omitempty"`
+
+	// The number of proxy replicas which are ready.
+	// +optional
+	ReadyReplicas int32 `json:"readyReplicas,omitempty"`
+
+	// The SHA-256 hash of the generated proxy configuration.
+	// +optional
+	ConfigHash string `json:"configHash,omitempty"`
+
+	// The replica (PVC name) which is currently the primary write server
+	// of the proxy.
+	// +optional
+	PrimaryWriteServer string `json:"primaryWriteServer,omitempty"`
 }
 
 // IBMSecurityVerifyDirectoryStatus defines the observed state of 
 // IBMSecurityVerifyDirectory
 type IBMSecurityVerifyDirectoryStatus struct {
     Conditions []metav1.Condition `json:"conditions,omitempty"`
+
+	// The generation of the document which was most recently processed.
+	// +optional
+	ObservedGeneration int64 `json:"observedGeneration,omitempty"`
+
+	// The number of replicas which have been requested.
+	// +optional
+	DesiredReplicas int32 `json:"desiredReplicas,omitempty"`
+
+	// The number of replicas which are ready.
+	// +optional
+	ReadyReplicas int32 `json:"readyReplicas,omitempty"`
+
+	// The observed state of each of the replicas.
+	// +optional
+	Replicas []IBMSecurityVerifyDirectoryReplicaStatus `json:"replicas,omitempty"`
+
+	// The observed state of the proxy.
+	// +optional
+	Proxy *IBMSecurityVerifyDirectoryProxyStatus `json:"proxy,omitempty"`
+
+	// The state of the most recent rotation of the generated credentials.
+	// +optional
+	CredentialRotation *IBMSecurityVerifyDirectoryRotationStatus `json:"credentialRotation,omitempty"`
+
+	// The details of the backup which was used to initialize the principal
+	// replica.
+	// +optional
+	Restore *IBMSecurityVerifyDirectoryRestoreStatus `json:"restore,omitempty"`
+
+	// The details of the initial LDIF data which was loaded into the 
+	// principal replica.
+	// +optional
+	InitialData *IBMSecurityVerifyDirectoryInitialDataStatus `json:"initialData,omitempty"`
+
+	// The status of the replication between the replicas, as determined by
+	// the most recent replication health check.
+	// +optional
+	Replication *IBMSecurityVerifyDirectoryReplicationStatus `json:"replication,omitempty"`
 }
 
 //+kubebuilder:object:root=true
 //+kubebuilder:subresource:status
+//+kubebuilder:printcolumn:name="Desired",type=integer,JSONPath=`.status.desiredReplicas`
+//+kubebuilder:printcolumn:name="Ready",type=integer,JSONPath=`.status.readyReplicas`
+//+kubebuilder:printcolumn:name="Primary",type=string,JSONPath=`.status.proxy.primaryWriteServer`
+//+kubebuilder:printcolumn:name="Available",type=string,JSONPath=`.status.conditions[?(@.type=="Ready")].status`
+//+kubebuilder:printcolumn:name="Degraded",type=string,JSONPath=`.status.conditions[?(@.type=="Degraded")].status`
+//+kubebuilder:printcolumn:name="Age",type=date,JSONPath=`.metadata.creationTimestamp`
 
 // IBMSecurityVerifyDirectory is the Schema for the 
 // ibmsecurityverifydirectories API
@@ -10,21 +10,18 @@ package v1
 
 import (
 	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 
 	"k8s.io/apimachinery/pkg/runtime"
 	"sigs.k8s.io/controller-runtime/pkg/webhook"
     "sigs.k8s.io/controller-runtime/pkg/client"
 
 	"context"
-	"crypto/tls"
 	"errors"
 	"fmt"
 	"reflect"
-	"regexp"
-	"strings"
 
-	"github.com/go-yaml/yaml"
-	"github.com/go-ldap/ldap/v3"
+	"github.com/ibm-security/verify-directory-operator/ldapconfig"
 	"github.com/ibm-security/verify-directory-operator/utils"
 
 	k8serrors "k8s.io/apimachinery/pkg/api/errors"
@@ -71,11 +68,118 @@ func (r *IBMSecurityVerifyDirectory) SetupWebhookWithManager(
 var _ webhook.Defaulter = &IBMSecurityVerifyDirectory{}
 
 /*
- * The following function is used to add default values into the document.
- * This is currently a no-op for this operator.
+ * The default values which are added to the document.
+ */
+
+const (
+	DefaultProxyReplicas          int32 = 1
+	DefaultConfigMapKey                 = "config.yaml"
+	DefaultServiceAccountName           = "default"
+	DefaultSeedJobTTLSeconds      int32 = 60
+	DefaultSeedJobBackoffLimit    int32 = 1
+	DefaultHealthCheckInterval    int32 = 300
+	DefaultPendingChangeThreshold int64 = 1000
+)
+
+/*
+ * The following function is used to add default values into the document,
+ * so that the stored document shows the effective configuration.  The 
+ * operator also applies the defaults to each document which it processes, 
+ * as the document may have been created before the defaulting webhook was
+ * registered.
  */
 
 func (r *IBMSecurityVerifyDirectory) Default() {
+
+	logger.V(1).Info("Entering a function", 
+				r.createLogParams("Function", "Default")...)
+
+	pods := &r.Spec.Pods
+
+	/*
+	 * The number of proxy replicas.
+	 */
+
+	if pods.Proxy.Replicas <= 0 {
+		pods.Proxy.Replicas = DefaultProxyReplicas
+	}
+
+	/*
+	 * The keys of the server and proxy ConfigMaps.
+	 */
+
+	if pods.ConfigMap.Server.Key == "" {
+		pods.ConfigMap.Server.Key = DefaultConfigMapKey
+	}
+
+	if pods.ConfigMap.Proxy.Key == "" {
+		pods.ConfigMap.Proxy.Key = DefaultConfigMapKey
+	}
+
+	/*
+	 * The image pull policy, which is set in the same way as Kubernetes 
+	 * would set the pull policy of the containers.
+	 */
+
+	if pods.Image.ImagePullPolicy == "" {
+		if pods.Image.Label == "" || pods.Image.Label == "latest" {
+			pods.Image.ImagePullPolicy = corev1.PullAlways
+		} else {
+			pods.Image.ImagePullPolicy = corev1.PullIfNotPresent
+		}
+	}
+
+	/*
+	 * The service account which the pods will run as.
+	 */
+
+	if pods.ServiceAccountName == "" {
+		pods.ServiceAccountName = DefaultServiceAccountName
+	}
+
+	/*
+	 * The settings of the seed job.
+	 */
+
+	if r.Spec.Replicas.SeedJob == nil {
+		r.Spec.Replicas.SeedJob = &IBMSecurityVerifyDirectorySeedJob{}
+	}
+
+	seedJob := r.Spec.Replicas.SeedJob
+
+	if seedJob.TTLSecondsAfterFinished == nil {
+		ttl := DefaultSeedJobTTLSeconds
+
+		seedJob.TTLSecondsAfterFinished = &ttl
+	}
+
+	if seedJob.BackoffLimit == nil {
+		backoffLimit := DefaultSeedJobBackoffLimit
+
+		seedJob.BackoffLimit = &backoffLimit
+	}
+
+	/*
+	 * The settings of the replication health check.
+	 */
+
+	if r.Spec.Replicas.HealthCheck == nil {
+		r.Spec.Replicas.HealthCheck = &IBMSecurityVerifyDirectoryHealthCheck{}
+	}
+
+	healthCheck := r.Spec.Replicas.HealthCheck
+
+	if healthCheck.IntervalSeconds == nil {
+		interval := DefaultHealthCheckInterval
+
+		healthCheck.IntervalSeconds = &interval
+	}
+
+	if healthCheck.PendingChangeThreshold == nil {
+		threshold := DefaultPendingChangeThreshold
+
+		healthCheck.PendingChangeThreshold = &threshold
+	}
 }
 
 /*****************************************************************************/
@@ -113,7 +217,7 @@ func (r *IBMSecurityVerifyDirectory) ValidateUpdate(old runtime.Object) error {
 	 * Check to ensure that we are not currently processing this document.
 	 */
 
-	if meta.IsStatusConditionTrue(r.Status.Conditions, "InProgress") {
+	if meta.IsStatusConditionTrue(r.Status.Conditions, ConditionProgressing) {
 		return errors.New("The last update to this document is still being " +
 			"processed by the operator.  Wait until the existing document " +
 			"has been fully processed before attempting to update the " +
@@ -130,17 +234,6 @@ func (r *IBMSecurityVerifyDirectory) ValidateUpdate(old runtime.Object) error {
 		return err
 	}
 
-	/*
-	 * Check to ensure that the document is not currently in the failing
-	 * state.
-	 */
-
-	err = r.validateDocumentState()
-
-	if err != nil {
-		return err
-	}
-
 	/*
 	 * Check to ensure that only valid fields have been updated in the
 	 * document.
@@ -153,7 +246,17 @@ func (r *IBMSecurityVerifyDirectory) ValidateUpdate(old runtime.Object) error {
 								"access the original document.")
 	}
 
-	err = r.validateDocumentUpdates(oldDirectory)
+	/*
+	 * The original document may have been stored before the defaulting 
+	 * webhook was registered, and so we apply the defaults to a copy of the
+	 * original document before comparing it with the new document.
+	 */
+
+	defaulted := oldDirectory.DeepCopy()
+
+	defaulted.Default()
+
+	err = r.validateDocumentUpdates(defaulted)
 
 	if err != nil {
 		return err
@@ -163,7 +266,7 @@ func (r *IBMSecurityVerifyDirectory) ValidateUpdate(old runtime.Object) error {
 	 * Validate the updates which are being made to the pods.
 	 */
 
-	err = r.validatePods()
+	err = r.validatePods(oldDirectory)
 
 	if err != nil {
 		return err
@@ -189,7 +292,7 @@ func (r *IBMSecurityVerifyDirectory) ValidateDelete() error {
 	 * name.
 	 */
 
-	if meta.IsStatusConditionTrue(r.Status.Conditions, "InProgress") {
+	if meta.IsStatusConditionTrue(r.Status.Conditions, ConditionProgressing) {
 		return errors.New("The last update to this document is still being " +
 			"processed by the operator.  Wait until the existing document " +
 			"has been fully processed before attempting to delete the " +
@@ -208,10 +311,16 @@ func (r *IBMSecurityVerifyDirectory) validateDocument() error {
 				r.createLogParams("Function", "validateDocument")...)
 
 	/*
-	 * Validate that each of the PVCs specified in the document exists.
+	 * Validate that each of the PVCs specified in the document exists.  In
+	 * the snapshot seed mode the PVCs of the new replicas are provisioned by
+	 * the operator, and so only the PVC of the principal must exist.
 	 */
 
-	for _, pvcName := range r.Spec.Replicas.PVCs {
+	for idx, pvcName := range r.Spec.Replicas.PVCs {
+		if idx > 0 && r.Spec.Replicas.SeedMode == "snapshot" {
+			continue
+		}
+
 		err = r.validatePVC(pvcName)
 
 		if err != nil {
@@ -310,11 +419,58 @@ func (r *IBMSecurityVerifyDirectory) validateDocument() error {
 	}
 
 	/*
-	 * Validate that the proxy ConfigMap does not contain any 
-	 * serverGroups or suffixes.
+	 * Validate that each of the sources of the initial data exists.
+	 */
+
+	for idx, data := range r.Spec.InitialData {
+		if (data.ConfigMap == nil) == (data.Secret == nil) {
+			return errors.New(fmt.Sprintf("Entry %d of spec.initialData " +
+				"must specify exactly one of a ConfigMap or a Secret.", idx))
+		}
+
+		if data.ConfigMap != nil {
+			err = r.validateConfigMap(
+				IBMSecurityVerifyDirectoryConfigMapEntry {
+					Name: data.ConfigMap.Name,
+					Key:  data.ConfigMap.Key,
+				})
+		} else {
+			err = r.validateSecret(data.Secret.Name)
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+
+	/*
+	 * Validate that each secret which is referenced by the server and proxy
+	 * ConfigMaps exists.
+	 */
+
+	for _, entry := range maps {
+		err = r.validateSecretReferences(entry)
+
+		if err != nil {
+			return err
+		}
+	}
+
+	/*
+	 * Validate the server and proxy configuration.
+	 */
+
+	err = r.validateConfiguration()
+
+	if err != nil {
+		return err
+	}
+
+	/*
+	 * Validate the secret which is used to store the generated credentials.
 	 */
 
-	err = r.validateProxyConfigMap()
+	err = r.validateCredentialsSecret()
 
 	if err != nil {
 		return err
@@ -438,101 +594,202 @@ func (r *IBMSecurityVerifyDirectory) validateSecret(
 /*****************************************************************************/
 
 /*
- * This function is used to validate the proxy ConfigMap.  It will ensure that
- * no server groups or suffixes have been defined.
+ * This function is used to validate that the secret which is used to store
+ * the generated credentials is either yet to be created, or is owned by this
+ * document.  The operator will not take over a secret which it doesn't own.
  */
 
-func (r *IBMSecurityVerifyDirectory) validateProxyConfigMap() (err error) {
+func (r *IBMSecurityVerifyDirectory) validateCredentialsSecret() (err error) {
 
 	logger.V(1).Info("Entering a function", 
-		r.createLogParams("Function", "validateProxyConfigMap")...)
+		r.createLogParams("Function", "validateCredentialsSecret")...)
 
-	/*
-	 * Retrieve the ConfigMap which contains the proxy configuration.
-	 */
+	if ! r.Spec.Credentials.Generate {
+		return
+	}
 
-	name := r.Spec.Pods.ConfigMap.Proxy.Name
-	key  := r.Spec.Pods.ConfigMap.Proxy.Key
+	name := utils.GetCredentialsSecretName(r.Name, r.Spec.Credentials.SecretName)
 
-	config := &corev1.ConfigMap{}
-	err	    = k8s_client.Get(context.TODO(), client.ObjectKey{
+	secret := &corev1.Secret{}
+	err     = k8s_client.Get(context.TODO(), client.ObjectKey{
 							Namespace: r.Namespace,
 							Name:      name,
-					}, config)
+					}, secret)
+
+	if err != nil {
+		if k8serrors.IsNotFound(err) {
+			err = nil
+		} else {
+			logger.Error(err, "Failed to retieve the requsted Secret.",
+					r.createLogParams("Secret", name)...)
+		}
+
+		return
+	}
+
+	if ! metav1.IsControlledBy(secret, r) {
+		err = errors.New(fmt.Sprintf("The credentials secret, %s, already " +
+				"exists and is not owned by this document.  The secret must " +
+				"be created by the operator.", name))
+	}
+
+	return
+}
+
+/*****************************************************************************/
+
+/*
+ * This function is used to validate the server and proxy configuration, so
+ * that an invalid or inconsistent configuration is rejected before anything
+ * is deployed.
+ */
+
+func (r *IBMSecurityVerifyDirectory) validateConfiguration() (err error) {
+
+	logger.V(1).Info("Entering a function", 
+		r.createLogParams("Function", "validateConfiguration")...)
+
+	rctx := r.getResolveContext()
+
+	/*
+	 * Validate the server configuration, along with the protocols which
+	 * are to be used for replication and by the proxy.
+	 */
+
+	server := r.Spec.Pods.ConfigMap.Server
 
-	logger.V(1).Info("Retrieved the Proxy ConfigMap", 
-			r.createLogParams("ConfigMap.Name", name, "ConfigMap", config)...)
+	body, err := r.getConfigMapBody(server)
 
 	if err != nil {
-		logger.Error(err, "Failed to retieve the requsted ConfigMap.",
-					r.createLogParams("ConfigMap", name)...)
+		return
+	}
 
-		return err
+	config, err := ldapconfig.ParseServerConfig(
+						body, rctx, r.Spec.Credentials.Generate)
+
+	if err == nil {
+		_, _, err = config.Ports.Select(r.Spec.Protocols.Replication)
+	}
+
+	if err == nil {
+		_, _, err = config.Ports.Select(r.Spec.Protocols.ProxyBackend)
+	}
+
+	if err != nil {
+		err = errors.New(fmt.Sprintf("The server ConfigMap key, %s:%s, " +
+				"contains an invalid configuration.  %s", 
+				server.Name, server.Key, err.Error()))
+
+		return
 	}
 
 	/*
-	 * Parse the YAML configuration into a map.  Unfortunately it is not
-	 * easy to parse YAML into a generic structure, and so after we have
-	 * unmarshalled the data we want to iteratively convert the data into 
-	 * a map of strings.
+	 * Validate the proxy configuration.
 	 */
 
-    var body interface{}
+	proxy := r.Spec.Pods.ConfigMap.Proxy
 
-    if err = yaml.Unmarshal([]byte(config.Data[key]), &body); err != nil {
-		logger.Error(err, "Failed to unmarshal the ConfigMap data.",
-					r.createLogParams("ConfigMap", name)...)
+	body, err = r.getConfigMapBody(proxy)
 
-		return err
-    }
+	if err != nil {
+		return
+	}
 
-	body = utils.ConvertYaml(body)
+	proxyConfig, err := ldapconfig.ParseProxyConfig(body, rctx)
 
-	logger.V(1).Info("Retrieved the Proxy ConfigMap data", 
-			r.createLogParams("ConfigMap.Name", name, "Data", body)...)
+	if err != nil {
+		err = errors.New(fmt.Sprintf("The proxy ConfigMap key, %s:%s, " +
+				"contains an invalid configuration.  %s", 
+				proxy.Name, proxy.Key, err.Error()))
+
+		return
+	}
 
 	/*
-	 * Ensure that the server-groups and suffixes entries don't exist.
+	 * Ensure that the proxy configuration is consistent with the server
+	 * configuration.  A mismatch would otherwise only be reported at
+	 * runtime, as a failure of the proxy to bind to the replicas or to
+	 * decrypt the configuration.
 	 */
 
-	entries := []string { "server-groups", "suffixes" }
+	err = ldapconfig.Compare(
+						config, proxyConfig, rctx, r.Spec.Credentials.Generate)
+
+	if err != nil {
+		err = errors.New(fmt.Sprintf("The proxy ConfigMap key, %s:%s, is " +
+				"not consistent with the server ConfigMap key, %s:%s.  %s", 
+				proxy.Name, proxy.Key, server.Name, server.Key, err.Error()))
+	}
+
+	return
+}
 
-	for _, entry := range entries {
-		config := utils.GetYamlValue(body, []string{"proxy", entry}, false, 
-						r.Namespace)
+/*****************************************************************************/
 
-		if config != nil {
-			err = errors.New(
-				fmt.Sprintf("The proxy ConfigMap key, %s:%s, includes the " +
-				"proxy.%s configuration entry. This is not allowed as this " +
-				"entry will be generated by the operator.", name, key, entry))
+/*
+ * This function is used to retrieve the configuration from the specified
+ * ConfigMap, parsed into a map.
+ */
 
-			return err
-		}
+func (r *IBMSecurityVerifyDirectory) getConfigMapBody(
+				entry IBMSecurityVerifyDirectoryConfigMapEntry) (
+					body map[string]interface{}, err error) {
+
+	config := &corev1.ConfigMap{}
+	err	    = k8s_client.Get(context.TODO(), client.ObjectKey{
+							Namespace: r.Namespace,
+							Name:      entry.Name,
+					}, config)
+
+	if err != nil {
+		logger.Error(err, "Failed to retieve the requsted ConfigMap.",
+					r.createLogParams("ConfigMap", entry.Name)...)
+
+		return
 	}
 
-	return nil
+	body, err = ldapconfig.Parse(config.Data[entry.Key])
+
+	if err != nil {
+		logger.Error(err, "Failed to unmarshal the ConfigMap data.",
+					r.createLogParams("ConfigMap", entry.Name)...)
+
+		err = errors.New(fmt.Sprintf("The ConfigMap key, %s:%s, could not " +
+				"be parsed.  %s", entry.Name, entry.Key, err.Error()))
+	}
+
+	return
 }
 
 /*****************************************************************************/
 
 /*
- * This function will check to ensure that the document is not currently in 
- * the failing state.
+ * This function is used to validate that each secret which is referenced 
+ * from the specified ConfigMap exists, and contains the referenced key.
  */
 
-func (r *IBMSecurityVerifyDirectory) validateDocumentState() (err error) {
+func (r *IBMSecurityVerifyDirectory) validateSecretReferences(
+				entry IBMSecurityVerifyDirectoryConfigMapEntry) (err error) {
 
 	logger.V(1).Info("Entering a function", 
-		r.createLogParams("Function", "validateDocumentState")...)
+		r.createLogParams("Function", "validateSecretReferences", 
+					"Entry", entry)...)
+
+	body, err := r.getConfigMapBody(entry)
+
+	if err != nil {
+		return
+	}
+
+	err = utils.ValidateSecretReferences(body, r.getResolveContext())
 
-	if meta.IsStatusConditionFalse(r.Status.Conditions, "Available") {
-		return errors.New(
-			"The deployment is in a failing state which means that it " +
-			"cannot be updated and instead must be deleted and then recreated.")
+	if err != nil {
+		err = errors.New(fmt.Sprintf("The ConfigMap key, %s:%s, contains " +
+				"an invalid secret reference.  %s", 
+				entry.Name, entry.Key, err.Error()))
 	}
 
-	return nil
+	return 
 }
 
 /*****************************************************************************/
@@ -611,6 +868,60 @@ func (r *IBMSecurityVerifyDirectory) validateDocumentUpdates(
 		return
 	}
 
+	if ! reflect.DeepEqual(r.Spec.Credentials, old.Spec.Credentials) {
+		err = errors.New("The spec.credentials entry has been changed.  If " +
+				"you need to modify spec.credentials you must first delete " +
+				"the document and then recreate it.")
+
+		return
+	}
+
+	if ! reflect.DeepEqual(r.Spec.TLS, old.Spec.TLS) {
+		err = errors.New("The spec.tls entry has been changed.  If " +
+				"you need to modify spec.tls you must first delete " +
+				"the document and then recreate it.")
+
+		return
+	}
+
+	if ! reflect.DeepEqual(r.Spec.Protocols, old.Spec.Protocols) {
+		err = errors.New("The spec.protocols entry has been changed.  If " +
+				"you need to modify spec.protocols you must first delete " +
+				"the document and then recreate it.")
+
+		return
+	}
+
+	if r.Spec.Replicas.SeedMode != old.Spec.Replicas.SeedMode {
+		err = errors.New("The spec.replicas.seedMode entry has been " +
+				"changed.  If you need to modify spec.replicas.seedMode you " +
+				"must first delete the document and then recreate it.")
+
+		return
+	}
+
+	/*
+	 * The backup is only ever restored, and the initial data loaded, into
+	 * the principal of a new environment, and so these cannot be changed
+	 * once the document has been created.
+	 */
+
+	if ! reflect.DeepEqual(r.Spec.RestoreFrom, old.Spec.RestoreFrom) {
+		err = errors.New("The spec.restoreFrom entry has been changed.  The " +
+				"backup can only be restored when the environment is " +
+				"first created.")
+
+		return
+	}
+
+	if ! reflect.DeepEqual(r.Spec.InitialData, old.Spec.InitialData) {
+		err = errors.New("The spec.initialData entry has been changed.  The " +
+				"initial data can only be loaded when the environment is " +
+				"first created.")
+
+		return
+	}
+
 	return 
 }
 
@@ -618,39 +929,34 @@ func (r *IBMSecurityVerifyDirectory) validateDocumentUpdates(
 
 /*
  * This function will validate that the pods are in a state which will allow
- * an update.  
+ * an update.  The validation is performed against the status of the existing
+ * document, as published by the operator, and so no requests are made to
+ * the replicas or the proxy.  The operator itself is responsible for moving
+ * the primary write role away from any replica which is to be deleted.
  */
 
-func (r *IBMSecurityVerifyDirectory) validatePods() (err error) {
+func (r *IBMSecurityVerifyDirectory) validatePods(
+			old *IBMSecurityVerifyDirectory) (err error) {
 
 	logger.V(1).Info("Entering a function", 
 		r.createLogParams("Function", "validatePods")...)
 
 	/*
-	 * Build up the list of pods which are to be added/deleted/left-alone.
+	 * Build up the list of replicas which currently exist.  If the operator
+	 * has not yet published the status of the replicas there is nothing
+	 * which we can validate.
 	 */
 
-	pods    := make(map[string]string)
-	podList := &corev1.PodList{}
-
-	opts := []client.ListOption{
-		client.InNamespace(r.Namespace),
-		client.MatchingLabels(utils.LabelsForApp(r.Name, "")),
+	if len(old.Status.Replicas) == 0 {
+		return nil
 	}
 
-	err = k8s_client.List(context.TODO(), podList, opts...)
+	replicas := make(map[string]IBMSecurityVerifyDirectoryReplicaStatus)
 
-	if err != nil {
-		logger.Error(err, "Failed to list the pods.", r.createLogParams()...)
-
-		return err
-	} 
-
-	logger.V(1).Info("Found existing pods", 
-			r.createLogParams("List", podList.Items)...)
-
-	for _, pod := range podList.Items {
-		pods[pod.ObjectMeta.Labels[utils.PVCLabel]] = pod.GetName()
+	for _, replica := range old.Status.Replicas {
+		if replica.Phase != "" && replica.Phase != "Pending" {
+			replicas[replica.PVC] = replica
+		}
 	}
 
 	var toBeDeleted []string
@@ -671,15 +977,15 @@ func (r *IBMSecurityVerifyDirectory) validatePods() (err error) {
 	 * Work out the entries to be deleted.  This consists of the existing
 	 * replicas which don't appear in the current list of replicas.  At the
 	 * same time we work out which entries are to be left alone.  This will
-	 * be those entries in the list of running pods which still appear in the
-	 * curent document.
+	 * be those entries in the list of existing replicas which still appear 
+	 * in the curent document.
 	 */
 
-	for key, _:= range pods {
+	for key, _ := range replicas {
 		if _, ok := pvcs[key]; !ok {
 			toBeDeleted = append(toBeDeleted, key)
 		} else {
-			toBeLeft = append(toBeLeft, pods[key])
+			toBeLeft = append(toBeLeft, key)
 		}
 	}
 
@@ -690,17 +996,17 @@ func (r *IBMSecurityVerifyDirectory) validatePods() (err error) {
 	 */
 
 	for _, pvc := range r.Spec.Replicas.PVCs {
-		if _, ok := pods[pvc]; !ok {
+		if _, ok := replicas[pvc]; !ok {
 			toBeAdded = append(toBeAdded, pvc)
 		}
 	}
 
-	logger.V(1).Info("Processed the pods", 
+	logger.V(1).Info("Processed the replicas", 
 			r.createLogParams("ToBeDeleted", toBeDeleted, "ToBeAdded", 
 					toBeAdded, "ToBeLeft", toBeLeft)...)
 
 	/*
-	 * If there are no changes to the pods we don't need to do anything
+	 * If there are no changes to the replicas we don't need to do anything
 	 * extra.
 	 */
 
@@ -709,54 +1015,36 @@ func (r *IBMSecurityVerifyDirectory) validatePods() (err error) {
 	}
 
 	/*
-	 * For each pod which is to be left-alone, validate that the pod is
-	 * currently running and ready.
+	 * For each replica which is to be left-alone, validate that the replica
+	 * is currently ready.
 	 */
 
-	for _, podName := range(toBeLeft) {
-		pod := &corev1.Pod{}
-
-		err  = k8s_client.Get(context.TODO(), client.ObjectKey{
-							Namespace: r.Namespace,
-							Name:      podName,
-					}, pod)
-
-		logger.V(1).Info("Retrieved the pod", 
-			r.createLogParams("Pod.Name", podName, "Pod", pod)...)
-
-		if err != nil {
-			logger.Error(err, "Failed to retrieve the pod.", 
-								r.createLogParams("Pod", podName)...)
-
-			return err
-		}
-
-		if pod.Status.Phase != corev1.PodRunning || 
-						!pod.Status.ContainerStatuses[0].Ready {
+	for _, pvcName := range toBeLeft {
+		if ! replicas[pvcName].Ready {
 			return errors.New(fmt.Sprintf("The pod, %s, is not currently " +
 				"ready.  You must wait until all pods are ready before " +
-				"attempting to edit the document.", podName))
+				"attempting to edit the document.", replicas[pvcName].Pod))
 		}
 	}
 
 	/*
-	 * If there are any pods which are to be deleted check to ensure that the
-	 * pod is not currently the primary write master in the proxy.
+	 * If the primary write server of the proxy is to be deleted at least one
+	 * of the existing replicas must be retained, so that the primary write
+	 * role can be moved to a replica which is already ready.
 	 */
 
-	primaries, err := r.getPrimaryWriteMasters()
-
-	if err != nil {
-		return err
+	if old.Status.Proxy == nil || len(toBeLeft) > 0 {
+		return nil
 	}
 
-	for _, pvc := range toBeDeleted {
-		if _, ok := primaries[pvc]; ok {
-			return errors.New(fmt.Sprintf("The pvc, %s, is currently " +
-				"being used as the primary write master by the LDAP proxy. " +
-				"As a result it is not currently possible to remove this " +
-				"PVC.", pvc))
-		}
+	primary := old.Status.Proxy.PrimaryWriteServer
+
+	if _, ok := replicas[primary]; ok && ! pvcs[primary] {
+		return errors.New(fmt.Sprintf("The pvc, %s, is currently being " +
+			"used as the primary write server by the LDAP proxy.  At least " +
+			"one of the existing replicas must be retained so that the " +
+			"primary write role can be moved before the PVC is removed.",
+			primary))
 	}
 
 	return nil
@@ -764,234 +1052,17 @@ func (r *IBMSecurityVerifyDirectory) validatePods() (err error) {
 
 /*****************************************************************************/
 
-func (r *IBMSecurityVerifyDirectory) getPrimaryWriteMasters() (primaries map[string]bool, err error) {
-
-	logger.V(1).Info("Entering a function", 
-		r.createLogParams("Function", "getPrimaryWriteMasters")...)
-
-	primaries = make(map[string]bool)
-
-	/*
-	 * Work out the service IP address and port for the proxy.
-	 */
-
-	service := &corev1.Service{}
-	err      = k8s_client.Get(context.TODO(), client.ObjectKey{
-						Namespace: r.Namespace,
-						Name:      utils.GetProxyDeploymentName(r.Name),
-					}, service)
-
-	if err != nil {
-		logger.Error(err, "Failed to locate the proxy service.",
-					r.createLogParams()...)
-
-		return
-	}
-
-	logger.V(1).Info("Retrieved the proxy service", 
-			r.createLogParams("Service", service)...)
-
-	address := service.Spec.ClusterIP
-	port    := service.Spec.Ports[0].Port
-
-	/*
-	 * Work out some of the configuration information for the proxy.
-	 */
-
-	configMapName := utils.GetProxyConfigMapName(r.Name)
-
-	config := &corev1.ConfigMap{}
-	err	    = k8s_client.Get(context.TODO(), client.ObjectKey{
-						Namespace: r.Namespace,
-						Name:      configMapName }, 
-					config)
-
-	logger.V(1).Info("Retrieved the proxy ConfigMap", 
-			r.createLogParams("ConfigMap", config)...)
-
-	if err != nil {
- 		logger.Error(err, "Failed to retrieve the ConfigMap",
-						r.createLogParams("ConfigMap.Name", configMapName)...)
-
-		return 
-	}
-
-	/*
-	 * Parse the configuration data into a map.
-	 */
-
-    var body interface{}
-
-    err = yaml.Unmarshal([]byte(config.Data[utils.ProxyCMKey]), &body)
-
-	if err != nil {
-		logger.Error(err, "Failed to decode the data from the ConfigMap.",
-				r.createLogParams("ConfigMap.Name", configMapName,
-				"ConfigMap.Key", utils.ProxyCMKey)...)
-
-		return
-    }
-
-	logger.V(1).Info("Retrieved the proxy ConfigMap data", 
-			r.createLogParams("Key", utils.ProxyCMKey, "Data", body)...)
-
-
-	body      = utils.ConvertYaml(body)
-	body, ok := body.(map[string]interface{})
-
-	if ! ok {
-		err = errors.New("Failed to decode the ConfigMap for the proxy.")
-
-		logger.Error(err, "Failed to decode the data from the ConfigMap.",
-				r.createLogParams("ConfigMap.Name", configMapName,
-				"ConfigMap.Key", utils.ProxyCMKey)...)
-
-		return 
-	}
-
-	/*
-	 * Retrieve the data from the map.
-	 */
-
-	secure    := false
-	adminDn   := "cn=root"
-	adminPwd  := ""
-
-	entry := utils.GetYamlValue(body, []string{"general","ports","ldap"}, 
-						true, r.Namespace)
-
-	if entry != nil {
-		iport, ok := entry.(int)
-
-		if ! ok {
-			err = errors.New(
-						"The general.ports.ldap configuration is incorrect.")
-
-			return
-		}
-
-		if (iport == 0) {
-			secure = true
-		}
-	}
-
-	entry = utils.GetYamlValue(body, []string{"general","admin","dn"}, 
-						true, r.Namespace)
-
-	if entry != nil {
-		adminDn = entry.(string)
-	}
-
-	entry = utils.GetYamlValue(body, []string{"general","admin","pwd"}, 
-						true, r.Namespace)
-
-	if entry == nil {
-		err = errors.New("The general.admin.pwd configuration is missing.")
-
-		return
-	}
-
-	adminPwd = entry.(string)
-
-	/*
-	 * Connect to the server.
-	 */
-
-	logger.V(1).Info("Connecting to the LDAP server", 
-			r.createLogParams("Address", address, "Port", port)...)
-
-	var l *ldap.Conn
-
-	if secure {
-		l, err = ldap.DialURL(fmt.Sprintf("ldaps://%s:%d", address, port), 
-				ldap.DialWithTLSConfig(&tls.Config{InsecureSkipVerify: true}))
-	} else {
-		l, err = ldap.DialURL(fmt.Sprintf("ldap://%s:%d", address, port))
-	}
-
-	if err != nil {
-		logger.Error(err, "Failed to connect to the LDAP proxy", 
-					r.createLogParams()...)
-
-		return
-	}
-	defer l.Close()
-
-	/*
-	 * Bind to the server.
-	 */
-	 
-	logger.V(1).Info("Binding to the LDAP server", 
-			r.createLogParams("DN", adminDn)...)
-
-	err = l.Bind(adminDn, adminPwd)
-	if err != nil {
-		logger.Error(err, "Failed to bind to the LDAP proxy",
-					r.createLogParams()...)
-
-		return
-	}
-
-	/*
-	 * Search the proxy to find out who the primary write master is.
-	 */
-
-	searchRequest := ldap.NewSearchRequest(
-		"cn=partitions,cn=proxy,cn=monitor",
-		ldap.ScopeBaseObject, ldap.NeverDerefAliases, 0, 0, false,
-		"(objectClass=*)",
-		nil,
-		nil,
-	)
-
-	sr, err := l.Search(searchRequest)
-	if err != nil {
-		logger.Error(err, 
-			"Failed to locate the split information from the LDAP proxy",
-			r.createLogParams()...)
-
-		return
-	}
-
-	logger.V(1).Info("Performed a search against the LDAP server", 
-			r.createLogParams("Results", sr)...)
-
-	if len(sr.Entries) == 0 {
-		err = errors.New(
-			"The split information does not exist in the LDAP proxy.")
-
-		logger.Error(err, "Entry does not exist.", r.createLogParams()...)
-
-		return
-	}
-
-	/*
-	 * Process the search results looking for any primary write masters.
-	 */
-
-	expr := fmt.Sprintf(".*ibm-slapdProxyBackendServerName=%s-(.[^+,]*)", 
-						strings.ToLower(r.Name))
-	re   := regexp.MustCompile(expr)
-
-	for _, entry := range(sr.Entries) {
-		for _, attr := range(entry.Attributes) {
-			if attr.Name == "ibm-slapdProxyCurrentServerRole" {
-				if len(attr.Values) == 1 && 
-								attr.Values[0] == "primarywriteserver" {
-					match := re.FindStringSubmatch(entry.DN)
+/*
+ * This function will return the context which is used to resolve the 
+ * configuration entries for the document.
+ */
 
-					if len(match) > 1 {
-						primaries[match[1]] = true
-					}
-				}
-			}
-		}
+func (r *IBMSecurityVerifyDirectory) getResolveContext() *utils.ResolveContext {
+	return &utils.ResolveContext{
+		Namespace: r.Namespace,
+		Env:       r.Spec.Pods.Env,
+		EnvFrom:   r.Spec.Pods.EnvFrom,
 	}
-
-	logger.Info("Found primary write servers.", 
-			r.createLogParams("PVC.Names", primaries)...)
-
-	return
 }
 
 /*****************************************************************************/
@@ -1012,7 +1083,11 @@ func (r *IBMSecurityVerifyDirectory) createLogParams(
 		params = append(params, extra)
 	}
 
-	return params
+	/*
+	 * Ensure that no sensitive information is written to the log.
+	 */
+
+	return utils.RedactLogParams(params)
 }
 /*****************************************************************************/
 
@@ -0,0 +1,497 @@
+/* vi: set ts=4 sw=4 noexpandtab : */
+
+/*
+ * Copyright contributors to the IBM Security Verify Directory Operator project
+ */
+
+package v1
+
+/*
+ * This file contains the tests for the defaulting of the document, for the
+ * validation of the configuration which is referenced by the document, and
+ * for the validation of the updates which are made to the replicas.
+ */
+
+/*****************************************************************************/
+
+import (
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/ibm-security/verify-directory-operator/utils"
+
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+/*****************************************************************************/
+
+/*
+ * The following functions return a pointer to the supplied value.
+ */
+
+func int32Ptr(value int32) *int32 {
+	return &value
+}
+
+func int64Ptr(value int64) *int64 {
+	return &value
+}
+
+/*****************************************************************************/
+
+/*
+ * Test the addition of the default values to the document.
+ */
+
+func TestDefault(t *testing.T) {
+	tests := []struct {
+		name     string
+		spec     IBMSecurityVerifyDirectorySpec
+		expected IBMSecurityVerifyDirectorySpec
+	} {
+		{
+			name: "defaults",
+			expected: IBMSecurityVerifyDirectorySpec{
+				Replicas: IBMSecurityVerifyDirectoryReplica{
+					SeedJob: &IBMSecurityVerifyDirectorySeedJob{
+						TTLSecondsAfterFinished:
+										int32Ptr(DefaultSeedJobTTLSeconds),
+						BackoffLimit: int32Ptr(DefaultSeedJobBackoffLimit),
+					},
+					HealthCheck: &IBMSecurityVerifyDirectoryHealthCheck{
+						IntervalSeconds:
+										int32Ptr(DefaultHealthCheckInterval),
+						PendingChangeThreshold:
+									int64Ptr(DefaultPendingChangeThreshold),
+					},
+				},
+				Pods: IBMSecurityVerifyDirectoryPods{
+					Image: IBMSecurityVerifyDirectoryImage{
+						ImagePullPolicy: corev1.PullAlways,
+					},
+					Proxy: IBMSecurityVerifyDirectoryProxy{
+						Replicas: DefaultProxyReplicas,
+					},
+					ConfigMap: IBMSecurityVerifyDirectoryConfigMap{
+						Proxy: IBMSecurityVerifyDirectoryConfigMapEntry{
+							Key: DefaultConfigMapKey,
+						},
+						Server: IBMSecurityVerifyDirectoryConfigMapEntry{
+							Key: DefaultConfigMapKey,
+						},
+					},
+					ServiceAccountName: DefaultServiceAccountName,
+				},
+			},
+		},
+		{
+			name: "explicit values",
+			spec: IBMSecurityVerifyDirectorySpec{
+				Replicas: IBMSecurityVerifyDirectoryReplica{
+					SeedJob: &IBMSecurityVerifyDirectorySeedJob{
+						TTLSecondsAfterFinished: int32Ptr(0),
+						BackoffLimit:            int32Ptr(3),
+						ActiveDeadlineSeconds:   int64Ptr(600),
+					},
+					HealthCheck: &IBMSecurityVerifyDirectoryHealthCheck{
+						IntervalSeconds:        int32Ptr(0),
+						PendingChangeThreshold: int64Ptr(10),
+					},
+				},
+				Pods: IBMSecurityVerifyDirectoryPods{
+					Image: IBMSecurityVerifyDirectoryImage{
+						Label:           "latest",
+						ImagePullPolicy: corev1.PullNever,
+					},
+					Proxy: IBMSecurityVerifyDirectoryProxy{
+						Replicas: 3,
+					},
+					ConfigMap: IBMSecurityVerifyDirectoryConfigMap{
+						Proxy: IBMSecurityVerifyDirectoryConfigMapEntry{
+							Name: "proxy",
+							Key:  "proxy.yaml",
+						},
+						Server: IBMSecurityVerifyDirectoryConfigMapEntry{
+							Name: "server",
+							Key:  "server.yaml",
+						},
+					},
+					ServiceAccountName: "isvd",
+				},
+			},
+			expected: IBMSecurityVerifyDirectorySpec{
+				Replicas: IBMSecurityVerifyDirectoryReplica{
+					SeedJob: &IBMSecurityVerifyDirectorySeedJob{
+						TTLSecondsAfterFinished: int32Ptr(0),
+						BackoffLimit:            int32Ptr(3),
+						ActiveDeadlineSeconds:   int64Ptr(600),
+					},
+					HealthCheck: &IBMSecurityVerifyDirectoryHealthCheck{
+						IntervalSeconds:        int32Ptr(0),
+						PendingChangeThreshold: int64Ptr(10),
+					},
+				},
+				Pods: IBMSecurityVerifyDirectoryPods{
+					Image: IBMSecurityVerifyDirectoryImage{
+						Label:           "latest",
+						ImagePullPolicy: corev1.PullNever,
+					},
+					Proxy: IBMSecurityVerifyDirectoryProxy{
+						Replicas: 3,
+					},
+					ConfigMap: IBMSecurityVerifyDirectoryConfigMap{
+						Proxy: IBMSecurityVerifyDirectoryConfigMapEntry{
+							Name: "proxy",
+							Key:  "proxy.yaml",
+						},
+						Server: IBMSecurityVerifyDirectoryConfigMapEntry{
+							Name: "server",
+							Key:  "server.yaml",
+						},
+					},
+					ServiceAccountName: "isvd",
+				},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			directory := &IBMSecurityVerifyDirectory{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      "isvd",
+					Namespace: "default",
+				},
+				Spec: test.spec,
+			}
+
+			directory.Default()
+
+			if ! reflect.DeepEqual(directory.Spec, test.expected) {
+				t.Errorf("Expected %+v, got %+v",
+						test.expected, directory.Spec)
+			}
+		})
+	}
+}
+
+/*****************************************************************************/
+
+/*
+ * Test the defaulting of the image pull policy, which depends on the label
+ * of the image.
+ */
+
+func TestDefaultImagePullPolicy(t *testing.T) {
+	tests := []struct {
+		label    string
+		expected corev1.PullPolicy
+	} {
+		{ "",        corev1.PullAlways       },
+		{ "latest",  corev1.PullAlways       },
+		{ "10.0.0",  corev1.PullIfNotPresent },
+	}
+
+	for _, test := range tests {
+		t.Run(test.label, func(t *testing.T) {
+			directory := &IBMSecurityVerifyDirectory{}
+
+			directory.Spec.Pods.Image.Label = test.label
+
+			directory.Default()
+
+			if policy := directory.Spec.Pods.Image.ImagePullPolicy;
+									policy != test.expected {
+				t.Errorf("Expected %s, got %s", test.expected, policy)
+			}
+		})
+	}
+}
+
+/*****************************************************************************/
+
+/*
+ * Test the validation of the updates which are made to the replicas.
+ */
+
+func TestValidatePods(t *testing.T) {
+	ready := func(pvc string) IBMSecurityVerifyDirectoryReplicaStatus {
+		return IBMSecurityVerifyDirectoryReplicaStatus{
+			PVC:   pvc,
+			Pod:   "isvd-" + pvc,
+			Phase: "Ready",
+			Ready: true,
+		}
+	}
+
+	notReady := func(pvc string) IBMSecurityVerifyDirectoryReplicaStatus {
+		status := ready(pvc)
+
+		status.Phase = "Starting"
+		status.Ready = false
+
+		return status
+	}
+
+	pending := func(pvc string) IBMSecurityVerifyDirectoryReplicaStatus {
+		status := notReady(pvc)
+
+		status.Phase = "Pending"
+
+		return status
+	}
+
+	tests := []struct {
+		name     string
+		replicas []IBMSecurityVerifyDirectoryReplicaStatus
+		primary  string
+		pvcs     []string
+		err      string
+	} {
+		{
+			name: "no published status",
+			pvcs: []string{ "replica-1", "replica-2" },
+		},
+		{
+			name:     "no changes",
+			replicas: []IBMSecurityVerifyDirectoryReplicaStatus{
+							ready("replica-1"), notReady("replica-2") },
+			pvcs:     []string{ "replica-1", "replica-2" },
+		},
+		{
+			name:     "replica added",
+			replicas: []IBMSecurityVerifyDirectoryReplicaStatus{
+							ready("replica-1") },
+			pvcs:     []string{ "replica-1", "replica-2" },
+		},
+		{
+			name:     "replica added while not ready",
+			replicas: []IBMSecurityVerifyDirectoryReplicaStatus{
+							ready("replica-1"), notReady("replica-2") },
+			pvcs:     []string{ "replica-1", "replica-2", "replica-3" },
+			err:      "The pod, isvd-replica-2, is not currently ready.",
+		},
+		{
+			name:     "pending replica ignored",
+			replicas: []IBMSecurityVerifyDirectoryReplicaStatus{
+							ready("replica-1"), pending("replica-2") },
+			pvcs:     []string{ "replica-1" },
+		},
+		{
+			name:     "primary deleted with replicas retained",
+			replicas: []IBMSecurityVerifyDirectoryReplicaStatus{
+							ready("replica-1"), ready("replica-2") },
+			primary:  "replica-1",
+			pvcs:     []string{ "replica-2" },
+		},
+		{
+			name:     "secondary deleted",
+			replicas: []IBMSecurityVerifyDirectoryReplicaStatus{
+							ready("replica-1"), ready("replica-2") },
+			primary:  "replica-1",
+			pvcs:     []string{ "replica-1" },
+		},
+		{
+			name:     "primary replaced",
+			replicas: []IBMSecurityVerifyDirectoryReplicaStatus{
+							ready("replica-1") },
+			primary:  "replica-1",
+			pvcs:     []string{ "replica-2" },
+			err:      "The pvc, replica-1, is currently being used as the " +
+							"primary write server",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			old := &IBMSecurityVerifyDirectory{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      "isvd",
+					Namespace: "default",
+				},
+				Status: IBMSecurityVerifyDirectoryStatus{
+					Replicas: test.replicas,
+				},
+			}
+
+			if test.primary != "" {
+				old.Status.Proxy = &IBMSecurityVerifyDirectoryProxyStatus{
+					PrimaryWriteServer: test.primary,
+				}
+			}
+
+			directory := old.DeepCopy()
+
+			directory.Spec.Replicas.PVCs = test.pvcs
+
+			err := directory.validatePods(old)
+
+			if test.err == "" {
+				if err != nil {
+					t.Errorf("An unexpected error was returned: %s",
+							err.Error())
+				}
+
+				return
+			}
+
+			if err == nil || ! strings.Contains(err.Error(), test.err) {
+				t.Errorf("Expected an error containing '%s', got: %v",
+						test.err, err)
+			}
+		})
+	}
+}
+
+/*****************************************************************************/
+
+/*
+ * Test the validation of the server and proxy configuration when the
+ * document is admitted.  An invalid configuration must be rejected before
+ * anything is deployed.
+ */
+
+func TestValidateDocumentConfiguration(t *testing.T) {
+	validServer := "general:\n" +
+				   "  license:\n" +
+				   "    key: license\n" +
+				   "  admin:\n" +
+				   "    pwd: passw0rd\n" +
+				   "server:\n" +
+				   "  suffixes:\n" +
+				   "  - dn: o=sample\n"
+
+	validProxy  := "general:\n" +
+				   "  license:\n" +
+				   "    key: license\n" +
+				   "  admin:\n" +
+				   "    pwd: passw0rd\n"
+
+	tests := []struct {
+		name   string
+		server string
+		proxy  string
+		err    string
+	} {
+		{
+			name:   "valid",
+			server: validServer,
+			proxy:  validProxy,
+		},
+		{
+			name:   "unparseable server",
+			server: "general: [",
+			proxy:  validProxy,
+			err:    "The ConfigMap key, isvd-server:config.yaml, could not " +
+						"be parsed.",
+		},
+		{
+			name:   "missing license key",
+			server: "general:\n  admin:\n    pwd: passw0rd\n" +
+						"server:\n  suffixes:\n  - dn: o=sample\n",
+			proxy:  validProxy,
+			err:    "The server ConfigMap key, isvd-server:config.yaml, " +
+						"contains an invalid configuration.",
+		},
+		{
+			name:   "missing secret",
+			server: strings.Replace(validServer, "key: license",
+						"key: secret:isvd-missing/license", 1),
+			proxy:  validProxy,
+			err:    "contains an invalid secret reference.",
+		},
+		{
+			name:   "proxy server groups",
+			server: validServer,
+			proxy:  validProxy + "proxy:\n  server-groups:\n  - name: group\n",
+			err:    "The proxy ConfigMap key, isvd-proxy:config.yaml, " +
+						"contains an invalid configuration.",
+		},
+		{
+			name:   "inconsistent admin dn",
+			server: validServer,
+			proxy:  strings.Replace(validProxy, "pwd: passw0rd",
+						"dn: cn=other\n    pwd: passw0rd", 1),
+			err:    "The proxy ConfigMap key, isvd-proxy:config.yaml, is " +
+						"not consistent with the server ConfigMap key",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			objects := []client.Object{
+				&corev1.PersistentVolumeClaim{
+					ObjectMeta: metav1.ObjectMeta{
+						Name:      "replica-1",
+						Namespace: "default",
+					},
+				},
+				&corev1.ConfigMap{
+					ObjectMeta: metav1.ObjectMeta{
+						Name:      "isvd-server",
+						Namespace: "default",
+					},
+					Data: map[string]string{
+						DefaultConfigMapKey: test.server,
+					},
+				},
+				&corev1.ConfigMap{
+					ObjectMeta: metav1.ObjectMeta{
+						Name:      "isvd-proxy",
+						Namespace: "default",
+					},
+					Data: map[string]string{
+						DefaultConfigMapKey: test.proxy,
+					},
+				},
+			}
+
+			previous, previousUtils := k8s_client, utils.K8sClient
+
+			k8s_client      = fake.NewClientBuilder().
+										WithObjects(objects...).Build()
+			utils.K8sClient = k8s_client
+
+			t.Cleanup(func() {
+				k8s_client, utils.K8sClient = previous, previousUtils
+			})
+
+			directory := &IBMSecurityVerifyDirectory{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      "isvd",
+					Namespace: "default",
+				},
+			}
+
+			directory.Spec.Replicas.PVCs = []string{ "replica-1" }
+			directory.Spec.Pods.ConfigMap.Server.Name = "isvd-server"
+			directory.Spec.Pods.ConfigMap.Proxy.Name  = "isvd-proxy"
+
+			directory.Default()
+
+			err := directory.validateDocument()
+
+			if test.err == "" {
+				if err != nil {
+					t.Errorf("An unexpected error was returned: %s",
+							err.Error())
+				}
+
+				return
+			}
+
+			if err == nil || ! strings.Contains(err.Error(), test.err) {
+				t.Errorf("Expected an error containing '%s', got: %v",
+						test.err, err)
+			}
+		})
+	}
+}
+
+/*****************************************************************************/
+
@@ -0,0 +1,131 @@
+/* vi: set ts=4 sw=4 noexpandtab : */
+
+/*
+ * Copyright contributors to the IBM Security Verify Directory Operator project
+ */
+
+package v1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// IBMSecurityVerifyDirectoryBackupSpec defines the desired state of
+// IBMSecurityVerifyDirectoryBackup
+type IBMSecurityVerifyDirectoryBackupSpec struct {
+	// The name of the IBMSecurityVerifyDirectory resource, in the same
+	// namespace, which is to be backed up.
+	Directory string `json:"directory"`
+
+	// The name of the PVC of the replica which is to be backed up.  Defaults
+	// to the first replica of the directory.
+	// +optional
+	Replica string `json:"replica,omitempty"`
+
+	//+kubebuilder:default=database
+	//+kubebuilder:validation:Enum=database;ldif
+	// The format of the backup.  A database backup is an archive of the data
+	// volume of the replica, and an LDIF backup is an export of the entries
+	// from each of the suffixes of the replica.
+	// +optional
+	Format string `json:"format,omitempty"`
+
+	// The name of the pre-created PVC to which the backups will be written.
+	// Each backup is written to the <name>/<job> directory of the PVC.
+	TargetPVC string `json:"targetPVC"`
+
+	// The schedule, in Cron format, on which the backups will be taken.  If
+	// no schedule is specified a single backup will be taken.
+	// See https://en.wikipedia.org/wiki/Cron.
+	// +optional
+	Schedule string `json:"schedule,omitempty"`
+
+	//+kubebuilder:default=7
+	//+kubebuilder:validation:Minimum=0
+	// The number of backups which will be retained in the target PVC.  Older
+	// backups are pruned after each successful backup.  A value of 0 means
+	// that backups are never pruned.
+	// +optional
+	Retain *int32 `json:"retain,omitempty"`
+
+	// Whether the scheduling of backups is suspended.
+	// +optional
+	Suspend bool `json:"suspend,omitempty"`
+}
+
+// IBMSecurityVerifyDirectoryBackupRecord defines the details of a single
+// backup.
+type IBMSecurityVerifyDirectoryBackupRecord struct {
+	// The name of the backup, which is also the name of the directory within
+	// the target PVC which contains the backup.
+	Name string `json:"name"`
+
+	// The name of the PVC of the replica which was backed up.
+	SourceReplica string `json:"sourceReplica"`
+
+	// The format of the backup.
+	Format string `json:"format"`
+
+	// The current phase of the backup: Running, Completed or Failed.
+	Phase string `json:"phase"`
+
+	// The size of the backup, in bytes.
+	// +optional
+	Size int64 `json:"size,omitempty"`
+
+	// The time at which the backup was started.
+	// +optional
+	StartTime *metav1.Time `json:"startTime,omitempty"`
+
+	// The time at which the backup completed.
+	// +optional
+	CompletionTime *metav1.Time `json:"completionTime,omitempty"`
+
+	// The time taken to perform the backup.
+	// +optional
+	Duration string `json:"duration,omitempty"`
+}
+
+// IBMSecurityVerifyDirectoryBackupStatus defines the observed state of
+// IBMSecurityVerifyDirectoryBackup
+type IBMSecurityVerifyDirectoryBackupStatus struct {
+	Conditions []metav1.Condition `json:"conditions,omitempty"`
+
+	// The backups which are currently retained, newest first.
+	// +optional
+	Backups []IBMSecurityVerifyDirectoryBackupRecord `json:"backups,omitempty"`
+
+	// The time at which the last successful backup completed.
+	// +optional
+	LastSuccessfulTime *metav1.Time `json:"lastSuccessfulTime,omitempty"`
+}
+
+//+kubebuilder:object:root=true
+//+kubebuilder:subresource:status
+//+kubebuilder:printcolumn:name="Directory",type=string,JSONPath=`.spec.directory`
+//+kubebuilder:printcolumn:name="Schedule",type=string,JSONPath=`.spec.schedule`
+//+kubebuilder:printcolumn:name="Last Backup",type=date,JSONPath=`.status.lastSuccessfulTime`
+
+// IBMSecurityVerifyDirectoryBackup is the Schema for the
+// ibmsecurityverifydirectorybackups API
+type IBMSecurityVerifyDirectoryBackup struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   IBMSecurityVerifyDirectoryBackupSpec   `json:"spec,omitempty"`
+	Status IBMSecurityVerifyDirectoryBackupStatus `json:"status,omitempty"`
+}
+
+//+kubebuilder:object:root=true
+
+// IBMSecurityVerifyDirectoryBackupList contains a list of
+// IBMSecurityVerifyDirectoryBackup
+type IBMSecurityVerifyDirectoryBackupList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []IBMSecurityVerifyDirectoryBackup `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&IBMSecurityVerifyDirectoryBackup{}, &IBMSecurityVerifyDirectoryBackupList{})
+}
@@ -15,14 +15,18 @@ package controllers
 
 import (
 	corev1  "k8s.io/api/core/v1"
+	metav1  "k8s.io/apimachinery/pkg/apis/meta/v1"
 
 	"errors"
+	"fmt"
 
+	"github.com/ibm-security/verify-directory-operator/ldapconfig"
 	"github.com/ibm-security/verify-directory-operator/utils"
 
+	"k8s.io/apimachinery/pkg/api/meta"
 	"k8s.io/apimachinery/pkg/types"
 
-	"github.com/go-yaml/yaml"
+	ibmv1 "github.com/ibm-security/verify-directory-operator/api/v1"
 )
 
 /*****************************************************************************/
@@ -39,192 +43,78 @@ func (r *IBMSecurityVerifyDirectoryReconciler) getServerConfig(
 				r.createLogParams(h, "Function", "getServerConfig")...)
 
 	/*
-	 * Retrieve the ConfigMap which contains the server configuration.
+	 * Retrieve the server configuration.
 	 */
 
 	name := h.directory.Spec.Pods.ConfigMap.Server.Name
 	key  := h.directory.Spec.Pods.ConfigMap.Server.Key
 
-	config := &corev1.ConfigMap{}
-	err	   := r.Get(h.ctx, 
-			types.NamespacedName{Name: name, Namespace: h.directory.Namespace}, 
-			config)
+	body, err := r.getServerConfigBody(h)
 
 	if err != nil {
-		r.Log.Error(err, "Failed to retrieve the server ConfigMap.",
-				r.createLogParams(h, "Name", name)...)
-
 		return err
 	}
 
-	r.Log.V(1).Info("Retrieved the server ConfigMap", 
-				r.createLogParams(h, "Map", config)...)
-
 	/*
-	 * Parse the YAML configuration into a map.  Unfortunately it is not
-	 * easy to parse YAML into a generic structure, and so after we have
-	 * unmarshalled the data we want to iteratively convert the data into 
-	 * a map of strings.
+	 * Ensure that each of the secrets referenced by the configuration can
+	 * be resolved.
 	 */
 
-    var body interface{}
-    if err := yaml.Unmarshal([]byte(config.Data[key]), &body); err != nil {
-		return err
-    }
-
-	body      = utils.ConvertYaml(body)
-	body, ok := body.(map[string]interface{})
-
-	if ! ok {
-		err = errors.New("The server configuration cannot be parsed.")
-
-		r.Log.Error(err, "Failed to unmarshal the ConfigMap data.",
-				r.createLogParams(h, "Name", name, "Key", key, 
-									"Data", config.Data[key])...)
+	err = r.validateSecretReferences(h, body, 
+						h.directory.Spec.Pods.ConfigMap.Server,
+						ibmv1.ConditionServerSecretsResolved)
 
+	if err != nil {
 		return err
 	}
 
-	r.Log.V(1).Info("Processed the server ConfigMap", 
-				r.createLogParams(h, "Data", body)...)
-
-	/*
-	 * Retrieve the general.ports.ldap configuration data.  
-	 */
-
-	h.config.port   = 9389
-	h.config.secure = false
-
-	ldap := utils.GetYamlValue(body, []string{"general","ports","ldap"}, 
-									true, h.directory.Namespace)
-
-	r.Log.V(1).Info("Retrieved the LDAP port configuration.", 
-				r.createLogParams(h, "Port", ldap)...)
-
-	if ldap != nil {
-		iport, ok := ldap.(int)
-
-		if ! ok {
-			err = errors.New(
-						"The general.ports.ldap configuration is incorrect.")
-
-			r.Log.Error(err, "Failed to process the ConfigMap data.",
-				r.createLogParams(h, "Name", name, "Key", key, 
-									"Data", ldap)...)
-
-			return err
-		}
-
-		h.config.port = int32(iport)
-
-		if h.config.port == 0 {
-			/*
-			 * If the port is 0 it means that it has not been activated and
-			 * so we need to use the ldaps port.
-			 */
-
-			h.config.secure = true
-			h.config.port   = 9636
-
-			ldaps := utils.GetYamlValue(
-							body, []string{"general","ports","ldaps"}, 
-							true, h.directory.Namespace)
-
-			r.Log.V(1).Info("LDAP port is disabled, retrieved the LDAPS port.", 
-				r.createLogParams(h, "Port", ldaps)...)
-
-			if ldaps != nil {
-				iport, ok := ldaps.(int)
-
-				if ! ok {
-					err = errors.New(
-						"The general.ports.ldaps configuration is incorrect.")
-
-					r.Log.Error(err, "Failed to process the ConfigMap data.",
-						r.createLogParams(h, "Name", name, "Key", key, 
-									"Data", ldaps)...)
-
-					return err
-				}
-
-				h.config.port = int32(iport)
-			}
-		}
-	}
-
 	/*
-	 * Retrieve the license key information.
+	 * Parse and validate the configuration.
 	 */
 
-	licenseKey := utils.GetYamlValue(body, 
-						[]string{"general","license","key"}, 
-						false, h.directory.Namespace)
-
-	r.Log.V(1).Info("Retrieved the license key.", 
-				r.createLogParams(h, "License.Key", licenseKey)...)
+	rctx := r.getResolveContext(h)
 
-	if licenseKey == nil {
-		err = errors.New("The general.license.key configuration is missing.")
+	config, err := ldapconfig.ParseServerConfig(body, rctx,
+						h.directory.Spec.Credentials.Generate)
 
+	if err != nil {
 		r.Log.Error(err, "Failed to process the ConfigMap data.",
 						r.createLogParams(h, "Name", name, "Key", key)...)
 
 		return err
 	}
 
-	h.config.licenseKey = licenseKey.(string)
+	h.config.ldapPort   = config.Ports.LDAP
+	h.config.ldapsPort  = config.Ports.LDAPS
+	h.config.licenseKey = config.LicenseKey
+	h.config.adminDn    = config.AdminDn
+	h.config.adminPwd   = config.AdminPwd
+	h.config.suffixes   = config.Suffixes
 
 	/*
-	 * Retrieve the admin DN.
+	 * Work out the port which is used for replication and the port which is
+	 * used by the proxy.
 	 */
 
-	adminDn := utils.GetYamlValue(body, []string{"general","admin","dn"}, 
-						false, h.directory.Namespace)
-
-	r.Log.V(1).Info("Retrieved the admin DN.", 
-				r.createLogParams(h, "Admin.DN", adminDn)...)
-
-	if adminDn == nil {
-		h.config.adminDn = "cn=root"
-	} else {
-		h.config.adminDn = adminDn.(string)
-	}
-
-	/*
-	 * Retrieve the admin password.
-	 */
-
-	adminPwd := utils.GetYamlValue(body, 
-									[]string{"general","admin","pwd"}, 
-									false, h.directory.Namespace)
-
-	if adminPwd == nil {
-		err = errors.New("The general.admin.pwd configuration is missing.")
-
-		r.Log.Error(err, "Failed to process the ConfigMap data.",
-						r.createLogParams(h, "Name", name, "Key", key)...)
+	h.config.replicationPort, h.config.replicationSecure, err =
+			config.Ports.Select(h.directory.Spec.Protocols.Replication)
 
+	if err != nil {
 		return err
-
 	}
 
-	h.config.adminPwd = adminPwd.(string)
-
-	/*
-	 * Retrieve the suffixes which are to be managed.  This is a little bit
-	 * more complicated than the standard configuration entries as we need to
-	 * extract each of the dn's from the suffixes entry.
-	 */
-
-	h.config.suffixes, err = r.getConfigSuffixes(h, body, h.directory.Namespace)
+	h.config.backendPort, h.config.backendSecure, err =
+			config.Ports.Select(h.directory.Spec.Protocols.ProxyBackend)
 
 	if err != nil {
 		return err
 	}
 
 	r.Log.Info("Server configuration information", 
-				r.createLogParams(h, "port", h.config.port, 
-							"is ssl", h.config.secure, 
+				r.createLogParams(h, "ldap port", h.config.ldapPort, 
+							"ldaps port", h.config.ldapsPort, 
+							"replication port", h.config.replicationPort, 
+							"proxy backend port", h.config.backendPort, 
 							"license.key", h.config.licenseKey,
 							"admin.dn", h.config.adminDn,
 							"admin.pwd", "XXX",
@@ -236,91 +126,99 @@ func (r *IBMSecurityVerifyDirectoryReconciler) getServerConfig(
 /*****************************************************************************/
 
 /*
- * Retrieve the suffixes which are being managed.  We need to extract each
- * of the DN values from the general.server.suffixes entry.
+ * The following function is used to retrieve the server configuration from
+ * the ConfigMap, parsed into a map.
  */
 
-func (r *IBMSecurityVerifyDirectoryReconciler) getConfigSuffixes(
-					h         *RequestHandle,
-					body      interface{}, 
-					namespace string) ([]string, error) {
-
-	r.Log.V(1).Info("Entering a function", 
-				r.createLogParams(h, "Function", "getConfigSuffixes")...)
-
-	var suffixes []string
-
-	entries := utils.GetYamlValue(body, []string{"server","suffixes"}, 
-						false, namespace)
+func (r *IBMSecurityVerifyDirectoryReconciler) getServerConfigBody(
+			h *RequestHandle) (map[string]interface{}, error) {
 
-	r.Log.V(1).Info("Retrieved the server suffixes.", 
-				r.createLogParams(h, "Suffixes", entries)...)
+	/*
+	 * Retrieve the ConfigMap which contains the server configuration.
+	 */
 
-	if entries == nil {
-		err := errors.New("The server.suffixes configuration is missing.")
+	name := h.directory.Spec.Pods.ConfigMap.Server.Name
+	key  := h.directory.Spec.Pods.ConfigMap.Server.Key
 
-		r.Log.Error(err, "Failed to retrieve the config suffixes.",
-						r.createLogParams(h)...)
+	config := &corev1.ConfigMap{}
+	err	   := r.Get(h.ctx, 
+			types.NamespacedName{Name: name, Namespace: h.directory.Namespace}, 
+			config)
 
+	if err != nil {
+		r.Log.Error(err, "Failed to retrieve the server ConfigMap.",
+				r.createLogParams(h, "Name", name)...)
 
 		return nil, err
 	}
 
+	r.Log.V(1).Info("Retrieved the server ConfigMap", 
+				r.createLogParams(h, "Map", config)...)
+
 	/*
-	 * The first thing to do is cast the yaml to the correct type.
+	 * Parse the YAML configuration into a map.
 	 */
 
-	suffixEntries, ok := entries.([]interface{}) 
+	data, err := ldapconfig.Parse(config.Data[key])
 
-	if !ok {
-		err := errors.New("The server.suffixes configuration is incorrect.")
-
-		r.Log.Error(err, "Failed to retrieve the config suffixes.",
-						r.createLogParams(h, "suffixes", suffixEntries)...)
+	if err != nil {
+		r.Log.Error(err, "Failed to unmarshal the ConfigMap data.",
+				r.createLogParams(h, "Name", name, "Key", key)...)
 
 		return nil, err
 	}
 
-	/*
-	 * Now we should iterate over the suffix entries, grabbing the DN value
-	 * for each entry.
-	 */
-
-	for _, entry := range suffixEntries {
-		suffixEntry, ok := entry.(map[string]interface{}) 
-
-		r.Log.V(1).Info("Processing a suffix entry.", 
-				r.createLogParams(h, "Suffix", suffixEntry)...)
+	r.Log.V(1).Info("Processed the server ConfigMap", 
+				r.createLogParams(h, "Data", data)...)
 
-		if !ok {
-			err := errors.New("The server.suffixes configuration is incorrect.")
+	return data, nil
+}
 
-			r.Log.Error(err, "Failed to retrieve the config suffixes.",
-						r.createLogParams(h, "suffix", suffixEntry)...)
+/*****************************************************************************/
 
-			return nil, err
-		}
+/*
+ * The following function is used to validate that each secret which is
+ * referenced from a ConfigMap exists, and contains the referenced key.  The
+ * result of the validation is recorded in the specified condition (either
+ * ServerSecretsResolved or ProxySecretsResolved) of the document.
+ */
 
-		dn := utils.GetYamlValue(suffixEntry, []string{"dn"}, false, namespace)
+func (r *IBMSecurityVerifyDirectoryReconciler) validateSecretReferences(
+				h             *RequestHandle,
+				body          interface{},
+				entry         ibmv1.IBMSecurityVerifyDirectoryConfigMapEntry,
+				conditionType string) (error) {
 
-		r.Log.V(1).Info("Found a DN for the suffix.", 
-				r.createLogParams(h, "Suffix", suffixEntry, "DN", dn)...)
+	r.Log.V(1).Info("Entering a function", 
+				r.createLogParams(h, "Function", "validateSecretReferences",
+						"Entry", entry, "Condition", conditionType)...)
+
+	condition := metav1.Condition{
+		Type:               conditionType,
+		Reason:             ibmv1.ReasonSecretsResolved,
+		Message:            "All referenced secrets have been resolved.",
+		Status:             metav1.ConditionTrue,
+		ObservedGeneration: h.directory.Generation,
+	}
 
-		if !ok {
-			err := errors.New("The server.suffixes configuration is incorrect.")
+	err := utils.ValidateSecretReferences(body, r.getResolveContext(h))
 
-			r.Log.Error(err, "Failed to retrieve the config suffixes.",
-						r.createLogParams(h, "suffix", suffixEntry, 
-											"dn", dn)...)
+	if err != nil {
+		err = errors.New(fmt.Sprintf("The ConfigMap key, %s:%s, contains " +
+				"an invalid secret reference.  %s", 
+				entry.Name, entry.Key, err.Error()))
 
-			return nil, err
-		}
+		r.Log.Error(err, "Failed to resolve a secret reference.",
+				r.createLogParams(h, "Name", entry.Name, "Key", entry.Key)...)
 
-		suffixes = append(suffixes, dn.(string))
+		condition.Reason  = ibmv1.ReasonSecretNotResolved
+		condition.Message = err.Error()
+		condition.Status  = metav1.ConditionFalse
 	}
 
-	return suffixes, nil
+	meta.SetStatusCondition(&h.directory.Status.Conditions, condition)
+
+	return err
 }
 
 /*****************************************************************************/
-
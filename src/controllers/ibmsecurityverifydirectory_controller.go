@@ -13,11 +13,15 @@ import (
 	corev1  "k8s.io/api/core/v1"
 
 	"context"
+	"time"
 
 	"k8s.io/apimachinery/pkg/api/errors"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/api/meta"
 
+	"k8s.io/client-go/tools/record"
+
+	"sigs.k8s.io/controller-runtime/pkg/builder"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/log"
 	"sigs.k8s.io/controller-runtime/pkg/predicate"
@@ -46,8 +50,9 @@ const ConfigMapKey = "config.yaml"
 
 type IBMSecurityVerifyDirectoryReconciler struct {
 	client.Client
-	Log logr.Logger
-	Scheme *runtime.Scheme
+	Log      logr.Logger
+	Scheme   *runtime.Scheme
+	Recorder record.EventRecorder
 }
 
 /*****************************************************************************/
@@ -55,14 +60,19 @@ type IBMSecurityVerifyDirectoryReconciler struct {
 //+kubebuilder:rbac:groups=ibm.com,resources=ibmsecurityverifydirectories,verbs=get;list;watch;create;update;patch;delete
 //+kubebuilder:rbac:groups=ibm.com,resources=ibmsecurityverifydirectories/status,verbs=get;update;patch
 //+kubebuilder:rbac:groups=ibm.com,resources=ibmsecurityverifydirectories/finalizers,verbs=update
+//+kubebuilder:rbac:groups=ibm.com,resources=ibmsecurityverifydirectorybackups,verbs=get;list;watch
 //+kubebuilder:rbac:groups=apps,resources=deployments,verbs=get;list;watch;create;update;patch;delete
-//+kubebuilder:rbac:groups=core,resources=pods,verbs=get;list;watch;create;delete
+//+kubebuilder:rbac:groups=core,resources=pods,verbs=get;list;watch;create;patch;delete
 //+kubebuilder:rbac:groups=core,resources=pods/exec,verbs=create
-//+kubebuilder:rbac:groups=core,resources=services,verbs=get;list;watch;create;delete
+//+kubebuilder:rbac:groups=core,resources=pods/log,verbs=get
+//+kubebuilder:rbac:groups=core,resources=events,verbs=create;patch
+//+kubebuilder:rbac:groups=core,resources=services,verbs=get;list;watch;create;update;delete
 //+kubebuilder:rbac:groups=batch,resources=jobs,verbs=get;list;watch;create;delete
 //+kubebuilder:rbac:groups=core,resources=configmaps,verbs=get;list;watch;create;delete
-//+kubebuilder:rbac:groups=core,resources=secrets,verbs=get;list;watch
-//+kubebuilder:rbac:groups=core,resources=persistentvolumeclaims,verbs=get;list;watch
+//+kubebuilder:rbac:groups=core,resources=secrets,verbs=get;list;watch;create;update;delete
+//+kubebuilder:rbac:groups=core,resources=persistentvolumeclaims,verbs=get;list;watch;create;delete
+//+kubebuilder:rbac:groups=snapshot.storage.k8s.io,resources=volumesnapshots,verbs=get;list;watch;create;delete
+//+kubebuilder:rbac:groups=cert-manager.io,resources=certificates,verbs=get;list;watch;create;update;delete
 
 /*****************************************************************************/
 
@@ -72,12 +82,16 @@ type IBMSecurityVerifyDirectoryReconciler struct {
  */
 
 type ServerConfig struct {
-	port       int32
-	secure     bool
-	licenseKey string
-	adminDn    string
-	adminPwd   string
-	suffixes   []string
+	ldapPort          int32
+	ldapsPort         int32
+	replicationPort   int32
+	replicationSecure bool
+	backendPort       int32
+	backendSecure     bool
+	licenseKey        string
+	adminDn           string
+	adminPwd          string
+	suffixes          []string
 }
 
 /*
@@ -87,10 +101,26 @@ type ServerConfig struct {
  */
 
 type RequestHandle struct {
-	ctx       context.Context
-	req       ctrl.Request
-	directory *ibmv1.IBMSecurityVerifyDirectory
-	config    ServerConfig
+	ctx          context.Context
+	req          ctrl.Request
+	directory    *ibmv1.IBMSecurityVerifyDirectory
+	config       ServerConfig
+	restartProxy bool
+
+	// Whether the addition of new replicas has been rolled back.
+	rolledBack   bool
+
+	// The time at which the deployment was marked as in progress, and the
+	// times at which the seed jobs were started.  These are used to 
+	// maintain the metrics.
+	inProgressSince   time.Time
+	seedJobStartTimes map[string]time.Time
+
+	// The replica which is to be used as the primary write server of the
+	// proxy, and the replicas from which the primary write role is being
+	// moved.
+	primaryWriteServer string
+	failoverFrom       []string
 }
 
 /*****************************************************************************/
@@ -138,6 +168,8 @@ func (r *IBMSecurityVerifyDirectoryReconciler) Reconcile(
 				"Resource not found most likely due to it having been deleted", 
 								r.createLogParams(&h)...)
 
+			r.deleteReplicaMetrics(req)
+
 			err = nil
 		} else {
 			/*
@@ -151,17 +183,44 @@ func (r *IBMSecurityVerifyDirectoryReconciler) Reconcile(
 		return ctrl.Result{}, nil
 	}
 
+	/*
+	 * Apply the default values to the document.  These will already have
+	 * been added by the defaulting webhook, unless the document was created
+	 * before the webhook was registered.  The defaults are only applied to
+	 * our copy of the document, for the processing of this request, as the
+	 * stored document may not pass the validation of the webhook.
+	 */
+
+	h.directory.Default()
+
 	r.Log.V(1).Info("Reconciling a document", 
 				r.createLogParams(&h, "Document", h.directory)...)
 
 	/*
-	 * Check to see whether the document is currently in the failing state.
-	 * We don't allow documents to be updated when they are in the failing
-	 * state.
+	 * Update the observed state of the replicas and the proxy, along with
+	 * the replica count metrics, once the document has been processed.
 	 */
 
-	if meta.IsStatusConditionFalse(h.directory.Status.Conditions, "Available") {
-		return ctrl.Result{}, nil
+	defer r.updateStatus(&h)
+
+	/*
+	 * Check to see whether the processing of the current generation of the
+	 * document has already failed.  We don't retry a failed step until the
+	 * document has been corrected, as the environment is left in its current
+	 * state to allow the failure to be examined.  The health of the
+	 * replication agreements does however continue to be checked.  A
+	 * rotation of the credentials doesn't change the generation of the
+	 * document, and so a pending rotation is always processed, as the
+	 * rotation is often needed most when the document is degraded.
+	 */
+
+	degraded := meta.FindStatusCondition(h.directory.Status.Conditions,
+							ibmv1.ConditionDegraded)
+
+	if degraded != nil && degraded.Status == metav1.ConditionTrue &&
+				degraded.ObservedGeneration == h.directory.Generation &&
+				! r.isRotationPending(&h) {
+		return r.scheduleHealthCheck(&h), nil
 	}
 
 	/*
@@ -171,10 +230,10 @@ func (r *IBMSecurityVerifyDirectoryReconciler) Reconcile(
 	existing, err := r.getExistingPods(&h)
 
 	if err != nil {
-		r.setCondition(err, &h,
+		r.setCondition(err, &h, ibmv1.ReasonPodListFailed,
 							"Failed to retrieve the list of existing pods.")
 
-		return ctrl.Result{}, nil
+		return r.getHealthCheckResult(&h), nil
 	}
 
 	r.Log.Info("Existing pods", r.createLogParams(&h, "Pods", existing)...)
@@ -192,14 +251,38 @@ func (r *IBMSecurityVerifyDirectoryReconciler) Reconcile(
 			"to be added", toBeAdded)...)
 
 	/*
-	 * Mark the deployment as in-progress.
+	 * Work out whether the processing of the document will result in a
+	 * change to the deployment.  This must be done before the Progressing
+	 * condition is updated.
 	 */
 
+	pending := r.isWorkPending(&h, existing, toBeAdded, toBeDeleted)
+
+	/*
+	 * If there is nothing to be changed we simply check the health of the
+	 * replication agreements, and schedule the next check.  The Progressing
+	 * condition is left untouched, so that the periodic health checks don't
+	 * block updates to the document.
+	 */
+
+	if ! pending {
+		return r.scheduleHealthCheck(&h), nil
+	}
+
+	/*
+	 * Mark the deployment as in-progress.  We also remove the conditions
+	 * which were maintained by earlier versions of the operator.
+	 */
+
+	meta.RemoveStatusCondition(&h.directory.Status.Conditions, "InProgress")
+	meta.RemoveStatusCondition(&h.directory.Status.Conditions, "Available")
+
 	condition := metav1.Condition{
-		Type:    "InProgress",
-		Reason:  "DeploymentProgress",
-		Message: "The deployment is being processed.",
-		Status:  metav1.ConditionTrue,
+		Type:               ibmv1.ConditionProgressing,
+		Reason:             ibmv1.ReasonReconciling,
+		Message:            "The deployment is being processed.",
+		Status:             metav1.ConditionTrue,
+		ObservedGeneration: h.directory.Generation,
 	}
 
 	meta.SetStatusCondition(&h.directory.Status.Conditions, condition)
@@ -208,9 +291,11 @@ func (r *IBMSecurityVerifyDirectoryReconciler) Reconcile(
 		r.Log.Error(err, "Failed to update the condition for the resource",
 						r.createLogParams(&h)...)
 	
-		return ctrl.Result{}, nil
+		return r.getHealthCheckResult(&h), nil
 	}
 
+	h.inProgressSince = time.Now()
+
 	/*
 	 * Get the configuration to be used by the server.
 	 */
@@ -218,10 +303,36 @@ func (r *IBMSecurityVerifyDirectoryReconciler) Reconcile(
 	err = r.getServerConfig(&h)
 
 	if err != nil {
-		r.setCondition(err, &h,
+		r.setCondition(err, &h, ibmv1.ReasonServerConfigInvalid,
 				"Failed to obtain the server information from the ConfigMap.")
 
-		return ctrl.Result{}, nil
+		return r.getHealthCheckResult(&h), nil
+	}
+
+	/*
+	 * Generate the admin and replication credentials, if required.
+	 */
+
+	err = r.ensureCredentials(&h)
+
+	if err != nil {
+		r.setCondition(err, &h, ibmv1.ReasonCredentialsFailed,
+							"Failed to generate the credentials.")
+
+		return r.getHealthCheckResult(&h), nil
+	}
+
+	/*
+	 * Rotate the generated credentials, if required.
+	 */
+
+	err = r.rotateCredentials(&h, existing)
+
+	if err != nil {
+		r.setCondition(err, &h, ibmv1.ReasonCredentialRotationFailed,
+							"Failed to rotate the credentials.")
+
+		return r.getHealthCheckResult(&h), nil
 	}
 
 	if len(toBeDeleted) != 0 || len(toBeAdded) != 0 {
@@ -232,13 +343,69 @@ func (r *IBMSecurityVerifyDirectoryReconciler) Reconcile(
 		existing, err = r.createReplicas(&h, existing, toBeAdded)
 
 		if err != nil {
-			r.setCondition(err, &h,
+			/*
+			 * If the new replicas have been rolled back the existing 
+			 * replicas will continue to serve requests, with the previous
+			 * topology, and so the document can be corrected and re-applied.
+			 */
+
+			reason := ibmv1.ReasonReplicaCreationFailed
+
+			if h.rolledBack {
+				reason = ibmv1.ReasonReplicaAdditionRolledBack
+			}
+
+			r.setCondition(err, &h, reason,
 					"Failed to create the new replicas.")
 
-			return ctrl.Result{}, nil
+			return r.getHealthCheckResult(&h), nil
 		}
 	}
 
+	/*
+	 * Ensure that the services of the existing replicas publish the ports
+	 * which are currently enabled.
+	 */
+
+	err = r.reconcileServices(&h, existing)
+
+	if err != nil {
+		r.setCondition(err, &h, ibmv1.ReasonServiceUpdateFailed,
+							"Failed to update the replica services.")
+
+		return r.getHealthCheckResult(&h), nil
+	}
+
+	/*
+	 * Restart any replicas whose certificate has been renewed since the
+	 * replica was started.
+	 */
+
+	err = r.rollRenewedCertificates(&h, existing)
+
+	if err != nil {
+		r.setCondition(err, &h, ibmv1.ReasonCertificateRollFailed,
+							"Failed to restart a replica with a renewed " +
+							"certificate.")
+
+		return r.getHealthCheckResult(&h), nil
+	}
+
+	/*
+	 * Work out which replica is to be used as the primary write server of
+	 * the proxy.  If the current primary write server is to be deleted
+	 * another replica will take over the role.
+	 */
+
+	err = r.preparePrimaryFailover(&h, existing, toBeDeleted)
+
+	if err != nil {
+		r.setCondition(err, &h, ibmv1.ReasonPrimaryFailoverFailed,
+							"Failed to move the primary write server.")
+
+		return r.getHealthCheckResult(&h), nil
+	}
+
 	/*
 	 * Now that we have created the replicas we need to deploy the
 	 * front-end proxy.
@@ -247,9 +414,25 @@ func (r *IBMSecurityVerifyDirectoryReconciler) Reconcile(
 	err = r.deployProxy(&h)
 
 	if err != nil {
-		r.setCondition(err, &h, "Failed to deploy the proxy.")
+		r.setCondition(err, &h, ibmv1.ReasonProxyDeploymentFailed,
+							"Failed to deploy the proxy.")
 
-		return ctrl.Result{}, nil
+		return r.getHealthCheckResult(&h), nil
+	}
+
+	/*
+	 * If the primary write server is being moved we need to wait for the
+	 * proxy to be rolled, and for the pending changes to be replicated,
+	 * before the previous primary write server is deleted.
+	 */
+
+	err = r.completePrimaryFailover(&h, existing, toBeDeleted)
+
+	if err != nil {
+		r.setCondition(err, &h, ibmv1.ReasonPrimaryFailoverFailed,
+							"Failed to move the primary write server.")
+
+		return r.getHealthCheckResult(&h), nil
 	}
 
 	/*
@@ -259,9 +442,10 @@ func (r *IBMSecurityVerifyDirectoryReconciler) Reconcile(
 	err = r.deleteReplicas(&h, existing, toBeDeleted)
 
 	if err != nil {
-		r.setCondition(err, &h, "Failed to delete the obsolete replicas.")
+		r.setCondition(err, &h, ibmv1.ReasonReplicaDeletionFailed,
+							"Failed to delete the obsolete replicas.")
 
-		return ctrl.Result{}, nil
+		return r.getHealthCheckResult(&h), nil
 	}
 
 	/*
@@ -270,56 +454,67 @@ func (r *IBMSecurityVerifyDirectoryReconciler) Reconcile(
 
 	r.Log.Info("Reconciled the document", r.createLogParams(&h)...) 
 
-	r.setCondition(err, &h, "")
+	r.setCondition(err, &h, ibmv1.ReasonAsExpected, "")
 
-	return ctrl.Result{}, nil
+	/*
+	 * Check the health of the replication agreements, and schedule the
+	 * next check.
+	 */
+
+	return r.scheduleHealthCheck(&h), nil
 }
 
 /*****************************************************************************/
 
 /*
  * The following function is used to wrap the logic which updates the
- * condition of the deployment.
+ * condition of the deployment once the document has been processed.  The
+ * supplied reason identifies the step which failed, and is only used if an
+ * error has been supplied.  The Ready condition is maintained separately, 
+ * by the updateStatus function, as the service will often remain available
+ * when a step fails.
  */
 
 func (r *IBMSecurityVerifyDirectoryReconciler) setCondition(
-				err error,
-				h   *RequestHandle,
-				msg string) error {
+				err    error,
+				h      *RequestHandle,
+				reason string,
+				msg    string) error {
 
 	progressCondition := metav1.Condition{
-		Type:    "InProgress",
-		Reason:  "DeploymentProgress",
-		Message: "The deployment has been processed.",
-		Status:  metav1.ConditionFalse,
+		Type:               ibmv1.ConditionProgressing,
+		Reason:             ibmv1.ReasonReconcileComplete,
+		Message:            "The deployment has been processed.",
+		Status:             metav1.ConditionFalse,
+		ObservedGeneration: h.directory.Generation,
 	}
 
-	meta.SetStatusCondition(&h.directory.Status.Conditions, progressCondition)
-
 	condition := metav1.Condition{
-		Type: "Available",
-	}
-
-	if h.directory.Generation == 1 {
-		condition.Reason  = "DeploymentCreated"
-		condition.Message = "The deployment has been created."
-	} else {
-		condition.Reason  = "DeploymentUpdated"
-		condition.Message = "The deployment has been updated."
+		Type:               ibmv1.ConditionDegraded,
+		ObservedGeneration: h.directory.Generation,
 	}
 
 	if err != nil {
+		progressCondition.Reason  = ibmv1.ReasonReconcileFailed
+		progressCondition.Message = "The processing of the deployment failed."
+
+		condition.Reason  = reason
 		condition.Message = err.Error()
-		condition.Status  = metav1.ConditionFalse
-	} else {
 		condition.Status  = metav1.ConditionTrue
+	} else {
+		condition.Reason  = ibmv1.ReasonAsExpected
+		condition.Message = "The deployment has been processed successfully."
+		condition.Status  = metav1.ConditionFalse
 	}
 
 	r.Log.V(1).Info("Setting a condition", 
 				r.createLogParams(h, "Condition", condition)...)
 
+	meta.SetStatusCondition(&h.directory.Status.Conditions, progressCondition)
 	meta.SetStatusCondition(&h.directory.Status.Conditions, condition)
 
+	r.inProgressFinished(h)
+
 	if err := r.Status().Update(h.ctx, h.directory); err != nil {
 		r.Log.Error(err, "Failed to update the condition for the resource",
 						r.createLogParams(h)...)
@@ -373,6 +568,41 @@ func (r *IBMSecurityVerifyDirectoryReconciler) getExistingPods(
 
 /*****************************************************************************/
 
+/*
+ * The following function is used to determine whether the processing of the
+ * document will result in a change to the deployment.  This is the case if
+ * the current generation of the document has not yet been processed, if
+ * replicas are to be added or deleted, if a rotation of the credentials is
+ * pending, or if a certificate has been renewed.
+ */
+
+func (r *IBMSecurityVerifyDirectoryReconciler) isWorkPending(
+			h           *RequestHandle,
+			existing    map[string]string,
+			toBeAdded   []string,
+			toBeDeleted []string) (pending bool) {
+
+	progressing := meta.FindStatusCondition(h.directory.Status.Conditions,
+							ibmv1.ConditionProgressing)
+
+	if progressing == nil || progressing.Status != metav1.ConditionFalse ||
+				progressing.ObservedGeneration != h.directory.Generation {
+		return true
+	}
+
+	if len(toBeAdded) > 0 || len(toBeDeleted) > 0 {
+		return true
+	}
+
+	if r.isRotationPending(h) {
+		return true
+	}
+
+	return r.isCertificateRenewalPending(h, existing)
+}
+
+/*****************************************************************************/
+
 /*
  * Analyse the list of existing pods to determine which replicas need to be
  * deleted and which replicas need to be added.
@@ -443,7 +673,36 @@ func (r *IBMSecurityVerifyDirectoryReconciler) createLogParams(
 		params = append(params, extra)
 	}
 
-	return params
+	/*
+	 * Ensure that no sensitive information is written to the log.
+	 */
+
+	return utils.RedactLogParams(params)
+}
+
+/*****************************************************************************/
+
+/*
+ * The following function is used to record an event against the document.
+ * The names of the PVC and pod to which the event relates are included in
+ * the message, and are also added as annotations of the event.
+ */
+
+func (r *IBMSecurityVerifyDirectoryReconciler) recordEvent(
+			h         *RequestHandle,
+			eventType string,
+			reason    string,
+			pvcName   string,
+			podName   string,
+			message   string) {
+
+	annotations := map[string]string{
+		utils.EventPVCAnnotation: pvcName,
+		utils.EventPodAnnotation: podName,
+	}
+
+	r.Recorder.AnnotatedEventf(h.directory, annotations, eventType, reason,
+				"%s (PVC: %s, Pod: %s)", message, pvcName, podName)
 }
 
 /*****************************************************************************/
@@ -455,10 +714,13 @@ func (r *IBMSecurityVerifyDirectoryReconciler) createLogParams(
 func (r *IBMSecurityVerifyDirectoryReconciler) SetupWithManager(
 							mgr ctrl.Manager) error {
 	return ctrl.NewControllerManagedBy(mgr).
-		For(&ibmv1.IBMSecurityVerifyDirectory{}).
-		WithEventFilter(predicate.Or(
+		For(&ibmv1.IBMSecurityVerifyDirectory{}, 
+			builder.WithPredicates(predicate.Or(
 				predicate.GenerationChangedPredicate{}, 
-				predicate.LabelChangedPredicate{})).
+				predicate.LabelChangedPredicate{},
+				predicate.AnnotationChangedPredicate{}))).
+		Owns(&corev1.Secret{}, 
+			builder.WithPredicates(predicate.ResourceVersionChangedPredicate{})).
 		Complete(r)
 }
 
@@ -0,0 +1,212 @@
+/* vi: set ts=4 sw=4 noexpandtab : */
+
+/*
+ * Copyright contributors to the IBM Security Verify Directory Operator project
+ */
+
+package controllers
+
+/*
+ * This file contains the tests for the main processing of the document by
+ * the controller.
+ */
+
+/*****************************************************************************/
+
+import (
+	appsv1  "k8s.io/api/apps/v1"
+	corev1  "k8s.io/api/core/v1"
+	metav1  "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"testing"
+
+	"github.com/ibm-security/verify-directory-operator/utils"
+
+	ibmv1 "github.com/ibm-security/verify-directory-operator/api/v1"
+)
+
+/*****************************************************************************/
+
+/*
+ * Test the detection of a change which is to be processed.  The Progressing
+ * condition is only set when there is a change to be processed, and not for
+ * the periodic health checks.
+ */
+
+func TestIsWorkPending(t *testing.T) {
+	tests := []struct {
+		name        string
+		status      metav1.ConditionStatus
+		generation  int64
+		request     string
+		toBeAdded   []string
+		toBeDeleted []string
+		tls         bool
+		revision    string
+		expected    bool
+	} {
+		{ "not processed",     "",                     1, "",  nil, nil,
+										false, "",         true  },
+		{ "in progress",       metav1.ConditionTrue,   1, "",  nil, nil,
+										false, "",         true  },
+		{ "new generation",    metav1.ConditionFalse,  2, "",  nil, nil,
+										false, "",         true  },
+		{ "no changes",        metav1.ConditionFalse,  1, "",  nil, nil,
+										false, "",         false },
+		{ "replica added",     metav1.ConditionFalse,  1, "",
+							[]string{ "replica-2" }, nil,
+										false, "",         true  },
+		{ "replica deleted",   metav1.ConditionFalse,  1, "",
+							nil, []string{ "replica-2" },
+										false, "",         true  },
+		{ "rotation",          metav1.ConditionFalse,  1, "2", nil, nil,
+										false, "",         true  },
+		{ "certificate",       metav1.ConditionFalse,  1, "",  nil, nil,
+										true,  "current",  false },
+		{ "renewed",           metav1.ConditionFalse,  1, "",  nil, nil,
+										true,  "previous", true  },
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r, h := newRotationTestHandle(t, &corev1.Secret{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      "isvd-credentials",
+					Namespace: "default",
+				},
+				Data: map[string][]byte{
+					utils.AdminPwdKey:              []byte("admin"),
+					utils.ReplicationPwdKey:        []byte("replication"),
+					utils.AppliedAdminPwdKey:       []byte("admin"),
+					utils.AppliedReplicationPwdKey: []byte("replication"),
+				},
+			})
+
+			h.directory.Generation = 1
+			h.directory.Annotations = map[string]string{
+				utils.RotateCredentialsAnnotation: test.request,
+			}
+			h.directory.Status.CredentialRotation.LastRequest = "1"
+
+			if test.request == "" {
+				h.directory.Status.CredentialRotation.LastRequest = ""
+			}
+
+			if test.status != "" {
+				h.directory.Status.Conditions = []metav1.Condition{{
+					Type:               ibmv1.ConditionProgressing,
+					Status:             test.status,
+					ObservedGeneration: test.generation,
+				}}
+			}
+
+			existing := map[string]string{ "replica-1": "isvd-replica-1" }
+
+			if test.tls {
+				setTestCertificates(t, r, h, existing, test.revision)
+			}
+
+			pending := r.isWorkPending(
+						h, existing, test.toBeAdded, test.toBeDeleted)
+
+			if pending != test.expected {
+				t.Errorf("Expected %t, got %t", test.expected, pending)
+			}
+		})
+	}
+}
+
+/*****************************************************************************/
+
+/*
+ * The following function will issue the certificates for the replicas, and
+ * the proxy, of the test document.  The pods and the proxy deployment record
+ * the current revision of the certificates unless a previous revision is
+ * requested.
+ */
+
+func setTestCertificates(
+			t        *testing.T,
+			r        *IBMSecurityVerifyDirectoryReconciler,
+			h        *RequestHandle,
+			existing map[string]string,
+			revision string) {
+
+	h.directory.Spec.TLS.IssuerRef = &ibmv1.IBMSecurityVerifyDirectoryIssuerRef{
+		Name: "isvd-issuer",
+	}
+
+	proxyName := utils.GetProxyDeploymentName(h.directory.Name)
+	names     := []string{ proxyName }
+
+	for _, podName := range existing {
+		names = append(names, podName)
+	}
+
+	annotations := make(map[string]map[string]string)
+
+	for _, name := range names {
+		err := r.Create(h.ctx, &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      utils.GetCertificateName(name),
+				Namespace: h.directory.Namespace,
+			},
+			Data: map[string][]byte{
+				"tls.crt": []byte(name + "-certificate"),
+			},
+		})
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		current, err := r.getCertificateRevision(h, name)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if revision != "current" {
+			current = revision
+		}
+
+		annotations[name] = map[string]string{
+			utils.TLSRevisionAnnotation: current,
+		}
+	}
+
+	for _, podName := range existing {
+		err := r.Create(h.ctx, &corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:        podName,
+				Namespace:   h.directory.Namespace,
+				Annotations: annotations[podName],
+			},
+		})
+
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err := r.Create(h.ctx, &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      proxyName,
+			Namespace: h.directory.Namespace,
+		},
+		Spec: appsv1.DeploymentSpec{
+			Template: corev1.PodTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{
+					Annotations: annotations[proxyName],
+				},
+			},
+		},
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+/*****************************************************************************/
+
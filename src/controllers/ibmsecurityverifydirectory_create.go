@@ -18,16 +18,63 @@ import (
 	corev1  "k8s.io/api/core/v1"
 	batchv1 "k8s.io/api/batch/v1"
 
+	"errors"
 	"fmt"
 	"strconv"
+	"strings"
+	"time"
 
+	"github.com/go-ldap/ldap/v3"
 	"github.com/ibm-security/verify-directory-operator/utils"
 
+	"k8s.io/apimachinery/pkg/types"
+
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
 	ctrl "sigs.k8s.io/controller-runtime"
 )
 
 /*****************************************************************************/
 
+/*
+ * The modes which are used to seed new replicas.
+ */
+
+const SeedModeOffline  = "offline"
+const SeedModeOnline   = "online"
+const SeedModeSnapshot = "snapshot"
+
+/*****************************************************************************/
+
+/*
+ * The script which is used to seed a new replica while the principal 
+ * remains running.  The entries which already exist in the new replica, such
+ * as the suffix entries, are ignored.
+ */
+
+const onlineSeedScript = `echo "${LDAP_SUFFIXES}" | while read -r suffix ; do
+    [ -z "${suffix}" ] && continue
+
+    idsldapsearch -h "${SOURCE_HOST}" -p "${LDAP_PORT}" \
+        -D "${LDAP_ADMIN_DN}" -w "${LDAP_ADMIN_PWD}" \
+        -b "${suffix}" -s sub -L "(objectclass=*)" > /tmp/seed.ldif || exit 1
+
+    idsldapadd -h "${LDAP_HOST}" -p "${LDAP_PORT}" \
+        -D "${LDAP_ADMIN_DN}" -w "${LDAP_ADMIN_PWD}" -k -c -f /tmp/seed.ldif
+
+    rc=$?
+
+    if [ ${rc} -ne 0 -a ${rc} -ne 68 ] ; then
+        echo "Failed to seed ${suffix}: ${rc}" | tee /dev/termination-log
+        exit ${rc}
+    fi
+done
+`
+
+/*****************************************************************************/
+
 /*
  * Create the required replicas for this deployment.
  */
@@ -79,51 +126,707 @@ func (r *IBMSecurityVerifyDirectoryReconciler) createReplicas(
 		 * the principal now.
 		 */
 
-		var pod string
+		var pod string
+
+		/*
+		 * Initialize the principal from a backup, if requested.
+		 */
+
+		var source *RestoreSource
+
+		source, err = r.getRestoreSource(h)
+
+		if err != nil {
+			return nil, err
+		}
+
+		err = r.restoreReplica(h, principal, source, false)
+
+		if err != nil {
+			return nil, err
+		}
+
+		r.setReplicaPhase(h, []string{principal}, ReplicaPhaseStarting)
+
+		pod, err = r.deployReplica(h, principal)
+
+		if err != nil {
+			return nil, err
+		}
+
+		err = r.createClusterService(h, pod, principal)
+
+		if err != nil {
+			return nil, err
+		}
+
+		err = r.waitForPod(h, pod)
+
+		if err != nil {
+			return nil, err
+		}
+
+		r.recordEvent(h, corev1.EventTypeNormal, "PrincipalCreated",
+					principal, pod, "The principal replica has been created.")
+
+		err = r.restoreReplica(h, principal, source, true)
+
+		if err != nil {
+			return nil, err
+		}
+
+		err = r.setRestoreStatus(h, principal, source)
+
+		if err != nil {
+			return nil, err
+		}
+
+		/*
+		 * Load the initial data into the principal, if required.
+		 */
+
+		err = r.importInitialData(h, principal)
+
+		if err != nil {
+			return nil, err
+		}
+
+		existing[principal] = pod
+
+		/*
+		 * If there are no additional replicas to be added we can simply
+		 * return now.
+		 */
+
+		if len(toBeAdded) == 0 {
+			return existing, err
+		}
+	}
+
+	/*
+	 * Add the new replicas.  If we fail to add the new replicas we roll back
+	 * the changes so that the deployment is returned to its previous 
+	 * topology.
+	 */
+
+	original := make(map[string]string)
+
+	for pvcName, podName := range existing {
+		original[pvcName] = podName
+	}
+
+	started := time.Now()
+
+	existing, err = r.addReplicas(h, principal, existing, toBeAdded)
+
+	replicaAddDuration.WithLabelValues(
+			metricsLabelValues(h, metricsResult(err))...).Observe(
+					time.Since(started).Seconds())
+
+	if err != nil {
+		rollbackErr := r.rollbackReplicas(h, principal, original, toBeAdded)
+
+		if rollbackErr != nil {
+			err = errors.New(fmt.Sprintf("%s  %s",
+							err.Error(), rollbackErr.Error()))
+		}
+
+		return nil, err
+	}
+
+	return existing, nil
+}
+
+/*****************************************************************************/
+
+/*
+ * The following function is used to add the new replicas to a deployment
+ * which already contains a running principal.
+ */
+
+func (r *IBMSecurityVerifyDirectoryReconciler) addReplicas(
+			h          *RequestHandle,
+			principal  string,
+			existing   map[string]string,
+			toBeAdded  []string) (map[string]string, error) {
+
+	var err error = nil
+
+	r.Log.V(1).Info("Entering a function", 
+				r.createLogParams(h, "Function", "addReplicas")...)
+
+	/*
+	 * Work out the mode which is to be used to seed the new replicas.
+	 */
+
+	mode := r.getSeedMode(h, existing)
+
+	/*
+	 * Iterate over each PVC which is to be added, creating the replication
+	 * agreement with the principal.  In the online mode the principal
+	 * remains running, and so the agreement is suspended until the new
+	 * replica has been seeded.  The changes which are made to the principal
+	 * in the meantime are queued, and are replicated once the agreement is
+	 * resumed.
+	 */
+
+	for _, pvcName := range toBeAdded {
+		err = r.createReplicationAgreement(
+					h, principal, principal, pvcName)
+
+		if err == nil && mode == SeedModeOnline {
+			err = r.holdReplicationAgreement(h, principal, pvcName, true)
+		}
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	r.Log.Info("Seeding the new replicas",
+			r.createLogParams(h, "Principal", principal, "Mode", mode)...)
+
+	if mode != SeedModeOnline {
+		r.setReplicaPhase(h, toBeAdded, ReplicaPhaseSeeding)
+	}
+
+	switch mode {
+		case SeedModeOffline:
+			err = r.seedReplicasOffline(h, principal, toBeAdded)
+		case SeedModeSnapshot:
+			err = r.seedReplicasFromSnapshot(h, principal, toBeAdded)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	/*
+	 * Now that the PVCs have been seeded with initial data we can now
+	 * create and start each of the new replicas.  In the online mode the 
+	 * PVCs are seeded once the new replicas have been started.
+	 */
+
+	replicaPods := make(map[string]string)
+
+	r.setReplicaPhase(h, toBeAdded, ReplicaPhaseStarting)
+
+	for _, pvcName := range toBeAdded {
+		var podName string
+
+		podName, err = r.deployReplica(h, pvcName)
+
+		if err != nil {
+			return nil, err
+		}
+
+		replicaPods[pvcName] = podName
+		existing[pvcName]    = podName
+	}
+
+	for pvcName, podName := range replicaPods {
+		err = r.waitForPod(h, podName)
+
+		if err != nil {
+			r.recordEvent(h, corev1.EventTypeWarning, "ReplicaStartFailed",
+					pvcName, podName, "The replica failed to start.")
+
+			return nil, err
+		}
+
+		r.recordEvent(h, corev1.EventTypeNormal, "ReplicaStarted",
+					pvcName, podName, "The replica has been started.")
+	}
+
+	/*
+	 * In the online mode the new replicas are seeded, from the running
+	 * principal, once they have been started.  The agreement with the
+	 * principal is then resumed.
+	 */
+
+	if mode == SeedModeOnline {
+		r.setReplicaPhase(h, toBeAdded, ReplicaPhaseSeeding)
+
+		for _, pvcName := range toBeAdded {
+			err = r.seedReplicaOnline(h, principal, pvcName)
+
+			if err == nil {
+				err = r.holdReplicationAgreement(h, principal, pvcName, false)
+			}
+
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	/*
+	 * The pods have each been started and so we now want to create the
+	 * replication agreements between each new pod and all existing pods.
+	 */
+
+	for _, pvcName := range toBeAdded {
+		err = r.createReplicationAgreements(h, principal, pvcName, existing)
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	/*
+	 * Now we can create the cluster service for each of the new replicas.
+	 */
+
+	for pvcName, podName:= range replicaPods {
+		err = r.createClusterService(h, podName, pvcName)
+
+		if err != nil {
+			return  nil, err
+		}
+	}
+
+	/*
+	 * Start the principal, if it was stopped.
+	 */
+
+	if mode != SeedModeOffline {
+		return existing, nil
+	}
+
+	principalPod, err := r.deployReplica(h, principal)
+
+	if err != nil {
+		return nil, err
+	}
+
+	err = r.createClusterService(h, principalPod, principal)
+
+	if err != nil {
+		return  nil, err
+	}
+
+	err = r.waitForPod(h, principalPod)
+
+	if err != nil {
+		r.recordEvent(h, corev1.EventTypeWarning, "ReplicaStartFailed",
+					principal, principalPod, "The principal failed to start.")
+
+		return nil, err
+	}
+
+	r.recordEvent(h, corev1.EventTypeNormal, "ReplicaStarted",
+				principal, principalPod, "The principal has been restarted.")
+
+	return existing, nil
+}
+
+/*****************************************************************************/
+
+/*
+ * The following function is used to suspend, or resume, the replication
+ * from a supplier to a consumer.  The replication is suspended by placing
+ * each of the agreements of the supplier for the consumer on hold.
+ */
+
+func (r *IBMSecurityVerifyDirectoryReconciler) holdReplicationAgreement(
+			h           *RequestHandle,
+			supplierPvc string,
+			consumerPvc string,
+			hold        bool) (err error) {
+
+	r.Log.Info("Setting the hold on the replication agreement",
+			r.createLogParams(h, "source", supplierPvc,
+					"destination", consumerPvc, "Hold", hold)...)
+
+	l, err := r.bindAdmin(h, supplierPvc)
+
+	if err != nil {
+		return
+	}
+
+	defer l.Close()
+
+	dns, err := r.findReplicationAgreements(h, l, consumerPvc)
+
+	if err != nil {
+		return
+	}
+
+	if len(dns) == 0 {
+		err = errors.New(fmt.Sprintf("No replication agreement for the " +
+				"replica, %s, was found on the replica, %s.",
+				consumerPvc, supplierPvc))
+
+		return
+	}
+
+	/*
+	 * Update each of the agreements for the consumer.
+	 */
+
+	value := "FALSE"
+
+	if hold {
+		value = "TRUE"
+	}
+
+	for _, dn := range dns {
+		modifyRequest := ldap.NewModifyRequest(dn, nil)
+
+		modifyRequest.Replace("ibm-replicationOnHold", []string{ value })
+
+		err = l.Modify(modifyRequest)
+
+		if err != nil {
+			return
+		}
+	}
+
+	return
+}
+
+/*****************************************************************************/
+
+/*
+ * The following function is used to connect to a replica, and bind to the
+ * replica using the admin credentials from the server configuration.
+ */
+
+func (r *IBMSecurityVerifyDirectoryReconciler) bindAdmin(
+			h       *RequestHandle,
+			pvcName string) (l *ldap.Conn, err error) {
+
+	rctx := r.getResolveContext(h)
+
+	adminDn, err := utils.ResolveNamedEntry(
+						"general.admin.dn", h.config.adminDn, rctx)
+
+	if err != nil {
+		return
+	}
+
+	adminPwd, err := utils.ResolveNamedEntry(
+						"general.admin.pwd", h.config.adminPwd, rctx)
+
+	if err != nil {
+		return
+	}
+
+	l, err = r.dialReplica(h, pvcName)
+
+	if err != nil {
+		return
+	}
+
+	err = l.Bind(fmt.Sprintf("%v", adminDn), fmt.Sprintf("%v", adminPwd))
+
+	if err != nil {
+		l.Close()
+
+		l = nil
+	}
+
+	return
+}
+
+/*****************************************************************************/
+
+/*
+ * The following function will return the DNs of the replication agreements,
+ * from the bound replica, for the specified consumer.
+ */
+
+func (r *IBMSecurityVerifyDirectoryReconciler) findReplicationAgreements(
+			h           *RequestHandle,
+			l           *ldap.Conn,
+			consumerPvc string) (dns []string, err error) {
+
+	consumerPod := r.getReplicaPodName(h.directory, consumerPvc)
+
+	for _, suffix := range h.config.suffixes {
+		searchRequest := ldap.NewSearchRequest(
+			suffix,
+			ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 0, 0, false,
+			fmt.Sprintf("(&(objectclass=ibm-replicationAgreement)" +
+					"(ibm-replicaConsumerId=%s))", ldap.EscapeFilter(consumerPod)),
+			[]string{ "1.1" },
+			nil,
+		)
+
+		var sr *ldap.SearchResult
+
+		sr, err = l.Search(searchRequest)
+
+		if ldap.IsErrorWithCode(err, ldap.LDAPResultNoSuchObject) {
+			err = nil
+
+			continue
+		}
+
+		if err != nil {
+			return
+		}
+
+		for _, entry := range sr.Entries {
+			dns = append(dns, entry.DN)
+		}
+	}
+
+	return
+}
+
+/*****************************************************************************/
+
+/*
+ * The following function is used to check that a supplier no longer holds
+ * any replication agreements for a consumer.
+ */
+
+func (r *IBMSecurityVerifyDirectoryReconciler) checkAgreementRemoved(
+			h           *RequestHandle,
+			supplierPvc string,
+			consumerPvc string) (err error) {
+
+	l, err := r.bindAdmin(h, supplierPvc)
+
+	if err != nil {
+		return
+	}
+
+	defer l.Close()
+
+	dns, err := r.findReplicationAgreements(h, l, consumerPvc)
+
+	if err == nil && len(dns) != 0 {
+		err = errors.New(fmt.Sprintf("The replication agreement for the " +
+				"replica, %s, still exists on the replica, %s.",
+				consumerPvc, supplierPvc))
+	}
+
+	return
+}
+
+/*****************************************************************************/
+
+/*
+ * The following function is used to roll back the addition of new replicas.
+ * The pods, services and jobs which were created for the new replicas are
+ * deleted, the principal is restarted if it had been stopped, and the 
+ * replication agreements for the new replicas are removed from the existing
+ * replicas.
+ */
+
+func (r *IBMSecurityVerifyDirectoryReconciler) rollbackReplicas(
+			h          *RequestHandle,
+			principal  string,
+			original   map[string]string,
+			toBeAdded  []string) (err error) {
+
+	r.Log.Info("Rolling back the addition of the new replicas", 
+			r.createLogParams(h, "Principal", principal, 
+						"Replicas", toBeAdded)...)
+
+	/*
+	 * Each step of the roll back is attempted, even if an earlier step
+	 * fails, and the failures are collected so that they can be reported.
+	 */
+
+	var failures []string
+
+	addFailure := func(pvcName string, stepErr error) {
+		failures = append(failures,
+					fmt.Sprintf("%s: %s", pvcName, stepErr.Error()))
+	}
+
+	/*
+	 * Delete the pods, services, jobs and certificates which were created 
+	 * for the new replicas.
+	 */
+
+	for _, pvcName := range toBeAdded {
+		stepErr := r.deleteReplica(h, pvcName)
+
+		if stepErr != nil {
+			addFailure(pvcName, stepErr)
+
+			continue
+		}
+
+		r.deleteJob(h, r.getSeedJobName(h.directory, pvcName))
+
+		stepErr = r.deleteCertificate(h,
+						r.getReplicaPodName(h.directory, pvcName))
+
+		if stepErr != nil {
+			addFailure(pvcName, stepErr)
+		}
+
+		/*
+		 * The PVCs which were provisioned from a snapshot are also deleted
+		 * so that they can be provisioned again.
+		 */
+
+		if r.getSeedMode(h, original) == SeedModeSnapshot {
+			r.deleteProvisionedPVC(h, pvcName)
+		}
+	}
+
+	/*
+	 * Restart the principal if it had been stopped.  This is always
+	 * attempted, regardless of whether the new replicas were removed.
+	 */
+
+	podName := r.getReplicaPodName(h.directory, principal)
+
+	pod     := &corev1.Pod{}
+	stepErr := r.Get(h.ctx, types.NamespacedName{
+						Namespace: h.directory.Namespace,
+						Name:      podName,
+					}, pod)
+
+	if k8serrors.IsNotFound(stepErr) {
+		podName, stepErr = r.deployReplica(h, principal)
+
+		if stepErr == nil {
+			stepErr = r.createClusterService(h, podName, principal)
+		}
+
+		if stepErr == nil {
+			stepErr = r.waitForPod(h, podName)
+		}
+	}
+
+	if stepErr != nil {
+		r.Log.Error(stepErr, "Failed to restart the principal",
+						r.createLogParams(h, "PVC.Name", principal)...)
+
+		addFailure(principal, stepErr)
+	}
+
+	/*
+	 * Remove the replication agreements for the new replicas.  The removal
+	 * of an agreement is checked against the supplier, as the agreement
+	 * might never have been created.
+	 */
+
+	for supplierPvc, supplierPod := range original {
+		for _, pvcName := range toBeAdded {
+			stepErr = r.deleteReplicationAgreement(h, supplierPod, pvcName)
+
+			if stepErr != nil {
+				stepErr = r.checkAgreementRemoved(h, supplierPvc, pvcName)
+			}
+
+			if stepErr != nil {
+				addFailure(supplierPvc, stepErr)
+			}
+		}
+	}
+
+	/*
+	 * The roll back is only complete if each of the steps succeeded.
+	 */
+
+	if len(failures) != 0 {
+		err = errors.New(fmt.Sprintf("Failed to roll back the addition of " +
+				"the new replicas: %s", strings.Join(failures, "; ")))
+
+		r.Log.Error(err, "Failed to roll back the addition of the new replicas",
+				r.createLogParams(h, "Replicas", toBeAdded)...)
+
+		return
+	}
+
+	r.Log.Info("Rolled back the addition of the new replicas", 
+			r.createLogParams(h, "Replicas", toBeAdded)...)
+
+	for _, pvcName := range toBeAdded {
+		r.recordEvent(h, corev1.EventTypeWarning, "ReplicaRolledBack",
+				pvcName, r.getReplicaPodName(h.directory, pvcName),
+				"The addition of the replica has been rolled back.")
+	}
+
+	h.rolledBack = true
+
+	return
+}
+
+/*****************************************************************************/
+
+/*
+ * The following function is used to delete a job, along with its pods.
+ */
+
+func (r *IBMSecurityVerifyDirectoryReconciler) deleteJob(
+			h    *RequestHandle,
+			name string) {
+
+	job := &batchv1.Job{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: h.directory.Namespace,
+		},
+	}
+
+	err := r.Delete(h.ctx, job, 
+				client.PropagationPolicy(metav1.DeletePropagationBackground))
 
-		pod, err = r.deployReplica(h, principal)
+	if err != nil && ! k8serrors.IsNotFound(err) {
+ 		r.Log.Error(err, "Failed to delete the job",
+						r.createLogParams(h, "Job.Name", name)...)
+	}
+}
 
-		if err != nil {
-			return nil, err
-		}
+/*****************************************************************************/
 
-		err = r.createClusterService(h, pod, h.config.port, principal)
+/*
+ * The following function will determine the mode which is used to seed the
+ * new replicas.  Unless a mode has been specified the new replicas are
+ * seeded while the principal remains running if more than one replica
+ * currently exists.  The online mode uses the LDAP port of the replicas,
+ * and so the offline mode is used if the LDAP port has not been enabled.
+ */
 
-		if err != nil {
-			return nil, err
-		}
+func (r *IBMSecurityVerifyDirectoryReconciler) getSeedMode(
+			h        *RequestHandle,
+			existing map[string]string) (mode string) {
 
-		err = r.waitForPod(h, pod)
+	mode = h.directory.Spec.Replicas.SeedMode
 
-		if err != nil {
-			return nil, err
-		}
+	if mode == "" {
+		mode = SeedModeOffline
 
-		existing[principal] = pod
+		if len(existing) > 1 {
+			mode = SeedModeOnline
+		}
+	}
 
-		/*
-		 * If there are no additional replicas to be added we can simply
-		 * return now.
-		 */
+	if mode == SeedModeOnline && h.config.ldapPort == 0 {
+		r.Log.Info("The LDAP port has not been enabled and so the new " +
+				"replicas will be seeded in the offline mode",
+				r.createLogParams(h)...)
 
-		if len(toBeAdded) == 0 {
-			return existing, err
-		}
+		mode = SeedModeOffline
 	}
 
-	/*
-	 * Iterate over each PVC which is to be added, creating the replication
-	 * agreement with the principal.
-	 */
+	return
+}
 
-	for _, pvcName := range toBeAdded {
-		err = r.createReplicationAgreement(
-					h, principal, principal, pvcName)
+/*****************************************************************************/
 
-		if err != nil {
-			return nil, err
-		}
-	}
+/*
+ * The following function is used to seed the new replicas while the
+ * principal has been stopped.  The data volume of the principal is copied
+ * to each of the new replicas by the seed job.
+ */
+
+func (r *IBMSecurityVerifyDirectoryReconciler) seedReplicasOffline(
+			h          *RequestHandle,
+			principal  string,
+			toBeAdded  []string) (err error) {
+
+	r.Log.V(1).Info("Entering a function", 
+				r.createLogParams(h, "Function", "seedReplicasOffline")...)
 
 	/*
 	 * Stop the principal.
@@ -132,9 +835,14 @@ func (r *IBMSecurityVerifyDirectoryReconciler) createReplicas(
 	err = r.deleteReplica(h, principal)
 
 	if err != nil {
-		return nil, err
+		return
 	}
 
+	r.recordEvent(h, corev1.EventTypeNormal, "PrincipalStopped",
+			principal, r.getReplicaPodName(h.directory, principal),
+			"The principal has been stopped so that the new replicas can " +
+			"be seeded.")
+
 	/*
 	 * We should be able to completely specify the seed container configuration
 	 * via environment variables, but a bug in the 10.0.0.0 release means
@@ -149,7 +857,7 @@ func (r *IBMSecurityVerifyDirectoryReconciler) createReplicas(
 			ConfigMapKey, "seed: \n  replica: \n    clean: true\n")
 
 	if err != nil {
-		return nil, err
+		return
 	}
 
 	/*
@@ -163,7 +871,7 @@ func (r *IBMSecurityVerifyDirectoryReconciler) createReplicas(
 		if err != nil {
 			r.deleteConfigMap(h, seedConfigMapName)
 
-			return nil, err
+			return
 		}
 	}
 
@@ -171,94 +879,26 @@ func (r *IBMSecurityVerifyDirectoryReconciler) createReplicas(
 		err = r.waitForJob(h, r.getSeedJobName(h.directory, pvcName))
 
 		if err != nil {
-			r.deleteConfigMap(h, seedConfigMapName)
-
-			return nil, err
-		}
-	}
-
-	/*
-	 * Delete the temporary ConfigMap which was created.
-	 */
-
-	r.deleteConfigMap(h, seedConfigMapName)
-
-	/*
-	 * Now that the PVCs have been seeded with initial data we can now
-	 * create and start each of the new replicas.  
-	 */
-
-	replicaPods := make(map[string]string)
-
-	for _, pvcName := range toBeAdded {
-		var podName string
-
-		podName, err = r.deployReplica(h, pvcName)
-
-		if err != nil {
-			return nil, err
-		}
-
-		replicaPods[pvcName] = podName
-		existing[pvcName]    = podName
-	}
-
-	for _, podName := range replicaPods {
-		err = r.waitForPod(h, podName)
-
-		if err != nil {
-			return nil, err
-		}
-	}
+			err = r.getSeedJobError(h, pvcName, err)
 
-	/*
-	 * The pods have each been started and so we now want to create the
-	 * replication agreements between each new pod and all existing pods.
-	 */
-
-	for _, pvcName := range toBeAdded {
-		err = r.createReplicationAgreements(h, principal, pvcName, existing)
+			r.deleteConfigMap(h, seedConfigMapName)
 
-		if err != nil {
-			return nil, err
+			return
 		}
-	}
-
-	/*
-	 * Now we can create the cluster service for each of the new replicas.
-	 */
 
-	for pvcName, podName:= range replicaPods {
-		err = r.createClusterService(h, podName, h.config.port, pvcName)
+		r.seedJobFinished(h, pvcName, nil)
 
-		if err != nil {
-			return  nil, err
-		}
+		r.recordSeedJobEvent(h, pvcName, "SeedJobCompleted", 
+					"The seed job has completed.")
 	}
 
 	/*
-	 * Start the principal.
+	 * Delete the temporary ConfigMap which was created.
 	 */
 
-	principalPod, err := r.deployReplica(h, principal)
-
-	if err != nil {
-		return nil, err
-	}
-
-	err = r.createClusterService(h, principalPod, h.config.port, principal)
-
-	if err != nil {
-		return  nil, err
-	}
-
-	err = r.waitForPod(h, principalPod)
-
-	if err != nil {
-		return nil, err
-	}
+	r.deleteConfigMap(h, seedConfigMapName)
 
-	return existing, nil
+	return
 }
 
 /*****************************************************************************/
@@ -316,15 +956,6 @@ func (r *IBMSecurityVerifyDirectoryReconciler) seedReplica(
 				},
 			},
 		},
-		{
-			Name: "isvd-principal",
-			VolumeSource: corev1.VolumeSource{
-				PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{
-					ClaimName: principalPvc,
-					ReadOnly:  true,
-				},
-			},
-		},
 	}
 
 	volumeMounts := []corev1.VolumeMount {
@@ -336,10 +967,29 @@ func (r *IBMSecurityVerifyDirectoryReconciler) seedReplica(
 			Name:      "isvd-data",
 			MountPath: "/var/isvd/data",
 		},
-		{
+	}
+
+	/*
+	 * The principal volume is not required if the data volume of the 
+	 * replica has already been provisioned from a snapshot of the principal,
+	 * in which case the seed job will only clean the replica data.
+	 */
+
+	if principalPvc != "" {
+		volumes = append(volumes, corev1.Volume {
+			Name: "isvd-principal",
+			VolumeSource: corev1.VolumeSource{
+				PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{
+					ClaimName: principalPvc,
+					ReadOnly:  true,
+				},
+			},
+		})
+
+		volumeMounts = append(volumeMounts, corev1.VolumeMount {
 			Name:      "isvd-principal",
 			MountPath: "/var/isvd/source",
-		},
+		})
 	}
 
 	/*
@@ -366,8 +1016,6 @@ func (r *IBMSecurityVerifyDirectoryReconciler) seedReplica(
 	 */
 
 	var completions  int32 = 1
-	var backOffLimit int32 = 1
-	var ttl          int32 = 60
 
 	job := &batchv1.Job{
 		ObjectMeta: metav1.ObjectMeta{
@@ -377,8 +1025,6 @@ func (r *IBMSecurityVerifyDirectoryReconciler) seedReplica(
 		},
 		Spec: batchv1.JobSpec{
 			Completions:             &completions,
-			TTLSecondsAfterFinished: &ttl,
-			BackoffLimit:            &backOffLimit,
 			Template:                corev1.PodTemplateSpec {
 				Spec: corev1.PodSpec {
 					Volumes:            volumes,
@@ -397,6 +1043,8 @@ func (r *IBMSecurityVerifyDirectoryReconciler) seedReplica(
 		},
 	}
 
+	r.applyJobSettings(&job.Spec, h.directory.Spec.Replicas.SeedJob)
+
 	ctrl.SetControllerReference(h.directory, job, r.Scheme)
 
 	r.Log.Info("Creating a new seed job", 
@@ -414,11 +1062,151 @@ func (r *IBMSecurityVerifyDirectoryReconciler) seedReplica(
 		return 
 	}
 
+	r.seedJobStarted(h, replicaPvc)
+
+	r.recordSeedJobEvent(h, replicaPvc, "SeedJobStarted", 
+				"The seed job has been started.")
+
 	return 
 }
 
 /*****************************************************************************/
 
+/*
+ * The following function is used to seed a new replica, which has already
+ * been started, while the principal remains running.  The data from each of
+ * the suffixes is exported from the principal and imported into the new
+ * replica using LDAP.
+ */
+
+func (r *IBMSecurityVerifyDirectoryReconciler) seedReplicaOnline(
+			h            *RequestHandle,
+			principalPvc string,
+			replicaPvc   string) (err error) {
+
+	r.Log.V(1).Info("Entering a function", 
+			r.createLogParams(h, "Function", "seedReplicaOnline",
+				"Principal.PVC", principalPvc, "Replica.PVC", replicaPvc)...)
+
+	/*
+	 * Set up the environment variables.
+	 */
+
+	ldapEnv, err := r.getLdapClientEnv(h, replicaPvc)
+
+	if err != nil {
+		return
+	}
+
+	env := append([]corev1.EnvVar{}, h.directory.Spec.Pods.Env...)
+	env  = append(env, ldapEnv...)
+	env  = append(env, 
+		corev1.EnvVar {
+			Name:  "SOURCE_HOST",
+			Value: fmt.Sprintf("%s.%s.svc", 
+						r.getReplicaPodName(h.directory, principalPvc),
+						h.directory.Namespace),
+		},
+		corev1.EnvVar {
+			Name:  "LDAP_SUFFIXES",
+			Value: strings.Join(h.config.suffixes, "\n"),
+		},
+	)
+
+	/*
+	 * Run the seed job.
+	 */
+
+	r.seedJobStarted(h, replicaPvc)
+
+	r.recordSeedJobEvent(h, replicaPvc, "SeedJobStarted", 
+				"The online seed job is being started.")
+
+	err = r.runServerJob(h, replicaPvc, 
+					r.getSeedJobName(h.directory, replicaPvc),
+					onlineSeedScript, env, nil, nil, 
+					h.directory.Spec.Replicas.SeedJob)
+
+	if err != nil {
+		err = r.getSeedJobError(h, replicaPvc, err)
+
+		return
+	}
+
+	r.seedJobFinished(h, replicaPvc, nil)
+
+	r.recordSeedJobEvent(h, replicaPvc, "SeedJobCompleted", 
+				"The online seed job has completed.")
+
+	return
+}
+
+/*****************************************************************************/
+
+/*
+ * The following function is used to record an event for the seed job of a
+ * replica.  The event includes the name of the seed job.
+ */
+
+func (r *IBMSecurityVerifyDirectoryReconciler) recordSeedJobEvent(
+			h          *RequestHandle,
+			replicaPvc string,
+			reason     string,
+			message    string) {
+
+	eventType := corev1.EventTypeNormal
+
+	if reason == "SeedJobFailed" {
+		eventType = corev1.EventTypeWarning
+	}
+
+	r.recordEvent(h, eventType, reason, replicaPvc, 
+			r.getReplicaPodName(h.directory, replicaPvc),
+			fmt.Sprintf("%s  Job: %s.", message, 
+					r.getSeedJobName(h.directory, replicaPvc)))
+}
+
+/*****************************************************************************/
+
+/*
+ * The following function is called when a seed job has failed.  The 
+ * diagnostics of the failed job are collected, as the job and its pods will
+ * soon be deleted, and are recorded in an event against the document.  The
+ * returned error includes the diagnostics so that they are also available
+ * in the condition of the document.
+ */
+
+func (r *IBMSecurityVerifyDirectoryReconciler) getSeedJobError(
+			h          *RequestHandle,
+			replicaPvc string,
+			jobErr     error) (err error) {
+
+	r.seedJobFinished(h, replicaPvc, jobErr)
+
+	jobName := r.getSeedJobName(h.directory, replicaPvc)
+
+	reason, logs := r.getJobDiagnostics(h, jobName)
+
+	msg := fmt.Sprintf("The seed job, %s, for the replica, %s, failed: %s",
+					jobName, replicaPvc, jobErr.Error())
+
+	if reason != "" {
+		msg = fmt.Sprintf("%s; termination reason: %s", msg, reason)
+	}
+
+	if logs != "" {
+		msg = fmt.Sprintf("%s; log tail: %s", msg, logs)
+	}
+
+	r.recordSeedJobEvent(h, replicaPvc, "SeedJobFailed", msg)
+
+	err = errors.New(msg)
+
+	return
+}
+
+/*****************************************************************************/
+
 /*
  * The following function is used to set up new replication agreements for 
  * the new replica.
@@ -472,7 +1260,7 @@ func (r *IBMSecurityVerifyDirectoryReconciler) createReplicationAgreement(
 	srcPod        := r.getReplicaPodName(h.directory, sourcePvc)
 	dstPod        := r.getReplicaPodName(h.directory, destPvc)
 	command       := []string{"isvd_manage_replica"}
-	portStr       := strconv.Itoa(int(h.config.port))
+	portStr       := strconv.Itoa(int(h.config.replicationPort))
 
 	/*
 	 * Let's play it safe and delete any pre-existing replication agreements
@@ -501,11 +1289,27 @@ func (r *IBMSecurityVerifyDirectoryReconciler) createReplicationAgreement(
 			"-s", principalPod)
 	}
 
-	if h.config.secure {
+	if h.config.replicationSecure {
 		command = append(command, "-z")
 	}
 
-	return r.executeCommand(h, srcPod, command)
+	err := r.executeCommand(h, srcPod, command)
+
+	if err != nil {
+		r.recordEvent(h, corev1.EventTypeWarning, 
+			"ReplicationAgreementFailed", destPvc, dstPod,
+			fmt.Sprintf("Failed to create the replication agreement on %s.",
+				srcPod))
+
+		return err
+	}
+
+	r.recordEvent(h, corev1.EventTypeNormal, "ReplicationAgreementCreated",
+			destPvc, dstPod, 
+			fmt.Sprintf("The replication agreement has been created on %s.",
+				srcPod))
+
+	return nil
 }
 
 /*****************************************************************************/
@@ -528,14 +1332,10 @@ func (r *IBMSecurityVerifyDirectoryReconciler) deployReplica(
 					h.directory.Spec.Pods.Image.Label)
 
 	/*
-	 * The port which is exported by the deployment.
+	 * The ports which are exported by the deployment.
 	 */
 
-	ports := []corev1.ContainerPort {{
-		Name:          "ldap",
-		ContainerPort: h.config.port,
-		Protocol:      corev1.ProtocolTCP,
-	}}
+	ports := r.getContainerPorts(h.config.ldapPort, h.config.ldapsPort)
 
 	/*
 	 * The volume configuration.
@@ -578,6 +1378,11 @@ func (r *IBMSecurityVerifyDirectoryReconciler) deployReplica(
 		},
 	}
 
+	tlsVolumes, tlsMounts := r.getTLSVolumes(h, podName)
+
+	volumes      = append(volumes, tlsVolumes...)
+	volumeMounts = append(volumeMounts, tlsMounts...)
+
 	/*
 	 * Set up the environment variables.
 	 */
@@ -594,6 +1399,8 @@ func (r *IBMSecurityVerifyDirectoryReconciler) deployReplica(
 		},
 	)
 
+	env = append(env, r.getCredentialsEnv(h, true)...)
+
 	/*
 	 * The liveness, and readiness probe definitions.
 	 */
@@ -651,6 +1458,33 @@ func (r *IBMSecurityVerifyDirectoryReconciler) deployReplica(
 
 	ctrl.SetControllerReference(h.directory, pod, r.Scheme)
 
+	/*
+	 * Request the certificate for the replica service.
+	 */
+
+	err := r.ensureCertificate(h, podName, pvcName)
+
+	if err != nil {
+		return "", err
+	}
+
+	/*
+	 * Record the revision of the certificate which is used by the pod so
+	 * that we can restart the pod when the certificate is renewed.
+	 */
+
+	revision, err := r.getCertificateRevision(h, podName)
+
+	if err != nil {
+		return "", err
+	}
+
+	if revision != "" {
+		pod.Annotations = map[string]string {
+			utils.TLSRevisionAnnotation: revision,
+		}
+	}
+
 	/*
 	 * Create the pod.
 	 */
@@ -661,7 +1495,7 @@ func (r *IBMSecurityVerifyDirectoryReconciler) deployReplica(
 	r.Log.V(1).Info("Pod details", 
 				r.createLogParams(h, "Details", pod)...)
 
-	err := r.Create(h.ctx, pod)
+	err = r.Create(h.ctx, pod)
 
 	if err != nil {
  		r.Log.Error(err, "Failed to create the new pod",
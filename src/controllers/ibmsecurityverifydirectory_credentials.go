@@ -0,0 +1,276 @@
+/* vi: set ts=4 sw=4 noexpandtab : */
+
+/*
+ * Copyright contributors to the IBM Security Verify Directory Operator project
+ */
+
+package controllers
+
+/*
+ * This file contains the functions which are used by the controller to manage
+ * the admin and replication credentials which are generated by the operator.
+ */
+
+/*****************************************************************************/
+
+import (
+	corev1  "k8s.io/api/core/v1"
+	metav1  "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"math/big"
+
+	"github.com/ibm-security/verify-directory-operator/utils"
+
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+
+	"k8s.io/apimachinery/pkg/types"
+
+	ctrl "sigs.k8s.io/controller-runtime"
+)
+
+/*****************************************************************************/
+
+/*
+ * Some constants...
+ */
+
+const generatedPwdLength = 32
+const generatedPwdChars  =
+		"ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789"
+
+/*****************************************************************************/
+
+/*
+ * The following function is used to ensure that the generated credentials
+ * exist, if the operator has been asked to generate the credentials.  The
+ * admin password which is used by the proxy to access the replicas will
+ * be updated to reference the generated credentials.
+ */
+
+func (r *IBMSecurityVerifyDirectoryReconciler) ensureCredentials(
+			h *RequestHandle) (err error) {
+
+	r.Log.V(1).Info("Entering a function",
+				r.createLogParams(h, "Function", "ensureCredentials")...)
+
+	if ! h.directory.Spec.Credentials.Generate {
+		return
+	}
+
+	name := r.getCredentialsSecretName(h)
+
+	/*
+	 * Check to see if the secret already exists.
+	 */
+
+	secret := &corev1.Secret{}
+	err     = r.Get(h.ctx,
+					types.NamespacedName{
+						Name:	   name,
+						Namespace: h.directory.Namespace }, secret)
+
+	if err != nil && ! k8serrors.IsNotFound(err) {
+ 		r.Log.Error(err, "Failed to retrieve the credentials secret",
+			r.createLogParams(h, "Secret.Name", name)...)
+
+		return
+	}
+
+	exists := (err == nil)
+
+	/*
+	 * We don't take over a secret which we don't own, as the generated 
+	 * keys would be added to the secret and any subsequent change to the
+	 * secret would not be seen by the operator.
+	 */
+
+	if exists && ! metav1.IsControlledBy(secret, h.directory) {
+		err = errors.New(fmt.Sprintf("The credentials secret, %s, already " +
+				"exists and is not owned by this document.  The secret must " +
+				"be created by the operator.", name))
+
+ 		r.Log.Error(err, "Failed to validate the credentials secret",
+			r.createLogParams(h, "Secret.Name", name)...)
+
+		return
+	}
+
+	if ! exists {
+		secret = &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      name,
+				Namespace: h.directory.Namespace,
+				Labels:    utils.LabelsForApp(h.directory.Name, name),
+			},
+			Type: corev1.SecretTypeOpaque,
+		}
+
+		ctrl.SetControllerReference(h.directory, secret, r.Scheme)
+	}
+
+	if secret.Data == nil {
+		secret.Data = make(map[string][]byte)
+	}
+
+	/*
+	 * Generate any of the credentials which are missing.
+	 */
+
+	updated := false
+
+	for _, key := range []string{ utils.AdminPwdKey, utils.ReplicationPwdKey } {
+		if _, ok := secret.Data[key]; ok {
+			continue
+		}
+
+		var pwd string
+
+		pwd, err = r.generatePassword()
+
+		if err != nil {
+			r.Log.Error(err, "Failed to generate a password",
+				r.createLogParams(h, "Secret.Name", name, "Secret.Key", key)...)
+
+			return
+		}
+
+		secret.Data[key] = []byte(pwd)
+		updated          = true
+	}
+
+	/*
+	 * Record the credentials which are being applied to the replicas, if
+	 * they have not already been recorded.
+	 */
+
+	applied := map[string]string {
+		utils.AppliedAdminPwdKey:       utils.AdminPwdKey,
+		utils.AppliedReplicationPwdKey: utils.ReplicationPwdKey,
+	}
+
+	for appliedKey, key := range applied {
+		if _, ok := secret.Data[appliedKey]; !ok {
+			secret.Data[appliedKey] = secret.Data[key]
+			updated                 = true
+		}
+	}
+
+	/*
+	 * Save the secret.
+	 */
+
+	if ! exists {
+		r.Log.Info("Creating the credentials secret",
+					r.createLogParams(h, "Secret.Name", name)...)
+
+		err = r.Create(h.ctx, secret)
+	} else if updated {
+		r.Log.Info("Updating the credentials secret",
+					r.createLogParams(h, "Secret.Name", name)...)
+
+		err = r.Update(h.ctx, secret)
+	}
+
+	if err != nil {
+ 		r.Log.Error(err, "Failed to save the credentials secret",
+			r.createLogParams(h, "Secret.Name", name)...)
+
+		return
+	}
+
+	/*
+	 * The proxy will resolve the admin password for each of the replicas
+	 * directly from the secret.
+	 */
+
+	h.config.adminPwd = fmt.Sprintf("secret:%s/%s", name, utils.AdminPwdKey)
+
+	return
+}
+
+/*****************************************************************************/
+
+/*
+ * The following function will return the environment variables which are
+ * used to pass the generated credentials to a container.  The replication
+ * credentials are only required by the server replicas.
+ */
+
+func (r *IBMSecurityVerifyDirectoryReconciler) getCredentialsEnv(
+			h           *RequestHandle,
+			replication bool) (env []corev1.EnvVar) {
+
+	if ! h.directory.Spec.Credentials.Generate {
+		return
+	}
+
+	name := r.getCredentialsSecretName(h)
+
+	entries := [][]string {
+		{ "general.admin.pwd", utils.AdminPwdKey },
+	}
+
+	if replication {
+		entries = append(entries, 
+				[]string{ "server.replication.admin.pwd", utils.ReplicationPwdKey })
+	}
+
+	for _, entry := range entries {
+		env = append(env, corev1.EnvVar {
+			Name: entry[0],
+			ValueFrom: &corev1.EnvVarSource {
+				SecretKeyRef: &corev1.SecretKeySelector {
+					LocalObjectReference: corev1.LocalObjectReference{
+						Name: name,
+					},
+					Key: entry[1],
+				},
+			},
+		})
+	}
+
+	return
+}
+
+/*****************************************************************************/
+
+/*
+ * The following function will return the name of the secret which holds
+ * the generated credentials.
+ */
+
+func (r *IBMSecurityVerifyDirectoryReconciler) getCredentialsSecretName(
+			h *RequestHandle) (string) {
+	return utils.GetCredentialsSecretName(h.directory.Name,
+						h.directory.Spec.Credentials.SecretName)
+}
+
+/*****************************************************************************/
+
+/*
+ * The following function is used to generate a new random password.
+ */
+
+func (r *IBMSecurityVerifyDirectoryReconciler) generatePassword() (
+			string, error) {
+
+	pwd := make([]byte, generatedPwdLength)
+	max := big.NewInt(int64(len(generatedPwdChars)))
+
+	for idx := range pwd {
+		n, err := rand.Int(rand.Reader, max)
+
+		if err != nil {
+			return "", err
+		}
+
+		pwd[idx] = generatedPwdChars[n.Int64()]
+	}
+
+	return string(pwd), nil
+}
+
+/*****************************************************************************/
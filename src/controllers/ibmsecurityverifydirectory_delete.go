@@ -17,6 +17,7 @@ import (
 	corev1  "k8s.io/api/core/v1"
 	metav1  "k8s.io/apimachinery/pkg/apis/meta/v1"
 
+	"fmt"
 	"strconv"
 	"time"
 
@@ -61,6 +62,10 @@ func (r *IBMSecurityVerifyDirectoryReconciler) deleteReplicas(
 			r.createLogParams(h, 
 				strconv.FormatInt(int64(idx), 10), pvcName)...)
 
+		started := time.Now()
+
+		r.setReplicaPhase(h, []string{pvcName}, ReplicaPhaseDeleting)
+
 		/*
 		 * Remove the replication agreement from each of the existing
 		 * replicas.
@@ -70,7 +75,7 @@ func (r *IBMSecurityVerifyDirectoryReconciler) deleteReplicas(
 		
 		for pvc, podName := range existing {
 			if _, ok := toBeDeletedPvcs[pvc]; !ok {
-				r.deleteReplicationAgreement(h, podName, id)
+				r.deleteReplicationAgreement(h, podName, pvcName)
 			}
 		}
 
@@ -80,6 +85,26 @@ func (r *IBMSecurityVerifyDirectoryReconciler) deleteReplicas(
 
 		err = r.deleteReplica(h, pvcName)
 
+		replicaRemoveDuration.WithLabelValues(
+				metricsLabelValues(h, metricsResult(err))...).Observe(
+						time.Since(started).Seconds())
+
+		if err != nil {
+			r.recordEvent(h, corev1.EventTypeWarning, "ReplicaDeleteFailed",
+					pvcName, id, "Failed to delete the replica.")
+
+			return
+		}
+
+		r.recordEvent(h, corev1.EventTypeNormal, "ReplicaDeleted",
+					pvcName, id, "The replica has been deleted.")
+
+		/*
+		 * Delete the certificate for the replica.
+		 */
+
+		err = r.deleteCertificate(h, id)
+
 		if err != nil {
 			return
 		}
@@ -168,20 +193,39 @@ func (r *IBMSecurityVerifyDirectoryReconciler) deleteReplica(
 /*****************************************************************************/
 
 /*
- * The following function is used to delete an existing replication agreement.
+ * The following function is used to delete the replication agreement for
+ * the specified replica from an existing pod.
  */
 
 func (r *IBMSecurityVerifyDirectoryReconciler) deleteReplicationAgreement(
 			h            *RequestHandle,
 			podName      string,
-			replicaId    string) {
+			replicaPvc   string) (err error) {
+
+	replicaId := r.getReplicaPodName(h.directory, replicaPvc)
 
 	r.Log.Info(
 		"Deleting an existing replication agreement", 
 		r.createLogParams(h, "Pod.Name", podName, "Replica.Id", replicaId)...)
 
-	r.executeCommand(h, podName, 
+	err = r.executeCommand(h, podName, 
 		[]string{"isvd_manage_replica", "-r", "-i", replicaId})
+
+	if err != nil {
+		r.recordEvent(h, corev1.EventTypeWarning, 
+			"ReplicationAgreementRemoveFailed", replicaPvc, replicaId,
+			fmt.Sprintf("Failed to remove the replication agreement from %s.",
+				podName))
+
+		return
+	}
+
+	r.recordEvent(h, corev1.EventTypeNormal, "ReplicationAgreementRemoved",
+			replicaPvc, replicaId,
+			fmt.Sprintf("The replication agreement has been removed from %s.",
+				podName))
+
+	return
 }
 
 /*****************************************************************************/
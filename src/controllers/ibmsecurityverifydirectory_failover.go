@@ -0,0 +1,442 @@
+/* vi: set ts=4 sw=4 noexpandtab : */
+
+/*
+ * Copyright contributors to the IBM Security Verify Directory Operator project
+ */
+
+package controllers
+
+/*
+ * This file contains the functions which are used by the controller to move
+ * the primary write role of the proxy away from a replica which is about to
+ * be deleted.  The proxy uses the first server of each suffix as the primary
+ * write server, and so the role is moved by regenerating the proxy
+ * configuration with the new primary write server listed first and then
+ * rolling the proxy.  Once the proxy has been rolled we wait for the
+ * outstanding changes of the previous primary write server to be replicated
+ * before the replica is deleted.
+ */
+
+/*****************************************************************************/
+
+import (
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/ibm-security/verify-directory-operator/utils"
+
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+/*****************************************************************************/
+
+/*
+ * Some constants...
+ */
+
+const proxyRolloutTimeout     = 600
+const replicationDrainTimeout = 600
+const replicationDrainPeriod  = 5
+
+/*****************************************************************************/
+
+/*
+ * The following function is used to determine which replica is to be used
+ * as the primary write server of the proxy.  The current primary write
+ * server is retained, so that the role doesn't move whenever the proxy
+ * configuration is regenerated.  If the current primary write server is
+ * about to be deleted a healthy replica is chosen to take over the role.
+ */
+
+func (r *IBMSecurityVerifyDirectoryReconciler) preparePrimaryFailover(
+			h           *RequestHandle,
+			existing    map[string]string,
+			toBeDeleted []string) (err error) {
+
+	r.Log.V(1).Info("Entering a function",
+				r.createLogParams(h, "Function", "preparePrimaryFailover",
+						"To.Be.Deleted", toBeDeleted)...)
+
+	/*
+	 * Work out the current primary write servers.  We ask the proxy, and
+	 * fall back to the last primary write server which was recorded in the
+	 * status of the document if the proxy cannot be queried.
+	 */
+
+	var primaries []string
+
+	roles, err := r.getProxyServerRoles(h)
+
+	if err != nil {
+		r.Log.V(1).Info("Failed to retrieve the server roles from the proxy",
+				r.createLogParams(h, "Error", err.Error())...)
+
+		err = nil
+
+		if h.directory.Status.Proxy != nil &&
+					h.directory.Status.Proxy.PrimaryWriteServer != "" {
+			primaries = append(primaries,
+					h.directory.Status.Proxy.PrimaryWriteServer)
+		}
+	}
+
+	for _, pvcName := range r.getOrderedReplicas(h, existing) {
+		if roles[pvcName] == proxyPrimaryWriteRole {
+			primaries = append(primaries, pvcName)
+		}
+	}
+
+	/*
+	 * Retain the current primary write server if it is still required.
+	 */
+
+	var failoverFrom []string
+
+	for _, pvcName := range primaries {
+		if containsString(toBeDeleted, pvcName) {
+			failoverFrom = append(failoverFrom, pvcName)
+		} else if h.primaryWriteServer == "" &&
+				containsString(h.directory.Spec.Replicas.PVCs, pvcName) {
+			h.primaryWriteServer = pvcName
+		}
+	}
+
+	if len(failoverFrom) == 0 {
+		return
+	}
+
+	/*
+	 * The primary write server is about to be deleted and so we need to
+	 * choose a new primary write server.
+	 */
+
+	if h.primaryWriteServer == "" {
+		h.primaryWriteServer, err = r.getFailoverTarget(
+									h, existing, toBeDeleted)
+
+		if err != nil {
+			r.recordEvent(h, corev1.EventTypeWarning, "PrimaryFailoverFailed",
+					failoverFrom[0],
+					r.getReplicaPodName(h.directory, failoverFrom[0]),
+					err.Error())
+
+			return
+		}
+	}
+
+	h.failoverFrom = failoverFrom
+	h.restartProxy = true
+
+	r.Log.Info("Moving the primary write server",
+			r.createLogParams(h, "From", failoverFrom,
+					"To", h.primaryWriteServer)...)
+
+	r.recordEvent(h, corev1.EventTypeNormal, "PrimaryFailoverStarted",
+			h.primaryWriteServer,
+			r.getReplicaPodName(h.directory, h.primaryWriteServer),
+			fmt.Sprintf("The primary write server is being moved from %s " +
+				"to %s.", strings.Join(failoverFrom, ", "),
+				h.primaryWriteServer))
+
+	return
+}
+
+/*****************************************************************************/
+
+/*
+ * The following function will choose the replica which is to take over the
+ * primary write role.  The replica must be ready and must not be about to
+ * be deleted.  The replica with the smallest replication backlog is chosen.
+ */
+
+func (r *IBMSecurityVerifyDirectoryReconciler) getFailoverTarget(
+			h           *RequestHandle,
+			existing    map[string]string,
+			toBeDeleted []string) (target string, err error) {
+
+	r.Log.V(1).Info("Entering a function",
+				r.createLogParams(h, "Function", "getFailoverTarget")...)
+
+	var backlog int64
+
+	for _, pvcName := range h.directory.Spec.Replicas.PVCs {
+		podName, ok := existing[pvcName]
+
+		if ! ok || containsString(toBeDeleted, pvcName) {
+			continue
+		}
+
+		pod := &corev1.Pod{}
+		err  = r.Get(h.ctx, types.NamespacedName{
+							Namespace: h.directory.Namespace,
+							Name:      podName,
+						}, pod)
+
+		if err != nil || ! isPodReady(pod) {
+			continue
+		}
+
+		var replicaBacklog int64
+
+		if status := r.findReplicaStatus(h, pvcName); status != nil {
+			replicaBacklog = status.ReplicationBacklog
+		}
+
+		if target == "" || replicaBacklog < backlog {
+			target  = pvcName
+			backlog = replicaBacklog
+		}
+	}
+
+	err = nil
+
+	if target == "" {
+		err = errors.New("There is no ready replica which can take over " +
+				"the primary write role from the replica which is being " +
+				"deleted.")
+	}
+
+	return
+}
+
+/*****************************************************************************/
+
+/*
+ * The following function will return the order in which the replicas are
+ * to be listed in the proxy configuration.  The primary write server is
+ * listed first, followed by the remaining replicas in the order in which
+ * they appear in the document.
+ */
+
+func (r *IBMSecurityVerifyDirectoryReconciler) getProxyServerOrder(
+			h *RequestHandle) (pvcNames []string) {
+
+	if h.primaryWriteServer != "" &&
+			containsString(h.directory.Spec.Replicas.PVCs,
+											h.primaryWriteServer) {
+		pvcNames = append(pvcNames, h.primaryWriteServer)
+	}
+
+	for _, pvcName := range h.directory.Spec.Replicas.PVCs {
+		if ! containsString(pvcNames, pvcName) {
+			pvcNames = append(pvcNames, pvcName)
+		}
+	}
+
+	return
+}
+
+/*****************************************************************************/
+
+/*
+ * The following function is used to complete the move of the primary write
+ * role.  It will wait for the proxy to be rolled, and then wait for the
+ * changes which are pending on the previous primary write server to be
+ * replicated to the remaining replicas.
+ */
+
+func (r *IBMSecurityVerifyDirectoryReconciler) completePrimaryFailover(
+			h           *RequestHandle,
+			existing    map[string]string,
+			toBeDeleted []string) (err error) {
+
+	r.Log.V(1).Info("Entering a function",
+				r.createLogParams(h, "Function", "completePrimaryFailover",
+						"From", h.failoverFrom)...)
+
+	if len(h.failoverFrom) == 0 {
+		return
+	}
+
+	/*
+	 * Wait for the proxy to be rolled.
+	 */
+
+	err = r.waitForProxyRollout(h)
+
+	/*
+	 * Wait for the pending changes to be replicated.
+	 */
+
+	for _, pvcName := range h.failoverFrom {
+		if err != nil {
+			break
+		}
+
+		err = r.waitForReplicationDrain(h, existing, toBeDeleted, pvcName)
+	}
+
+	if err != nil {
+		r.recordEvent(h, corev1.EventTypeWarning, "PrimaryFailoverFailed",
+				h.primaryWriteServer,
+				r.getReplicaPodName(h.directory, h.primaryWriteServer),
+				fmt.Sprintf("Failed to move the primary write server: %s",
+					err.Error()))
+
+		return
+	}
+
+	r.recordEvent(h, corev1.EventTypeNormal, "PrimaryFailoverCompleted",
+			h.primaryWriteServer,
+			r.getReplicaPodName(h.directory, h.primaryWriteServer),
+			fmt.Sprintf("The primary write server has been moved to %s.",
+				h.primaryWriteServer))
+
+	h.failoverFrom = nil
+
+	return
+}
+
+/*****************************************************************************/
+
+/*
+ * The following function is used to wait for the proxy deployment to be
+ * rolled, i.e. for each of the proxy pods to be running the current
+ * configuration and to be ready.
+ */
+
+func (r *IBMSecurityVerifyDirectoryReconciler) waitForProxyRollout(
+			h *RequestHandle) (err error) {
+
+	name := utils.GetProxyDeploymentName(h.directory.Name)
+
+	r.Log.Info("Waiting for the proxy deployment to be rolled",
+			r.createLogParams(h, "Deployment.Name", name)...)
+
+	err = wait.PollImmediate(time.Second,
+				time.Duration(proxyRolloutTimeout) * time.Second,
+				func() (bool, error) {
+		deployment := &appsv1.Deployment{}
+		err        := r.Get(h.ctx, types.NamespacedName{
+								Namespace: h.directory.Namespace,
+								Name:      name,
+							}, deployment)
+
+		if err != nil {
+			return false, nil
+		}
+
+		var replicas int32 = 1
+
+		if deployment.Spec.Replicas != nil {
+			replicas = *deployment.Spec.Replicas
+		}
+
+		status := deployment.Status
+
+		return status.ObservedGeneration >= deployment.Generation &&
+					status.UpdatedReplicas == replicas &&
+					status.ReadyReplicas   == replicas &&
+					status.Replicas        == replicas, nil
+	})
+
+	if err != nil {
+ 		r.Log.Error(err,
+				"The proxy failed to be rolled within the allocated time.",
+				r.createLogParams(h, "Deployment.Name", name)...)
+
+		err = errors.New(fmt.Sprintf("The proxy deployment, %s, failed to " +
+				"be rolled within the allocated time.", name))
+	}
+
+	return
+}
+
+/*****************************************************************************/
+
+/*
+ * The following function is used to wait for the changes which are pending
+ * on the specified replica to be replicated to each of the replicas which
+ * are to be retained.
+ */
+
+func (r *IBMSecurityVerifyDirectoryReconciler) waitForReplicationDrain(
+			h           *RequestHandle,
+			existing    map[string]string,
+			toBeDeleted []string,
+			pvcName     string) (err error) {
+
+	/*
+	 * The pending changes cannot be replicated if the replica is not ready.
+	 * The replica is not deleted in this case, as its pending changes would
+	 * be lost, and so the step fails.
+	 */
+
+	podName := r.getReplicaPodName(h.directory, pvcName)
+
+	pod := &corev1.Pod{}
+	err  = r.Get(h.ctx, types.NamespacedName{
+						Namespace: h.directory.Namespace,
+						Name:      podName,
+					}, pod)
+
+	if err != nil || ! isPodReady(pod) {
+		err = errors.New(fmt.Sprintf("The replica, %s, is not ready and so " +
+				"its pending changes cannot be replicated.  The replica " +
+				"will not be deleted until it is ready.", pvcName))
+
+		r.Log.Error(err, "Failed to replicate the pending changes",
+				r.createLogParams(h, "PVC.Name", pvcName)...)
+
+		return
+	}
+
+	r.Log.Info("Waiting for the pending changes to be replicated",
+			r.createLogParams(h, "PVC.Name", pvcName)...)
+
+	consumers := make(map[string]string)
+
+	for pvc, podName := range existing {
+		consumers[podName] = pvc
+	}
+
+	var pending int64
+
+	err = wait.PollImmediate(
+				time.Duration(replicationDrainPeriod) * time.Second,
+				time.Duration(replicationDrainTimeout) * time.Second,
+				func() (bool, error) {
+		agreements, err := r.getReplicaAgreements(h, pvcName, consumers)
+
+		if err != nil {
+			r.Log.V(1).Info("Failed to retrieve the replication agreements",
+				r.createLogParams(h, "PVC.Name", pvcName,
+						"Error", err.Error())...)
+
+			return false, nil
+		}
+
+		pending = 0
+
+		for _, agreement := range agreements {
+			if ! containsString(toBeDeleted, agreement.Consumer) {
+				pending += agreement.PendingChanges
+			}
+		}
+
+		return pending == 0, nil
+	})
+
+	if err != nil {
+ 		r.Log.Error(err,
+				"The pending changes were not replicated within the " +
+				"allocated time.",
+				r.createLogParams(h, "PVC.Name", pvcName,
+						"Pending", pending)...)
+
+		err = errors.New(fmt.Sprintf("The pending changes of the replica, " +
+				"%s, were not replicated within the allocated time (%d " +
+				"changes are still pending).", pvcName, pending))
+	}
+
+	return
+}
+
+/*****************************************************************************/
+
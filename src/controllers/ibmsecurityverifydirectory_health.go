@@ -0,0 +1,591 @@
+/* vi: set ts=4 sw=4 noexpandtab : */
+
+/*
+ * Copyright contributors to the IBM Security Verify Directory Operator project
+ */
+
+package controllers
+
+/*
+ * This file contains the functions which are used by the controller to
+ * periodically check the health of the replication agreements between the
+ * replicas.
+ */
+
+/*****************************************************************************/
+
+import (
+	metav1  "k8s.io/apimachinery/pkg/apis/meta/v1"
+	corev1  "k8s.io/api/core/v1"
+
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-ldap/ldap/v3"
+
+	"k8s.io/apimachinery/pkg/api/meta"
+
+	"github.com/ibm-security/verify-directory-operator/utils"
+
+	ctrl  "sigs.k8s.io/controller-runtime"
+	ibmv1 "github.com/ibm-security/verify-directory-operator/api/v1"
+)
+
+/*****************************************************************************/
+
+/*
+ * Some constants...
+ */
+
+const ReplicationHealthyCondition = "ReplicationHealthy"
+
+/*
+ * The attributes of a replication agreement which are used to determine the
+ * health of the agreement.  These are operational attributes and so must be
+ * explicitly requested.
+ */
+
+var agreementAttributes = []string{
+	"ibm-replicaConsumerId",
+	"ibm-replicationState",
+	"ibm-replicationPendingChangeCount",
+	"ibm-replicationFailedChangeCount",
+	"ibm-replicationLastChangeId",
+	"ibm-replicationLastResult",
+}
+
+/*
+ * The agreement states which indicate that the supplier is unable to
+ * replicate changes to the consumer.
+ */
+
+var unhealthyAgreementStates = []string{
+	"retrying",
+	"on hold",
+	"onhold",
+	"error log full",
+}
+
+/*****************************************************************************/
+
+/*
+ * The following function will return the interval at which the replication
+ * health check is to be performed.  An interval of 0 indicates that the
+ * health check has been disabled.
+ */
+
+func (r *IBMSecurityVerifyDirectoryReconciler) getHealthCheckInterval(
+			h *RequestHandle) time.Duration {
+
+	interval := ibmv1.DefaultHealthCheckInterval
+
+	healthCheck := h.directory.Spec.Replicas.HealthCheck
+
+	if healthCheck != nil && healthCheck.IntervalSeconds != nil {
+		interval = *healthCheck.IntervalSeconds
+	}
+
+	return time.Duration(interval) * time.Second
+}
+
+/*****************************************************************************/
+
+/*
+ * The following function will return the result which is used to schedule
+ * the next health check.  No check is scheduled if the health checks have
+ * been disabled.
+ */
+
+func (r *IBMSecurityVerifyDirectoryReconciler) getHealthCheckResult(
+			h *RequestHandle) ctrl.Result {
+	return ctrl.Result{RequeueAfter: r.getHealthCheckInterval(h)}
+}
+
+/*****************************************************************************/
+
+/*
+ * The following function is used to check the health of the replication
+ * agreements, and to schedule the next check.  The next check is always
+ * scheduled, even if the current check fails, so that the health of the
+ * agreements continues to be monitored.  If the processing of the document
+ * was skipped, because the document is degraded, the server configuration
+ * will not yet have been loaded and so it is loaded here.
+ */
+
+func (r *IBMSecurityVerifyDirectoryReconciler) scheduleHealthCheck(
+			h *RequestHandle) (result ctrl.Result) {
+
+	result = r.getHealthCheckResult(h)
+
+	if result.RequeueAfter == 0 {
+		r.clearReplicationHealth(h)
+
+		return
+	}
+
+	var err error
+
+	if h.config.ldapPort == 0 && h.config.ldapsPort == 0 {
+		err = r.getServerConfig(h)
+
+		if err == nil && h.directory.Spec.Credentials.Generate {
+			h.config.adminPwd = fmt.Sprintf("secret:%s/%s",
+						r.getCredentialsSecretName(h), utils.AdminPwdKey)
+		}
+	}
+
+	var existing map[string]string
+
+	if err == nil {
+		existing, err = r.getExistingPods(h)
+	}
+
+	if err == nil {
+		err = r.checkReplicationHealth(h, existing)
+	}
+
+	if err != nil {
+		r.Log.Error(err, "Failed to check the health of the replication " +
+				"agreements", r.createLogParams(h)...)
+	}
+
+	return
+}
+
+/*****************************************************************************/
+
+/*
+ * The following function will return the number of pending changes above
+ * which a replication agreement is considered to be unhealthy.
+ */
+
+func (r *IBMSecurityVerifyDirectoryReconciler) getPendingChangeThreshold(
+			h *RequestHandle) int64 {
+
+	healthCheck := h.directory.Spec.Replicas.HealthCheck
+
+	if healthCheck != nil && healthCheck.PendingChangeThreshold != nil {
+		return *healthCheck.PendingChangeThreshold
+	}
+
+	return ibmv1.DefaultPendingChangeThreshold
+}
+
+/*****************************************************************************/
+
+/*
+ * The following function is used to remove the replication health status
+ * from the document, when the health check has been disabled.
+ */
+
+func (r *IBMSecurityVerifyDirectoryReconciler) clearReplicationHealth(
+			h *RequestHandle) (err error) {
+
+	if meta.FindStatusCondition(h.directory.Status.Conditions,
+							ReplicationHealthyCondition) == nil &&
+							h.directory.Status.Replication == nil {
+		return
+	}
+
+	meta.RemoveStatusCondition(&h.directory.Status.Conditions,
+							ReplicationHealthyCondition)
+
+	h.directory.Status.Replication = nil
+
+	err = r.Status().Update(h.ctx, h.directory)
+
+	if err != nil {
+		r.Log.Error(err, "Failed to update the replication status",
+						r.createLogParams(h)...)
+	}
+
+	return
+}
+
+/*****************************************************************************/
+
+/*
+ * The following function is used to check the health of the replication
+ * agreements of each of the replicas.  The status of each agreement is
+ * recorded in the status of the document, along with the ReplicationHealthy
+ * condition.
+ */
+
+func (r *IBMSecurityVerifyDirectoryReconciler) checkReplicationHealth(
+			h        *RequestHandle,
+			existing map[string]string) (err error) {
+
+	r.Log.V(1).Info("Entering a function",
+				r.createLogParams(h, "Function", "checkReplicationHealth")...)
+
+	replicas := r.getOrderedReplicas(h, existing)
+
+	condition := metav1.Condition{
+		Type:    ReplicationHealthyCondition,
+		Status:  metav1.ConditionTrue,
+		Reason:  "ReplicationHealthy",
+		Message: "All of the replication agreements are healthy.",
+	}
+
+	var agreements []ibmv1.IBMSecurityVerifyDirectoryAgreementStatus
+
+	if len(replicas) < 2 {
+		condition.Reason  = "SingleReplica"
+		condition.Message = "There is only a single replica and so no " +
+							"replication agreements exist."
+	} else {
+		var failures []string
+
+		agreements, failures = r.getAgreementStatus(h, replicas)
+
+		var unhealthy []string
+
+		for _, agreement := range agreements {
+			if ! agreement.Healthy {
+				unhealthy = append(unhealthy, fmt.Sprintf(
+						"%s -> %s (%s): %s", agreement.Supplier,
+						agreement.Consumer, agreement.Context,
+						agreement.Message))
+			}
+		}
+
+		if len(unhealthy) > 0 {
+			condition.Status  = metav1.ConditionFalse
+			condition.Reason  = "ReplicationDegraded"
+			condition.Message = fmt.Sprintf("%d of the %d replication " +
+						"agreements are unhealthy: %s", len(unhealthy),
+						len(agreements), strings.Join(unhealthy, "; "))
+		} else if len(failures) > 0 {
+			condition.Status  = metav1.ConditionUnknown
+			condition.Reason  = "ReplicationCheckFailed"
+			condition.Message = fmt.Sprintf("The replication agreements " +
+						"could not be checked: %s",
+						strings.Join(failures, "; "))
+		}
+	}
+
+	/*
+	 * Update the status of the document.
+	 */
+
+	now := metav1.Now()
+
+	h.directory.Status.Replication =
+				&ibmv1.IBMSecurityVerifyDirectoryReplicationStatus{
+		Agreements:    agreements,
+		LastCheckTime: &now,
+	}
+
+	r.Log.V(1).Info("Setting a condition",
+				r.createLogParams(h, "Condition", condition)...)
+
+	meta.SetStatusCondition(&h.directory.Status.Conditions, condition)
+
+	err = r.Status().Update(h.ctx, h.directory)
+
+	if err != nil {
+		r.Log.Error(err, "Failed to update the replication status",
+						r.createLogParams(h)...)
+	}
+
+	return
+}
+
+/*****************************************************************************/
+
+/*
+ * The following function will return the status of each of the replication
+ * agreements, along with a description of any replicas which could not be
+ * queried.
+ */
+
+func (r *IBMSecurityVerifyDirectoryReconciler) getAgreementStatus(
+			h        *RequestHandle,
+			replicas []string) (
+				agreements []ibmv1.IBMSecurityVerifyDirectoryAgreementStatus,
+				failures   []string) {
+
+	/*
+	 * The agreements from the previous check, which are used to detect
+	 * stalled agreements and changes in the health of an agreement.
+	 */
+
+	previous := make(map[string]ibmv1.IBMSecurityVerifyDirectoryAgreementStatus)
+
+	if h.directory.Status.Replication != nil {
+		for _, agreement := range h.directory.Status.Replication.Agreements {
+			previous[agreementKey(agreement)] = agreement
+		}
+	}
+
+	/*
+	 * The consumer of an agreement is identified by its replica identifier,
+	 * which is the name of the pod of the replica.
+	 */
+
+	consumers := make(map[string]string)
+
+	for _, pvcName := range replicas {
+		consumers[r.getReplicaPodName(h.directory, pvcName)] = pvcName
+	}
+
+	threshold := r.getPendingChangeThreshold(h)
+
+	for _, pvcName := range replicas {
+		found, err := r.getReplicaAgreements(h, pvcName, consumers)
+
+		if err != nil {
+			failures = append(failures, fmt.Sprintf("%s: %s",
+								pvcName, err.Error()))
+
+			continue
+		}
+
+		for _, agreement := range found {
+			last, seen := previous[agreementKey(agreement)]
+
+			r.evaluateAgreement(&agreement, last, seen, threshold)
+
+			if ! agreement.Healthy && (! seen || last.Healthy) {
+				r.recordEvent(h, corev1.EventTypeWarning,
+					"ReplicationUnhealthy", agreement.Consumer,
+					r.getReplicaPodName(h.directory, agreement.Consumer),
+					fmt.Sprintf("The replication agreement from %s for the " +
+						"context, %s, is unhealthy: %s", agreement.Supplier,
+						agreement.Context, agreement.Message))
+			} else if agreement.Healthy && seen && ! last.Healthy {
+				r.recordEvent(h, corev1.EventTypeNormal,
+					"ReplicationRecovered", agreement.Consumer,
+					r.getReplicaPodName(h.directory, agreement.Consumer),
+					fmt.Sprintf("The replication agreement from %s for the " +
+						"context, %s, is healthy.", agreement.Supplier,
+						agreement.Context))
+			}
+
+			agreements = append(agreements, agreement)
+		}
+	}
+
+	return
+}
+
+/*****************************************************************************/
+
+/*
+ * The following function is used to retrieve the replication agreements
+ * which are held by the specified (supplier) replica.
+ */
+
+func (r *IBMSecurityVerifyDirectoryReconciler) getReplicaAgreements(
+			h         *RequestHandle,
+			pvcName   string,
+			consumers map[string]string) (
+				agreements []ibmv1.IBMSecurityVerifyDirectoryAgreementStatus,
+				err        error) {
+
+	r.Log.V(1).Info("Entering a function",
+				r.createLogParams(h, "Function", "getReplicaAgreements",
+						"PVC.Name", pvcName)...)
+
+	/*
+	 * Resolve the admin credentials.
+	 */
+
+	rctx := r.getResolveContext(h)
+
+	adminDn, err := utils.ResolveNamedEntry(
+						"general.admin.dn", h.config.adminDn, rctx)
+
+	if err != nil {
+		return
+	}
+
+	adminPwd, err := utils.ResolveNamedEntry(
+						"general.admin.pwd", h.config.adminPwd, rctx)
+
+	if err != nil {
+		return
+	}
+
+	/*
+	 * Connect and bind to the replica.
+	 */
+
+	l, err := r.dialReplica(h, pvcName)
+
+	if err != nil {
+		return
+	}
+
+	defer l.Close()
+
+	err = l.Bind(fmt.Sprintf("%v", adminDn), fmt.Sprintf("%v", adminPwd))
+
+	if err != nil {
+		return
+	}
+
+	/*
+	 * Search each of the replication contexts for the agreements.
+	 */
+
+	processed := make(map[string]bool)
+
+	for _, suffix := range h.config.suffixes {
+		searchRequest := ldap.NewSearchRequest(
+			suffix,
+			ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 0, 0, false,
+			"(objectclass=ibm-replicationAgreement)",
+			agreementAttributes,
+			nil,
+		)
+
+		var sr *ldap.SearchResult
+
+		sr, err = l.Search(searchRequest)
+
+		if ldap.IsErrorWithCode(err, ldap.LDAPResultNoSuchObject) {
+			err = nil
+
+			continue
+		}
+
+		if err != nil {
+			return
+		}
+
+		for _, entry := range sr.Entries {
+			if processed[strings.ToLower(entry.DN)] {
+				continue
+			}
+
+			processed[strings.ToLower(entry.DN)] = true
+
+			consumerId := entry.GetEqualFoldAttributeValue(
+										"ibm-replicaConsumerId")
+
+			consumer, ok := consumers[consumerId]
+
+			if ! ok {
+				consumer = consumerId
+			}
+
+			agreements = append(agreements,
+						ibmv1.IBMSecurityVerifyDirectoryAgreementStatus{
+				Supplier:       pvcName,
+				Consumer:       consumer,
+				Context:        suffix,
+				State:          entry.GetEqualFoldAttributeValue(
+										"ibm-replicationState"),
+				PendingChanges: agreementCount(entry,
+										"ibm-replicationPendingChangeCount"),
+				FailedChanges:  agreementCount(entry,
+										"ibm-replicationFailedChangeCount"),
+				LastChangeId:   entry.GetEqualFoldAttributeValue(
+										"ibm-replicationLastChangeId"),
+				LastResult:     entry.GetEqualFoldAttributeValue(
+										"ibm-replicationLastResult"),
+			})
+		}
+	}
+
+	r.Log.V(1).Info("Retrieved the replication agreements",
+			r.createLogParams(h, "PVC.Name", pvcName,
+					"Agreements", agreements)...)
+
+	return
+}
+
+/*****************************************************************************/
+
+/*
+ * The following function is used to determine whether an agreement is
+ * healthy.  An agreement is unhealthy if it is in an error state, if changes
+ * have failed to replicate, if too many changes are pending, or if changes
+ * are pending but no change has been replicated since the previous check.
+ */
+
+func (r *IBMSecurityVerifyDirectoryReconciler) evaluateAgreement(
+			agreement *ibmv1.IBMSecurityVerifyDirectoryAgreementStatus,
+			last      ibmv1.IBMSecurityVerifyDirectoryAgreementStatus,
+			seen      bool,
+			threshold int64) {
+
+	agreement.Healthy = false
+
+	state := strings.ToLower(agreement.State)
+
+	for _, unhealthy := range unhealthyAgreementStates {
+		if state == unhealthy {
+			agreement.Message = fmt.Sprintf(
+					"The agreement is in the '%s' state.", agreement.State)
+
+			return
+		}
+	}
+
+	if agreement.FailedChanges > 0 {
+		agreement.Message = fmt.Sprintf(
+				"%d changes have failed to replicate.", agreement.FailedChanges)
+
+		return
+	}
+
+	if agreement.PendingChanges > threshold {
+		agreement.Message = fmt.Sprintf("%d changes are pending, which " +
+				"exceeds the threshold of %d.", agreement.PendingChanges,
+				threshold)
+
+		return
+	}
+
+	if seen && agreement.PendingChanges > 0 && last.PendingChanges > 0 &&
+					agreement.LastChangeId == last.LastChangeId {
+		agreement.Message = fmt.Sprintf("The agreement has stalled: %d " +
+				"changes are pending and no change has been replicated " +
+				"since the previous check.", agreement.PendingChanges)
+
+		return
+	}
+
+	agreement.Healthy = true
+	agreement.Message = ""
+}
+
+/*****************************************************************************/
+
+/*
+ * The following function will return the key which is used to identify a
+ * replication agreement.
+ */
+
+func agreementKey(
+			agreement ibmv1.IBMSecurityVerifyDirectoryAgreementStatus) string {
+	return fmt.Sprintf("%s/%s/%s",
+			agreement.Supplier, agreement.Consumer, agreement.Context)
+}
+
+/*****************************************************************************/
+
+/*
+ * The following function will return the numeric value of the specified
+ * attribute of an agreement.  A value of 0 is returned if the attribute is
+ * missing or is not numeric.
+ */
+
+func agreementCount(entry *ldap.Entry, attribute string) int64 {
+	value, err := strconv.ParseInt(
+			strings.TrimSpace(entry.GetEqualFoldAttributeValue(attribute)),
+			10, 64)
+
+	if err != nil {
+		return 0
+	}
+
+	return value
+}
+
+/*****************************************************************************/
+
@@ -0,0 +1,201 @@
+/* vi: set ts=4 sw=4 noexpandtab : */
+
+/*
+ * Copyright contributors to the IBM Security Verify Directory Operator project
+ */
+
+package controllers
+
+/*
+ * This file contains the functions which are used by the controller to
+ * load the initial LDIF data into the principal replica of a new
+ * environment.
+ */
+
+/*****************************************************************************/
+
+import (
+	metav1  "k8s.io/apimachinery/pkg/apis/meta/v1"
+	corev1  "k8s.io/api/core/v1"
+
+	"errors"
+	"fmt"
+	"strings"
+
+	ibmv1 "github.com/ibm-security/verify-directory-operator/api/v1"
+)
+
+/*****************************************************************************/
+
+/*
+ * Some constants...
+ */
+
+const InitialDataMountPath = "/var/isvd/ldif"
+
+/*
+ * The script which is used to import the initial LDIF data into the
+ * principal.  The LDIF files are imported in order, and as the suffix
+ * entries will already exist in the principal 'already exists' errors are
+ * ignored.
+ */
+
+const importLdifScript = `for file in $(ls -1 "${LDIF_DIR}"/*.ldif | sort) ; do
+    echo "Importing ${file}"
+
+    idsldapadd -h "${LDAP_HOST}" -p "${LDAP_PORT}" \
+        -D "${LDAP_ADMIN_DN}" -w "${LDAP_ADMIN_PWD}" -c -f "${file}"
+
+    rc=$?
+
+    if [ ${rc} -ne 0 -a ${rc} -ne 68 ] ; then
+        echo "Failed to import ${file}: ${rc}" | tee /dev/termination-log
+        exit ${rc}
+    fi
+done
+`
+
+/*****************************************************************************/
+
+/*
+ * The following function is used to load the initial LDIF data into the
+ * principal when the principal is first created.  The data is only ever
+ * loaded once, and the completion of the load is recorded in the status of
+ * the document.
+ */
+
+func (r *IBMSecurityVerifyDirectoryReconciler) importInitialData(
+			h       *RequestHandle,
+			pvcName string) (err error) {
+
+	if len(h.directory.Spec.InitialData) == 0 ||
+							h.directory.Status.InitialData != nil {
+		return
+	}
+
+	r.Log.Info("Loading the initial data into the principal",
+				r.createLogParams(h, "PVC.Name", pvcName)...)
+
+	/*
+	 * Each of the LDIF sources is mounted as a separate file within the
+	 * LDIF directory.  The files are named so that they are imported in the
+	 * order in which they were specified.
+	 */
+
+	var volumes      []corev1.Volume
+	var volumeMounts []corev1.VolumeMount
+	var sources      []string
+
+	for idx, data := range h.directory.Spec.InitialData {
+		name := fmt.Sprintf("isvd-ldif-%d", idx)
+		file := fmt.Sprintf("%03d.ldif", idx)
+
+		volume := corev1.Volume {
+			Name: name,
+		}
+
+		if data.ConfigMap != nil && data.Secret == nil {
+			volume.VolumeSource = corev1.VolumeSource{
+				ConfigMap: &corev1.ConfigMapVolumeSource{
+					LocalObjectReference: data.ConfigMap.LocalObjectReference,
+					Items: []corev1.KeyToPath{{
+						Key:  data.ConfigMap.Key,
+						Path: file,
+					}},
+				},
+			}
+
+			sources = append(sources, fmt.Sprintf("configmap:%s/%s",
+						data.ConfigMap.Name, data.ConfigMap.Key))
+		} else if data.Secret != nil && data.ConfigMap == nil {
+			volume.VolumeSource = corev1.VolumeSource{
+				Secret: &corev1.SecretVolumeSource{
+					SecretName: data.Secret.Name,
+					Items: []corev1.KeyToPath{{
+						Key:  data.Secret.Key,
+						Path: file,
+					}},
+				},
+			}
+
+			sources = append(sources, fmt.Sprintf("secret:%s/%s",
+						data.Secret.Name, data.Secret.Key))
+		} else {
+			err = errors.New(fmt.Sprintf("Entry %d of the initial data must " +
+					"specify exactly one of a ConfigMap or a Secret.", idx))
+
+			r.Log.Error(err, "Failed to process the initial data",
+						r.createLogParams(h)...)
+
+			return
+		}
+
+		volumes = append(volumes, volume)
+
+		volumeMounts = append(volumeMounts, corev1.VolumeMount {
+			Name:      name,
+			MountPath: fmt.Sprintf("%s/%s", InitialDataMountPath, file),
+			SubPath:   file,
+			ReadOnly:  true,
+		})
+	}
+
+	/*
+	 * Set up the environment variables.
+	 */
+
+	ldapEnv, err := r.getLdapClientEnv(h, pvcName)
+
+	if err != nil {
+		return
+	}
+
+	env := append([]corev1.EnvVar{}, h.directory.Spec.Pods.Env...)
+	env  = append(env, ldapEnv...)
+	env  = append(env, corev1.EnvVar {
+		Name:  "LDIF_DIR",
+		Value: InitialDataMountPath,
+	})
+
+	/*
+	 * Run the import job.
+	 */
+
+	err = r.runServerJob(h, pvcName, r.getImportJobName(h.directory, pvcName),
+					importLdifScript, env, volumes, volumeMounts, nil)
+
+	if err != nil {
+		return
+	}
+
+	/*
+	 * Record the completion of the import so that it is never run again.
+	 */
+
+	now := metav1.Now()
+
+	h.directory.Status.InitialData =
+				&ibmv1.IBMSecurityVerifyDirectoryInitialDataStatus{
+		Replica:        pvcName,
+		Sources:        sources,
+		CompletionTime: &now,
+	}
+
+	err = r.Status().Update(h.ctx, h.directory)
+
+	if err != nil {
+		r.Log.Error(err, "Failed to update the initial data status",
+						r.createLogParams(h)...)
+
+		return
+	}
+
+	r.Log.Info("Loaded the initial data into the principal",
+				r.createLogParams(h, "PVC.Name", pvcName,
+						"Sources", strings.Join(sources, ","))...)
+
+	return
+}
+
+/*****************************************************************************/
+
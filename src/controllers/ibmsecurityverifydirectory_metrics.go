@@ -0,0 +1,255 @@
+/* vi: set ts=4 sw=4 noexpandtab : */
+
+/*
+ * Copyright contributors to the IBM Security Verify Directory Operator project
+ */
+
+package controllers
+
+/*
+ * This file contains the Prometheus metrics which are maintained by the
+ * controller.  The metrics are registered with the controller-runtime
+ * registry, and so are exposed by the metrics endpoint of the manager.  Each
+ * metric is labelled with the namespace and name of the document.
+ */
+
+/*****************************************************************************/
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	ctrl "sigs.k8s.io/controller-runtime"
+
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
+)
+
+/*****************************************************************************/
+
+/*
+ * Some constants...
+ */
+
+const metricsPrefix = "verify_directory"
+
+var metricsLabels = []string{"namespace", "name"}
+
+/*
+ * The buckets, in seconds, which are used by the duration histograms.  The
+ * lifecycle operations can take anywhere from a few seconds through to an
+ * hour, for a large seed.
+ */
+
+var durationBuckets = []float64{5, 15, 30, 60, 120, 300, 600, 1200, 3600}
+
+/*****************************************************************************/
+
+/*
+ * The metrics.
+ */
+
+var (
+	desiredReplicasGauge = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: metricsPrefix + "_replicas_desired",
+			Help: "The number of replicas which have been requested.",
+		}, metricsLabels)
+
+	actualReplicasGauge = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: metricsPrefix + "_replicas_actual",
+			Help: "The number of replica pods which currently exist.",
+		}, metricsLabels)
+
+	seedJobDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    metricsPrefix + "_seed_job_duration_seconds",
+			Help:    "The time taken by the seed job of a new replica.",
+			Buckets: durationBuckets,
+		}, metricsLabels)
+
+	seedJobFailures = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: metricsPrefix + "_seed_job_failures_total",
+			Help: "The number of seed jobs which have failed.",
+		}, metricsLabels)
+
+	replicaAddDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    metricsPrefix + "_replica_add_duration_seconds",
+			Help:    "The time taken to add new replicas to a deployment.",
+			Buckets: durationBuckets,
+		}, append(metricsLabels, "result"))
+
+	replicaRemoveDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    metricsPrefix + "_replica_remove_duration_seconds",
+			Help:    "The time taken to remove a replica from a deployment.",
+			Buckets: durationBuckets,
+		}, append(metricsLabels, "result"))
+
+	execFailures = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: metricsPrefix + "_exec_failures_total",
+			Help: "The number of commands executed in a pod which have failed.",
+		}, append(metricsLabels, "command"))
+
+	proxyRestarts = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: metricsPrefix + "_proxy_restarts_total",
+			Help: "The number of times that the proxy has been restarted.",
+		}, metricsLabels)
+
+	inProgressDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    metricsPrefix + "_in_progress_duration_seconds",
+			Help:    "The time for which the deployment was in progress.",
+			Buckets: durationBuckets,
+		}, metricsLabels)
+)
+
+/*****************************************************************************/
+
+/*
+ * Register the metrics with the controller-runtime registry.
+ */
+
+func init() {
+	metrics.Registry.MustRegister(
+		desiredReplicasGauge,
+		actualReplicasGauge,
+		seedJobDuration,
+		seedJobFailures,
+		replicaAddDuration,
+		replicaRemoveDuration,
+		execFailures,
+		proxyRestarts,
+		inProgressDuration,
+	)
+}
+
+/*****************************************************************************/
+
+/*
+ * The following function will return the metric label values for the
+ * document which is being processed, along with any additional values.
+ */
+
+func metricsLabelValues(h *RequestHandle, extras ...string) []string {
+	return append([]string{h.req.Namespace, h.req.Name}, extras...)
+}
+
+/*****************************************************************************/
+
+/*
+ * The following function will return the result label value for the supplied
+ * error.
+ */
+
+func metricsResult(err error) string {
+	if err != nil {
+		return "failure"
+	}
+
+	return "success"
+}
+
+/*****************************************************************************/
+
+/*
+ * The following function is used to update the replica count metrics.
+ */
+
+func (r *IBMSecurityVerifyDirectoryReconciler) updateReplicaMetrics(
+			h      *RequestHandle,
+			actual int) {
+
+	desiredReplicasGauge.WithLabelValues(metricsLabelValues(h)...).Set(
+				float64(len(h.directory.Spec.Replicas.PVCs)))
+
+	actualReplicasGauge.WithLabelValues(metricsLabelValues(h)...).Set(
+				float64(actual))
+}
+
+/*****************************************************************************/
+
+/*
+ * The following function is used to remove the metrics of a document which
+ * has been deleted.  Only the gauges are removed, as the counters and
+ * histograms are required to retain their history.
+ */
+
+func (r *IBMSecurityVerifyDirectoryReconciler) deleteReplicaMetrics(
+			req ctrl.Request) {
+
+	desiredReplicasGauge.DeleteLabelValues(req.Namespace, req.Name)
+	actualReplicasGauge.DeleteLabelValues(req.Namespace, req.Name)
+}
+
+/*****************************************************************************/
+
+/*
+ * The following function is used to record the start of the seed job for
+ * a replica.
+ */
+
+func (r *IBMSecurityVerifyDirectoryReconciler) seedJobStarted(
+			h          *RequestHandle,
+			replicaPvc string) {
+
+	if h.seedJobStartTimes == nil {
+		h.seedJobStartTimes = make(map[string]time.Time)
+	}
+
+	h.seedJobStartTimes[replicaPvc] = time.Now()
+}
+
+/*****************************************************************************/
+
+/*
+ * The following function is used to record the completion, or failure, of
+ * the seed job for a replica.
+ */
+
+func (r *IBMSecurityVerifyDirectoryReconciler) seedJobFinished(
+			h          *RequestHandle,
+			replicaPvc string,
+			err        error) {
+
+	if err != nil {
+		seedJobFailures.WithLabelValues(metricsLabelValues(h)...).Inc()
+	}
+
+	if started, ok := h.seedJobStartTimes[replicaPvc]; ok {
+		seedJobDuration.WithLabelValues(metricsLabelValues(h)...).Observe(
+					time.Since(started).Seconds())
+
+		delete(h.seedJobStartTimes, replicaPvc)
+	}
+}
+
+/*****************************************************************************/
+
+/*
+ * The following function is used to record the time for which the
+ * deployment was in progress.  It is called whenever the Progressing
+ * condition is cleared, but the time is only recorded if a change to the
+ * deployment was being processed.
+ */
+
+func (r *IBMSecurityVerifyDirectoryReconciler) inProgressFinished(
+			h *RequestHandle) {
+
+	if h.inProgressSince.IsZero() {
+		return
+	}
+
+	inProgressDuration.WithLabelValues(metricsLabelValues(h)...).Observe(
+					time.Since(h.inProgressSince).Seconds())
+
+	h.inProgressSince = time.Time{}
+}
+
+/*****************************************************************************/
+
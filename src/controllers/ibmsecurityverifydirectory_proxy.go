@@ -19,13 +19,12 @@ import (
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 
 	"bytes"
-	"errors"
 	"fmt"
 	"reflect"
 	"strings"
 	"time"
 
-	"github.com/go-yaml/yaml"
+	"github.com/ibm-security/verify-directory-operator/ldapconfig"
 	"github.com/ibm-security/verify-directory-operator/utils"
 
 	k8syaml "sigs.k8s.io/yaml"
@@ -36,7 +35,8 @@ import (
 	k8serrors "k8s.io/apimachinery/pkg/api/errors"
 
 	"k8s.io/apimachinery/pkg/types"
-	"k8s.io/apimachinery/pkg/util/intstr"
+
+	ibmv1 "github.com/ibm-security/verify-directory-operator/api/v1"
 )
 
 /*****************************************************************************/
@@ -59,7 +59,17 @@ func (r *IBMSecurityVerifyDirectoryReconciler) deployProxy(
 	 * this would be a pain.
 	 */
 
-	json, port, err := r.getProxyJson(h)
+	json, ldapPort, ldapsPort, err := r.getProxyJson(h)
+
+	if err != nil {
+		return err
+	}
+
+	/*
+	 * Add the certificates which are issued by cert-manager.
+	 */
+
+	json, err = r.addProxyTLSConfig(h, json)
 
 	if err != nil {
 		return err
@@ -89,7 +99,8 @@ func (r *IBMSecurityVerifyDirectoryReconciler) deployProxy(
 	 * We now want to create/restart the proxy.
 	 */
 
-	err = r.createProxyDeployment(h, port, updated)
+	err = r.createProxyDeployment(
+					h, ldapPort, ldapsPort, updated || h.restartProxy)
 
 	if err != nil {
 		return err
@@ -106,7 +117,8 @@ func (r *IBMSecurityVerifyDirectoryReconciler) deployProxy(
  */
 
 func (r *IBMSecurityVerifyDirectoryReconciler) getProxyJson(
-			h *RequestHandle) (json string, port int32, err error) {
+			h *RequestHandle) (
+				json string, ldapPort int32, ldapsPort int32, err error) {
 
 	r.Log.V(1).Info("Entering a function", 
 				r.createLogParams(h, "Function", "getProxyJson")...)
@@ -152,21 +164,12 @@ func (r *IBMSecurityVerifyDirectoryReconciler) getProxyJson(
 				r.createLogParams(h, "Name", name, "Key", key, "Data", json)...)
 
 	/*
-	 * Determine the port which will be used by the proxy.
+	 * Parse the YAML configuration into a map.
 	 */
 
-	port = 9389
-
-	/*
-	 * Parse the YAML configuration into a map.  Unfortunately it is not
-	 * easy to parse YAML into a generic structure, and so after we have
-	 * unmarshalled the data we want to iteratively convert the data into 
-	 * a map of strings.
-	 */
+	body, err := ldapconfig.Parse(config.Data[key])
 
-	var body interface{}
-
-	if err = yaml.Unmarshal([]byte(config.Data[key]), &body); err != nil {
+	if err != nil {
  		r.Log.Error(err, "Failed to load the ConfigMap data",
 						r.createLogParams(h, "ConfigMap.Name", name,
 								"ConfigMap.Key", key)...)
@@ -174,63 +177,36 @@ func (r *IBMSecurityVerifyDirectoryReconciler) getProxyJson(
 		return 
 	}
 
-	body      = utils.ConvertYaml(body)
-	body, ok := body.(map[string]interface{})
+	/*
+	 * Ensure that each of the secrets referenced by the configuration can
+	 * be resolved.
+	 */
 
-	if ! ok {
-		err = errors.New("The server configuration cannot be parsed.")
+	err = r.validateSecretReferences(h, body, 
+						h.directory.Spec.Pods.ConfigMap.Proxy,
+						ibmv1.ConditionProxySecretsResolved)
 
+	if err != nil {
 		return
 	}
 
-	ldap := utils.GetYamlValue(body, []string{"general","ports","ldap"}, 
-						true, h.directory.Namespace)
-
-	r.Log.V(1).Info("Retrieved the proxy LDAP port configuration.", 
-				r.createLogParams(h, "Port", ldap)...)
-
-	if ldap != nil {
-		iport, ok := ldap.(int)
-
-		if ! ok {
-			err = errors.New(
-						"The general.ports.ldap configuration is incorrect.")
-
-			return
-		}
-
-		port = int32(iport)
-
-		if port == 0 {
-			/*
-			 * If the port is 0 it means that it has not been activated and
-			 * so we need to use the ldaps port.
-			 */
-
-			port = 9636
-
-			ldaps := utils.GetYamlValue(
-							body, []string{"general","ports","ldaps"}, 
-							true, h.directory.Namespace)
-
-			r.Log.V(1).Info("Retrieved the proxy LDAPS port configuration.", 
-				r.createLogParams(h, "Port", ldaps)...)
-
-			if ldaps != nil {
-				iport, ok := ldaps.(int)
+	/*
+	 * Determine the ports which will be used by the proxy.
+	 */
 
-				if ! ok {
-					err = errors.New(
-						"The general.ports.ldaps configuration is incorrect.")
+	ports, err := ldapconfig.GetPorts(body, r.getResolveContext(h))
 
-					return
-				}
+	if err != nil {
+ 		r.Log.Error(err, "Failed to process the ConfigMap data",
+						r.createLogParams(h, "ConfigMap.Name", name,
+								"ConfigMap.Key", key)...)
 
-				port = int32(iport)
-			}
-		}
+		return
 	}
 
+	ldapPort  = ports.LDAP
+	ldapsPort = ports.LDAPS
+
 	return
 }
 
@@ -266,12 +242,14 @@ func (r *IBMSecurityVerifyDirectoryReconciler) constructProxyYaml(
 	json = json[0:closingIdx]
 
 	/*
-	 * Create a slice which contains each of the replica names.
+	 * Create a slice which contains each of the replica names.  The proxy
+	 * uses the first server of each suffix as the primary write server, and
+	 * so the replicas are listed with the primary write server first.
 	 */
 
 	var names []string
 
-	for _, pvcName := range h.directory.Spec.Replicas.PVCs {
+	for _, pvcName := range r.getProxyServerOrder(h) {
 		names = append(names, r.getReplicaPodName(h.directory, pvcName))
 	}
 	
@@ -341,7 +319,7 @@ func (r *IBMSecurityVerifyDirectoryReconciler) constructProxyYaml(
 
 	var prefix string
 
-	if h.config.secure {
+	if h.config.backendSecure {
 		prefix = "ldaps"
 	} else {
 		prefix = "ldap"
@@ -351,7 +329,9 @@ func (r *IBMSecurityVerifyDirectoryReconciler) constructProxyYaml(
 
 	serverGroups.WriteString("[ { \"name\": \"proxy\", \"servers\": [")
 
-	for idx, pod := range names {
+	for idx, pvcName := range r.getProxyServerOrder(h) {
+		pod := r.getReplicaPodName(h.directory, pvcName)
+
 		r.Log.V(1).Info("Adding a server to the proxy configuration.", 
 				r.createLogParams(h, "Pod", pod)...)
 
@@ -362,8 +342,8 @@ func (r *IBMSecurityVerifyDirectoryReconciler) constructProxyYaml(
 		entry := fmt.Sprintf(
 			"{ \"name\": \"%s\", \"id\": \"%s\", \"target\": \"%s://%s:%d\", " +
 			"\"user\": { \"dn\": \"%s\", \"password\": \"%s\" } }", 
-			pod, pod, prefix, pod, h.config.port, 
-			h.config.adminDn, h.config.adminPwd)
+			pod, pod, prefix, pod, h.config.backendPort, 
+			h.config.adminDn, r.getBackendPassword(h, pvcName))
 
 		serverGroups.WriteString(entry)
 	}
@@ -468,6 +448,12 @@ func (r *IBMSecurityVerifyDirectoryReconciler) saveProxyConfig(
 		return
 	}
 
+	r.recordEvent(h, corev1.EventTypeNormal, "ProxyConfigUpdated",
+			h.directory.Spec.Pods.Proxy.PVC, 
+			utils.GetProxyDeploymentName(h.directory.Name),
+			fmt.Sprintf("The proxy configuration, %s, has been regenerated.",
+				name))
+
 	return
 }
 
@@ -479,16 +465,28 @@ func (r *IBMSecurityVerifyDirectoryReconciler) saveProxyConfig(
  */
 
 func (r *IBMSecurityVerifyDirectoryReconciler) createProxyDeployment(
-			h       *RequestHandle,
-			port    int32,
-			updated bool) (err error) {
+			h         *RequestHandle,
+			ldapPort  int32,
+			ldapsPort int32,
+			updated   bool) (err error) {
 
 	r.Log.V(1).Info("Entering a function", 
 				r.createLogParams(h, "Function", "createProxyDeployment",
-						"Port", port, "Updated", updated)...)
+						"LDAP.Port", ldapPort, "LDAPS.Port", ldapsPort,
+						"Updated", updated)...)
 
 	name := utils.GetProxyDeploymentName(h.directory.Name)
 
+	/*
+	 * Request the certificate for the proxy service.
+	 */
+
+	err = r.ensureCertificate(h, name, name)
+
+	if err != nil {
+		return
+	}
+
 	/*
 	 * Check to see whether the pod already exists.
 	 */
@@ -520,14 +518,10 @@ func (r *IBMSecurityVerifyDirectoryReconciler) createProxyDeployment(
 					h.directory.Spec.Pods.Image.Label)
 
 	/*
-	 * The port which is exported by the deployment.
+	 * The ports which are exported by the deployment.
 	 */
 
-	ports := []corev1.ContainerPort {{
-		Name:          "ldap",
-		ContainerPort: port,
-		Protocol:      corev1.ProtocolTCP,
-	}}
+	ports := r.getContainerPorts(ldapPort, ldapsPort)
 
 	/*
 	 * The volume configuration.
@@ -579,6 +573,11 @@ func (r *IBMSecurityVerifyDirectoryReconciler) createProxyDeployment(
 		})
 	}
 
+	tlsVolumes, tlsMounts := r.getTLSVolumes(h, name)
+
+	volumes      = append(volumes, tlsVolumes...)
+	volumeMounts = append(volumeMounts, tlsMounts...)
+
 	/*
 	 * Set up the environment variables.
 	 */
@@ -590,6 +589,8 @@ func (r *IBMSecurityVerifyDirectoryReconciler) createProxyDeployment(
 		},
 	)
 
+	env = append(env, r.getCredentialsEnv(h, false)...)
+
 	/*
 	 * The liveness, and readiness probe definitions.
 	 */
@@ -629,15 +630,30 @@ func (r *IBMSecurityVerifyDirectoryReconciler) createProxyDeployment(
 	}
 
 	/*
-	 * Finalise the deployment definition.
+	 * Record the revision of the certificate in the pod template so that
+	 * the deployment is rolled out again when the certificate is renewed.
 	 */
 
-	var replicas int32 = 1
+	var annotations map[string]string
 
-	if h.directory.Spec.Pods.Proxy.Replicas > 0 {
-		replicas = h.directory.Spec.Pods.Proxy.Replicas
+	revision, err := r.getCertificateRevision(h, name)
+
+	if err != nil {
+		return
 	}
 
+	if revision != "" {
+		annotations = map[string]string {
+			utils.TLSRevisionAnnotation: revision,
+		}
+	}
+
+	/*
+	 * Finalise the deployment definition.
+	 */
+
+	replicas := h.directory.Spec.Pods.Proxy.Replicas
+
 	dep := &appsv1.Deployment{
 		ObjectMeta: metav1.ObjectMeta{
 			Name:      name,
@@ -651,7 +667,8 @@ func (r *IBMSecurityVerifyDirectoryReconciler) createProxyDeployment(
 			},
 			Template: corev1.PodTemplateSpec{
 				ObjectMeta: metav1.ObjectMeta{
-					Labels: labels,
+					Labels:      labels,
+					Annotations: annotations,
 				},
 				Spec: corev1.PodSpec{
 					Volumes:            volumes,
@@ -729,8 +746,18 @@ func (r *IBMSecurityVerifyDirectoryReconciler) createProxyDeployment(
 				r.Log.Error(err, "Failed to restart the proxy deployment",
 					r.createLogParams(h, "Deployment.Name", name)...)
 
+				r.recordEvent(h, corev1.EventTypeWarning, "ProxyRestartFailed",
+					h.directory.Spec.Pods.Proxy.PVC, name,
+					"Failed to restart the proxy deployment.")
+
 				return
 			}
+
+			proxyRestarts.WithLabelValues(metricsLabelValues(h)...).Inc()
+
+			r.recordEvent(h, corev1.EventTypeNormal, "ProxyRestarted",
+					h.directory.Spec.Pods.Proxy.PVC, name,
+					"The proxy deployment has been restarted.")
 		}
 
 	} else {
@@ -754,54 +781,15 @@ func (r *IBMSecurityVerifyDirectoryReconciler) createProxyDeployment(
 
 			return 
 		}
+	}
 
-		/*
-		 * Create the cluster service for the proxy.
-		 */
-
-
-		service := &corev1.Service{
-			ObjectMeta: metav1.ObjectMeta{
-				Name:      name,
-				Namespace: h.directory.Namespace,
-				Labels:    labels,
-			},
-			Spec: corev1.ServiceSpec{
-				Type:     corev1.ServiceTypeClusterIP,
-				Selector: labels,
-				Ports:    []corev1.ServicePort{{
-					Name:       name,
-					Protocol:   corev1.ProtocolTCP,
-					Port:       port,
-					TargetPort: intstr.IntOrString {
-						Type:   intstr.Int,
-						IntVal: port,
-					},
-				}},
-			},
-		}
-
-		ctrl.SetControllerReference(h.directory, service, r.Scheme)
-
-		/*
-		 * Create the service.
-		 */
-
-		r.Log.Info("Creating a new service for the proxy", 
-				r.createLogParams(h, "Deployment.Name", name)...)
-
-		r.Log.V(1).Info("Proxy service details.", 
-				r.createLogParams(h, "Service", service)...)
-
-		err := r.Create(h.ctx, service)
-
-		if err != nil {
-			r.Log.Error(err, "Failed to create the service for the proxy",
-				r.createLogParams(h, "Deployment.Name", name)...)
+	/*
+	 * Create the cluster service for the proxy, or update the ports of the
+	 * existing service.
+	 */
 
-			return err
-		}
-	}
+	err = r.ensureService(h, name, labels,
+						r.getServicePorts(ldapPort, ldapsPort))
 
 	return
 }
@@ -0,0 +1,319 @@
+/* vi: set ts=4 sw=4 noexpandtab : */
+
+/*
+ * Copyright contributors to the IBM Security Verify Directory Operator project
+ */
+
+package controllers
+
+/*
+ * This file contains the functions which are used by the controller to
+ * initialize the principal replica of a new environment from a backup.
+ */
+
+/*****************************************************************************/
+
+import (
+	metav1  "k8s.io/apimachinery/pkg/apis/meta/v1"
+	corev1  "k8s.io/api/core/v1"
+
+	"errors"
+	"fmt"
+
+	"k8s.io/apimachinery/pkg/types"
+
+	ibmv1 "github.com/ibm-security/verify-directory-operator/api/v1"
+)
+
+/*****************************************************************************/
+
+/*
+ * The script which is used to restore a database backup into the data
+ * volume of the principal, before the principal is started.  The data
+ * volume is only ever cleared if it is empty, or if it holds the marker of
+ * a restore which did not complete, so that existing data is never lost.
+ */
+
+const restoreDatabaseScript = `set -e
+
+if [ ! -f "${BACKUP_FILE}" ] ; then
+    echo "The backup file, ${BACKUP_FILE}, does not exist." | \
+        tee /dev/termination-log
+    exit 1
+fi
+
+marker=/var/isvd/data/.isvd-restore
+
+if [ ! -f ${marker} ] ; then
+    if [ -n "$(find /var/isvd/data -mindepth 1 -maxdepth 1 \
+                    ! -name lost+found | head -1)" ] ; then
+        echo "The data volume already contains data." | \
+            tee /dev/termination-log
+        exit 1
+    fi
+
+    touch ${marker}
+fi
+
+find /var/isvd/data -mindepth 1 ! -path ${marker} -delete
+
+tar -xzf "${BACKUP_FILE}" -C /var/isvd/data
+
+rm -f ${marker}
+`
+
+/*
+ * The script which is used to import an LDIF backup into the principal,
+ * once the principal has been started.  The suffix entries will already
+ * exist in the principal and so 'already exists' errors are ignored.
+ */
+
+const restoreLdifScript = `if [ ! -f "${BACKUP_FILE}" ] ; then
+    echo "The backup file, ${BACKUP_FILE}, does not exist." | \
+        tee /dev/termination-log
+    exit 1
+fi
+
+idsldapadd -h "${LDAP_HOST}" -p "${LDAP_PORT}" \
+    -D "${LDAP_ADMIN_DN}" -w "${LDAP_ADMIN_PWD}" -c -f "${BACKUP_FILE}"
+
+rc=$?
+
+if [ ${rc} -ne 0 -a ${rc} -ne 68 ] ; then
+    exit ${rc}
+fi
+`
+
+/*****************************************************************************/
+
+/*
+ * The following structure is used to hold the details of the backup which
+ * is to be restored.
+ */
+
+type RestoreSource struct {
+	backup string
+	record ibmv1.IBMSecurityVerifyDirectoryBackupRecord
+	pvc    string
+}
+
+/*****************************************************************************/
+
+/*
+ * The following function will return the backup which is to be restored
+ * into the principal.  A nil source is returned if no backup has been
+ * requested, or if the backup has already been restored.
+ */
+
+func (r *IBMSecurityVerifyDirectoryReconciler) getRestoreSource(
+			h *RequestHandle) (source *RestoreSource, err error) {
+
+	r.Log.V(1).Info("Entering a function",
+				r.createLogParams(h, "Function", "getRestoreSource")...)
+
+	restoreFrom := h.directory.Spec.RestoreFrom
+
+	if restoreFrom == nil || h.directory.Status.Restore != nil {
+		return
+	}
+
+	/*
+	 * Retrieve the backup document.
+	 */
+
+	backup := &ibmv1.IBMSecurityVerifyDirectoryBackup{}
+	err     = r.Get(h.ctx, types.NamespacedName{
+						Namespace: h.directory.Namespace,
+						Name:      restoreFrom.Backup,
+					}, backup)
+
+	if err != nil {
+ 		r.Log.Error(err, "Failed to retrieve the backup",
+					r.createLogParams(h, "Backup.Name", restoreFrom.Backup)...)
+
+		return
+	}
+
+	/*
+	 * Locate the backup which is to be restored.  The backups are held
+	 * in the status of the document, newest first.
+	 */
+
+	for _, record := range backup.Status.Backups {
+		if restoreFrom.Name != "" && record.Name != restoreFrom.Name {
+			continue
+		}
+
+		if record.Phase != BackupPhaseCompleted {
+			if restoreFrom.Name == "" {
+				continue
+			}
+
+			err = errors.New(fmt.Sprintf(
+				"The backup, %s, has not completed.", record.Name))
+
+			return
+		}
+
+		source = &RestoreSource{
+			backup: backup.Name,
+			record: record,
+			pvc:    backup.Spec.TargetPVC,
+		}
+
+		if source.record.Format == "" {
+			source.record.Format = "database"
+		}
+
+		r.Log.Info("Restoring the principal from a backup",
+				r.createLogParams(h, "Backup.Name", backup.Name,
+							"Backup.Record", record.Name)...)
+
+		return
+	}
+
+	err = errors.New(fmt.Sprintf(
+				"No completed backup is available from the backup, %s.",
+				backup.Name))
+
+	return
+}
+
+/*****************************************************************************/
+
+/*
+ * The following function is used to restore the backup into the principal.
+ * A database backup must be restored before the principal is started, and
+ * an LDIF backup must be restored once the principal has been started.
+ */
+
+func (r *IBMSecurityVerifyDirectoryReconciler) restoreReplica(
+			h       *RequestHandle,
+			pvcName string,
+			source  *RestoreSource,
+			started bool) (err error) {
+
+	if source == nil || (source.record.Format == "ldif") != started {
+		return
+	}
+
+	r.Log.V(1).Info("Entering a function",
+				r.createLogParams(h, "Function", "restoreReplica",
+						"PVC.Name", pvcName, "Started", started)...)
+
+	/*
+	 * The volume configuration.
+	 */
+
+	volumes := []corev1.Volume {
+		{
+			Name: "isvd-backup",
+			VolumeSource: corev1.VolumeSource{
+				PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{
+					ClaimName: source.pvc,
+					ReadOnly:  true,
+				},
+			},
+		},
+	}
+
+	volumeMounts := []corev1.VolumeMount {
+		{
+			Name:      "isvd-backup",
+			MountPath: BackupMountPath,
+			ReadOnly:  true,
+		},
+	}
+
+	/*
+	 * Set up the environment variables.
+	 */
+
+	env := append([]corev1.EnvVar{}, h.directory.Spec.Pods.Env...)
+
+	script := restoreDatabaseScript
+	file   := "backup.tar.gz"
+
+	if started {
+		var ldapEnv []corev1.EnvVar
+
+		ldapEnv, err = r.getLdapClientEnv(h, pvcName)
+
+		if err != nil {
+			return
+		}
+
+		env    = append(env, ldapEnv...)
+		script = restoreLdifScript
+		file   = "backup.ldif"
+	} else {
+		volumes = append(volumes, corev1.Volume {
+			Name: "isvd-data",
+			VolumeSource: corev1.VolumeSource{
+				PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{
+					ClaimName: pvcName,
+					ReadOnly:  false,
+				},
+			},
+		})
+
+		volumeMounts = append(volumeMounts, corev1.VolumeMount {
+			Name:      "isvd-data",
+			MountPath: "/var/isvd/data",
+		})
+	}
+
+	env = append(env, corev1.EnvVar {
+		Name:  "BACKUP_FILE",
+		Value: fmt.Sprintf("%s/%s/%s/%s", BackupMountPath, source.backup,
+						source.record.Name, file),
+	})
+
+	/*
+	 * Run the restore job.
+	 */
+
+	err = r.runServerJob(h, pvcName, r.getRestoreJobName(h.directory, pvcName),
+					script, env, volumes, volumeMounts, nil)
+
+	return
+}
+
+/*****************************************************************************/
+
+/*
+ * The following function is used to record the backup which was restored
+ * into the principal, so that the backup is never restored again.
+ */
+
+func (r *IBMSecurityVerifyDirectoryReconciler) setRestoreStatus(
+			h       *RequestHandle,
+			pvcName string,
+			source  *RestoreSource) (err error) {
+
+	if source == nil {
+		return
+	}
+
+	now := metav1.Now()
+
+	h.directory.Status.Restore = &ibmv1.IBMSecurityVerifyDirectoryRestoreStatus{
+		Backup:         source.backup,
+		Name:           source.record.Name,
+		Format:         source.record.Format,
+		Replica:        pvcName,
+		CompletionTime: &now,
+	}
+
+	err = r.Status().Update(h.ctx, h.directory)
+
+	if err != nil {
+		r.Log.Error(err, "Failed to update the restore status",
+						r.createLogParams(h)...)
+	}
+
+	return
+}
+
+/*****************************************************************************/
+
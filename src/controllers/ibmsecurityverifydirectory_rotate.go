@@ -0,0 +1,766 @@
+/* vi: set ts=4 sw=4 noexpandtab : */
+
+/*
+ * Copyright contributors to the IBM Security Verify Directory Operator project
+ */
+
+package controllers
+
+/*
+ * This file contains the functions which are used by the controller to
+ * rotate the admin and replication credentials which are generated by the
+ * operator.
+ */
+
+/*****************************************************************************/
+
+import (
+	corev1  "k8s.io/api/core/v1"
+	metav1  "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"fmt"
+
+	"github.com/go-ldap/ldap/v3"
+	"github.com/ibm-security/verify-directory-operator/utils"
+
+	"k8s.io/apimachinery/pkg/types"
+
+	ibmv1 "github.com/ibm-security/verify-directory-operator/api/v1"
+)
+
+/*****************************************************************************/
+
+/*
+ * The phases of a credential rotation.
+ */
+
+const RotationInProgress = "InProgress"
+const RotationCompleted  = "Completed"
+const RotationRolledBack = "RolledBack"
+
+/*
+ * The attribute of a replication agreement which references the credentials
+ * object used by the supplier.
+ */
+
+const replicaCredentialsAttribute = "ibm-replicaCredentialsDN"
+
+/*****************************************************************************/
+
+/*
+ * The following function is used to determine whether a rotation of the
+ * generated credentials is pending, i.e. whether the rotation annotation
+ * has changed, or whether the credentials within the secret no longer match
+ * the credentials which have been applied to the replicas.  Neither of
+ * these changes the generation of the document, and so this is used to
+ * process a rotation request for a document which is otherwise left alone.
+ */
+
+func (r *IBMSecurityVerifyDirectoryReconciler) isRotationPending(
+			h *RequestHandle) (pending bool) {
+
+	if ! h.directory.Spec.Credentials.Generate {
+		return
+	}
+
+	status  := h.directory.Status.CredentialRotation
+	request := h.directory.Annotations[utils.RotateCredentialsAnnotation]
+
+	if request != "" && (status == nil || request != status.LastRequest) {
+		return true
+	}
+
+	name := r.getCredentialsSecretName(h)
+
+	secret := &corev1.Secret{}
+	err    := r.Get(h.ctx,
+					types.NamespacedName{
+						Name:	   name,
+						Namespace: h.directory.Namespace }, secret)
+
+	if err != nil {
+		r.Log.V(1).Info("Failed to retrieve the credentials secret",
+			r.createLogParams(h, "Secret.Name", name, 
+						"Error", err.Error())...)
+
+		return
+	}
+
+	pending = ! bytes.Equal(secret.Data[utils.AdminPwdKey],
+					secret.Data[utils.AppliedAdminPwdKey]) ||
+			! bytes.Equal(secret.Data[utils.ReplicationPwdKey],
+					secret.Data[utils.AppliedReplicationPwdKey])
+
+	return
+}
+
+/*****************************************************************************/
+
+/*
+ * The following function is used to rotate the generated credentials.  A
+ * rotation is triggered when the rotation annotation changes, in which case
+ * new credentials are generated, or when the credentials within the secret
+ * no longer match the credentials which have been applied to the replicas.
+ *
+ * Each replica is restarted, one at a time, with the new credentials and
+ * we then make sure that we can bind to the replica.  The proxy is rolled
+ * after each restart so that it uses the new admin credentials for the
+ * restarted replica, and the original admin credentials for the remaining
+ * replicas.  If the bind fails the original credentials are restored.  Once
+ * all of the replicas have been restarted the replication credentials which
+ * are used by the replication agreements are updated in place, so that any
+ * changes which were queued during the rotation are then replicated.
+ */
+
+func (r *IBMSecurityVerifyDirectoryReconciler) rotateCredentials(
+			h        *RequestHandle,
+			existing map[string]string) (err error) {
+
+	r.Log.V(1).Info("Entering a function",
+				r.createLogParams(h, "Function", "rotateCredentials")...)
+
+	if ! h.directory.Spec.Credentials.Generate {
+		return
+	}
+
+	name := r.getCredentialsSecretName(h)
+
+	secret := &corev1.Secret{}
+	err     = r.Get(h.ctx,
+					types.NamespacedName{
+						Name:	   name,
+						Namespace: h.directory.Namespace }, secret)
+
+	if err != nil {
+ 		r.Log.Error(err, "Failed to retrieve the credentials secret",
+			r.createLogParams(h, "Secret.Name", name)...)
+
+		return
+	}
+
+	/*
+	 * Work out whether a rotation has been requested via the annotation.  If
+	 * it has we need to generate the new credentials.
+	 */
+
+	status  := h.directory.Status.CredentialRotation
+	request := h.directory.Annotations[utils.RotateCredentialsAnnotation]
+
+	if status == nil {
+		status = &ibmv1.IBMSecurityVerifyDirectoryRotationStatus{}
+	}
+
+	if request != "" && request != status.LastRequest {
+		r.Log.Info("A rotation of the credentials has been requested",
+				r.createLogParams(h, "Request", request)...)
+
+		for _, key := range []string{
+					utils.AdminPwdKey, utils.ReplicationPwdKey } {
+			var pwd string
+
+			pwd, err = r.generatePassword()
+
+			if err != nil {
+				r.Log.Error(err, "Failed to generate a password",
+					r.createLogParams(h, "Secret.Name", name,
+						"Secret.Key", key)...)
+
+				return
+			}
+
+			secret.Data[key] = []byte(pwd)
+		}
+
+		err = r.Update(h.ctx, secret)
+
+		if err != nil {
+	 		r.Log.Error(err, "Failed to save the credentials secret",
+				r.createLogParams(h, "Secret.Name", name)...)
+
+			return
+		}
+
+		status.LastRequest = request
+	}
+
+	/*
+	 * Check to see whether the credentials have changed.
+	 */
+
+	if bytes.Equal(secret.Data[utils.AdminPwdKey],
+					secret.Data[utils.AppliedAdminPwdKey]) &&
+			bytes.Equal(secret.Data[utils.ReplicationPwdKey],
+					secret.Data[utils.AppliedReplicationPwdKey]) {
+
+		if status.LastRequest != request {
+			status.LastRequest = request
+
+			err = r.setRotationStatus(h, status, status.Phase, status.Message)
+		}
+
+		return
+	}
+
+	r.Log.Info("Rotating the credentials",
+				r.createLogParams(h, "Secret.Name", name)...)
+
+	/*
+	 * Restart each of the replicas, one at a time, with the new
+	 * credentials.  We process the replicas in the order in which they
+	 * are defined in the document.
+	 */
+
+	status.UpdatedReplicas = nil
+
+	err = r.setRotationStatus(h, status, RotationInProgress,
+				"The replicas are being restarted with the new credentials.")
+
+	if err != nil {
+		return
+	}
+
+	adminPwd := string(secret.Data[utils.AdminPwdKey])
+
+	for _, pvcName := range r.getOrderedReplicas(h, existing) {
+		err = r.restartReplica(h, pvcName)
+
+		if err == nil {
+			err = r.bindReplica(h, pvcName, adminPwd)
+		}
+
+		if err != nil {
+			return r.rollbackCredentials(h, secret, status,
+						append(status.UpdatedReplicas, pvcName), err, false)
+		}
+
+		status.UpdatedReplicas = append(status.UpdatedReplicas, pvcName)
+
+		err = r.setRotationStatus(h, status, RotationInProgress,
+				fmt.Sprintf("%d of %d replicas have been restarted with the " +
+					"new credentials.", len(status.UpdatedReplicas),
+					len(existing)))
+
+		if err != nil {
+			return
+		}
+
+		/*
+		 * Roll the proxy so that it will use the new admin credentials for 
+		 * the restarted replica.
+		 */
+
+		err = r.rollProxy(h)
+
+		if err != nil {
+			return r.rollbackCredentials(h, secret, status,
+						status.UpdatedReplicas, err, false)
+		}
+	}
+
+	/*
+	 * Update the replication credentials which are used by the replication
+	 * agreements.  Changes will have been queued by the suppliers while the 
+	 * replicas were being restarted, and will be replicated once the 
+	 * credentials have been updated.
+	 */
+
+	err = r.updateReplicationCredentials(h, existing,
+				adminPwd, string(secret.Data[utils.ReplicationPwdKey]))
+
+	if err != nil {
+		return r.rollbackCredentials(h, secret, status,
+						status.UpdatedReplicas, err, true)
+	}
+
+	/*
+	 * Record the new credentials as having been applied.
+	 */
+
+	secret.Data[utils.AppliedAdminPwdKey] = secret.Data[utils.AdminPwdKey]
+	secret.Data[utils.AppliedReplicationPwdKey] =
+									secret.Data[utils.ReplicationPwdKey]
+
+	err = r.Update(h.ctx, secret)
+
+	if err != nil {
+ 		r.Log.Error(err, "Failed to save the credentials secret",
+			r.createLogParams(h, "Secret.Name", name)...)
+
+		return
+	}
+
+	/*
+	 * The proxy has already been rolled with the new credentials for each
+	 * of the replicas.
+	 */
+
+	status.UpdatedReplicas = nil
+
+	r.Log.Info("Rotated the credentials",
+				r.createLogParams(h, "Secret.Name", name)...)
+
+	return r.setRotationStatus(h, status, RotationCompleted,
+				"The credentials have been rotated.")
+}
+
+/*****************************************************************************/
+
+/*
+ * The following function is used to roll back a failed rotation.  The
+ * original credentials are restored to the secret, the replicas which have
+ * already been restarted are restarted again and the proxy is rolled.  If
+ * the replication credentials have already been updated they are also
+ * restored.
+ */
+
+func (r *IBMSecurityVerifyDirectoryReconciler) rollbackCredentials(
+			h           *RequestHandle,
+			secret      *corev1.Secret,
+			status      *ibmv1.IBMSecurityVerifyDirectoryRotationStatus,
+			replicas    []string,
+			cause       error,
+			replication bool) (err error) {
+
+	r.Log.Error(cause, "Failed to rotate the credentials, rolling back",
+				r.createLogParams(h, "Replicas", replicas)...)
+
+	/*
+	 * Restore the original credentials.
+	 */
+
+	secret.Data[utils.AdminPwdKey]       = secret.Data[utils.AppliedAdminPwdKey]
+	secret.Data[utils.ReplicationPwdKey] =
+								secret.Data[utils.AppliedReplicationPwdKey]
+
+	err = r.Update(h.ctx, secret)
+
+	if err != nil {
+ 		r.Log.Error(err, "Failed to restore the credentials secret",
+			r.createLogParams(h, "Secret.Name", secret.Name)...)
+
+		return
+	}
+
+	/*
+	 * Restart the replicas which have been updated.
+	 */
+
+	for _, pvcName := range replicas {
+		err = r.restartReplica(h, pvcName)
+
+		if err != nil {
+			return
+		}
+	}
+
+	/*
+	 * Restore the replication credentials.
+	 */
+
+	if replication {
+		err = r.updateReplicationCredentials(h, r.getReplicaMap(h, replicas),
+				string(secret.Data[utils.AdminPwdKey]),
+				string(secret.Data[utils.ReplicationPwdKey]))
+
+		if err != nil {
+			return
+		}
+	}
+
+	/*
+	 * Roll the proxy so that it will once again use the original admin
+	 * credentials for each of the replicas.
+	 */
+
+	status.UpdatedReplicas = nil
+
+	if len(replicas) > 0 {
+		h.directory.Status.CredentialRotation = status
+
+		err = r.rollProxy(h)
+
+		if err != nil {
+			return
+		}
+	}
+
+	/*
+	 * The deployment is still healthy and so we don't return an error,
+	 * but we do record the failure in the status of the rotation.
+	 */
+
+	return r.setRotationStatus(h, status, RotationRolledBack,
+		fmt.Sprintf("The rotation of the credentials failed and the " +
+			"original credentials have been restored.  %s", cause.Error()))
+}
+
+/*****************************************************************************/
+
+/*
+ * The following function is used to restart a replica, waiting for the
+ * replica to become ready.
+ */
+
+func (r *IBMSecurityVerifyDirectoryReconciler) restartReplica(
+			h       *RequestHandle,
+			pvcName string) (err error) {
+
+	r.Log.Info("Restarting the replica",
+				r.createLogParams(h, "PVC.Name", pvcName)...)
+
+	err = r.deleteReplica(h, pvcName)
+
+	if err != nil {
+		return
+	}
+
+	pod, err := r.deployReplica(h, pvcName)
+
+	if err != nil {
+		return
+	}
+
+	err = r.createClusterService(h, pod, pvcName)
+
+	if err != nil {
+		return
+	}
+
+	return r.waitForPod(h, pod)
+}
+
+/*****************************************************************************/
+
+/*
+ * The following function is used to make sure that we can bind to a
+ * replica using the admin credentials.
+ */
+
+func (r *IBMSecurityVerifyDirectoryReconciler) bindReplica(
+			h        *RequestHandle,
+			pvcName  string,
+			adminPwd string) (err error) {
+
+	r.Log.V(1).Info("Binding to the replica",
+			r.createLogParams(h, "PVC.Name", pvcName, 
+					"DN", h.config.adminDn)...)
+
+	l, err := r.dialReplica(h, pvcName)
+
+	if err == nil {
+		defer l.Close()
+
+		err = l.Bind(h.config.adminDn, adminPwd)
+	}
+
+	if err != nil {
+		r.Log.Error(err, "Failed to bind to the replica",
+				r.createLogParams(h, "PVC.Name", pvcName)...)
+
+		err = errors.New(fmt.Sprintf("Failed to bind to the replica, %s, " +
+				"using the new credentials: %s", pvcName, err.Error()))
+	}
+
+	return
+}
+
+/*****************************************************************************/
+
+/*
+ * The following function is used to connect to a replica, using the backend
+ * port of the replica.
+ */
+
+func (r *IBMSecurityVerifyDirectoryReconciler) dialReplica(
+			h       *RequestHandle,
+			pvcName string) (l *ldap.Conn, err error) {
+
+	address := fmt.Sprintf("%s.%s.svc",
+				r.getReplicaPodName(h.directory, pvcName),
+				h.directory.Namespace)
+
+	r.Log.V(1).Info("Connecting to the replica",
+			r.createLogParams(h, "Address", address,
+					"Port", h.config.backendPort)...)
+
+	if h.config.backendSecure {
+		var tlsConfig *tls.Config
+
+		tlsConfig, err = r.getTLSConfig(h, address)
+
+		if err != nil {
+			return
+		}
+
+		l, err = ldap.DialURL(
+				fmt.Sprintf("ldaps://%s:%d", address, h.config.backendPort),
+				ldap.DialWithTLSConfig(tlsConfig))
+	} else {
+		l, err = ldap.DialURL(
+				fmt.Sprintf("ldap://%s:%d", address, h.config.backendPort))
+	}
+
+	return
+}
+
+/*****************************************************************************/
+
+/*
+ * The following function is used to update, in place, the replication
+ * credentials which are used by the replication agreements of each replica.
+ * The credentials object of each agreement is modified, rather than
+ * recreating the agreements, so that the changes which have been queued
+ * by the suppliers are retained.
+ */
+
+func (r *IBMSecurityVerifyDirectoryReconciler) updateReplicationCredentials(
+			h              *RequestHandle,
+			existing       map[string]string,
+			adminPwd       string,
+			replicationPwd string) (err error) {
+
+	r.Log.V(1).Info("Entering a function",
+			r.createLogParams(h, "Function", "updateReplicationCredentials")...)
+
+	for _, pvcName := range r.getOrderedReplicas(h, existing) {
+		err = r.updateReplicaCredentials(h, pvcName, adminPwd, replicationPwd)
+
+		if err != nil {
+			r.Log.Error(err, "Failed to update the replication credentials",
+				r.createLogParams(h, "PVC.Name", pvcName)...)
+
+			err = errors.New(fmt.Sprintf("Failed to update the replication " +
+					"credentials of the replica, %s: %s", pvcName, err.Error()))
+
+			return
+		}
+	}
+
+	return
+}
+
+/*****************************************************************************/
+
+/*
+ * The following function is used to update the replication credentials
+ * objects which are referenced by the replication agreements of a single
+ * replica.
+ */
+
+func (r *IBMSecurityVerifyDirectoryReconciler) updateReplicaCredentials(
+			h              *RequestHandle,
+			pvcName        string,
+			adminPwd       string,
+			replicationPwd string) (err error) {
+
+	r.Log.Info("Updating the replication credentials",
+			r.createLogParams(h, "PVC.Name", pvcName)...)
+
+	l, err := r.dialReplica(h, pvcName)
+
+	if err != nil {
+		return
+	}
+
+	defer l.Close()
+
+	err = l.Bind(h.config.adminDn, adminPwd)
+
+	if err != nil {
+		return
+	}
+
+	/*
+	 * Work out the credentials objects which are referenced by the
+	 * agreements of the replica.
+	 */
+
+	credentials := make(map[string]bool)
+
+	for _, suffix := range h.config.suffixes {
+		searchRequest := ldap.NewSearchRequest(
+			suffix,
+			ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 0, 0, false,
+			"(objectclass=ibm-replicationAgreement)",
+			[]string{ replicaCredentialsAttribute },
+			nil,
+		)
+
+		var sr *ldap.SearchResult
+
+		sr, err = l.Search(searchRequest)
+
+		if ldap.IsErrorWithCode(err, ldap.LDAPResultNoSuchObject) {
+			err = nil
+
+			continue
+		}
+
+		if err != nil {
+			return
+		}
+
+		for _, entry := range sr.Entries {
+			dn := entry.GetEqualFoldAttributeValue(replicaCredentialsAttribute)
+
+			if dn != "" {
+				credentials[dn] = true
+			}
+		}
+	}
+
+	/*
+	 * Update each of the credentials objects.
+	 */
+
+	for dn, _ := range credentials {
+		modifyRequest := ldap.NewModifyRequest(dn, nil)
+
+		modifyRequest.Replace("replicaCredentials", []string{ replicationPwd })
+
+		err = l.Modify(modifyRequest)
+
+		if err != nil {
+			return
+		}
+	}
+
+	return
+}
+
+/*****************************************************************************/
+
+/*
+ * The following function is used to regenerate the proxy configuration and
+ * roll the proxy, waiting for the roll out to complete.
+ */
+
+func (r *IBMSecurityVerifyDirectoryReconciler) rollProxy(
+			h *RequestHandle) (err error) {
+
+	h.restartProxy = true
+
+	err = r.deployProxy(h)
+
+	h.restartProxy = false
+
+	if err != nil {
+		return
+	}
+
+	return r.waitForProxyRollout(h)
+}
+
+/*****************************************************************************/
+
+/*
+ * The following function will return the admin password which the proxy is
+ * to use for the specified replica.  While the credentials are being rotated
+ * the replicas which have not yet been restarted still use the original
+ * admin password.
+ */
+
+func (r *IBMSecurityVerifyDirectoryReconciler) getBackendPassword(
+			h       *RequestHandle,
+			pvcName string) (string) {
+
+	status := h.directory.Status.CredentialRotation
+
+	if ! h.directory.Spec.Credentials.Generate || status == nil ||
+				status.Phase != RotationInProgress ||
+				containsString(status.UpdatedReplicas, pvcName) {
+		return h.config.adminPwd
+	}
+
+	return fmt.Sprintf("secret:%s/%s",
+				r.getCredentialsSecretName(h), utils.AppliedAdminPwdKey)
+}
+
+/*****************************************************************************/
+
+/*
+ * The following function will return a map of the specified replicas, keyed
+ * on the PVC name.
+ */
+
+func (r *IBMSecurityVerifyDirectoryReconciler) getReplicaMap(
+			h        *RequestHandle,
+			pvcNames []string) (replicas map[string]string) {
+
+	replicas = make(map[string]string)
+
+	for _, pvcName := range pvcNames {
+		replicas[pvcName] = r.getReplicaPodName(h.directory, pvcName)
+	}
+
+	return
+}
+
+/*****************************************************************************/
+
+/*
+ * The following function will return the PVC names of the existing replicas,
+ * in the order in which they are defined in the document.  Any replicas which
+ * are no longer defined in the document are returned last.
+ */
+
+func (r *IBMSecurityVerifyDirectoryReconciler) getOrderedReplicas(
+			h        *RequestHandle,
+			existing map[string]string) (replicas []string) {
+
+	found := make(map[string]bool)
+
+	for _, pvcName := range h.directory.Spec.Replicas.PVCs {
+		if _, ok := existing[pvcName]; ok {
+			replicas        = append(replicas, pvcName)
+			found[pvcName]  = true
+		}
+	}
+
+	for pvcName, _ := range existing {
+		if ! found[pvcName] {
+			replicas = append(replicas, pvcName)
+		}
+	}
+
+	return
+}
+
+/*****************************************************************************/
+
+/*
+ * The following function is used to save the status of the rotation.
+ */
+
+func (r *IBMSecurityVerifyDirectoryReconciler) setRotationStatus(
+			h       *RequestHandle,
+			status  *ibmv1.IBMSecurityVerifyDirectoryRotationStatus,
+			phase   string,
+			message string) (err error) {
+
+	if status.Phase != phase || status.LastTransitionTime == nil {
+		now := metav1.Now()
+
+		status.LastTransitionTime = &now
+	}
+
+	status.Phase   = phase
+	status.Message = message
+
+	h.directory.Status.CredentialRotation = status
+
+	err = r.Status().Update(h.ctx, h.directory)
+
+	if err != nil {
+		r.Log.Error(err, "Failed to update the rotation status",
+						r.createLogParams(h)...)
+	}
+
+	return
+}
+
+/*****************************************************************************/
+
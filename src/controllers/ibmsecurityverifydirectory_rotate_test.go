@@ -0,0 +1,302 @@
+/* vi: set ts=4 sw=4 noexpandtab : */
+
+/*
+ * Copyright contributors to the IBM Security Verify Directory Operator project
+ */
+
+package controllers
+
+/*
+ * This file contains the tests for the rotation of the generated credentials.
+ */
+
+/*****************************************************************************/
+
+import (
+	corev1  "k8s.io/api/core/v1"
+	metav1  "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/go-logr/logr"
+	"github.com/ibm-security/verify-directory-operator/utils"
+
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	ibmv1 "github.com/ibm-security/verify-directory-operator/api/v1"
+)
+
+/*****************************************************************************/
+
+/*
+ * The following function will return a request handle, along with the
+ * reconciler, for a document which is in the middle of a rotation.
+ */
+
+func newRotationTestHandle(
+			t      *testing.T,
+			secret *corev1.Secret) (
+				r *IBMSecurityVerifyDirectoryReconciler, h *RequestHandle) {
+
+	scheme := runtime.NewScheme()
+
+	if err := clientgoscheme.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ibmv1.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+
+	directory := &ibmv1.IBMSecurityVerifyDirectory{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "isvd",
+			Namespace: "default",
+		},
+		Spec: ibmv1.IBMSecurityVerifyDirectorySpec{
+			Credentials: ibmv1.IBMSecurityVerifyDirectoryCredentials{
+				Generate: true,
+			},
+		},
+		Status: ibmv1.IBMSecurityVerifyDirectoryStatus{
+			CredentialRotation: &ibmv1.IBMSecurityVerifyDirectoryRotationStatus{
+				Phase:           RotationInProgress,
+				UpdatedReplicas: []string{ "replica-1" },
+			},
+		},
+	}
+
+	r = &IBMSecurityVerifyDirectoryReconciler{
+		Client: fake.NewClientBuilder().WithScheme(scheme).
+					WithObjects(directory, secret).Build(),
+		Log:    logr.Discard(),
+		Scheme: scheme,
+	}
+
+	h = &RequestHandle{
+		ctx:       context.TODO(),
+		req:       ctrl.Request{
+						NamespacedName: types.NamespacedName{
+							Namespace: directory.Namespace,
+							Name:      directory.Name,
+						},
+					},
+		directory: directory,
+		config:    ServerConfig{
+						adminPwd: "secret:isvd-credentials/admin_password",
+					},
+	}
+
+	return
+}
+
+/*****************************************************************************/
+
+/*
+ * Test the roll back of a rotation which failed before any of the replicas
+ * were successfully restarted.  The original credentials must be restored
+ * to the secret and the failure recorded in the status of the rotation.
+ */
+
+func TestRollbackCredentials(t *testing.T) {
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "isvd-credentials",
+			Namespace: "default",
+		},
+		Data: map[string][]byte{
+			utils.AdminPwdKey:              []byte("new-admin"),
+			utils.ReplicationPwdKey:        []byte("new-replication"),
+			utils.AppliedAdminPwdKey:       []byte("old-admin"),
+			utils.AppliedReplicationPwdKey: []byte("old-replication"),
+		},
+	}
+
+	r, h := newRotationTestHandle(t, secret)
+
+	status := h.directory.Status.CredentialRotation.DeepCopy()
+
+	err := r.rollbackCredentials(h, secret, status, nil,
+						errors.New("bind failed"), false)
+
+	if err != nil {
+		t.Fatalf("The roll back failed: %v", err)
+	}
+
+	/*
+	 * Check the secret.
+	 */
+
+	saved := &corev1.Secret{}
+
+	err = r.Get(h.ctx, types.NamespacedName{
+						Namespace: secret.Namespace,
+						Name:      secret.Name,
+					}, saved)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]string {
+		utils.AdminPwdKey:              "old-admin",
+		utils.ReplicationPwdKey:        "old-replication",
+		utils.AppliedAdminPwdKey:       "old-admin",
+		utils.AppliedReplicationPwdKey: "old-replication",
+	}
+
+	for key, value := range expected {
+		if string(saved.Data[key]) != value {
+			t.Errorf("The %s key is '%s', expected '%s'.",
+						key, saved.Data[key], value)
+		}
+	}
+
+	/*
+	 * Check the status of the rotation.
+	 */
+
+	directory := &ibmv1.IBMSecurityVerifyDirectory{}
+
+	err = r.Get(h.ctx, h.req.NamespacedName, directory)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rotation := directory.Status.CredentialRotation
+
+	if rotation == nil {
+		t.Fatal("The rotation status has not been saved.")
+	}
+
+	if rotation.Phase != RotationRolledBack {
+		t.Errorf("The phase is '%s', expected '%s'.",
+					rotation.Phase, RotationRolledBack)
+	}
+
+	if len(rotation.UpdatedReplicas) != 0 {
+		t.Errorf("The updated replicas were not cleared: %v",
+					rotation.UpdatedReplicas)
+	}
+
+	if ! strings.Contains(rotation.Message, "bind failed") {
+		t.Errorf("The message does not contain the cause: %s",
+					rotation.Message)
+	}
+
+	if rotation.LastTransitionTime == nil {
+		t.Error("The last transition time has not been set.")
+	}
+}
+
+/*****************************************************************************/
+
+/*
+ * Test the password which is used by the proxy for each replica.
+ */
+
+func TestGetBackendPassword(t *testing.T) {
+	r, h := newRotationTestHandle(t, &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "isvd-credentials",
+			Namespace: "default",
+		},
+	})
+
+	applied := "secret:isvd-credentials/" + utils.AppliedAdminPwdKey
+
+	tests := []struct {
+		name     string
+		phase    string
+		generate bool
+		pvcName  string
+		expected string
+	} {
+		{ "updated replica",     RotationInProgress, true,  "replica-1",
+							h.config.adminPwd },
+		{ "pending replica",     RotationInProgress, true,  "replica-2",
+							applied },
+		{ "completed rotation",  RotationCompleted,  true,  "replica-2",
+							h.config.adminPwd },
+		{ "rolled back",         RotationRolledBack, true,  "replica-2",
+							h.config.adminPwd },
+		{ "not generated",       RotationInProgress, false, "replica-2",
+							h.config.adminPwd },
+	}
+
+	for _, test := range tests {
+		h.directory.Status.CredentialRotation.Phase = test.phase
+		h.directory.Spec.Credentials.Generate       = test.generate
+
+		pwd := r.getBackendPassword(h, test.pvcName)
+
+		if pwd != test.expected {
+			t.Errorf("%s: the password is '%s', expected '%s'.",
+						test.name, pwd, test.expected)
+		}
+	}
+}
+
+/*****************************************************************************/
+
+/*
+ * Test the detection of a pending rotation.
+ */
+
+func TestIsRotationPending(t *testing.T) {
+	tests := []struct {
+		name        string
+		generate    bool
+		request     string
+		lastRequest string
+		adminPwd    string
+		expected    bool
+	} {
+		{ "not generated",      false, "2",  "1", "new-admin", false },
+		{ "no changes",         true,  "",   "",  "old-admin", false },
+		{ "request processed",  true,  "1",  "1", "old-admin", false },
+		{ "new request",        true,  "2",  "1", "old-admin", true  },
+		{ "secret changed",     true,  "1",  "1", "new-admin", true  },
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r, h := newRotationTestHandle(t, &corev1.Secret{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      "isvd-credentials",
+					Namespace: "default",
+				},
+				Data: map[string][]byte{
+					utils.AdminPwdKey:              []byte(test.adminPwd),
+					utils.ReplicationPwdKey:        []byte("replication"),
+					utils.AppliedAdminPwdKey:       []byte("old-admin"),
+					utils.AppliedReplicationPwdKey: []byte("replication"),
+				},
+			})
+
+			h.directory.Spec.Credentials.Generate = test.generate
+			h.directory.Annotations = map[string]string{
+				utils.RotateCredentialsAnnotation: test.request,
+			}
+			h.directory.Status.CredentialRotation.LastRequest =
+											test.lastRequest
+
+			if pending := r.isRotationPending(h); pending != test.expected {
+				t.Errorf("Expected %t, got %t", test.expected, pending)
+			}
+		})
+	}
+}
+
+/*****************************************************************************/
+
@@ -0,0 +1,507 @@
+/* vi: set ts=4 sw=4 noexpandtab : */
+
+/*
+ * Copyright contributors to the IBM Security Verify Directory Operator project
+ */
+
+package controllers
+
+/*
+ * This file contains the functions which are used by the controller to seed
+ * new replicas from a CSI VolumeSnapshot of the principal.
+ */
+
+/*****************************************************************************/
+
+import (
+	metav1  "k8s.io/apimachinery/pkg/apis/meta/v1"
+	corev1  "k8s.io/api/core/v1"
+
+	"errors"
+	"fmt"
+	"time"
+
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/wait"
+
+	"github.com/ibm-security/verify-directory-operator/utils"
+
+	ctrl "sigs.k8s.io/controller-runtime"
+)
+
+/*****************************************************************************/
+
+/*
+ * Some constants...
+ */
+
+const snapshotAPIGroup = "snapshot.storage.k8s.io"
+
+var volumeSnapshotGVK = schema.GroupVersionKind{
+	Group:   snapshotAPIGroup,
+	Version: "v1",
+	Kind:    "VolumeSnapshot",
+}
+
+/*****************************************************************************/
+
+/*
+ * The following function is used to seed the new replicas from a snapshot
+ * of the principal.  The replication agreements for the new replicas have
+ * already been created on the principal.  The principal is stopped while
+ * the snapshot is taken, so that the snapshot contains a consistent copy
+ * of the data, and is restarted as soon as the snapshot has been taken,
+ * rather than once the snapshot is ready to be used, as the upload of the
+ * snapshot by the storage provider can take some time.  The PVC of each
+ * new replica is then provisioned from the snapshot, and the seed
+ * job is used to clean the replica data.  Any changes which are made to the
+ * principal once it has been restarted are queued by the agreements.
+ */
+
+func (r *IBMSecurityVerifyDirectoryReconciler) seedReplicasFromSnapshot(
+			h          *RequestHandle,
+			principal  string,
+			toBeAdded  []string) (err error) {
+
+	r.Log.V(1).Info("Entering a function",
+				r.createLogParams(h, "Function", "seedReplicasFromSnapshot",
+						"Principal.PVC", principal)...)
+
+	/*
+	 * Retrieve the PVC of the principal, which is used as the template for
+	 * the PVCs of the new replicas.
+	 */
+
+	principalClaim := &corev1.PersistentVolumeClaim{}
+	err             = r.Get(h.ctx, types.NamespacedName{
+							Namespace: h.directory.Namespace,
+							Name:      principal,
+						}, principalClaim)
+
+	if err != nil {
+ 		r.Log.Error(err, "Failed to retrieve the principal PVC",
+						r.createLogParams(h, "PVC.Name", principal)...)
+
+		return
+	}
+
+	/*
+	 * Stop the principal, take the snapshot, and then restart the
+	 * principal.
+	 */
+
+	err = r.deleteReplica(h, principal)
+
+	if err != nil {
+		return
+	}
+
+	r.recordEvent(h, corev1.EventTypeNormal, "PrincipalStopped",
+			principal, r.getReplicaPodName(h.directory, principal),
+			"The principal has been stopped so that a snapshot of its data " +
+			"volume can be taken.")
+
+	snapshotName, err := r.createSnapshot(h, principal)
+
+	startErr := r.startPrincipal(h, principal)
+
+	if err != nil {
+		return
+	}
+
+	if startErr != nil {
+		r.deleteSnapshot(h, snapshotName)
+
+		err = startErr
+
+		return
+	}
+
+	/*
+	 * Wait for the snapshot to be ready to be used.
+	 */
+
+	err = r.waitForSnapshot(h, snapshotName, false)
+
+	if err != nil {
+		return
+	}
+
+	/*
+	 * Provision the PVC of each new replica from the snapshot.  The
+	 * snapshot is no longer required once the PVCs have been provisioned.
+	 */
+
+	for _, pvcName := range toBeAdded {
+		err = r.provisionReplicaPVC(h, pvcName, snapshotName, principalClaim)
+
+		if err != nil {
+			r.deleteSnapshot(h, snapshotName)
+
+			return
+		}
+	}
+
+	/*
+	 * Seed each of the new replicas.  As the data has already been copied
+	 * from the principal the seed job only needs to clean the replica data.
+	 */
+
+	seedConfigMapName := r.getSeedConfigMapName(h.directory)
+
+	err = r.createConfigMap(h, seedConfigMapName,
+			ConfigMapKey, "seed: \n  replica: \n    clean: true\n")
+
+	if err != nil {
+		r.deleteSnapshot(h, snapshotName)
+
+		return
+	}
+
+	for _, pvcName := range toBeAdded {
+		err = r.seedReplica(h, "", pvcName)
+
+		if err == nil {
+			err = r.waitForJob(h, r.getSeedJobName(h.directory, pvcName))
+
+			if err != nil {
+				err = r.getSeedJobError(h, pvcName, err)
+			} else {
+				r.seedJobFinished(h, pvcName, nil)
+
+				r.recordSeedJobEvent(h, pvcName, "SeedJobCompleted", 
+							"The seed job has completed.")
+			}
+		}
+
+		if err != nil {
+			break
+		}
+	}
+
+	r.deleteConfigMap(h, seedConfigMapName)
+	r.deleteSnapshot(h, snapshotName)
+
+	return
+}
+
+/*****************************************************************************/
+
+/*
+ * The following function is used to restart the principal once the
+ * snapshot has been taken.
+ */
+
+func (r *IBMSecurityVerifyDirectoryReconciler) startPrincipal(
+			h         *RequestHandle,
+			principal string) (err error) {
+
+	podName, err := r.deployReplica(h, principal)
+
+	if err == nil {
+		err = r.createClusterService(h, podName, principal)
+	}
+
+	if err == nil {
+		err = r.waitForPod(h, podName)
+	}
+
+	if err != nil {
+		r.recordEvent(h, corev1.EventTypeWarning, "ReplicaStartFailed",
+					principal, podName, "The principal failed to start.")
+
+		return
+	}
+
+	r.recordEvent(h, corev1.EventTypeNormal, "ReplicaStarted",
+				principal, podName, "The principal has been restarted.")
+
+	return
+}
+
+/*****************************************************************************/
+
+/*
+ * The following function is used to take a snapshot of the specified PVC,
+ * waiting until the snapshot has been taken.  The snapshot may not yet be
+ * ready to be used.
+ */
+
+func (r *IBMSecurityVerifyDirectoryReconciler) createSnapshot(
+			h       *RequestHandle,
+			pvcName string) (name string, err error) {
+
+	name = r.getSnapshotName(h.directory, pvcName)
+
+	spec := map[string]interface{} {
+		"source": map[string]interface{} {
+			"persistentVolumeClaimName": pvcName,
+		},
+	}
+
+	if h.directory.Spec.Replicas.VolumeSnapshotClassName != "" {
+		spec["volumeSnapshotClassName"] =
+						h.directory.Spec.Replicas.VolumeSnapshotClassName
+	}
+
+	snapshot := &unstructured.Unstructured{
+		Object: map[string]interface{} {
+			"spec": spec,
+		},
+	}
+
+	snapshot.SetGroupVersionKind(volumeSnapshotGVK)
+	snapshot.SetName(name)
+	snapshot.SetNamespace(h.directory.Namespace)
+	snapshot.SetLabels(utils.LabelsForApp(h.directory.Name, pvcName))
+
+	ctrl.SetControllerReference(h.directory, snapshot, r.Scheme)
+
+	r.Log.Info("Creating a new volume snapshot",
+				r.createLogParams(h, "VolumeSnapshot.Name", name)...)
+
+	err = r.Create(h.ctx, snapshot)
+
+	if err != nil {
+ 		r.Log.Error(err, "Failed to create the volume snapshot",
+				r.createLogParams(h, "VolumeSnapshot.Name", name)...)
+
+		return
+	}
+
+	/*
+	 * Wait for the snapshot to be taken.
+	 */
+
+	err = r.waitForSnapshot(h, name, true)
+
+	return
+}
+
+/*****************************************************************************/
+
+/*
+ * The following function is used to wait until the specified snapshot has
+ * been taken, or until the snapshot is ready to be used.  The snapshot is
+ * deleted if it is not available within the allocated time.
+ */
+
+func (r *IBMSecurityVerifyDirectoryReconciler) waitForSnapshot(
+			h     *RequestHandle,
+			name  string,
+			taken bool) (err error) {
+
+	state := "ready"
+
+	if taken {
+		state = "taken"
+	}
+
+	r.Log.Info(fmt.Sprintf(
+				"Waiting up to 10 minutes for the volume snapshot to be %s",
+				state), r.createLogParams(h, "VolumeSnapshot.Name", name)...)
+
+	err = wait.PollImmediate(time.Second, time.Duration(600) * time.Second,
+					r.isSnapshotReady(h, name, taken))
+
+	if err != nil {
+ 		r.Log.Error(err, fmt.Sprintf(
+				"The volume snapshot was not %s within the allocated time.",
+				state), r.createLogParams(h, "VolumeSnapshot.Name", name)...)
+
+		r.deleteSnapshot(h, name)
+	}
+
+	return
+}
+
+/*****************************************************************************/
+
+/*
+ * Return a condition function that indicates whether the given snapshot is
+ * ready to be used or, if requested, whether the snapshot has been taken.
+ * The creation time of the snapshot is set once the snapshot has been taken.
+ */
+
+func (r *IBMSecurityVerifyDirectoryReconciler) isSnapshotReady(
+				h     *RequestHandle,
+				name  string,
+				taken bool) wait.ConditionFunc {
+
+	return func() (bool, error) {
+		snapshot := &unstructured.Unstructured{}
+		snapshot.SetGroupVersionKind(volumeSnapshotGVK)
+
+		err := r.Get(h.ctx,
+					types.NamespacedName{
+						Name:      name,
+						Namespace: h.directory.Namespace }, snapshot)
+
+		if err != nil {
+			return false, nil
+		}
+
+		msg, found, _ := unstructured.NestedString(
+							snapshot.Object, "status", "error", "message")
+
+		if found {
+			return true, errors.New(fmt.Sprintf(
+					"The volume snapshot failed: %s", msg))
+		}
+
+		if taken {
+			created, _, _ := unstructured.NestedString(
+							snapshot.Object, "status", "creationTime")
+
+			return created != "", nil
+		}
+
+		ready, _, _ := unstructured.NestedBool(
+							snapshot.Object, "status", "readyToUse")
+
+		return ready, nil
+	}
+}
+
+/*****************************************************************************/
+
+/*
+ * The following function is used to delete the specified snapshot.
+ */
+
+func (r *IBMSecurityVerifyDirectoryReconciler) deleteSnapshot(
+			h    *RequestHandle,
+			name string) {
+
+	snapshot := &unstructured.Unstructured{}
+	snapshot.SetGroupVersionKind(volumeSnapshotGVK)
+	snapshot.SetName(name)
+	snapshot.SetNamespace(h.directory.Namespace)
+
+	r.Log.Info("Deleting a volume snapshot",
+				r.createLogParams(h, "VolumeSnapshot.Name", name)...)
+
+	err := r.Delete(h.ctx, snapshot)
+
+	if err != nil && ! k8serrors.IsNotFound(err) {
+ 		r.Log.Error(err, "Failed to delete the volume snapshot",
+				r.createLogParams(h, "VolumeSnapshot.Name", name)...)
+	}
+}
+
+/*****************************************************************************/
+
+/*
+ * The following function is used to provision the PVC of a new replica from
+ * the snapshot of the principal.  The PVC must not already exist, and will
+ * be created with the same storage class, access modes and size as the PVC
+ * of the principal.
+ */
+
+func (r *IBMSecurityVerifyDirectoryReconciler) provisionReplicaPVC(
+			h              *RequestHandle,
+			pvcName        string,
+			snapshotName   string,
+			principalClaim *corev1.PersistentVolumeClaim) (err error) {
+
+	r.Log.V(1).Info("Entering a function",
+				r.createLogParams(h, "Function", "provisionReplicaPVC",
+						"PVC.Name", pvcName)...)
+
+	claim := &corev1.PersistentVolumeClaim{}
+	err    = r.Get(h.ctx, types.NamespacedName{
+							Namespace: h.directory.Namespace,
+							Name:      pvcName,
+						}, claim)
+
+	if err == nil {
+		err = errors.New(fmt.Sprintf("The PVC, %s, already exists.  The " +
+				"PVC of a new replica must not be pre-created when the " +
+				"snapshot seed mode is being used.", pvcName))
+
+		return
+	}
+
+	if ! k8serrors.IsNotFound(err) {
+ 		r.Log.Error(err, "Failed to retrieve the PVC",
+						r.createLogParams(h, "PVC.Name", pvcName)...)
+
+		return
+	}
+
+	apiGroup := snapshotAPIGroup
+
+	claim = &corev1.PersistentVolumeClaim{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      pvcName,
+			Namespace: h.directory.Namespace,
+			Labels:    utils.LabelsForApp(h.directory.Name, pvcName),
+		},
+		Spec: corev1.PersistentVolumeClaimSpec{
+			AccessModes:      principalClaim.Spec.AccessModes,
+			StorageClassName: principalClaim.Spec.StorageClassName,
+			VolumeMode:       principalClaim.Spec.VolumeMode,
+			Resources:        principalClaim.Spec.Resources,
+			DataSource:       &corev1.TypedLocalObjectReference{
+				APIGroup: &apiGroup,
+				Kind:     volumeSnapshotGVK.Kind,
+				Name:     snapshotName,
+			},
+		},
+	}
+
+	r.Log.Info("Provisioning a new PVC from the volume snapshot",
+				r.createLogParams(h, "PVC.Name", pvcName,
+						"VolumeSnapshot.Name", snapshotName)...)
+
+	err = r.Create(h.ctx, claim)
+
+	if err != nil {
+ 		r.Log.Error(err, "Failed to create the PVC",
+						r.createLogParams(h, "PVC.Name", pvcName)...)
+	}
+
+	return
+}
+
+/*****************************************************************************/
+
+/*
+ * The following function is used to delete a PVC which was provisioned by
+ * the operator from a snapshot.  PVCs which were not provisioned by the
+ * operator are left untouched.
+ */
+
+func (r *IBMSecurityVerifyDirectoryReconciler) deleteProvisionedPVC(
+			h       *RequestHandle,
+			pvcName string) {
+
+	claim := &corev1.PersistentVolumeClaim{}
+	err   := r.Get(h.ctx, types.NamespacedName{
+							Namespace: h.directory.Namespace,
+							Name:      pvcName,
+						}, claim)
+
+	if err != nil || claim.Spec.DataSource == nil ||
+			claim.Spec.DataSource.Kind != volumeSnapshotGVK.Kind ||
+			claim.Labels[utils.PVCLabel] != pvcName {
+		return
+	}
+
+	r.Log.Info("Deleting a provisioned PVC",
+				r.createLogParams(h, "PVC.Name", pvcName)...)
+
+	err = r.Delete(h.ctx, claim)
+
+	if err != nil && ! k8serrors.IsNotFound(err) {
+ 		r.Log.Error(err, "Failed to delete the PVC",
+						r.createLogParams(h, "PVC.Name", pvcName)...)
+	}
+}
+
+/*****************************************************************************/
+
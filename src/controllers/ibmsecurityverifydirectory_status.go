@@ -0,0 +1,622 @@
+/* vi: set ts=4 sw=4 noexpandtab : */
+
+/*
+ * Copyright contributors to the IBM Security Verify Directory Operator project
+ */
+
+package controllers
+
+/*
+ * This file contains the functions which are used by the controller to
+ * maintain the observed state of the replicas and the proxy in the status
+ * of the document.
+ */
+
+/*****************************************************************************/
+
+import (
+	metav1  "k8s.io/apimachinery/pkg/apis/meta/v1"
+	corev1  "k8s.io/api/core/v1"
+	appsv1  "k8s.io/api/apps/v1"
+
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/go-ldap/ldap/v3"
+	"github.com/go-yaml/yaml"
+
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/types"
+
+	"github.com/ibm-security/verify-directory-operator/utils"
+
+	ibmv1 "github.com/ibm-security/verify-directory-operator/api/v1"
+)
+
+/*****************************************************************************/
+
+/*
+ * Some constants...
+ */
+
+const ReplicaPhasePending  = "Pending"
+const ReplicaPhaseSeeding  = "Seeding"
+const ReplicaPhaseStarting = "Starting"
+const ReplicaPhaseReady    = "Ready"
+const ReplicaPhaseDeleting = "Deleting"
+
+const ReplicaRolePrincipal = "principal"
+const ReplicaRoleMaster    = "master"
+const ReplicaRoleReadOnly  = "read-only"
+
+/*
+ * The role which the proxy reports for its primary write server.
+ */
+
+const proxyPrimaryWriteRole = "primarywriteserver"
+
+/*****************************************************************************/
+
+/*
+ * The following function is used to set the phase of the specified replicas
+ * in the status of the document.  This allows the progress of a long running
+ * operation to be observed.
+ */
+
+func (r *IBMSecurityVerifyDirectoryReconciler) setReplicaPhase(
+			h        *RequestHandle,
+			pvcNames []string,
+			phase    string) {
+
+	now := metav1.Now()
+
+	for _, pvcName := range pvcNames {
+		status := r.findReplicaStatus(h, pvcName)
+
+		if status == nil {
+			h.directory.Status.Replicas = append(h.directory.Status.Replicas,
+					ibmv1.IBMSecurityVerifyDirectoryReplicaStatus{
+						PVC:     pvcName,
+						Pod:     r.getReplicaPodName(h.directory, pvcName),
+					})
+
+			status = &h.directory.Status.Replicas[
+									len(h.directory.Status.Replicas)-1]
+		}
+
+		if status.Phase != phase {
+			status.Phase              = phase
+			status.LastTransitionTime = &now
+		}
+	}
+
+	if err := r.Status().Update(h.ctx, h.directory); err != nil {
+		r.Log.Error(err, "Failed to update the replica status",
+						r.createLogParams(h, "Phase", phase)...)
+	}
+}
+
+/*****************************************************************************/
+
+/*
+ * The following function will return the status entry of the specified
+ * replica, or nil if the replica has no status entry.
+ */
+
+func (r *IBMSecurityVerifyDirectoryReconciler) findReplicaStatus(
+			h       *RequestHandle,
+			pvcName string) *ibmv1.IBMSecurityVerifyDirectoryReplicaStatus {
+
+	for idx := range h.directory.Status.Replicas {
+		if h.directory.Status.Replicas[idx].PVC == pvcName {
+			return &h.directory.Status.Replicas[idx]
+		}
+	}
+
+	return nil
+}
+
+/*****************************************************************************/
+
+/*
+ * The following function is used to refresh the observed state of the
+ * replicas and the proxy in the status of the document.  It is called once
+ * the document has been processed.
+ */
+
+func (r *IBMSecurityVerifyDirectoryReconciler) updateStatus(
+			h *RequestHandle) {
+
+	r.Log.V(1).Info("Entering a function",
+				r.createLogParams(h, "Function", "updateStatus")...)
+
+	existing, err := r.getExistingPods(h)
+
+	if err != nil {
+		return
+	}
+
+	/*
+	 * Work out the roles of the replicas.  The principal is the first of the
+	 * existing replicas, and the proxy will tell us which replicas are
+	 * read-only and which replica is the primary write server.
+	 */
+
+	proxy := r.getProxyStatus(h)
+
+	roles, err := r.getProxyServerRoles(h)
+
+	if err != nil {
+		r.Log.V(1).Info("Failed to retrieve the server roles from the proxy",
+				r.createLogParams(h, "Error", err.Error())...)
+
+		if h.directory.Status.Proxy != nil {
+			proxy.PrimaryWriteServer =
+						h.directory.Status.Proxy.PrimaryWriteServer
+		}
+	}
+
+	ordered := r.getOrderedReplicas(h, existing)
+
+	for _, pvcName := range ordered {
+		if roles[pvcName] == proxyPrimaryWriteRole {
+			proxy.PrimaryWriteServer = pvcName
+
+			break
+		}
+	}
+
+	/*
+	 * Work out the replication backlog of each replica.
+	 */
+
+	backlog := make(map[string]int64)
+
+	if h.directory.Status.Replication != nil {
+		for _, agreement := range h.directory.Status.Replication.Agreements {
+			backlog[agreement.Consumer] += agreement.PendingChanges
+		}
+	}
+
+	/*
+	 * Construct the status of each replica.  The replicas which have been
+	 * requested are listed first, followed by any replicas which are still
+	 * to be deleted.
+	 */
+
+	pvcNames := append([]string{}, h.directory.Spec.Replicas.PVCs...)
+
+	for _, pvcName := range ordered {
+		if ! containsString(pvcNames, pvcName) {
+			pvcNames = append(pvcNames, pvcName)
+		}
+	}
+
+	var replicas []ibmv1.IBMSecurityVerifyDirectoryReplicaStatus
+	var ready    int32
+
+	now := metav1.Now()
+
+	for _, pvcName := range pvcNames {
+		status := ibmv1.IBMSecurityVerifyDirectoryReplicaStatus{
+			PVC:                pvcName,
+			Pod:                r.getReplicaPodName(h.directory, pvcName),
+			Phase:              ReplicaPhasePending,
+			ReplicationBacklog: backlog[pvcName],
+		}
+
+		if previous := r.findReplicaStatus(h, pvcName); previous != nil {
+			status.Phase              = previous.Phase
+			status.LastTransitionTime = previous.LastTransitionTime
+		}
+
+		phase := ReplicaPhasePending
+
+		if _, ok := existing[pvcName]; ok {
+			pod := &corev1.Pod{}
+			err  = r.Get(h.ctx, types.NamespacedName{
+								Namespace: h.directory.Namespace,
+								Name:      status.Pod,
+							}, pod)
+
+			if err == nil {
+				status.Ready   = isPodReady(pod)
+				status.Service = status.Pod
+
+				if len(pod.Spec.Containers) > 0 {
+					status.Image = pod.Spec.Containers[0].Image
+				}
+
+				if pod.DeletionTimestamp != nil ||
+						! containsString(
+								h.directory.Spec.Replicas.PVCs, pvcName) {
+					phase = ReplicaPhaseDeleting
+				} else if status.Ready {
+					phase = ReplicaPhaseReady
+				} else {
+					phase = ReplicaPhaseStarting
+				}
+			}
+
+			status.Role = ReplicaRoleMaster
+
+			if len(ordered) > 0 && ordered[0] == pvcName {
+				status.Role = ReplicaRolePrincipal
+			} else if strings.Contains(strings.ToLower(roles[pvcName]),
+															"read") {
+				status.Role = ReplicaRoleReadOnly
+			}
+		}
+
+		if status.Ready {
+			ready++
+		}
+
+		if status.Phase != phase {
+			status.Phase              = phase
+			status.LastTransitionTime = &now
+		}
+
+		replicas = append(replicas, status)
+	}
+
+	/*
+	 * Update the status of the document.
+	 */
+
+	h.directory.Status.Replicas           = replicas
+	h.directory.Status.DesiredReplicas    =
+						int32(len(h.directory.Spec.Replicas.PVCs))
+	h.directory.Status.ReadyReplicas      = ready
+	h.directory.Status.Proxy              = proxy
+	h.directory.Status.ObservedGeneration = h.directory.Generation
+
+	meta.SetStatusCondition(&h.directory.Status.Conditions,
+				r.getReadyCondition(h, proxy, ready))
+
+	if err := r.Status().Update(h.ctx, h.directory); err != nil {
+		r.Log.Error(err, "Failed to update the status of the document",
+						r.createLogParams(h)...)
+	}
+
+	r.updateReplicaMetrics(h, len(existing))
+}
+
+/*****************************************************************************/
+
+/*
+ * The following function will return the Ready condition of the document.
+ * The deployment is ready when the proxy, and each of the requested replicas,
+ * are ready.  This is independent of whether the most recent processing of
+ * the document succeeded, which is reported by the Degraded condition.
+ */
+
+func (r *IBMSecurityVerifyDirectoryReconciler) getReadyCondition(
+			h     *RequestHandle,
+			proxy *ibmv1.IBMSecurityVerifyDirectoryProxyStatus,
+			ready int32) (condition metav1.Condition) {
+
+	desired := int32(len(h.directory.Spec.Replicas.PVCs))
+
+	condition = metav1.Condition{
+		Type:               ibmv1.ConditionReady,
+		Status:             metav1.ConditionFalse,
+		ObservedGeneration: h.directory.Generation,
+	}
+
+	if proxy.ReadyReplicas == 0 {
+		condition.Reason  = ibmv1.ReasonProxyNotReady
+		condition.Message = "The proxy is not ready."
+	} else if ready < desired {
+		condition.Reason  = ibmv1.ReasonReplicasNotReady
+		condition.Message = fmt.Sprintf(
+				"%d of the %d replicas are ready.", ready, desired)
+	} else {
+		condition.Status  = metav1.ConditionTrue
+		condition.Reason  = ibmv1.ReasonReplicasReady
+		condition.Message = fmt.Sprintf(
+				"The proxy and the %d replicas are ready.", desired)
+	}
+
+	return
+}
+
+/*****************************************************************************/
+
+/*
+ * The following function will return the observed state of the proxy.
+ */
+
+func (r *IBMSecurityVerifyDirectoryReconciler) getProxyStatus(
+			h *RequestHandle) (
+				status *ibmv1.IBMSecurityVerifyDirectoryProxyStatus) {
+
+	status = &ibmv1.IBMSecurityVerifyDirectoryProxyStatus{}
+
+	name := utils.GetProxyDeploymentName(h.directory.Name)
+
+	deployment := &appsv1.Deployment{}
+	err        := r.Get(h.ctx, types.NamespacedName{
+								Namespace: h.directory.Namespace,
+								Name:      name,
+							}, deployment)
+
+	if err == nil {
+		if deployment.Spec.Replicas != nil {
+			status.Replicas = *deployment.Spec.Replicas
+		}
+
+		status.ReadyReplicas = deployment.Status.ReadyReplicas
+	}
+
+	configMap := &corev1.ConfigMap{}
+	err        = r.Get(h.ctx, types.NamespacedName{
+								Namespace: h.directory.Namespace,
+								Name:      utils.GetProxyConfigMapName(
+														h.directory.Name),
+							}, configMap)
+
+	if err == nil {
+		status.ConfigHash = fmt.Sprintf("%x",
+					sha256.Sum256([]byte(configMap.Data[utils.ProxyCMKey])))
+	}
+
+	return
+}
+
+/*****************************************************************************/
+
+/*
+ * The following function will query the proxy for the current role of each
+ * of the replicas.  The returned map is indexed on the name of the PVC of
+ * the replica.
+ */
+
+func (r *IBMSecurityVerifyDirectoryReconciler) getProxyServerRoles(
+			h *RequestHandle) (roles map[string]string, err error) {
+
+	r.Log.V(1).Info("Entering a function",
+				r.createLogParams(h, "Function", "getProxyServerRoles")...)
+
+	roles = make(map[string]string)
+
+	/*
+	 * Work out the service address and port for the proxy.  The proxy
+	 * service will publish both the LDAP and LDAPS ports if they have both
+	 * been enabled, in which case we use the LDAP port.
+	 */
+
+	service := &corev1.Service{}
+	err      = r.Get(h.ctx, types.NamespacedName{
+							Namespace: h.directory.Namespace,
+							Name:      utils.GetProxyDeploymentName(
+														h.directory.Name),
+						}, service)
+
+	if err != nil {
+		return
+	}
+
+	address := fmt.Sprintf("%s.%s.svc", service.Name, service.Namespace)
+	port    := int32(0)
+	secure  := false
+
+	for _, servicePort := range service.Spec.Ports {
+		if servicePort.Name == "ldap" {
+			port   = servicePort.Port
+			secure = false
+
+			break
+		} else if servicePort.Name == "ldaps" {
+			port   = servicePort.Port
+			secure = true
+		}
+	}
+
+	if port == 0 {
+		err = errors.New("The proxy service does not publish an LDAP port.")
+
+		return
+	}
+
+	/*
+	 * Work out the admin credentials of the proxy.
+	 */
+
+	adminDn, adminPwd, err := r.getProxyCredentials(h)
+
+	if err != nil {
+		return
+	}
+
+	/*
+	 * Connect and bind to the proxy.
+	 */
+
+	var l *ldap.Conn
+
+	if secure {
+		tlsConfig, tlsErr := r.getTLSConfig(h, address)
+
+		if tlsErr != nil {
+			err = tlsErr
+
+			return
+		}
+
+		l, err = ldap.DialURL(fmt.Sprintf("ldaps://%s:%d", address, port),
+				ldap.DialWithTLSConfig(tlsConfig))
+	} else {
+		l, err = ldap.DialURL(fmt.Sprintf("ldap://%s:%d", address, port))
+	}
+
+	if err != nil {
+		return
+	}
+
+	defer l.Close()
+
+	err = l.Bind(adminDn, adminPwd)
+
+	if err != nil {
+		return
+	}
+
+	/*
+	 * Search the proxy for the current role of each of the backend servers.
+	 */
+
+	searchRequest := ldap.NewSearchRequest(
+		"cn=partitions,cn=proxy,cn=monitor",
+		ldap.ScopeBaseObject, ldap.NeverDerefAliases, 0, 0, false,
+		"(objectClass=*)",
+		nil,
+		nil,
+	)
+
+	sr, err := l.Search(searchRequest)
+
+	if err != nil {
+		return
+	}
+
+	expr := fmt.Sprintf(".*ibm-slapdProxyBackendServerName=%s-(.[^+,]*)",
+						strings.ToLower(h.directory.Name))
+	re   := regexp.MustCompile(expr)
+
+	for _, entry := range sr.Entries {
+		role := entry.GetEqualFoldAttributeValue(
+								"ibm-slapdProxyCurrentServerRole")
+
+		match := re.FindStringSubmatch(entry.DN)
+
+		if len(match) < 2 || role == "" {
+			continue
+		}
+
+		/*
+		 * A replica may be a backend server of several partitions, and so
+		 * we only want to record the primary write role once it has been
+		 * found.
+		 */
+
+		if roles[match[1]] != proxyPrimaryWriteRole {
+			roles[match[1]] = role
+		}
+	}
+
+	r.Log.V(1).Info("Retrieved the server roles from the proxy",
+			r.createLogParams(h, "Roles", roles)...)
+
+	return
+}
+
+/*****************************************************************************/
+
+/*
+ * The following function will return the admin credentials of the proxy.
+ * If the credentials have been generated by the operator the password is
+ * retrieved from the credentials secret.
+ */
+
+func (r *IBMSecurityVerifyDirectoryReconciler) getProxyCredentials(
+			h *RequestHandle) (adminDn string, adminPwd string, err error) {
+
+	name := utils.GetProxyConfigMapName(h.directory.Name)
+
+	configMap := &corev1.ConfigMap{}
+	err        = r.Get(h.ctx, types.NamespacedName{
+								Namespace: h.directory.Namespace,
+								Name:      name,
+							}, configMap)
+
+	if err != nil {
+		return
+	}
+
+	var body interface{}
+
+	err = yaml.Unmarshal([]byte(configMap.Data[utils.ProxyCMKey]), &body)
+
+	if err != nil {
+		return
+	}
+
+	body = utils.ConvertYaml(body)
+	rctx := r.getResolveContext(h)
+
+	adminDn = "cn=root"
+
+	entry, err := utils.GetYamlValue(body, []string{"general","admin","dn"},
+						true, rctx)
+
+	if err != nil {
+		return
+	}
+
+	if entry != nil {
+		adminDn = fmt.Sprintf("%v", entry)
+	}
+
+	if h.directory.Spec.Credentials.Generate {
+		entry, err = utils.ResolveEntry(fmt.Sprintf("secret:%s/%s",
+					r.getCredentialsSecretName(h), utils.AdminPwdKey), rctx)
+	} else {
+		entry, err = utils.GetYamlValue(body,
+					[]string{"general","admin","pwd"}, true, rctx)
+	}
+
+	if err != nil {
+		return
+	}
+
+	if entry == nil {
+		err = errors.New("The general.admin.pwd configuration is missing.")
+
+		return
+	}
+
+	adminPwd = fmt.Sprintf("%v", entry)
+
+	return
+}
+
+/*****************************************************************************/
+
+/*
+ * The following function is used to determine whether the specified pod is
+ * ready.
+ */
+
+func isPodReady(pod *corev1.Pod) bool {
+	for _, condition := range pod.Status.Conditions {
+		if condition.Type == corev1.PodReady {
+			return condition.Status == corev1.ConditionTrue
+		}
+	}
+
+	return false
+}
+
+/*****************************************************************************/
+
+/*
+ * The following function is used to determine whether the specified list
+ * contains the specified string.
+ */
+
+func containsString(list []string, value string) bool {
+	for _, entry := range list {
+		if entry == value {
+			return true
+		}
+	}
+
+	return false
+}
+
+/*****************************************************************************/
+
@@ -0,0 +1,770 @@
+/* vi: set ts=4 sw=4 noexpandtab : */
+
+/*
+ * Copyright contributors to the IBM Security Verify Directory Operator project
+ */
+
+package controllers
+
+/*
+ * This file contains the functions which are used by the controller to
+ * request TLS certificates from cert-manager, and to verify the certificates
+ * presented by the servers.
+ */
+
+/*****************************************************************************/
+
+import (
+	appsv1  "k8s.io/api/apps/v1"
+	corev1  "k8s.io/api/core/v1"
+
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/go-yaml/yaml"
+	"github.com/ibm-security/verify-directory-operator/utils"
+
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+
+	ctrl "sigs.k8s.io/controller-runtime"
+
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+/*****************************************************************************/
+
+/*
+ * Some constants...
+ */
+
+const tlsCertLabel  = "isvd-tls"
+const tlsVolumeName = "isvd-tls"
+
+var certificateGVK = schema.GroupVersionKind{
+	Group:   "cert-manager.io",
+	Version: "v1",
+	Kind:    "Certificate",
+}
+
+/*****************************************************************************/
+
+/*
+ * The following function is used to determine whether the operator should
+ * request the TLS certificates from cert-manager.
+ */
+
+func (r *IBMSecurityVerifyDirectoryReconciler) isTLSManaged(
+			h *RequestHandle) (bool) {
+	return h.directory.Spec.TLS.IssuerRef != nil
+}
+
+/*****************************************************************************/
+
+/*
+ * The following function is used to request a certificate for the specified
+ * service, if the certificate has not already been requested.  The
+ * certificate will be stored by cert-manager in a secret of the same name.
+ */
+
+func (r *IBMSecurityVerifyDirectoryReconciler) ensureCertificate(
+			h           *RequestHandle,
+			serviceName string,
+			labelName   string) (err error) {
+
+	r.Log.V(1).Info("Entering a function",
+				r.createLogParams(h, "Function", "ensureCertificate",
+						"Service.Name", serviceName)...)
+
+	if ! r.isTLSManaged(h) {
+		return
+	}
+
+	name := utils.GetCertificateName(serviceName)
+
+	/*
+	 * Check to see if the certificate already exists.
+	 */
+
+	cert := &unstructured.Unstructured{}
+	cert.SetGroupVersionKind(certificateGVK)
+
+	err = r.Get(h.ctx,
+				types.NamespacedName{
+					Name:      name,
+					Namespace: h.directory.Namespace }, cert)
+
+	if err == nil {
+		return r.ensureCertificateOutputFormats(h, cert)
+	}
+
+	if ! k8serrors.IsNotFound(err) {
+ 		r.Log.Error(err, "Failed to retrieve the certificate",
+			r.createLogParams(h, "Certificate.Name", name)...)
+
+		return
+	}
+
+	/*
+	 * Construct the certificate.  The certificate will contain the various
+	 * DNS names which can be used to access the service from within the
+	 * cluster.
+	 */
+
+	ns       := h.directory.Namespace
+	issuer   := h.directory.Spec.TLS.IssuerRef
+	dnsNames := []interface{} {
+		serviceName,
+		fmt.Sprintf("%s.%s", serviceName, ns),
+		fmt.Sprintf("%s.%s.svc", serviceName, ns),
+		fmt.Sprintf("%s.%s.svc.cluster.local", serviceName, ns),
+	}
+
+	cert = &unstructured.Unstructured{
+		Object: map[string]interface{} {
+			"spec": map[string]interface{} {
+				"secretName": name,
+				"commonName": serviceName,
+				"dnsNames":   dnsNames,
+				"usages":     []interface{} {
+					"server auth",
+					"client auth",
+				},
+				"issuerRef":  map[string]interface{} {
+					"name":  issuer.Name,
+					"kind":  issuer.Kind,
+					"group": issuer.Group,
+				},
+				"additionalOutputFormats": certificateOutputFormats(),
+			},
+		},
+	}
+
+	cert.SetGroupVersionKind(certificateGVK)
+	cert.SetName(name)
+	cert.SetNamespace(ns)
+	cert.SetLabels(utils.LabelsForApp(h.directory.Name, labelName))
+
+	ctrl.SetControllerReference(h.directory, cert, r.Scheme)
+
+	r.Log.Info("Requesting a new certificate",
+				r.createLogParams(h, "Certificate.Name", name)...)
+
+	err = r.Create(h.ctx, cert)
+
+	if err != nil {
+ 		r.Log.Error(err, "Failed to create the certificate",
+				r.createLogParams(h, "Certificate.Name", name)...)
+
+		return
+	}
+
+	return
+}
+
+/*****************************************************************************/
+
+/*
+ * The following function will return the additional output formats which
+ * are requested from cert-manager.  The combined PEM format stores the
+ * certificate and the private key in a single file, as is required by the
+ * keyfile.keys configuration entry.
+ */
+
+func certificateOutputFormats() []interface{} {
+	return []interface{} {
+		map[string]interface{} {
+			"type": "CombinedPEM",
+		},
+	}
+}
+
+/*****************************************************************************/
+
+/*
+ * The following function is used to ensure that an existing certificate,
+ * which may have been requested by an earlier version of the operator,
+ * requests the additional output formats.
+ */
+
+func (r *IBMSecurityVerifyDirectoryReconciler) ensureCertificateOutputFormats(
+			h    *RequestHandle,
+			cert *unstructured.Unstructured) (err error) {
+
+	formats, _, _ := unstructured.NestedSlice(
+					cert.Object, "spec", "additionalOutputFormats")
+
+	if len(formats) > 0 {
+		return
+	}
+
+	err = unstructured.SetNestedSlice(cert.Object, certificateOutputFormats(),
+					"spec", "additionalOutputFormats")
+
+	if err == nil {
+		err = r.Update(h.ctx, cert)
+	}
+
+	if err != nil {
+ 		r.Log.Error(err, "Failed to update the certificate",
+				r.createLogParams(h, "Certificate.Name", cert.GetName())...)
+	}
+
+	return
+}
+
+/*****************************************************************************/
+
+/*
+ * The following function is used to delete the certificate, and the
+ * secret which holds the certificate, for the specified service.
+ */
+
+func (r *IBMSecurityVerifyDirectoryReconciler) deleteCertificate(
+			h           *RequestHandle,
+			serviceName string) (err error) {
+
+	r.Log.V(1).Info("Entering a function",
+				r.createLogParams(h, "Function", "deleteCertificate",
+						"Service.Name", serviceName)...)
+
+	if ! r.isTLSManaged(h) {
+		return
+	}
+
+	name := utils.GetCertificateName(serviceName)
+
+	cert := &unstructured.Unstructured{}
+	cert.SetGroupVersionKind(certificateGVK)
+	cert.SetName(name)
+	cert.SetNamespace(h.directory.Namespace)
+
+	r.Log.Info("Deleting a certificate",
+				r.createLogParams(h, "Certificate.Name", name)...)
+
+	err = r.Delete(h.ctx, cert)
+
+	if err != nil && ! k8serrors.IsNotFound(err) {
+ 		r.Log.Error(err, "Failed to delete the certificate",
+				r.createLogParams(h, "Certificate.Name", name)...)
+
+		return
+	}
+
+	/*
+	 * cert-manager does not delete the secret when the certificate is
+	 * deleted.
+	 */
+
+	secret := &corev1.Secret{}
+	secret.SetName(name)
+	secret.SetNamespace(h.directory.Namespace)
+
+	err = r.Delete(h.ctx, secret)
+
+	if err != nil && ! k8serrors.IsNotFound(err) {
+ 		r.Log.Error(err, "Failed to delete the certificate secret",
+				r.createLogParams(h, "Secret.Name", name)...)
+
+		return
+	}
+
+	return nil
+}
+
+/*****************************************************************************/
+
+/*
+ * The following function will return the volume, and the volume mount,
+ * which are used to pass the certificate for the specified service to a
+ * container.  The secret is mounted, rather than being passed in the
+ * environment, so that the private key is not exposed in the definition of
+ * the pod.  The combined certificate and private key can be referenced from
+ * the keyfile.keys configuration entry.
+ */
+
+func (r *IBMSecurityVerifyDirectoryReconciler) getTLSVolumes(
+			h           *RequestHandle,
+			serviceName string) (
+				volumes []corev1.Volume, mounts []corev1.VolumeMount) {
+
+	if ! r.isTLSManaged(h) {
+		return
+	}
+
+	volumes = append(volumes, corev1.Volume {
+		Name: tlsVolumeName,
+		VolumeSource: corev1.VolumeSource{
+			Secret: &corev1.SecretVolumeSource{
+				SecretName: utils.GetCertificateName(serviceName),
+			},
+		},
+	})
+
+	mounts = append(mounts, corev1.VolumeMount {
+		Name:      tlsVolumeName,
+		MountPath: utils.TLSMountPath,
+		ReadOnly:  true,
+	})
+
+	return
+}
+
+/*****************************************************************************/
+
+/*
+ * The following function will return the secret which holds the certificate
+ * for the specified service.  A nil secret is returned if the certificate
+ * has not yet been issued.
+ */
+
+func (r *IBMSecurityVerifyDirectoryReconciler) getCertificateSecret(
+			h           *RequestHandle,
+			serviceName string) (secret *corev1.Secret, err error) {
+
+	name := utils.GetCertificateName(serviceName)
+
+	secret = &corev1.Secret{}
+	err    = r.Get(h.ctx,
+				types.NamespacedName{
+					Name:      name,
+					Namespace: h.directory.Namespace }, secret)
+
+	if k8serrors.IsNotFound(err) {
+		return nil, nil
+	}
+
+	if err != nil {
+ 		r.Log.Error(err, "Failed to retrieve the certificate secret",
+			r.createLogParams(h, "Secret.Name", name)...)
+
+		return nil, err
+	}
+
+	return
+}
+
+/*****************************************************************************/
+
+/*
+ * The following function will return the revision of the certificate for
+ * the specified service.  The revision is a hash of the certificate, and
+ * is used to detect the renewal of the certificate.  An empty revision is
+ * returned if the certificate has not yet been issued.
+ */
+
+func (r *IBMSecurityVerifyDirectoryReconciler) getCertificateRevision(
+			h           *RequestHandle,
+			serviceName string) (revision string, err error) {
+
+	if ! r.isTLSManaged(h) {
+		return
+	}
+
+	secret, err := r.getCertificateSecret(h, serviceName)
+
+	if err != nil || secret == nil || len(secret.Data["tls.crt"]) == 0 {
+		return
+	}
+
+	revision = fmt.Sprintf("%x", sha256.Sum256(secret.Data["tls.crt"]))[:16]
+
+	return
+}
+
+/*****************************************************************************/
+
+/*
+ * The following function is used to restart each replica whose certificate
+ * has been renewed since the replica was started.  The server only loads
+ * its certificate when it is started, and so the replica would otherwise
+ * continue to present the previous certificate.
+ */
+
+func (r *IBMSecurityVerifyDirectoryReconciler) rollRenewedCertificates(
+			h        *RequestHandle,
+			existing map[string]string) (err error) {
+
+	r.Log.V(1).Info("Entering a function",
+				r.createLogParams(h, "Function", "rollRenewedCertificates")...)
+
+	if ! r.isTLSManaged(h) {
+		return
+	}
+
+	for _, pvcName := range r.getOrderedReplicas(h, existing) {
+		var restart bool
+
+		podName := existing[pvcName]
+
+		restart, err = r.isCertificateRenewed(h, podName)
+
+		if err != nil {
+			return
+		}
+
+		if ! restart {
+			continue
+		}
+
+		r.Log.Info("Restarting a replica with a renewed certificate",
+				r.createLogParams(h, "PVC.Name", pvcName)...)
+
+		err = r.restartReplica(h, pvcName)
+
+		if err != nil {
+			r.recordEvent(h, corev1.EventTypeWarning, "CertificateRollFailed",
+					pvcName, podName, fmt.Sprintf("Failed to restart the " +
+						"replica with the renewed certificate: %s",
+						err.Error()))
+
+			return
+		}
+
+		r.recordEvent(h, corev1.EventTypeNormal, "CertificateRolled",
+				pvcName, podName, "The replica has been restarted with the " +
+					"renewed certificate.")
+	}
+
+	return
+}
+
+/*****************************************************************************/
+
+/*
+ * The following function is used to determine whether the revision of a
+ * certificate has changed since the revision was recorded against the
+ * corresponding replica pod, or the proxy deployment.  An error is treated
+ * as a pending renewal, so that the error is reported when the document is
+ * processed.
+ */
+
+func (r *IBMSecurityVerifyDirectoryReconciler) isCertificateRenewalPending(
+			h        *RequestHandle,
+			existing map[string]string) (pending bool) {
+
+	if ! r.isTLSManaged(h) {
+		return
+	}
+
+	for _, podName := range existing {
+		revision, err := r.getCertificateRevision(h, podName)
+
+		if err != nil {
+			return true
+		}
+
+		if revision == "" {
+			continue
+		}
+
+		pod := &corev1.Pod{}
+		err  = r.Get(h.ctx, types.NamespacedName{
+							Namespace: h.directory.Namespace,
+							Name:      podName,
+						}, pod)
+
+		if err != nil ||
+				pod.Annotations[utils.TLSRevisionAnnotation] != revision {
+			return true
+		}
+	}
+
+	name := utils.GetProxyDeploymentName(h.directory.Name)
+
+	revision, err := r.getCertificateRevision(h, name)
+
+	if err != nil {
+		return true
+	}
+
+	if revision == "" {
+		return
+	}
+
+	dep := &appsv1.Deployment{}
+	err  = r.Get(h.ctx, types.NamespacedName{
+						Namespace: h.directory.Namespace,
+						Name:      name,
+					}, dep)
+
+	if err != nil ||
+		dep.Spec.Template.Annotations[utils.TLSRevisionAnnotation] != revision {
+		return true
+	}
+
+	return
+}
+
+/*****************************************************************************/
+
+/*
+ * The following function is used to determine whether the certificate of
+ * the specified replica pod has been renewed since the pod was started.  A
+ * pod which mounts the certificate, but which was started before the
+ * certificate was first issued, already uses the issued certificate and so
+ * the revision is just recorded against the pod.
+ */
+
+func (r *IBMSecurityVerifyDirectoryReconciler) isCertificateRenewed(
+			h       *RequestHandle,
+			podName string) (renewed bool, err error) {
+
+	revision, err := r.getCertificateRevision(h, podName)
+
+	if err != nil || revision == "" {
+		return
+	}
+
+	pod := &corev1.Pod{}
+	err  = r.Get(h.ctx, types.NamespacedName{
+						Namespace: h.directory.Namespace,
+						Name:      podName,
+					}, pod)
+
+	if err != nil {
+ 		r.Log.Error(err, "Failed to retrieve the pod",
+			r.createLogParams(h, "Pod.Name", podName)...)
+
+		return
+	}
+
+	current := pod.Annotations[utils.TLSRevisionAnnotation]
+
+	if current == revision {
+		return
+	}
+
+	mounted := false
+
+	for _, volume := range pod.Spec.Volumes {
+		if volume.Name == tlsVolumeName {
+			mounted = true
+		}
+	}
+
+	if current != "" || ! mounted {
+		return true, nil
+	}
+
+	patch := client.MergeFrom(pod.DeepCopy())
+
+	if pod.Annotations == nil {
+		pod.Annotations = make(map[string]string)
+	}
+
+	pod.Annotations[utils.TLSRevisionAnnotation] = revision
+
+	err = r.Patch(h.ctx, pod, patch)
+
+	if err != nil {
+ 		r.Log.Error(err, "Failed to record the certificate revision",
+			r.createLogParams(h, "Pod.Name", podName)...)
+	}
+
+	return
+}
+
+/*****************************************************************************/
+
+/*
+ * The following function is used to add the issued certificate, and the
+ * issuing CA, to the keyfile configuration of the proxy.  The certificate
+ * will only be used by the proxy if a certificate label has not already
+ * been configured.
+ */
+
+func (r *IBMSecurityVerifyDirectoryReconciler) addProxyTLSConfig(
+			h        *RequestHandle,
+			jsonData string) (string, error) {
+
+	r.Log.V(1).Info("Entering a function",
+				r.createLogParams(h, "Function", "addProxyTLSConfig")...)
+
+	if ! r.isTLSManaged(h) {
+		return jsonData, nil
+	}
+
+	var body map[string]interface{}
+
+	if err := json.Unmarshal([]byte(jsonData), &body); err != nil {
+ 		r.Log.Error(err, "Failed to parse the proxy configuration",
+						r.createLogParams(h)...)
+
+		return "", err
+	}
+
+	/*
+	 * Add the CA and the certificate to the keyfile.
+	 */
+
+	keyfile, err := r.getJsonMap(body, "keyfile")
+
+	if err != nil {
+		return "", err
+	}
+
+	trusted, _ := keyfile["trusted-certificates"].([]interface{})
+	keys,    _ := keyfile["keys"].([]interface{})
+
+	keyfile["keys"] = append(keys, map[string]interface{} {
+				"label": tlsCertLabel,
+				"key":   fmt.Sprintf("file:%s/%s",
+								utils.TLSMountPath, utils.TLSKeyFile),
+			})
+
+	/*
+	 * Not every issuer provides the certificate of the CA, and so the CA
+	 * is only trusted if it has been provided.
+	 */
+
+	secret, err := r.getCertificateSecret(h,
+					utils.GetProxyDeploymentName(h.directory.Name))
+
+	if err != nil {
+		return "", err
+	}
+
+	if secret != nil && len(secret.Data[utils.TLSCAFile]) > 0 {
+		keyfile["trusted-certificates"] = append(trusted,
+				fmt.Sprintf("file:%s/%s", utils.TLSMountPath, utils.TLSCAFile))
+	}
+
+	/*
+	 * Use the certificate if no other certificate has been configured.
+	 */
+
+	general, err := r.getJsonMap(body, "general")
+
+	if err != nil {
+		return "", err
+	}
+
+	ssl, err := r.getJsonMap(general, "ssl")
+
+	if err != nil {
+		return "", err
+	}
+
+	if _, ok := ssl["cert-label"]; !ok {
+		ssl["cert-label"] = tlsCertLabel
+	}
+
+	data, err := json.Marshal(body)
+
+	if err != nil {
+ 		r.Log.Error(err, "Failed to construct the proxy configuration",
+						r.createLogParams(h)...)
+
+		return "", err
+	}
+
+	return string(data), nil
+}
+
+/*****************************************************************************/
+
+/*
+ * The following function will return the named map from the supplied
+ * JSON object, creating the map if it doesn't already exist.
+ */
+
+func (r *IBMSecurityVerifyDirectoryReconciler) getJsonMap(
+			body map[string]interface{},
+			name string) (map[string]interface{}, error) {
+
+	if body[name] == nil {
+		body[name] = make(map[string]interface{})
+	}
+
+	entry, ok := body[name].(map[string]interface{})
+
+	if ! ok {
+		return nil, errors.New(fmt.Sprintf(
+				"The %s configuration entry is incorrect.", name))
+	}
+
+	return entry, nil
+}
+
+/*****************************************************************************/
+
+/*
+ * The following function is used to construct the TLS configuration which
+ * is used by the operator when connecting to the specified server.  The
+ * certificate presented by the server is verified against the CA bundle
+ * from the document or, if no CA bundle has been specified, the trusted
+ * certificates from the proxy configuration.
+ */
+
+func (r *IBMSecurityVerifyDirectoryReconciler) getTLSConfig(
+			h          *RequestHandle,
+			serverName string) (tlsConfig *tls.Config, err error) {
+
+	r.Log.V(1).Info("Entering a function",
+				r.createLogParams(h, "Function", "getTLSConfig",
+						"Server.Name", serverName)...)
+
+	/*
+	 * Retrieve the proxy configuration.
+	 */
+
+	name := h.directory.Spec.Pods.ConfigMap.Proxy.Name
+	key  := h.directory.Spec.Pods.ConfigMap.Proxy.Key
+
+	config := &corev1.ConfigMap{}
+	err     = r.Get(h.ctx,
+			types.NamespacedName{Name: name, Namespace: h.directory.Namespace},
+			config)
+
+	if err != nil {
+ 		r.Log.Error(err, "Failed to retrieve the ConfigMap",
+						r.createLogParams(h, "ConfigMap.Name", name)...)
+
+		return
+	}
+
+	var body interface{}
+
+	if err = yaml.Unmarshal([]byte(config.Data[key]), &body); err != nil {
+ 		r.Log.Error(err, "Failed to load the ConfigMap data",
+						r.createLogParams(h, "ConfigMap.Name", name,
+								"ConfigMap.Key", key)...)
+
+		return
+	}
+
+	body = utils.ConvertYaml(body)
+
+	/*
+	 * Load the trusted certificates.
+	 */
+
+	managedCA := ""
+
+	if r.isTLSManaged(h) {
+		managedCA = utils.GetCertificateName(
+						utils.GetProxyDeploymentName(h.directory.Name))
+	}
+
+	certs, err := utils.GetTrustedCertificates(body,
+				h.directory.Spec.TLS.CABundle, managedCA, r.getResolveContext(h))
+
+	if err != nil {
+ 		r.Log.Error(err, "Failed to load the trusted certificates",
+						r.createLogParams(h)...)
+
+		return
+	}
+
+	return utils.NewTLSConfig(serverName, certs)
+}
+
+/*****************************************************************************/
+
@@ -21,6 +21,8 @@ import (
 	"bytes"
 	"errors"
 	"fmt"
+	"reflect"
+	"strconv"
 	"strings"
 	"time"
 
@@ -36,6 +38,8 @@ import (
 
 	ctrl "sigs.k8s.io/controller-runtime"
 
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
 	"github.com/ibm-security/verify-directory-operator/utils"
 
 	ibmv1 "github.com/ibm-security/verify-directory-operator/api/v1"
@@ -43,6 +47,14 @@ import (
 
 /*****************************************************************************/
 
+/*
+ * The number of lines from the log of a failed job which are captured.
+ */
+
+const JobLogTailLines = 20
+
+/*****************************************************************************/
+
 /*
  * The following function is used to generate the pod name for the PVC.
  */
@@ -80,6 +92,61 @@ func (r *IBMSecurityVerifyDirectoryReconciler) getSeedJobName(
 
 /*****************************************************************************/
 
+/*
+ * The following function will create the name of the job which is used to
+ * restore a backup into the replica.
+ */
+
+func (r *IBMSecurityVerifyDirectoryReconciler) getRestoreJobName(
+			directory    *ibmv1.IBMSecurityVerifyDirectory,
+			pvc          string) (string) {
+	return fmt.Sprintf("%s-restore", r.getReplicaPodName(directory, pvc))
+}
+
+/*****************************************************************************/
+
+/*
+ * The following function will create the name of the job which is used to
+ * import the initial data into the replica.
+ */
+
+func (r *IBMSecurityVerifyDirectoryReconciler) getImportJobName(
+			directory    *ibmv1.IBMSecurityVerifyDirectory,
+			pvc          string) (string) {
+	return fmt.Sprintf("%s-import", r.getReplicaPodName(directory, pvc))
+}
+
+/*****************************************************************************/
+
+/*
+ * The following function will create the name of the volume snapshot which
+ * is taken of the replica.
+ */
+
+func (r *IBMSecurityVerifyDirectoryReconciler) getSnapshotName(
+			directory    *ibmv1.IBMSecurityVerifyDirectory,
+			pvc          string) (string) {
+	return fmt.Sprintf("%s-snapshot", r.getReplicaPodName(directory, pvc))
+}
+
+/*****************************************************************************/
+
+/*
+ * The following function will return the context which is used to resolve
+ * the configuration entries for the deployment.
+ */
+
+func (r *IBMSecurityVerifyDirectoryReconciler) getResolveContext(
+			h *RequestHandle) (*utils.ResolveContext) {
+	return &utils.ResolveContext{
+		Namespace: h.directory.Namespace,
+		Env:       h.directory.Spec.Pods.Env,
+		EnvFrom:   h.directory.Spec.Pods.EnvFrom,
+	}
+}
+
+/*****************************************************************************/
+
 /*
  * The following function is used to create a ConfigMap with the specified
  * data.
@@ -195,8 +262,18 @@ func (r *IBMSecurityVerifyDirectoryReconciler) isJobComplete(
 			return false, nil
 		}
 
-		if job.Status.Failed > 0 {
-			return true, errors.New("The job failed!")
+		/*
+		 * A failed pod will be retried by the job controller until the
+		 * backoff limit is reached, and so we only treat the job as failed
+		 * once the job controller has marked it as failed.
+		 */
+
+		for _, condition := range job.Status.Conditions {
+			if condition.Type == batchv1.JobFailed && 
+							condition.Status == corev1.ConditionTrue {
+				return true, errors.New(fmt.Sprintf("The job failed: %s: %s",
+							condition.Reason, condition.Message))
+			}
 		}
 
 		if job.Status.Succeeded > 0 {
@@ -311,14 +388,31 @@ func (r *IBMSecurityVerifyDirectoryReconciler) waitForJob(
 				h    *RequestHandle,
 				name string) (err error) {
 
+	/*
+	 * We wait for up to 10 minutes, unless the job has been given a longer
+	 * deadline, in which case we wait for a minute past the deadline.
+	 */
+
+	var timeout int64 = 600
+
+	job := &batchv1.Job{}
+	err  = r.Get(h.ctx, types.NamespacedName{
+						Name:      name,
+						Namespace: h.directory.Namespace }, job)
+
+	if err == nil && job.Spec.ActiveDeadlineSeconds != nil &&
+					*job.Spec.ActiveDeadlineSeconds + 60 > timeout {
+		timeout = *job.Spec.ActiveDeadlineSeconds + 60
+	}
+
 	/*
 	 * Wait for the job to finish.
 	 */
 
-	r.Log.Info("Waiting up to 10 minutes for the job to finish", 
-					r.createLogParams(h, "Job.Name", name)...)
+	r.Log.Info("Waiting for the job to finish", 
+			r.createLogParams(h, "Job.Name", name, "Timeout", timeout)...)
 
-	err = wait.PollImmediate(time.Second, time.Duration(600) * time.Second, 
+	err = wait.PollImmediate(time.Second, time.Duration(timeout) * time.Second, 
 					r.isJobComplete(h, name))
 
 	if err != nil {
@@ -335,42 +429,288 @@ func (r *IBMSecurityVerifyDirectoryReconciler) waitForJob(
 /*****************************************************************************/
 
 /*
- * The following function is used to create a new service.
+ * The following function is used to apply the supplied job settings to a
+ * job specification.  The default settings are used if no settings have
+ * been supplied.
+ */
+
+func (r *IBMSecurityVerifyDirectoryReconciler) applyJobSettings(
+			spec     *batchv1.JobSpec,
+			settings *ibmv1.IBMSecurityVerifyDirectorySeedJob) {
+
+	backOffLimit := ibmv1.DefaultSeedJobBackoffLimit
+	ttl          := ibmv1.DefaultSeedJobTTLSeconds
+
+	spec.BackoffLimit            = &backOffLimit
+	spec.TTLSecondsAfterFinished = &ttl
+
+	if settings == nil {
+		return
+	}
+
+	if settings.BackoffLimit != nil {
+		spec.BackoffLimit = settings.BackoffLimit
+	}
+
+	if settings.TTLSecondsAfterFinished != nil {
+		spec.TTLSecondsAfterFinished = settings.TTLSecondsAfterFinished
+	}
+
+	spec.ActiveDeadlineSeconds = settings.ActiveDeadlineSeconds
+}
+
+/*****************************************************************************/
+
+/*
+ * The following function is used to run a job, using the server image,
+ * which executes the supplied script.  The function will wait for the job
+ * to complete.  The default job settings are used if no settings have been
+ * supplied.
+ */
+
+func (r *IBMSecurityVerifyDirectoryReconciler) runServerJob(
+			h            *RequestHandle,
+			pvcName      string,
+			jobName      string,
+			script       string,
+			env          []corev1.EnvVar,
+			volumes      []corev1.Volume,
+			volumeMounts []corev1.VolumeMount,
+			settings     *ibmv1.IBMSecurityVerifyDirectorySeedJob) (err error) {
+
+	r.Log.V(1).Info("Entering a function", 
+				r.createLogParams(h, "Function", "runServerJob",
+						"Job.Name", jobName)...)
+
+	imageName := fmt.Sprintf("%s/verify-directory-server:%s",
+					h.directory.Spec.Pods.Image.Repo,
+					h.directory.Spec.Pods.Image.Label)
+
+	var completions  int32 = 1
+
+	job := &batchv1.Job{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      jobName,
+			Namespace: h.directory.Namespace,
+			Labels:    utils.LabelsForApp(h.directory.Name, pvcName),
+		},
+		Spec: batchv1.JobSpec{
+			Completions:             &completions,
+			Template:                corev1.PodTemplateSpec {
+				Spec: corev1.PodSpec {
+					Volumes:            volumes,
+					ImagePullSecrets:   h.directory.Spec.Pods.Image.ImagePullSecrets,
+					ServiceAccountName: h.directory.Spec.Pods.ServiceAccountName,
+					RestartPolicy:      corev1.RestartPolicyNever,
+					Containers:         []corev1.Container{{
+						Command:         []string{ "/bin/sh", "-c", script },
+						Env:             env,
+						EnvFrom:         h.directory.Spec.Pods.EnvFrom,
+						Image:           imageName,
+						Name:            jobName,
+						ImagePullPolicy: h.directory.Spec.Pods.Image.ImagePullPolicy,
+						VolumeMounts:    volumeMounts,
+					}},
+				},
+			},
+		},
+	}
+
+	r.applyJobSettings(&job.Spec, settings)
+
+	ctrl.SetControllerReference(h.directory, job, r.Scheme)
+
+	r.Log.Info("Creating a new job", 
+						r.createLogParams(h, "Job.Name", job.Name)...)
+
+	r.Log.V(1).Info("Job details", 
+				r.createLogParams(h, "Details", job)...)
+
+	err = r.Create(h.ctx, job)
+
+	if err != nil {
+ 		r.Log.Error(err, "Failed to create the new job",
+						r.createLogParams(h, "Job.Name", job.Name)...)
+
+		return
+	}
+
+	/*
+	 * Wait for the job to complete.
+	 */
+
+	err = r.waitForJob(h, jobName)
+
+	return
+}
+
+/*****************************************************************************/
+
+/*
+ * The following function will return the environment variables which are
+ * used by a job to connect to the specified replica using the LDAP client
+ * utilities.  The connection is always made using the LDAP port of the
+ * replica.
+ */
+
+func (r *IBMSecurityVerifyDirectoryReconciler) getLdapClientEnv(
+			h       *RequestHandle,
+			pvcName string) (env []corev1.EnvVar, err error) {
+
+	if h.config.ldapPort == 0 {
+		err = errors.New("The LDAP port of the server must be enabled to " +
+					"import LDIF data.")
+
+		return
+	}
+
+	dnEnv, err := utils.GetEnvVar("LDAP_ADMIN_DN", h.config.adminDn)
+
+	if err != nil {
+		return
+	}
+
+	pwdEnv, err := utils.GetEnvVar("LDAP_ADMIN_PWD", h.config.adminPwd)
+
+	if err != nil {
+		return
+	}
+
+	env = []corev1.EnvVar {
+		{
+			Name:  "LDAP_HOST",
+			Value: fmt.Sprintf("%s.%s.svc",
+						r.getReplicaPodName(h.directory, pvcName),
+						h.directory.Namespace),
+		},
+		{
+			Name:  "LDAP_PORT",
+			Value: strconv.Itoa(int(h.config.ldapPort)),
+		},
+		dnEnv,
+		pwdEnv,
+	}
+
+	return
+}
+
+/*****************************************************************************/
+
+/*
+ * The following function is used to create the service for a replica, or
+ * to update the ports of the existing service.
  */
 
 func (r *IBMSecurityVerifyDirectoryReconciler) createClusterService(
 			h          *RequestHandle,
 			podName    string,
-			serverPort int32,
 			pvcName    string) (error) {
 
 	r.Log.V(1).Info("Entering a function", 
 				r.createLogParams(h, "Function", "createClusterService",
-						"Pod.Name", podName, "Port", serverPort,
-						"PVC.Name", pvcName)...)	
+						"Pod.Name", podName, "PVC.Name", pvcName)...)	
+
+	return r.ensureService(h, podName,
+				utils.LabelsForApp(h.directory.Name, pvcName),
+				r.getServicePorts(h.config.ldapPort, h.config.ldapsPort))
+}
+
+/*****************************************************************************/
+
+/*
+ * The following function is used to ensure that the service for each of the
+ * existing replicas publishes the ports which are currently enabled.  The
+ * ports are reconciled on every pass so that a change to the enabled ports,
+ * or a service which was created by an earlier version of the operator, is
+ * corrected.
+ */
+
+func (r *IBMSecurityVerifyDirectoryReconciler) reconcileServices(
+			h        *RequestHandle,
+			existing map[string]string) (err error) {
+
+	r.Log.V(1).Info("Entering a function", 
+				r.createLogParams(h, "Function", "reconcileServices")...)	
+
+	for _, pvcName := range r.getOrderedReplicas(h, existing) {
+		err = r.createClusterService(h, existing[pvcName], pvcName)
+
+		if err != nil {
+			return
+		}
+	}
+
+	return
+}
+
+/*****************************************************************************/
+
+/*
+ * The following function is used to create a new service, or to update the
+ * ports of an existing service.
+ */
+
+func (r *IBMSecurityVerifyDirectoryReconciler) ensureService(
+			h      *RequestHandle,
+			name   string,
+			labels map[string]string,
+			ports  []corev1.ServicePort) (err error) {
+
+	/*
+	 * Check to see whether the service already exists.
+	 */
+
+	service := &corev1.Service{}
+	err      = r.Get(h.ctx, types.NamespacedName{
+							Namespace: h.directory.Namespace,
+							Name:      name,
+						}, service)
+
+	if err != nil && ! k8serrors.IsNotFound(err) {
+ 		r.Log.Error(err, "Failed to retrieve the service",
+				r.createLogParams(h, "Service.Name", name)...)
+
+		return
+	}
+
+	if err == nil {
+		if reflect.DeepEqual(service.Spec.Ports, ports) {
+			return
+		}
+
+		/*
+		 * Update the ports of the existing service.
+		 */
+
+		service.Spec.Ports = ports
+
+		r.Log.Info("Updating the ports of the service", 
+				r.createLogParams(h, "Service.Name", name)...)
+
+		err = r.Update(h.ctx, service)
+
+		if err != nil {
+ 			r.Log.Error(err, "Failed to update the service",
+					r.createLogParams(h, "Service.Name", name)...)
+		}
+
+		return
+	}
 
 	/*
 	 * Initialise the service structure.
 	 */
 
-	service := &corev1.Service{
+	service = &corev1.Service{
 		ObjectMeta: metav1.ObjectMeta{
-			Name:      podName,
+			Name:      name,
 			Namespace: h.directory.Namespace,
-			Labels:    utils.LabelsForApp(h.directory.Name, pvcName),
+			Labels:    labels,
 		},
 		Spec: corev1.ServiceSpec{
 			Type:     corev1.ServiceTypeClusterIP,
-			Selector: utils.LabelsForApp(h.directory.Name, pvcName),
-			Ports:    []corev1.ServicePort{{
-				Name:       podName,
-				Protocol:   corev1.ProtocolTCP,
-				Port:       serverPort,
-				TargetPort: intstr.IntOrString {
-					Type:   intstr.Int,
-					IntVal: serverPort,
-				},
-			}},
+			Selector: labels,
+			Ports:    ports,
 		},
 	}
 
@@ -380,22 +720,76 @@ func (r *IBMSecurityVerifyDirectoryReconciler) createClusterService(
 	 * Create the service.
 	 */
 
-	r.Log.Info("Creating a new service for the pod", 
-				r.createLogParams(h, "Pod.Name", podName)...)
+	r.Log.Info("Creating a new service", 
+				r.createLogParams(h, "Service.Name", name)...)
 
 	r.Log.V(1).Info("Service details", 
 			r.createLogParams(h, "Service", service)...)
 
-	err := r.Create(h.ctx, service)
+	err = r.Create(h.ctx, service)
 
 	if err != nil {
- 		r.Log.Error(err, "Failed to create the service for the pod",
-				r.createLogParams(h, "Pod.Name", podName)...)
+ 		r.Log.Error(err, "Failed to create the service",
+				r.createLogParams(h, "Service.Name", name)...)
+	}
 
-		return err
+	return
+}
+
+/*****************************************************************************/
+
+/*
+ * The following function will return the container ports for the LDAP and
+ * LDAPS ports which have been enabled.
+ */
+
+func (r *IBMSecurityVerifyDirectoryReconciler) getContainerPorts(
+				ldapPort  int32,
+				ldapsPort int32) (ports []corev1.ContainerPort) {
+
+	if ldapPort != 0 {
+		ports = append(ports, corev1.ContainerPort {
+			Name:          "ldap",
+			ContainerPort: ldapPort,
+			Protocol:      corev1.ProtocolTCP,
+		})
 	}
 
-	return nil
+	if ldapsPort != 0 {
+		ports = append(ports, corev1.ContainerPort {
+			Name:          "ldaps",
+			ContainerPort: ldapsPort,
+			Protocol:      corev1.ProtocolTCP,
+		})
+	}
+
+	return
+}
+
+/*****************************************************************************/
+
+/*
+ * The following function will return the service ports for the LDAP and
+ * LDAPS ports which have been enabled.
+ */
+
+func (r *IBMSecurityVerifyDirectoryReconciler) getServicePorts(
+				ldapPort  int32,
+				ldapsPort int32) (ports []corev1.ServicePort) {
+
+	for _, port := range r.getContainerPorts(ldapPort, ldapsPort) {
+		ports = append(ports, corev1.ServicePort {
+			Name:       port.Name,
+			Protocol:   corev1.ProtocolTCP,
+			Port:       port.ContainerPort,
+			TargetPort: intstr.IntOrString {
+				Type:   intstr.Int,
+				IntVal: port.ContainerPort,
+			},
+		})
+	}
+
+	return
 }
 
 /*****************************************************************************/
@@ -452,6 +846,9 @@ func (r *IBMSecurityVerifyDirectoryReconciler) executeCommand(
 		r.Log.Error(err, "Failed to execute a command!", 
 				r.createLogParams(h, "command", command)...)
 
+		execFailures.WithLabelValues(
+					metricsLabelValues(h, command[0])...).Inc()
+
 		return err
 	}
 
@@ -464,6 +861,9 @@ func (r *IBMSecurityVerifyDirectoryReconciler) executeCommand(
 				r.createLogParams(h, "command", command, 
 					"stdout", stdout.String(), "stderr", stderr.String())...)
 
+		execFailures.WithLabelValues(
+					metricsLabelValues(h, command[0])...).Inc()
+
 		return err
 	}
 
@@ -476,4 +876,169 @@ func (r *IBMSecurityVerifyDirectoryReconciler) executeCommand(
 
 /*****************************************************************************/
 
+/*
+ * The following function is used to collect the diagnostics for a failed
+ * job, so that they are still available once the job, and its pods, have
+ * been deleted.  The termination reason of the most recently failed pod is
+ * returned, along with the tail of its log.
+ */
+
+func (r *IBMSecurityVerifyDirectoryReconciler) getJobDiagnostics(
+				h       *RequestHandle,
+				jobName string) (reason string, logs string) {
+
+	r.Log.V(1).Info("Entering a function", 
+				r.createLogParams(h, "Function", "getJobDiagnostics",
+						"Job.Name", jobName)...)
+
+	/*
+	 * Locate the most recently failed pod of the job.  The job controller
+	 * adds the 'job-name' label to each of the pods which it creates.
+	 */
+
+	podList := &corev1.PodList{}
+
+	err := r.List(h.ctx, podList, client.InNamespace(h.directory.Namespace),
+						client.MatchingLabels{"job-name": jobName})
+
+	if err != nil {
+ 		r.Log.Error(err, "Failed to retrieve the pods for the job",
+						r.createLogParams(h, "Job.Name", jobName)...)
+
+		return
+	}
+
+	var failed *corev1.Pod
+
+	for idx, pod := range podList.Items {
+		if pod.Status.Phase != corev1.PodFailed {
+			continue
+		}
+
+		if failed == nil || 
+			failed.CreationTimestamp.Before(&pod.CreationTimestamp) {
+			failed = &podList.Items[idx]
+		}
+	}
+
+	if failed == nil {
+		reason = "No failed pod was found for the job."
+
+		return
+	}
+
+	/*
+	 * Determine the termination reason of the pod.
+	 */
+
+	reason = failed.Status.Reason
+
+	for _, status := range failed.Status.ContainerStatuses {
+		terminated := status.State.Terminated
+
+		if terminated == nil {
+			continue
+		}
+
+		reason = fmt.Sprintf("%s (exit code %d)", 
+						terminated.Reason, terminated.ExitCode)
+
+		if terminated.Message != "" {
+			reason = fmt.Sprintf("%s: %s", reason, 
+						strings.TrimSpace(terminated.Message))
+		}
+	}
+
+	/*
+	 * Retrieve the tail of the log of the pod.
+	 */
+
+	kubeClient := kubernetes.NewForConfigOrDie(ctrl.GetConfigOrDie())
+
+	var tailLines int64 = JobLogTailLines
+
+	data, err := kubeClient.CoreV1().Pods(h.directory.Namespace).GetLogs(
+					failed.Name, &corev1.PodLogOptions{
+						TailLines: &tailLines,
+					}).DoRaw(h.ctx)
+
+	if err != nil {
+ 		r.Log.Error(err, "Failed to retrieve the log of the pod",
+						r.createLogParams(h, "Pod.Name", failed.Name)...)
+
+		return
+	}
+
+	logs = strings.TrimSpace(string(data))
+
+	/*
+	 * The diagnostics are written to the log, and are included in the
+	 * events and the conditions of the document, and so any sensitive data
+	 * must first be masked.  The secrets which were available to the pod
+	 * are registered so that their values are also masked.
+	 */
+
+	r.registerPodSecrets(h, failed)
+
+	reason = fmt.Sprintf("%v", utils.Redact(reason))
+	logs   = fmt.Sprintf("%v", utils.Redact(logs))
+
+	r.Log.Info("Collected the diagnostics for a failed job",
+			r.createLogParams(h, "Job.Name", jobName, "Pod.Name", failed.Name,
+					"Reason", reason, "Logs", logs)...)
+
+	return
+}
+
+/*****************************************************************************/
+
+/*
+ * The following function is used to register the values of the secrets
+ * which were available to a pod, along with the admin password, so that the
+ * values are masked by the redaction functions.  Any errors are ignored as
+ * the values are only being registered.
+ */
+
+func (r *IBMSecurityVerifyDirectoryReconciler) registerPodSecrets(
+				h   *RequestHandle,
+				pod *corev1.Pod) {
+
+	rctx := r.getResolveContext(h)
+
+	utils.ResolveNamedEntry("general.admin.pwd", h.config.adminPwd, rctx)
+
+	for _, container := range pod.Spec.Containers {
+		for _, env := range container.Env {
+			if env.ValueFrom == nil || env.ValueFrom.SecretKeyRef == nil {
+				continue
+			}
+
+			utils.ResolveEntry(fmt.Sprintf("secret:%s/%s",
+						env.ValueFrom.SecretKeyRef.Name,
+						env.ValueFrom.SecretKeyRef.Key), rctx)
+		}
+
+		for _, envFrom := range container.EnvFrom {
+			if envFrom.SecretRef == nil {
+				continue
+			}
+
+			secret := &corev1.Secret{}
+			err    := r.Get(h.ctx, types.NamespacedName{
+								Namespace: pod.Namespace,
+								Name:      envFrom.SecretRef.Name,
+							}, secret)
+
+			if err != nil {
+				continue
+			}
+
+			for _, value := range secret.Data {
+				utils.RegisterSecretValue(string(value))
+			}
+		}
+	}
+}
+
+/*****************************************************************************/
 
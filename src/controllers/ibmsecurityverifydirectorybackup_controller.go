@@ -0,0 +1,1456 @@
+/* vi: set ts=4 sw=4 noexpandtab : */
+
+/*
+ * Copyright contributors to the IBM Security Verify Directory Operator project
+ */
+
+package controllers
+
+/*
+ * This file contains the controller which is used to manage the backups of
+ * a directory server deployment.
+ */
+
+/*****************************************************************************/
+
+import (
+	metav1  "k8s.io/apimachinery/pkg/apis/meta/v1"
+	corev1  "k8s.io/api/core/v1"
+	batchv1 "k8s.io/api/batch/v1"
+
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/wait"
+
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+
+	"sigs.k8s.io/controller-runtime/pkg/builder"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"sigs.k8s.io/controller-runtime/pkg/source"
+
+	"github.com/go-logr/logr"
+	"github.com/ibm-security/verify-directory-operator/ldapconfig"
+	"github.com/ibm-security/verify-directory-operator/utils"
+
+	ctrl  "sigs.k8s.io/controller-runtime"
+	ibmv1 "github.com/ibm-security/verify-directory-operator/api/v1"
+)
+
+/*****************************************************************************/
+
+/*
+ * Some constants...
+ */
+
+const BackupMountPath = "/var/isvd/backup"
+const SourceMountPath = "/var/isvd/source"
+
+const BackupPhaseRunning   = "Running"
+const BackupPhaseCompleted = "Completed"
+const BackupPhaseFailed    = "Failed"
+
+const DefaultBackupRetain int32 = 7
+
+/*
+ * The script which is executed by the backup job.  The backup is written to
+ * a directory, named after the job, within the target PVC.  A database
+ * backup is archived from a volume which has been provisioned from a
+ * snapshot of the replica, and so the data volume of the running replica is
+ * never read directly.  Once the backup has been taken the older backups
+ * are pruned and the size of the backup is written to the termination log
+ * so that it can be recorded in the status of the document.
+ */
+
+const backupScript = `set -e
+
+BACKUP_DIR="${BACKUP_ROOT}/${BACKUP_NAME}"
+
+mkdir -p "${BACKUP_DIR}"
+
+if [ "${BACKUP_FORMAT}" = "ldif" ] ; then
+    echo "${LDAP_SUFFIXES}" | while read -r suffix ; do
+        [ -z "${suffix}" ] && continue
+
+        idsldapsearch -h "${LDAP_HOST}" -p "${LDAP_PORT}" \
+            -D "${LDAP_ADMIN_DN}" -w "${LDAP_ADMIN_PWD}" \
+            -b "${suffix}" -s sub -L "(objectclass=*)" \
+            >> "${BACKUP_DIR}/backup.ldif"
+    done
+else
+    tar -czf "${BACKUP_DIR}/backup.tar.gz" -C "${SOURCE_DIR}" .
+fi
+
+if [ "${BACKUP_RETAIN}" -gt 0 ] ; then
+    ls -1dt "${BACKUP_ROOT}"/*/ | tail -n +$((BACKUP_RETAIN + 1)) | \
+        xargs -r rm -rf
+fi
+
+du -sb "${BACKUP_DIR}" | cut -f1 > /dev/termination-log
+`
+
+/*****************************************************************************/
+
+/*
+ * IBMSecurityVerifyDirectoryBackupReconciler reconciles an
+ * IBMSecurityVerifyDirectoryBackup object.
+ */
+
+type IBMSecurityVerifyDirectoryBackupReconciler struct {
+	client.Client
+	Log logr.Logger
+	Scheme *runtime.Scheme
+}
+
+/*****************************************************************************/
+
+//+kubebuilder:rbac:groups=ibm.com,resources=ibmsecurityverifydirectorybackups,verbs=get;list;watch;create;update;patch;delete
+//+kubebuilder:rbac:groups=ibm.com,resources=ibmsecurityverifydirectorybackups/status,verbs=get;update;patch
+//+kubebuilder:rbac:groups=ibm.com,resources=ibmsecurityverifydirectorybackups/finalizers,verbs=update
+//+kubebuilder:rbac:groups=batch,resources=cronjobs,verbs=get;list;watch;create;update;delete
+//+kubebuilder:rbac:groups=batch,resources=jobs,verbs=get;list;watch;create;update;delete
+//+kubebuilder:rbac:groups=core,resources=persistentvolumeclaims,verbs=get;list;watch;create;delete
+//+kubebuilder:rbac:groups=snapshot.storage.k8s.io,resources=volumesnapshots,verbs=get;list;watch;create;delete
+
+/*****************************************************************************/
+
+/*
+ * The following structure is used to define a request handle for the backup
+ * controller.
+ */
+
+type BackupRequestHandle struct {
+	ctx       context.Context
+	req       ctrl.Request
+	backup    *ibmv1.IBMSecurityVerifyDirectoryBackup
+	directory *ibmv1.IBMSecurityVerifyDirectory
+	replica   string
+}
+
+/*****************************************************************************/
+
+/*
+ * Reconcile is part of the main kubernetes reconciliation loop which aims to
+ * move the current state of the cluster closer to the desired state.
+ */
+
+func (r *IBMSecurityVerifyDirectoryBackupReconciler) Reconcile(
+			ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+
+	h := BackupRequestHandle{
+		ctx:       ctx,
+		req:       req,
+		backup:    &ibmv1.IBMSecurityVerifyDirectoryBackup{},
+		directory: &ibmv1.IBMSecurityVerifyDirectory{},
+	}
+
+	r.Log.V(1).Info("Entering a function",
+				r.createLogParams(&h, "Function", "Reconcile")...)
+
+	/*
+	 * Fetch the backup document.
+	 */
+
+	err	:= r.Get(ctx, req.NamespacedName, h.backup)
+
+	if err != nil {
+		if k8serrors.IsNotFound(err) {
+			r.Log.Info(
+				"Resource not found most likely due to it having been deleted",
+								r.createLogParams(&h)...)
+		} else {
+			r.Log.Error(err, "Failed to get the VerifyDirectoryBackup resource",
+					r.createLogParams(&h)...)
+		}
+
+		return ctrl.Result{}, nil
+	}
+
+	/*
+	 * Fetch the directory which is to be backed up.
+	 */
+
+	err = r.Get(ctx, types.NamespacedName{
+						Namespace: req.Namespace,
+						Name:      h.backup.Spec.Directory,
+					}, h.directory)
+
+	if err != nil {
+		r.setCondition(err, &h, ibmv1.ReasonDirectoryNotFound,
+							"Failed to retrieve the directory.")
+
+		return ctrl.Result{}, nil
+	}
+
+	h.directory.Default()
+
+	/*
+	 * Work out the replica which is to be backed up.
+	 */
+
+	h.replica, err = r.getSourceReplica(&h)
+
+	if err != nil {
+		r.setCondition(err, &h, ibmv1.ReasonReplicaInvalid,
+							"Failed to determine the replica.")
+
+		return ctrl.Result{}, nil
+	}
+
+	/*
+	 * Construct the job which is used to perform the backup.
+	 */
+
+	jobSpec, err := r.getJobSpec(&h)
+
+	if err != nil {
+		r.setCondition(err, &h, ibmv1.ReasonBackupJobFailed,
+							"Failed to construct the backup job.")
+
+		return ctrl.Result{}, nil
+	}
+
+	/*
+	 * Create the job, or the cron job if the backups are to be scheduled.
+	 */
+
+	if h.backup.Spec.Schedule == "" {
+		err = r.createJob(&h, jobSpec)
+	} else {
+		err = r.saveCronJob(&h, jobSpec)
+	}
+
+	if err != nil {
+		r.setCondition(err, &h, ibmv1.ReasonBackupJobFailed,
+							"Failed to create the backup job.")
+
+		return ctrl.Result{}, nil
+	}
+
+	/*
+	 * Provision the source volume of any database backup job which is
+	 * waiting to be started.  We retry periodically if the volume cannot
+	 * be provisioned, as the job will remain suspended until it has been.
+	 */
+
+	err = r.prepareSourceVolume(&h)
+
+	if err != nil {
+		r.setCondition(err, &h, ibmv1.ReasonSourceVolumeFailed,
+							"Failed to provision the source volume.")
+
+		return ctrl.Result{RequeueAfter: time.Minute}, nil
+	}
+
+	/*
+	 * Update the status of the backups.
+	 */
+
+	err = r.updateBackupRecords(&h)
+
+	if err != nil {
+		r.setCondition(err, &h, ibmv1.ReasonBackupStatusFailed,
+							"Failed to update the backup status.")
+
+		return ctrl.Result{}, nil
+	}
+
+	r.setCondition(nil, &h, "", "")
+
+	return ctrl.Result{}, nil
+}
+
+/*****************************************************************************/
+
+/*
+ * The following function is used to determine the replica which is to be
+ * backed up.
+ */
+
+func (r *IBMSecurityVerifyDirectoryBackupReconciler) getSourceReplica(
+			h *BackupRequestHandle) (string, error) {
+
+	pvcs := h.directory.Spec.Replicas.PVCs
+
+	if h.backup.Spec.Replica == "" {
+		if len(pvcs) == 0 {
+			return "", errors.New(fmt.Sprintf(
+				"The directory, %s, does not contain any replicas.",
+				h.directory.Name))
+		}
+
+		return pvcs[0], nil
+	}
+
+	for _, pvc := range pvcs {
+		if pvc == h.backup.Spec.Replica {
+			return pvc, nil
+		}
+	}
+
+	return "", errors.New(fmt.Sprintf(
+				"The replica, %s, is not a replica of the directory, %s.",
+				h.backup.Spec.Replica, h.directory.Name))
+}
+
+/*****************************************************************************/
+
+/*
+ * The following function is used to construct the specification of the job
+ * which is used to perform the backup.  The volumes are mounted in the same
+ * way as the seed job, with the target PVC mounted in place of the replica
+ * data.
+ */
+
+func (r *IBMSecurityVerifyDirectoryBackupReconciler) getJobSpec(
+			h *BackupRequestHandle) (spec batchv1.JobSpec, err error) {
+
+	r.Log.V(1).Info("Entering a function",
+				r.createLogParams(h, "Function", "getJobSpec")...)
+
+	dr, dh := r.getDirectoryHandle(h)
+
+	directory := h.directory
+	podName   := dr.getReplicaPodName(directory, h.replica)
+	format    := h.backup.Spec.Format
+
+	if format == "" {
+		format = "database"
+	}
+
+	imageName := fmt.Sprintf("%s/verify-directory-server:%s",
+					directory.Spec.Pods.Image.Repo,
+					directory.Spec.Pods.Image.Label)
+
+	/*
+	 * The volume configuration.
+	 */
+
+	volumes := []corev1.Volume {
+		{
+			Name: "isvd-backup",
+			VolumeSource: corev1.VolumeSource{
+				PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{
+					ClaimName: h.backup.Spec.TargetPVC,
+					ReadOnly:  false,
+				},
+			},
+		},
+	}
+
+	volumeMounts := []corev1.VolumeMount {
+		{
+			Name:      "isvd-backup",
+			MountPath: BackupMountPath,
+		},
+	}
+
+	/*
+	 * Set up the environment variables.
+	 */
+
+	env := append([]corev1.EnvVar{}, directory.Spec.Pods.Env...)
+
+	env = append(env,
+		corev1.EnvVar {
+			Name:  "BACKUP_FORMAT",
+			Value: format,
+		},
+		corev1.EnvVar {
+			Name:  "BACKUP_ROOT",
+			Value: fmt.Sprintf("%s/%s", BackupMountPath, h.backup.Name),
+		},
+		corev1.EnvVar {
+			Name:  "BACKUP_RETAIN",
+			Value: strconv.Itoa(r.getBackupRetain(h)),
+		},
+		corev1.EnvVar {
+			Name:  "BACKUP_NAME",
+			ValueFrom: &corev1.EnvVarSource {
+				FieldRef: &corev1.ObjectFieldSelector {
+					FieldPath: "metadata.labels['job-name']",
+				},
+			},
+		},
+	)
+
+	suspend := false
+
+	if format == "ldif" {
+		/*
+		 * The LDIF is exported from the running replica, and so we need the
+		 * connection details of the replica.
+		 */
+
+		var ldapEnv []corev1.EnvVar
+
+		ldapEnv, err = r.getLdapEnv(h, dr, dh, podName)
+
+		if err != nil {
+			return
+		}
+
+		env = append(env, ldapEnv...)
+	} else {
+		/*
+		 * The database is archived from a volume which is provisioned from
+		 * a snapshot of the data volume of the replica.  The job is created
+		 * suspended, and is only started once the volume has been
+		 * provisioned (see prepareSourceVolume).
+		 */
+
+		volumes = append(volumes, corev1.Volume {
+			Name: "isvd-source",
+			VolumeSource: corev1.VolumeSource{
+				PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{
+					ClaimName: r.getSourceVolumeName(h),
+					ReadOnly:  true,
+				},
+			},
+		})
+
+		volumeMounts = append(volumeMounts, corev1.VolumeMount {
+			Name:      "isvd-source",
+			MountPath: SourceMountPath,
+			ReadOnly:  true,
+		})
+
+		env = append(env, corev1.EnvVar {
+			Name:  "SOURCE_DIR",
+			Value: SourceMountPath,
+		})
+
+		suspend = true
+	}
+
+	/*
+	 * Construct the job specification.  The retry settings of the seed job
+	 * of the directory are also applied to the backup jobs.
+	 */
+
+	var completions  int32 = 1
+
+	backOffLimit := ibmv1.DefaultSeedJobBackoffLimit
+	seedJob      := directory.Spec.Replicas.SeedJob
+
+	if seedJob != nil && seedJob.BackoffLimit != nil {
+		backOffLimit = *seedJob.BackoffLimit
+	}
+
+	spec = batchv1.JobSpec{
+		Completions:  &completions,
+		BackoffLimit: &backOffLimit,
+		Suspend:      &suspend,
+		Template:     corev1.PodTemplateSpec {
+			ObjectMeta: metav1.ObjectMeta{
+				Labels: r.labelsForBackup(h),
+			},
+			Spec: corev1.PodSpec {
+				Volumes:            volumes,
+				ImagePullSecrets:   directory.Spec.Pods.Image.ImagePullSecrets,
+				ServiceAccountName: directory.Spec.Pods.ServiceAccountName,
+				RestartPolicy:      corev1.RestartPolicyNever,
+				Containers:         []corev1.Container{{
+					Command:         []string{ "/bin/sh", "-c", backupScript },
+					Env:             env,
+					EnvFrom:         directory.Spec.Pods.EnvFrom,
+					Image:           imageName,
+					Name:            "backup",
+					ImagePullPolicy: directory.Spec.Pods.Image.ImagePullPolicy,
+					VolumeMounts:    volumeMounts,
+				}},
+			},
+		},
+	}
+
+	if seedJob != nil {
+		spec.ActiveDeadlineSeconds = seedJob.ActiveDeadlineSeconds
+	}
+
+	return
+}
+
+/*****************************************************************************/
+
+/*
+ * The following function will return the environment variables which are
+ * used to connect to the replica when exporting the LDIF.  The LDIF is
+ * always exported using the LDAP port of the replica.
+ */
+
+func (r *IBMSecurityVerifyDirectoryBackupReconciler) getLdapEnv(
+			h       *BackupRequestHandle,
+			dr      *IBMSecurityVerifyDirectoryReconciler,
+			dh      *RequestHandle,
+			podName string) (env []corev1.EnvVar, err error) {
+
+	body, err := dr.getServerConfigBody(dh)
+
+	if err != nil {
+		return
+	}
+
+	config, err := ldapconfig.ParseServerConfig(body,
+						dr.getResolveContext(dh),
+						h.directory.Spec.Credentials.Generate)
+
+	if err != nil {
+		return
+	}
+
+	ldapPort := config.Ports.LDAP
+
+	if ldapPort == 0 {
+		err = errors.New("An LDIF backup requires the LDAP port of the " +
+					"server to be enabled.")
+
+		return
+	}
+
+	suffixes := config.Suffixes
+
+	/*
+	 * Work out the admin credentials.
+	 */
+
+	adminDn  := config.AdminDn
+	adminPwd := config.AdminPwd
+
+	if h.directory.Spec.Credentials.Generate {
+		adminPwd = fmt.Sprintf("secret:%s/%s",
+				utils.GetCredentialsSecretName(h.directory.Name,
+						h.directory.Spec.Credentials.SecretName),
+				utils.AdminPwdKey)
+	}
+
+	dnEnv, err := utils.GetEnvVar("LDAP_ADMIN_DN", adminDn)
+
+	if err != nil {
+		return
+	}
+
+	pwdEnv, err := utils.GetEnvVar("LDAP_ADMIN_PWD", adminPwd)
+
+	if err != nil {
+		return
+	}
+
+	env = []corev1.EnvVar {
+		{
+			Name:  "LDAP_HOST",
+			Value: fmt.Sprintf("%s.%s.svc", podName, h.directory.Namespace),
+		},
+		{
+			Name:  "LDAP_PORT",
+			Value: strconv.Itoa(int(ldapPort)),
+		},
+		{
+			Name:  "LDAP_SUFFIXES",
+			Value: strings.Join(suffixes, "\n"),
+		},
+		dnEnv,
+		pwdEnv,
+	}
+
+	return
+}
+
+/*****************************************************************************/
+
+/*
+ * The following function will return the directory controller, and a
+ * request handle for the directory, so that the functions of the directory
+ * controller can be used to retrieve the configuration of the directory.
+ */
+
+func (r *IBMSecurityVerifyDirectoryBackupReconciler) getDirectoryHandle(
+			h *BackupRequestHandle) (
+				*IBMSecurityVerifyDirectoryReconciler, *RequestHandle) {
+
+	dr := &IBMSecurityVerifyDirectoryReconciler{
+		Client: r.Client,
+		Log:    r.Log,
+		Scheme: r.Scheme,
+	}
+
+	dh := &RequestHandle{
+		ctx:       h.ctx,
+		req:       ctrl.Request{NamespacedName: types.NamespacedName{
+						Namespace: h.directory.Namespace,
+						Name:      h.directory.Name,
+					}},
+		directory: h.directory,
+	}
+
+	return dr, dh
+}
+
+/*****************************************************************************/
+
+/*
+ * The following function is used to create the job for a single backup,
+ * if the job has not already been created.
+ */
+
+func (r *IBMSecurityVerifyDirectoryBackupReconciler) createJob(
+			h    *BackupRequestHandle,
+			spec batchv1.JobSpec) (err error) {
+
+	name := strings.ToLower(h.backup.Name)
+
+	/*
+	 * Remove any cron job which might have been created for a previous
+	 * schedule.
+	 */
+
+	err = r.deleteCronJob(h)
+
+	if err != nil {
+		return
+	}
+
+	/*
+	 * Check to see if the job already exists.
+	 */
+
+	job := &batchv1.Job{}
+	err  = r.Get(h.ctx, types.NamespacedName{
+						Namespace: h.backup.Namespace,
+						Name:      name,
+					}, job)
+
+	if err == nil || ! k8serrors.IsNotFound(err) {
+		return
+	}
+
+	job = &batchv1.Job{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: h.backup.Namespace,
+			Labels:    r.labelsForBackup(h),
+		},
+		Spec: spec,
+	}
+
+	ctrl.SetControllerReference(h.backup, job, r.Scheme)
+
+	r.Log.Info("Creating a new backup job",
+						r.createLogParams(h, "Job.Name", job.Name)...)
+
+	r.Log.V(1).Info("Backup job details",
+				r.createLogParams(h, "Details", job)...)
+
+	err = r.Create(h.ctx, job)
+
+	if err != nil {
+ 		r.Log.Error(err, "Failed to create the backup job",
+						r.createLogParams(h, "Job.Name", job.Name)...)
+	}
+
+	return
+}
+
+/*****************************************************************************/
+
+/*
+ * The following function is used to create or update the cron job which
+ * is used to schedule the backups.
+ */
+
+func (r *IBMSecurityVerifyDirectoryBackupReconciler) saveCronJob(
+			h    *BackupRequestHandle,
+			spec batchv1.JobSpec) (err error) {
+
+	name := strings.ToLower(h.backup.Name)
+
+	suspend := h.backup.Spec.Suspend
+
+	cronJob := &batchv1.CronJob{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: h.backup.Namespace,
+			Labels:    r.labelsForBackup(h),
+		},
+		Spec: batchv1.CronJobSpec{
+			Schedule:          h.backup.Spec.Schedule,
+			Suspend:           &suspend,
+			ConcurrencyPolicy: batchv1.ForbidConcurrent,
+			JobTemplate:       batchv1.JobTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{
+					Labels: r.labelsForBackup(h),
+				},
+				Spec: spec,
+			},
+		},
+	}
+
+	ctrl.SetControllerReference(h.backup, cronJob, r.Scheme)
+
+	/*
+	 * Check to see if the cron job already exists.
+	 */
+
+	existing := &batchv1.CronJob{}
+	err       = r.Get(h.ctx, types.NamespacedName{
+						Namespace: h.backup.Namespace,
+						Name:      name,
+					}, existing)
+
+	if err != nil {
+		if ! k8serrors.IsNotFound(err) {
+	 		r.Log.Error(err, "Failed to retrieve the backup cron job",
+						r.createLogParams(h, "CronJob.Name", name)...)
+
+			return
+		}
+
+		r.Log.Info("Creating a new backup cron job",
+						r.createLogParams(h, "CronJob.Name", name)...)
+
+		err = r.Create(h.ctx, cronJob)
+	} else if existing.Spec.Schedule != cronJob.Spec.Schedule ||
+			! reflect.DeepEqual(existing.Spec.Suspend, cronJob.Spec.Suspend) ||
+			! reflect.DeepEqual(existing.Spec.JobTemplate.Spec.Suspend,
+						cronJob.Spec.JobTemplate.Spec.Suspend) ||
+			! reflect.DeepEqual(existing.Spec.JobTemplate.Spec.BackoffLimit,
+						cronJob.Spec.JobTemplate.Spec.BackoffLimit) ||
+			! reflect.DeepEqual(
+						existing.Spec.JobTemplate.Spec.ActiveDeadlineSeconds,
+						cronJob.Spec.JobTemplate.Spec.ActiveDeadlineSeconds) ||
+			! reflect.DeepEqual(existing.Spec.JobTemplate.Spec.Template.Spec,
+						cronJob.Spec.JobTemplate.Spec.Template.Spec) {
+
+		r.Log.Info("Updating the backup cron job",
+						r.createLogParams(h, "CronJob.Name", name)...)
+
+		existing.Spec.Schedule    = cronJob.Spec.Schedule
+		existing.Spec.Suspend     = cronJob.Spec.Suspend
+		existing.Spec.JobTemplate = cronJob.Spec.JobTemplate
+
+		err = r.Update(h.ctx, existing)
+	}
+
+	if err != nil {
+ 		r.Log.Error(err, "Failed to save the backup cron job",
+						r.createLogParams(h, "CronJob.Name", name)...)
+	}
+
+	return
+}
+
+/*****************************************************************************/
+
+/*
+ * The following function is used to delete the cron job for the backup, if
+ * it exists.
+ */
+
+func (r *IBMSecurityVerifyDirectoryBackupReconciler) deleteCronJob(
+			h *BackupRequestHandle) (err error) {
+
+	cronJob := &batchv1.CronJob{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      strings.ToLower(h.backup.Name),
+			Namespace: h.backup.Namespace,
+		},
+	}
+
+	err = r.Delete(h.ctx, cronJob)
+
+	if err != nil && k8serrors.IsNotFound(err) {
+		err = nil
+	}
+
+	return
+}
+
+/*****************************************************************************/
+
+/*
+ * The following function will return the name of the PVC, and of the
+ * snapshot from which the PVC is provisioned, which is used as the source
+ * of a database backup.
+ */
+
+func (r *IBMSecurityVerifyDirectoryBackupReconciler) getSourceVolumeName(
+			h *BackupRequestHandle) (string) {
+	return fmt.Sprintf("%s-source", strings.ToLower(h.backup.Name))
+}
+
+/*****************************************************************************/
+
+/*
+ * The following function is used to provision the source volume of a
+ * database backup job which is waiting to be started.  A database backup
+ * job is created suspended, as the data volume of a running replica cannot
+ * be archived directly.  Instead a snapshot is taken of the data volume,
+ * a PVC is provisioned from the snapshot, and the job is then started.  The
+ * source volume is deleted once no backup job remains active.
+ */
+
+func (r *IBMSecurityVerifyDirectoryBackupReconciler) prepareSourceVolume(
+			h *BackupRequestHandle) (err error) {
+
+	r.Log.V(1).Info("Entering a function",
+				r.createLogParams(h, "Function", "prepareSourceVolume")...)
+
+	jobs := &batchv1.JobList{}
+
+	err = r.List(h.ctx, jobs,
+				client.InNamespace(h.backup.Namespace),
+				client.MatchingLabels{utils.BackupLabel: h.backup.Name})
+
+	if err != nil {
+ 		r.Log.Error(err, "Failed to retrieve the backup jobs",
+						r.createLogParams(h)...)
+
+		return
+	}
+
+	/*
+	 * Work out whether a job is currently running, and which job, if any,
+	 * is waiting to be started.
+	 */
+
+	var waiting *batchv1.Job
+
+	running := false
+
+	for idx, job := range jobs.Items {
+		if job.Status.Succeeded > 0 || r.isJobFailed(&job) {
+			continue
+		}
+
+		if job.Spec.Suspend != nil && *job.Spec.Suspend {
+			if waiting == nil {
+				waiting = &jobs.Items[idx]
+			}
+		} else {
+			running = true
+		}
+	}
+
+	/*
+	 * The source volume is still in use if a job is running, and is no
+	 * longer required if no job is waiting to be started.
+	 */
+
+	if running {
+		return
+	}
+
+	if waiting == nil {
+		r.deleteSourceVolume(h, false)
+
+		return
+	}
+
+	/*
+	 * Remove the volume from any previous backup, and then provision the
+	 * volume for this job.
+	 */
+
+	err = r.deleteSourceVolume(h, true)
+
+	if err == nil {
+		err = r.provisionSourceVolume(h)
+	}
+
+	if err != nil {
+		r.deleteSourceVolume(h, false)
+
+		return
+	}
+
+	/*
+	 * Start the job.
+	 */
+
+	r.Log.Info("Starting the backup job",
+				r.createLogParams(h, "Job.Name", waiting.Name)...)
+
+	suspend := false
+
+	waiting.Spec.Suspend = &suspend
+
+	err = r.Update(h.ctx, waiting)
+
+	if err != nil {
+ 		r.Log.Error(err, "Failed to start the backup job",
+						r.createLogParams(h, "Job.Name", waiting.Name)...)
+	}
+
+	return
+}
+
+/*****************************************************************************/
+
+/*
+ * The following function is used to take a snapshot of the data volume of
+ * the replica, and to provision the source volume from the snapshot.  The
+ * source volume is created with the same storage class, access modes and
+ * size as the data volume of the replica.
+ */
+
+func (r *IBMSecurityVerifyDirectoryBackupReconciler) provisionSourceVolume(
+			h *BackupRequestHandle) (err error) {
+
+	r.Log.V(1).Info("Entering a function",
+				r.createLogParams(h, "Function", "provisionSourceVolume")...)
+
+	dr, dh := r.getDirectoryHandle(h)
+
+	name := r.getSourceVolumeName(h)
+
+	/*
+	 * Retrieve the PVC of the replica.
+	 */
+
+	replicaClaim := &corev1.PersistentVolumeClaim{}
+	err           = r.Get(h.ctx, types.NamespacedName{
+							Namespace: h.backup.Namespace,
+							Name:      h.replica,
+						}, replicaClaim)
+
+	if err != nil {
+ 		r.Log.Error(err, "Failed to retrieve the replica PVC",
+						r.createLogParams(h, "PVC.Name", h.replica)...)
+
+		return
+	}
+
+	/*
+	 * Take the snapshot of the replica, and wait for it to be ready.
+	 */
+
+	spec := map[string]interface{} {
+		"source": map[string]interface{} {
+			"persistentVolumeClaimName": h.replica,
+		},
+	}
+
+	if h.directory.Spec.Replicas.VolumeSnapshotClassName != "" {
+		spec["volumeSnapshotClassName"] =
+						h.directory.Spec.Replicas.VolumeSnapshotClassName
+	}
+
+	snapshot := &unstructured.Unstructured{
+		Object: map[string]interface{} {
+			"spec": spec,
+		},
+	}
+
+	snapshot.SetGroupVersionKind(volumeSnapshotGVK)
+	snapshot.SetName(name)
+	snapshot.SetNamespace(h.backup.Namespace)
+	snapshot.SetLabels(r.labelsForBackup(h))
+
+	ctrl.SetControllerReference(h.backup, snapshot, r.Scheme)
+
+	r.Log.Info("Creating a new volume snapshot",
+				r.createLogParams(h, "VolumeSnapshot.Name", name)...)
+
+	err = r.Create(h.ctx, snapshot)
+
+	if err != nil {
+ 		r.Log.Error(err, "Failed to create the volume snapshot",
+				r.createLogParams(h, "VolumeSnapshot.Name", name)...)
+
+		return
+	}
+
+	r.Log.Info("Waiting up to 10 minutes for the volume snapshot to be ready",
+				r.createLogParams(h, "VolumeSnapshot.Name", name)...)
+
+	err = wait.PollImmediate(time.Second, time.Duration(600) * time.Second,
+					dr.isSnapshotReady(dh, name, false))
+
+	if err != nil {
+ 		r.Log.Error(err,
+				"The volume snapshot was not ready within the allocated time.",
+				r.createLogParams(h, "VolumeSnapshot.Name", name)...)
+
+		return
+	}
+
+	/*
+	 * Provision the source volume from the snapshot.
+	 */
+
+	apiGroup := snapshotAPIGroup
+
+	claim := &corev1.PersistentVolumeClaim{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: h.backup.Namespace,
+			Labels:    r.labelsForBackup(h),
+		},
+		Spec: corev1.PersistentVolumeClaimSpec{
+			AccessModes:      replicaClaim.Spec.AccessModes,
+			StorageClassName: replicaClaim.Spec.StorageClassName,
+			VolumeMode:       replicaClaim.Spec.VolumeMode,
+			Resources:        replicaClaim.Spec.Resources,
+			DataSource:       &corev1.TypedLocalObjectReference{
+				APIGroup: &apiGroup,
+				Kind:     volumeSnapshotGVK.Kind,
+				Name:     name,
+			},
+		},
+	}
+
+	ctrl.SetControllerReference(h.backup, claim, r.Scheme)
+
+	r.Log.Info("Provisioning the source volume from the volume snapshot",
+				r.createLogParams(h, "PVC.Name", name)...)
+
+	err = r.Create(h.ctx, claim)
+
+	if err != nil {
+ 		r.Log.Error(err, "Failed to create the source volume",
+						r.createLogParams(h, "PVC.Name", name)...)
+	}
+
+	return
+}
+
+/*****************************************************************************/
+
+/*
+ * The following function is used to delete the source volume, and the
+ * snapshot from which it was provisioned.  The function can optionally wait
+ * for the deletion to complete.
+ */
+
+func (r *IBMSecurityVerifyDirectoryBackupReconciler) deleteSourceVolume(
+			h        *BackupRequestHandle,
+			waitFlag bool) (err error) {
+
+	name := r.getSourceVolumeName(h)
+
+	claim := &corev1.PersistentVolumeClaim{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: h.backup.Namespace,
+		},
+	}
+
+	snapshot := &unstructured.Unstructured{}
+	snapshot.SetGroupVersionKind(volumeSnapshotGVK)
+	snapshot.SetName(name)
+	snapshot.SetNamespace(h.backup.Namespace)
+
+	for _, obj := range []client.Object{ claim, snapshot } {
+		err = r.Delete(h.ctx, obj)
+
+		if err != nil && ! k8serrors.IsNotFound(err) {
+ 			r.Log.Error(err, "Failed to delete the source volume",
+						r.createLogParams(h, "Name", name)...)
+
+			return
+		}
+
+		err = nil
+	}
+
+	if ! waitFlag {
+		return
+	}
+
+	r.Log.Info("Waiting for the previous source volume to be deleted",
+				r.createLogParams(h, "Name", name)...)
+
+	err = wait.PollImmediate(time.Second, time.Duration(300) * time.Second,
+				func() (bool, error) {
+					for _, obj := range []client.Object{ claim, snapshot } {
+						err := r.Get(h.ctx, client.ObjectKeyFromObject(obj), obj)
+
+						if err == nil || ! k8serrors.IsNotFound(err) {
+							return false, nil
+						}
+					}
+
+					return true, nil
+				})
+
+	if err != nil {
+ 		r.Log.Error(err,
+				"The source volume was not deleted within the allocated time.",
+				r.createLogParams(h, "Name", name)...)
+	}
+
+	return
+}
+
+/*****************************************************************************/
+
+/*
+ * The following function is used to update the status of each of the
+ * backups from the backup jobs.  The status of backups whose jobs have since
+ * been removed is retained, up to the number of backups which are to be
+ * retained.
+ */
+
+func (r *IBMSecurityVerifyDirectoryBackupReconciler) updateBackupRecords(
+			h *BackupRequestHandle) (err error) {
+
+	r.Log.V(1).Info("Entering a function",
+				r.createLogParams(h, "Function", "updateBackupRecords")...)
+
+	records := make(map[string]ibmv1.IBMSecurityVerifyDirectoryBackupRecord)
+
+	for _, record := range h.backup.Status.Backups {
+		records[record.Name] = record
+	}
+
+	/*
+	 * Process each of the backup jobs.
+	 */
+
+	jobs := &batchv1.JobList{}
+
+	err = r.List(h.ctx, jobs,
+				client.InNamespace(h.backup.Namespace),
+				client.MatchingLabels{utils.BackupLabel: h.backup.Name})
+
+	if err != nil {
+ 		r.Log.Error(err, "Failed to retrieve the backup jobs",
+						r.createLogParams(h)...)
+
+		return
+	}
+
+	for _, job := range jobs.Items {
+		record := ibmv1.IBMSecurityVerifyDirectoryBackupRecord{
+			Name:          job.Name,
+			SourceReplica: h.replica,
+			Format:        h.backup.Spec.Format,
+			Phase:         BackupPhaseRunning,
+			StartTime:     job.Status.StartTime,
+		}
+
+		if existing, ok := records[job.Name]; ok {
+			record.SourceReplica = existing.SourceReplica
+			record.Format        = existing.Format
+		}
+
+		if job.Status.Succeeded > 0 {
+			record.Phase          = BackupPhaseCompleted
+			record.CompletionTime = job.Status.CompletionTime
+			record.Size           = r.getBackupSize(h, job.Name)
+
+			if record.StartTime != nil && record.CompletionTime != nil {
+				record.Duration = record.CompletionTime.Sub(
+									record.StartTime.Time).String()
+			}
+		} else if r.isJobFailed(&job) {
+			record.Phase = BackupPhaseFailed
+		}
+
+		records[job.Name] = record
+	}
+
+	/*
+	 * Sort the backups, newest first, and only keep those which have been
+	 * retained.
+	 */
+
+	backups := []ibmv1.IBMSecurityVerifyDirectoryBackupRecord{}
+
+	for _, record := range records {
+		backups = append(backups, record)
+	}
+
+	sort.SliceStable(backups, func(i, j int) bool {
+		if backups[i].StartTime == nil || backups[j].StartTime == nil {
+			return backups[i].Name > backups[j].Name
+		}
+
+		return backups[j].StartTime.Before(backups[i].StartTime)
+	})
+
+	retain := r.getBackupRetain(h)
+
+	if retain > 0 && len(backups) > retain {
+		backups = backups[:retain]
+	}
+
+	h.backup.Status.Backups = backups
+
+	for _, record := range backups {
+		if record.Phase == BackupPhaseCompleted {
+			if h.backup.Status.LastSuccessfulTime == nil ||
+				h.backup.Status.LastSuccessfulTime.Before(
+									record.CompletionTime) {
+				h.backup.Status.LastSuccessfulTime = record.CompletionTime
+			}
+		}
+	}
+
+	return
+}
+
+/*****************************************************************************/
+
+/*
+ * The following function is used to determine whether a job has failed.
+ */
+
+func (r *IBMSecurityVerifyDirectoryBackupReconciler) isJobFailed(
+			job *batchv1.Job) (bool) {
+
+	for _, condition := range job.Status.Conditions {
+		if condition.Type == batchv1.JobFailed &&
+						condition.Status == corev1.ConditionTrue {
+			return true
+		}
+	}
+
+	return false
+}
+
+/*****************************************************************************/
+
+/*
+ * The following function is used to retrieve the size of the backup, which
+ * is written to the termination log of the backup container.
+ */
+
+func (r *IBMSecurityVerifyDirectoryBackupReconciler) getBackupSize(
+			h       *BackupRequestHandle,
+			jobName string) (int64) {
+
+	pods := &corev1.PodList{}
+
+	err := r.List(h.ctx, pods,
+				client.InNamespace(h.backup.Namespace),
+				client.MatchingLabels{"job-name": jobName})
+
+	if err != nil {
+ 		r.Log.Error(err, "Failed to retrieve the backup pods",
+						r.createLogParams(h, "Job.Name", jobName)...)
+
+		return 0
+	}
+
+	for _, pod := range pods.Items {
+		for _, status := range pod.Status.ContainerStatuses {
+			terminated := status.State.Terminated
+
+			if terminated == nil || terminated.ExitCode != 0 {
+				continue
+			}
+
+			size, err := strconv.ParseInt(
+							strings.TrimSpace(terminated.Message), 10, 64)
+
+			if err == nil {
+				return size
+			}
+		}
+	}
+
+	return 0
+}
+
+/*****************************************************************************/
+
+/*
+ * The following function is used to wrap the logic which updates the
+ * conditions of the backup.  The standard Ready, Progressing and Degraded
+ * conditions are maintained, where Progressing indicates whether a backup
+ * is currently running.
+ */
+
+func (r *IBMSecurityVerifyDirectoryBackupReconciler) setCondition(
+				err    error,
+				h      *BackupRequestHandle,
+				reason string,
+				msg    string) error {
+
+	generation := h.backup.Generation
+
+	readyCondition := metav1.Condition{
+		Type:               ibmv1.ConditionReady,
+		ObservedGeneration: generation,
+	}
+
+	progressCondition := metav1.Condition{
+		Type:               ibmv1.ConditionProgressing,
+		Reason:             ibmv1.ReasonBackupIdle,
+		Message:            "No backup is currently running.",
+		Status:             metav1.ConditionFalse,
+		ObservedGeneration: generation,
+	}
+
+	condition := metav1.Condition{
+		Type:               ibmv1.ConditionDegraded,
+		ObservedGeneration: generation,
+	}
+
+	if err != nil {
+		readyCondition.Reason  = reason
+		readyCondition.Message = err.Error()
+		readyCondition.Status  = metav1.ConditionFalse
+
+		progressCondition.Reason  = ibmv1.ReasonReconcileFailed
+		progressCondition.Message = "The processing of the backup failed."
+
+		condition.Reason  = reason
+		condition.Message = err.Error()
+		condition.Status  = metav1.ConditionTrue
+	} else {
+		if h.backup.Spec.Schedule != "" {
+			readyCondition.Reason  = ibmv1.ReasonBackupScheduled
+			readyCondition.Message = "The backups have been scheduled."
+		} else {
+			readyCondition.Reason  = ibmv1.ReasonBackupCreated
+			readyCondition.Message = "The backup job has been created."
+		}
+
+		readyCondition.Status = metav1.ConditionTrue
+
+		for _, record := range h.backup.Status.Backups {
+			if record.Phase == BackupPhaseRunning {
+				progressCondition.Reason  = ibmv1.ReasonBackupRunning
+				progressCondition.Message = fmt.Sprintf(
+						"The backup, %s, is running.", record.Name)
+				progressCondition.Status  = metav1.ConditionTrue
+
+				break
+			}
+		}
+
+		condition.Reason  = ibmv1.ReasonAsExpected
+		condition.Message = "The backup has been processed successfully."
+		condition.Status  = metav1.ConditionFalse
+	}
+
+	r.Log.V(1).Info("Setting a condition",
+				r.createLogParams(h, "Condition", condition)...)
+
+	meta.RemoveStatusCondition(&h.backup.Status.Conditions, "Available")
+
+	meta.SetStatusCondition(&h.backup.Status.Conditions, readyCondition)
+	meta.SetStatusCondition(&h.backup.Status.Conditions, progressCondition)
+	meta.SetStatusCondition(&h.backup.Status.Conditions, condition)
+
+	if err := r.Status().Update(h.ctx, h.backup); err != nil {
+		r.Log.Error(err, "Failed to update the condition for the resource",
+						r.createLogParams(h)...)
+
+		return err
+	}
+
+	if msg != "" {
+		r.Log.Error(err, msg, r.createLogParams(h)...)
+	}
+
+	return nil
+}
+
+/*****************************************************************************/
+
+/*
+ * Return the number of backups which are to be retained.  The default is
+ * used if the number has not been specified, which will only be the case
+ * if the document was stored before the default was added to the CRD.
+ */
+
+func (r *IBMSecurityVerifyDirectoryBackupReconciler) getBackupRetain(
+			h *BackupRequestHandle) int {
+	if h.backup.Spec.Retain == nil {
+		return int(DefaultBackupRetain)
+	}
+
+	return int(*h.backup.Spec.Retain)
+}
+
+/*****************************************************************************/
+
+/*
+ * Construct and return the labels for the backup jobs.
+ */
+
+func (r *IBMSecurityVerifyDirectoryBackupReconciler) labelsForBackup(
+			h *BackupRequestHandle) map[string]string {
+	return map[string]string{
+		"app.kubernetes.io/created-by": "verify-directory-operator",
+		"app.kubernetes.io/part-of":    "verify-directory",
+		utils.BackupLabel:              h.backup.Name,
+	}
+}
+
+/*****************************************************************************/
+
+/*
+ * This function will create the logging parameters for a request.
+ */
+
+func (r *IBMSecurityVerifyDirectoryBackupReconciler) createLogParams(
+			h *BackupRequestHandle, extras ...interface{}) []interface{} {
+
+	params := []interface{}{
+				"Backup.Namespace", h.req.Namespace,
+				"Backup.Name",      h.req.Name,
+			}
+
+	for _, extra := range extras {
+		params = append(params, extra)
+	}
+
+	/*
+	 * Ensure that no sensitive information is written to the log.
+	 */
+
+	return utils.RedactLogParams(params)
+}
+
+/*****************************************************************************/
+
+/*
+ * SetupWithManager sets up the controller with the Manager.  The backup
+ * jobs which are created by the cron job are not owned by the backup
+ * document, and so we map the jobs back to the document using the backup
+ * label.
+ */
+
+func (r *IBMSecurityVerifyDirectoryBackupReconciler) SetupWithManager(
+							mgr ctrl.Manager) error {
+	return ctrl.NewControllerManagedBy(mgr).
+		For(&ibmv1.IBMSecurityVerifyDirectoryBackup{},
+			builder.WithPredicates(predicate.GenerationChangedPredicate{})).
+		Owns(&batchv1.CronJob{}).
+		Watches(&source.Kind{Type: &batchv1.Job{}},
+			handler.EnqueueRequestsFromMapFunc(
+				func(obj client.Object) []reconcile.Request {
+					name, ok := obj.GetLabels()[utils.BackupLabel]
+
+					if ! ok {
+						return nil
+					}
+
+					return []reconcile.Request{{
+						NamespacedName: types.NamespacedName{
+							Namespace: obj.GetNamespace(),
+							Name:      name,
+						},
+					}}
+				})).
+		Complete(r)
+}
+
+/*****************************************************************************/
+
@@ -0,0 +1,597 @@
+/* vi: set ts=4 sw=4 noexpandtab : */
+
+/*
+ * Copyright contributors to the IBM Security Verify Directory Operator project
+ */
+
+package ldapconfig
+
+/*
+ * This file contains a typed representation of the server and proxy
+ * configuration, as held in the server and proxy ConfigMaps, along with the
+ * functions which are used to parse and validate the configuration.  The
+ * same parsing is used by the admission webhook, so that an invalid
+ * configuration is rejected before anything is deployed, and by the
+ * controllers.
+ */
+
+/*****************************************************************************/
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/go-yaml/yaml"
+	"github.com/ibm-security/verify-directory-operator/utils"
+)
+
+/*****************************************************************************/
+
+/*
+ * Some constants...
+ */
+
+const (
+	DefaultLDAPPort  int32 = 9389
+	DefaultLDAPSPort int32 = 9636
+	DefaultAdminDn         = "cn=root"
+)
+
+/*
+ * The proxy configuration entries which are generated by the operator, and
+ * so must not be included in the proxy ConfigMap.
+ */
+
+var GeneratedProxyEntries = []string { "server-groups", "suffixes" }
+
+/*****************************************************************************/
+
+/*
+ * The ports which have been enabled in the configuration.  A port of 0
+ * indicates that the port has not been enabled.
+ */
+
+type Ports struct {
+	LDAP  int32
+	LDAPS int32
+}
+
+/*
+ * The server configuration which is required by the operator.  With the
+ * exception of the ports, the entries are not resolved, and so may contain
+ * a secret, ConfigMap or environment variable reference.
+ */
+
+type ServerConfig struct {
+	Ports         Ports
+	LicenseAccept string
+	LicenseKey    string
+	KeyStash      string
+	AdminDn       string
+	AdminPwd      string
+	Suffixes      []string
+}
+
+/*
+ * The proxy configuration which is required by the operator.  With the
+ * exception of the ports, the entries are not resolved.
+ */
+
+type ProxyConfig struct {
+	Ports         Ports
+	LicenseAccept string
+	LicenseKey    string
+	KeyStash      string
+	AdminDn       string
+	AdminPwd      string
+}
+
+/*****************************************************************************/
+
+/*
+ * The following function is used to parse the YAML configuration data into
+ * a map.  Unfortunately it is not easy to parse YAML into a generic
+ * structure, and so after we have unmarshalled the data we want to
+ * iteratively convert the data into a map of strings.
+ */
+
+func Parse(data string) (body map[string]interface{}, err error) {
+	var raw interface{}
+
+	if err = yaml.Unmarshal([]byte(data), &raw); err != nil {
+		return
+	}
+
+	body, ok := utils.ConvertYaml(raw).(map[string]interface{})
+
+	if ! ok {
+		err = errors.New("The configuration cannot be parsed.")
+	}
+
+	return
+}
+
+/*****************************************************************************/
+
+/*
+ * The following function is used to parse and validate the server
+ * configuration.  The admin password is only optional if the operator is
+ * going to generate the credentials.
+ */
+
+func ParseServerConfig(
+			body                 map[string]interface{},
+			rctx                 *utils.ResolveContext,
+			generatedCredentials bool) (config *ServerConfig, err error) {
+
+	config = &ServerConfig{}
+
+	/*
+	 * The ports.
+	 */
+
+	config.Ports, err = GetPorts(body, rctx)
+
+	if err != nil {
+		return
+	}
+
+	/*
+	 * The license and the key stash.
+	 */
+
+	var found bool
+
+	config.LicenseKey, found, err = getString(
+						body, []string{"general","license","key"})
+
+	if err == nil && ! found {
+		err = errors.New("The general.license.key configuration is missing.")
+	}
+
+	if err != nil {
+		return
+	}
+
+	config.LicenseAccept, _, err = getString(
+						body, []string{"general","license","accept"})
+
+	if err != nil {
+		return
+	}
+
+	config.KeyStash, _, err = getString(body, []string{"general","key-stash"})
+
+	if err != nil {
+		return
+	}
+
+	/*
+	 * The admin DN and password.
+	 */
+
+	config.AdminDn, err = getAdminDn(body)
+
+	if err != nil {
+		return
+	}
+
+	config.AdminPwd, found, err = getString(
+						body, []string{"general","admin","pwd"})
+
+	if err == nil && ! found && ! generatedCredentials {
+		err = errors.New("The general.admin.pwd configuration is missing.")
+	}
+
+	if err != nil {
+		return
+	}
+
+	/*
+	 * The suffixes which are to be managed.
+	 */
+
+	config.Suffixes, err = getSuffixes(body)
+
+	return
+}
+
+/*****************************************************************************/
+
+/*
+ * The following function is used to parse and validate the proxy
+ * configuration.
+ */
+
+func ParseProxyConfig(
+			body map[string]interface{},
+			rctx *utils.ResolveContext) (config *ProxyConfig, err error) {
+
+	config = &ProxyConfig{}
+
+	/*
+	 * Ensure that the entries which are generated by the operator don't
+	 * exist.
+	 */
+
+	for _, entry := range GeneratedProxyEntries {
+		value, _ := utils.GetYamlValue(body, []string{"proxy", entry},
+						false, rctx)
+
+		if value != nil {
+			err = errors.New(fmt.Sprintf("The proxy.%s configuration entry " +
+				"is not allowed as this entry will be generated by the " +
+				"operator.", entry))
+
+			return
+		}
+	}
+
+	/*
+	 * The ports.
+	 */
+
+	config.Ports, err = GetPorts(body, rctx)
+
+	if err != nil {
+		return
+	}
+
+	/*
+	 * The license, key stash and admin credentials.  These entries are
+	 * validated against the server configuration by the Compare function.
+	 */
+
+	config.LicenseAccept, _, err = getString(
+						body, []string{"general","license","accept"})
+
+	if err != nil {
+		return
+	}
+
+	config.LicenseKey, _, err = getString(
+						body, []string{"general","license","key"})
+
+	if err != nil {
+		return
+	}
+
+	config.KeyStash, _, err = getString(body, []string{"general","key-stash"})
+
+	if err != nil {
+		return
+	}
+
+	config.AdminDn, err = getAdminDn(body)
+
+	if err != nil {
+		return
+	}
+
+	config.AdminPwd, _, err = getString(body, []string{"general","admin","pwd"})
+
+	return
+}
+
+/*****************************************************************************/
+
+/*
+ * The following function is used to ensure that the proxy configuration is
+ * consistent with the server configuration.  The proxy must use the same
+ * key stash and license as the replicas, and the admin credentials of the
+ * proxy must match those of the replicas, as the proxy connects to the
+ * replicas using the admin credentials of the server.  The admin password
+ * is not compared if the credentials are generated by the operator, as the
+ * generated password is used by both the proxy and the replicas.
+ */
+
+func Compare(
+			server               *ServerConfig,
+			proxy                *ProxyConfig,
+			rctx                 *utils.ResolveContext,
+			generatedCredentials bool) (err error) {
+
+	entries := []struct {
+		key    string
+		server string
+		proxy  string
+	} {
+		{ "general.key-stash",      server.KeyStash,      proxy.KeyStash      },
+		{ "general.license.accept", server.LicenseAccept, proxy.LicenseAccept },
+		{ "general.license.key",    server.LicenseKey,    proxy.LicenseKey    },
+		{ "general.admin.dn",       server.AdminDn,       proxy.AdminDn       },
+		{ "general.admin.pwd",      server.AdminPwd,      proxy.AdminPwd      },
+	}
+
+	for _, entry := range entries {
+		if entry.key == "general.admin.pwd" && generatedCredentials {
+			continue
+		}
+
+		var serverValue, proxyValue string
+
+		serverValue, err = resolveString(entry.key, entry.server, rctx)
+
+		if err != nil {
+			return
+		}
+
+		proxyValue, err = resolveString(entry.key, entry.proxy, rctx)
+
+		if err != nil {
+			return
+		}
+
+		if serverValue != proxyValue {
+			err = errors.New(fmt.Sprintf("The %s configuration of the proxy " +
+					"does not match that of the server.", entry.key))
+
+			return
+		}
+	}
+
+	return
+}
+
+/*****************************************************************************/
+
+/*
+ * The following function is used to retrieve the LDAP and LDAPS ports from
+ * the supplied configuration.  The LDAPS port is only enabled if it has been
+ * explicitly configured, or if the LDAP port has been disabled.
+ */
+
+func GetPorts(
+			body map[string]interface{},
+			rctx *utils.ResolveContext) (ports Ports, err error) {
+
+	ports.LDAP, _, err = getPort(body, "ldap", DefaultLDAPPort, rctx)
+
+	if err != nil {
+		return
+	}
+
+	var found bool
+
+	ports.LDAPS, found, err = getPort(body, "ldaps", 0, rctx)
+
+	if err != nil {
+		return
+	}
+
+	/*
+	 * If the LDAP port has not been activated the LDAPS port will be
+	 * used, even if it has not been explicitly configured.
+	 */
+
+	if ports.LDAP == 0 && ! found {
+		ports.LDAPS = DefaultLDAPSPort
+	}
+
+	if ports.LDAP == 0 && ports.LDAPS == 0 {
+		err = errors.New("Neither the LDAP port nor the LDAPS port has " +
+				"been enabled.")
+	}
+
+	return
+}
+
+/*****************************************************************************/
+
+/*
+ * The following function is used to select the port, and whether the
+ * connection is secure, for the specified protocol.  If no protocol has
+ * been specified the LDAP port will be used, unless it has not been
+ * enabled.
+ */
+
+func (ports Ports) Select(
+			protocol string) (port int32, secure bool, err error) {
+
+	switch protocol {
+		case "ldap":
+			if ports.LDAP == 0 {
+				err = errors.New("The ldap protocol has been selected, but " +
+							"the LDAP port has not been enabled.")
+			}
+
+			return ports.LDAP, false, err
+
+		case "ldaps":
+			if ports.LDAPS == 0 {
+				err = errors.New("The ldaps protocol has been selected, but " +
+							"the LDAPS port has not been enabled.")
+			}
+
+			return ports.LDAPS, true, err
+	}
+
+	if ports.LDAP != 0 {
+		return ports.LDAP, false, nil
+	}
+
+	return ports.LDAPS, true, nil
+}
+
+/*****************************************************************************/
+
+/*
+ * The following function is used to retrieve the specified port from the
+ * general.ports entry of the configuration.  The port must be an integer
+ * between 0 and 65535.  The default port is returned if the port has not
+ * been configured.
+ */
+
+func getPort(
+			body        map[string]interface{},
+			name        string,
+			defaultPort int32,
+			rctx        *utils.ResolveContext) (
+					port int32, found bool, err error) {
+
+	port = defaultPort
+
+	entry, err := utils.GetYamlValue(body,
+						[]string{"general","ports",name}, true, rctx)
+
+	if err != nil {
+		err = errors.New(fmt.Sprintf("The general.ports.%s entry could not " +
+				"be resolved: %s", name, err.Error()))
+
+		return
+	}
+
+	if entry == nil {
+		return
+	}
+
+	found      = true
+	iport, ok := utils.GetYamlInt(entry)
+
+	if ! ok || iport < 0 || iport > 65535 {
+		err = errors.New(fmt.Sprintf(
+				"The general.ports.%s configuration is incorrect.", name))
+
+		return
+	}
+
+	port = int32(iport)
+
+	return
+}
+
+/*****************************************************************************/
+
+/*
+ * The following function is used to retrieve the specified string entry from
+ * the configuration.  The entry is not resolved.
+ */
+
+func getString(
+			body map[string]interface{},
+			key  []string) (value string, found bool, err error) {
+
+	entry, _ := utils.GetYamlValue(body, key, false, nil)
+
+	if entry == nil {
+		return
+	}
+
+	found     = true
+	value, ok := entry.(string)
+
+	if ! ok {
+		err = errors.New(fmt.Sprintf("The %s configuration is incorrect.",
+				strings.Join(key, ".")))
+	}
+
+	return
+}
+
+/*****************************************************************************/
+
+/*
+ * The following function is used to retrieve the admin DN from the
+ * configuration.  The default admin DN is returned if the admin DN has not
+ * been configured.
+ */
+
+func getAdminDn(body map[string]interface{}) (adminDn string, err error) {
+
+	adminDn, found, err := getString(body, []string{"general","admin","dn"})
+
+	if err == nil && ! found {
+		adminDn = DefaultAdminDn
+	}
+
+	return
+}
+
+/*****************************************************************************/
+
+/*
+ * The following function is used to resolve the specified string entry of
+ * the configuration.  An empty entry, i.e. an entry which has not been
+ * configured, is returned as an empty string.
+ */
+
+func resolveString(
+			key   string,
+			entry string,
+			rctx  *utils.ResolveContext) (value string, err error) {
+
+	if entry == "" {
+		return
+	}
+
+	resolved, err := utils.ResolveNamedEntry(key, entry, rctx)
+
+	if err != nil {
+		err = errors.New(fmt.Sprintf("The %s entry could not be " +
+				"resolved: %s", key, err.Error()))
+
+		return
+	}
+
+	value = fmt.Sprintf("%v", resolved)
+
+	return
+}
+
+/*****************************************************************************/
+
+/*
+ * Retrieve the suffixes which are being managed.  We need to extract each
+ * of the DN values from the server.suffixes entry.
+ */
+
+func getSuffixes(body map[string]interface{}) (suffixes []string, err error) {
+
+	entries, _ := utils.GetYamlValue(body, []string{"server","suffixes"},
+						false, nil)
+
+	if entries == nil {
+		err = errors.New("The server.suffixes configuration is missing.")
+
+		return
+	}
+
+	suffixEntries, ok := entries.([]interface{})
+
+	if ! ok || len(suffixEntries) == 0 {
+		err = errors.New("The server.suffixes configuration is incorrect.")
+
+		return
+	}
+
+	/*
+	 * Iterate over the suffix entries, grabbing the DN value for each
+	 * entry.
+	 */
+
+	for idx, entry := range suffixEntries {
+		suffixEntry, ok := entry.(map[string]interface{})
+
+		var dn    string
+		var found bool
+
+		if ok {
+			dn, found, err = getString(suffixEntry, []string{"dn"})
+		}
+
+		if ! ok || err != nil || ! found || dn == "" {
+			err = errors.New(fmt.Sprintf("The server.suffixes[%d].dn " +
+				"configuration is missing or incorrect.", idx))
+
+			return
+		}
+
+		suffixes = append(suffixes, dn)
+	}
+
+	return
+}
+
+/*****************************************************************************/
+
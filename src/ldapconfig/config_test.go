@@ -0,0 +1,626 @@
+/* vi: set ts=4 sw=4 noexpandtab : */
+
+/*
+ * Copyright contributors to the IBM Security Verify Directory Operator project
+ */
+
+package ldapconfig
+
+/*
+ * This file contains the tests for the parsing and validation of the server
+ * and proxy configuration.
+ */
+
+/*****************************************************************************/
+
+import (
+	corev1 "k8s.io/api/core/v1"
+
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/ibm-security/verify-directory-operator/utils"
+)
+
+/*****************************************************************************/
+
+/*
+ * The following function will parse the supplied YAML, failing the test if
+ * the YAML cannot be parsed.
+ */
+
+func parseTestConfig(t *testing.T, data string) map[string]interface{} {
+	body, err := Parse(data)
+
+	if err != nil {
+		t.Fatalf("Failed to parse the configuration: %s", err.Error())
+	}
+
+	return body
+}
+
+/*****************************************************************************/
+
+/*
+ * The following function will check the error which was returned by a
+ * function against the expected error.  An empty expected error indicates
+ * that no error should have been returned.
+ */
+
+func checkTestError(t *testing.T, err error, expected string) bool {
+	if expected == "" {
+		if err != nil {
+			t.Errorf("An unexpected error was returned: %s", err.Error())
+		}
+
+		return err == nil
+	}
+
+	if err == nil || ! strings.Contains(err.Error(), expected) {
+		t.Errorf("Expected an error containing '%s', got: %v", expected, err)
+	}
+
+	return false
+}
+
+/*****************************************************************************/
+
+/*
+ * Test the parsing of the server configuration.
+ */
+
+func TestParseServerConfig(t *testing.T) {
+	tests := []struct {
+		name      string
+		data      string
+		generated bool
+		expected  *ServerConfig
+		err       string
+	} {
+		{
+			name: "complete",
+			data: `
+general:
+  ports:
+    ldap: 1389
+    ldaps: 1636
+  license:
+    accept: limited
+    key: secret:isvd-secret/license-key
+  key-stash: B64:c3Rhc2g=
+  admin:
+    dn: cn=admin
+    pwd: passw0rd
+server:
+  suffixes:
+  - dn: o=sample
+  - dn: o=other
+`,
+			expected: &ServerConfig{
+				Ports:         Ports{ LDAP: 1389, LDAPS: 1636 },
+				LicenseAccept: "limited",
+				LicenseKey:    "secret:isvd-secret/license-key",
+				KeyStash:      "B64:c3Rhc2g=",
+				AdminDn:       "cn=admin",
+				AdminPwd:      "passw0rd",
+				Suffixes:      []string{ "o=sample", "o=other" },
+			},
+		},
+		{
+			name: "defaults",
+			data: `
+general:
+  license:
+    key: license
+  admin:
+    pwd: passw0rd
+server:
+  suffixes:
+  - dn: o=sample
+`,
+			expected: &ServerConfig{
+				Ports:      Ports{ LDAP: DefaultLDAPPort },
+				LicenseKey: "license",
+				AdminDn:    DefaultAdminDn,
+				AdminPwd:   "passw0rd",
+				Suffixes:   []string{ "o=sample" },
+			},
+		},
+		{
+			name: "generated credentials",
+			data: `
+general:
+  license:
+    key: license
+server:
+  suffixes:
+  - dn: o=sample
+`,
+			generated: true,
+			expected: &ServerConfig{
+				Ports:      Ports{ LDAP: DefaultLDAPPort },
+				LicenseKey: "license",
+				AdminDn:    DefaultAdminDn,
+				Suffixes:   []string{ "o=sample" },
+			},
+		},
+		{
+			name: "missing license key",
+			data: `
+general:
+  admin:
+    pwd: passw0rd
+server:
+  suffixes:
+  - dn: o=sample
+`,
+			err: "general.license.key configuration is missing",
+		},
+		{
+			name: "missing admin password",
+			data: `
+general:
+  license:
+    key: license
+server:
+  suffixes:
+  - dn: o=sample
+`,
+			err: "general.admin.pwd configuration is missing",
+		},
+		{
+			name: "missing suffixes",
+			data: `
+general:
+  license:
+    key: license
+  admin:
+    pwd: passw0rd
+`,
+			err: "server.suffixes configuration is missing",
+		},
+		{
+			name: "missing suffix dn",
+			data: `
+general:
+  license:
+    key: license
+  admin:
+    pwd: passw0rd
+server:
+  suffixes:
+  - dn: o=sample
+  - name: other
+`,
+			err: "server.suffixes[1].dn",
+		},
+		{
+			name: "invalid port",
+			data: `
+general:
+  ports:
+    ldap: abc
+  license:
+    key: license
+  admin:
+    pwd: passw0rd
+server:
+  suffixes:
+  - dn: o=sample
+`,
+			err: "general.ports.ldap configuration is incorrect",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config, err := ParseServerConfig(
+						parseTestConfig(t, test.data), nil, test.generated)
+
+			if ! checkTestError(t, err, test.err) {
+				return
+			}
+
+			if ! reflect.DeepEqual(config, test.expected) {
+				t.Errorf("Expected %+v, got %+v", test.expected, config)
+			}
+		})
+	}
+}
+
+/*****************************************************************************/
+
+/*
+ * Test the parsing of the proxy configuration.
+ */
+
+func TestParseProxyConfig(t *testing.T) {
+	tests := []struct {
+		name     string
+		data     string
+		expected *ProxyConfig
+		err      string
+	} {
+		{
+			name: "complete",
+			data: `
+general:
+  ports:
+    ldap: 0
+  license:
+    accept: limited
+    key: license
+  key-stash: B64:c3Rhc2g=
+  admin:
+    dn: cn=proxy
+    pwd: passw0rd
+proxy:
+  tuning: {}
+`,
+			expected: &ProxyConfig{
+				Ports:         Ports{ LDAPS: DefaultLDAPSPort },
+				LicenseAccept: "limited",
+				LicenseKey:    "license",
+				KeyStash:      "B64:c3Rhc2g=",
+				AdminDn:       "cn=proxy",
+				AdminPwd:      "passw0rd",
+			},
+		},
+		{
+			name: "defaults",
+			data: `
+general:
+  license:
+    key: license
+`,
+			expected: &ProxyConfig{
+				Ports:      Ports{ LDAP: DefaultLDAPPort },
+				LicenseKey: "license",
+				AdminDn:    DefaultAdminDn,
+			},
+		},
+		{
+			name: "generated server groups",
+			data: `
+proxy:
+  server-groups:
+  - name: group
+`,
+			err: "proxy.server-groups configuration entry is not allowed",
+		},
+		{
+			name: "generated suffixes",
+			data: `
+proxy:
+  suffixes:
+  - name: suffix
+`,
+			err: "proxy.suffixes configuration entry is not allowed",
+		},
+		{
+			name: "no ports",
+			data: `
+general:
+  ports:
+    ldap: 0
+    ldaps: 0
+`,
+			err: "Neither the LDAP port nor the LDAPS port",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config, err := ParseProxyConfig(
+						parseTestConfig(t, test.data), nil)
+
+			if ! checkTestError(t, err, test.err) {
+				return
+			}
+
+			if ! reflect.DeepEqual(config, test.expected) {
+				t.Errorf("Expected %+v, got %+v", test.expected, config)
+			}
+		})
+	}
+}
+
+/*****************************************************************************/
+
+/*
+ * Test the comparison of the server and proxy configuration.  The admin
+ * password is not compared if the credentials are generated by the operator.
+ */
+
+func TestCompare(t *testing.T) {
+	rctx := &utils.ResolveContext{
+		Namespace: "default",
+		Env:       []corev1.EnvVar{
+			{ Name: "KEY_STASH", Value: "stash" },
+		},
+	}
+
+	server := &ServerConfig{
+		LicenseAccept: "limited",
+		LicenseKey:    "license",
+		KeyStash:      "B64:c3Rhc2g=",
+		AdminDn:       "cn=root",
+		AdminPwd:      "passw0rd",
+	}
+
+	tests := []struct {
+		name      string
+		proxy     ProxyConfig
+		generated bool
+		err       string
+	} {
+		{
+			name: "identical",
+			proxy: ProxyConfig{
+				LicenseAccept: "limited",
+				LicenseKey:    "license",
+				KeyStash:      "B64:c3Rhc2g=",
+				AdminDn:       "cn=root",
+				AdminPwd:      "passw0rd",
+			},
+		},
+		{
+			name: "resolved key stash",
+			proxy: ProxyConfig{
+				LicenseAccept: "limited",
+				LicenseKey:    "license",
+				KeyStash:      "env:KEY_STASH",
+				AdminDn:       "cn=root",
+				AdminPwd:      "passw0rd",
+			},
+		},
+		{
+			name: "different admin dn",
+			proxy: ProxyConfig{
+				LicenseAccept: "limited",
+				LicenseKey:    "license",
+				KeyStash:      "B64:c3Rhc2g=",
+				AdminDn:       "cn=proxy",
+				AdminPwd:      "passw0rd",
+			},
+			err: "general.admin.dn configuration of the proxy does not match",
+		},
+		{
+			name: "different admin password",
+			proxy: ProxyConfig{
+				LicenseAccept: "limited",
+				LicenseKey:    "license",
+				KeyStash:      "B64:c3Rhc2g=",
+				AdminDn:       "cn=root",
+				AdminPwd:      "other",
+			},
+			err: "general.admin.pwd configuration of the proxy does not match",
+		},
+		{
+			name: "generated admin password",
+			proxy: ProxyConfig{
+				LicenseAccept: "limited",
+				LicenseKey:    "license",
+				KeyStash:      "B64:c3Rhc2g=",
+				AdminDn:       "cn=root",
+			},
+			generated: true,
+		},
+		{
+			name: "generated credentials with a different admin dn",
+			proxy: ProxyConfig{
+				LicenseAccept: "limited",
+				LicenseKey:    "license",
+				KeyStash:      "B64:c3Rhc2g=",
+				AdminDn:       "cn=proxy",
+			},
+			generated: true,
+			err:       "general.admin.dn configuration of the proxy",
+		},
+		{
+			name: "different key stash",
+			proxy: ProxyConfig{
+				LicenseAccept: "limited",
+				LicenseKey:    "license",
+				KeyStash:      "B64:b3RoZXI=",
+				AdminDn:       "cn=root",
+				AdminPwd:      "passw0rd",
+			},
+			err: "general.key-stash configuration of the proxy does not match",
+		},
+		{
+			name: "different license acceptance",
+			proxy: ProxyConfig{
+				LicenseAccept: "production",
+				LicenseKey:    "license",
+				KeyStash:      "B64:c3Rhc2g=",
+				AdminDn:       "cn=root",
+				AdminPwd:      "passw0rd",
+			},
+			err: "general.license.accept configuration of the proxy",
+		},
+		{
+			name: "missing license key",
+			proxy: ProxyConfig{
+				LicenseAccept: "limited",
+				KeyStash:      "B64:c3Rhc2g=",
+				AdminDn:       "cn=root",
+				AdminPwd:      "passw0rd",
+			},
+			err: "general.license.key configuration of the proxy",
+		},
+		{
+			name: "unresolvable entry",
+			proxy: ProxyConfig{
+				LicenseAccept: "limited",
+				LicenseKey:    "license",
+				KeyStash:      "env:UNKNOWN",
+				AdminDn:       "cn=root",
+				AdminPwd:      "passw0rd",
+			},
+			err: "general.key-stash entry could not be resolved",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			checkTestError(t, Compare(server, &test.proxy, rctx,
+								test.generated), test.err)
+		})
+	}
+}
+
+/*****************************************************************************/
+
+/*
+ * Test the retrieval of the ports from the configuration.
+ */
+
+func TestGetPorts(t *testing.T) {
+	rctx := &utils.ResolveContext{
+		Namespace: "default",
+		Env:       []corev1.EnvVar{
+			{ Name: "LDAPS_PORT", Value: "2636" },
+		},
+	}
+
+	tests := []struct {
+		name     string
+		data     string
+		expected Ports
+		err      string
+	} {
+		{
+			name:     "defaults",
+			data:     "general: {}",
+			expected: Ports{ LDAP: DefaultLDAPPort },
+		},
+		{
+			name:     "both ports",
+			data:     "general: { ports: { ldap: 1389, ldaps: 1636 } }",
+			expected: Ports{ LDAP: 1389, LDAPS: 1636 },
+		},
+		{
+			name:     "LDAP disabled",
+			data:     "general: { ports: { ldap: 0 } }",
+			expected: Ports{ LDAPS: DefaultLDAPSPort },
+		},
+		{
+			name:     "string port",
+			data:     "general: { ports: { ldap: '1389' } }",
+			expected: Ports{ LDAP: 1389 },
+		},
+		{
+			name:     "environment port",
+			data:     "general: { ports: { ldaps: 'env:LDAPS_PORT' } }",
+			expected: Ports{ LDAP: DefaultLDAPPort, LDAPS: 2636 },
+		},
+		{
+			name: "out of range",
+			data: "general: { ports: { ldaps: 65536 } }",
+			err:  "general.ports.ldaps configuration is incorrect",
+		},
+		{
+			name: "negative",
+			data: "general: { ports: { ldap: -1 } }",
+			err:  "general.ports.ldap configuration is incorrect",
+		},
+		{
+			name: "unresolvable",
+			data: "general: { ports: { ldap: 'env:UNKNOWN' } }",
+			err:  "general.ports.ldap entry could not be resolved",
+		},
+		{
+			name: "both disabled",
+			data: "general: { ports: { ldap: 0, ldaps: 0 } }",
+			err:  "Neither the LDAP port nor the LDAPS port",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ports, err := GetPorts(parseTestConfig(t, test.data), rctx)
+
+			if ! checkTestError(t, err, test.err) {
+				return
+			}
+
+			if ports != test.expected {
+				t.Errorf("Expected %+v, got %+v", test.expected, ports)
+			}
+		})
+	}
+}
+
+/*****************************************************************************/
+
+/*
+ * Test the selection of the port for a protocol.
+ */
+
+func TestPortsSelect(t *testing.T) {
+	tests := []struct {
+		name     string
+		ports    Ports
+		protocol string
+		port     int32
+		secure   bool
+		err      string
+	} {
+		{
+			name:     "ldap",
+			ports:    Ports{ LDAP: 1389, LDAPS: 1636 },
+			protocol: "ldap",
+			port:     1389,
+		},
+		{
+			name:     "ldaps",
+			ports:    Ports{ LDAP: 1389, LDAPS: 1636 },
+			protocol: "ldaps",
+			port:     1636,
+			secure:   true,
+		},
+		{
+			name:     "default to ldap",
+			ports:    Ports{ LDAP: 1389, LDAPS: 1636 },
+			port:     1389,
+		},
+		{
+			name:     "default to ldaps",
+			ports:    Ports{ LDAPS: 1636 },
+			port:     1636,
+			secure:   true,
+		},
+		{
+			name:     "ldap disabled",
+			ports:    Ports{ LDAPS: 1636 },
+			protocol: "ldap",
+			secure:   false,
+			err:      "the LDAP port has not been enabled",
+		},
+		{
+			name:     "ldaps disabled",
+			ports:    Ports{ LDAP: 1389 },
+			protocol: "ldaps",
+			secure:   true,
+			err:      "the LDAPS port has not been enabled",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			port, secure, err := test.ports.Select(test.protocol)
+
+			checkTestError(t, err, test.err)
+
+			if port != test.port || secure != test.secure {
+				t.Errorf("Expected %d/%t, got %d/%t",
+						test.port, test.secure, port, secure)
+			}
+		})
+	}
+}
+
+/*****************************************************************************/
+
@@ -83,9 +83,10 @@ func main() {
 	utils.K8sClient = mgr.GetClient()
 
 	if err = (&controllers.IBMSecurityVerifyDirectoryReconciler{
-		Client: mgr.GetClient(),
-		Log:    ctrl.Log.WithName("controllers").WithName("IBMSecurityVerifyDirectory"),
-		Scheme: mgr.GetScheme(),
+		Client:   mgr.GetClient(),
+		Log:      ctrl.Log.WithName("controllers").WithName("IBMSecurityVerifyDirectory"),
+		Scheme:   mgr.GetScheme(),
+		Recorder: mgr.GetEventRecorderFor("verify-directory-operator"),
 	}).SetupWithManager(mgr); err != nil {
 		setupLog.Error(err, "unable to create controller", "controller", "IBMSecurityVerifyDirectory")
 		os.Exit(1)
@@ -94,6 +95,14 @@ func main() {
 		setupLog.Error(err, "unable to create webhook", "webhook", "IBMSecurityVerifyDirectory")
 		os.Exit(1)
 	}
+	if err = (&controllers.IBMSecurityVerifyDirectoryBackupReconciler{
+		Client: mgr.GetClient(),
+		Log:    ctrl.Log.WithName("controllers").WithName("IBMSecurityVerifyDirectoryBackup"),
+		Scheme: mgr.GetScheme(),
+	}).SetupWithManager(mgr); err != nil {
+		setupLog.Error(err, "unable to create controller", "controller", "IBMSecurityVerifyDirectoryBackup")
+		os.Exit(1)
+	}
 	//+kubebuilder:scaffold:builder
 
 	if err := mgr.AddHealthzCheck("healthz", healthz.Ping); err != nil {
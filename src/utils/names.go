@@ -22,9 +22,60 @@ import (
  * Some constants...
  */
 
-const PVCLabel   = "app.kubernetes.io/pvc-name"
-var   ProxyCMKey = "config.yaml"
+const PVCLabel    = "app.kubernetes.io/pvc-name"
+const BackupLabel = "app.kubernetes.io/backup-name"
+var   ProxyCMKey  = "config.yaml"
 
+/*
+ * The annotations which are added to the events which are recorded against
+ * a document.
+ */
+
+const EventPVCAnnotation = "ibm.com/pvc-name"
+const EventPodAnnotation = "ibm.com/pod-name"
+
+/*
+ * The keys of the secret which holds the generated credentials.
+ */
+
+const AdminPwdKey       = "admin_password"
+const ReplicationPwdKey = "replication_password"
+
+/*
+ * The keys of the secret which hold the credentials which are currently
+ * applied to the replicas.  These are used to detect changes to the
+ * generated credentials, and to roll back a failed rotation.
+ */
+
+const AppliedAdminPwdKey       = "applied_admin_password"
+const AppliedReplicationPwdKey = "applied_replication_password"
+
+/*
+ * The annotation which can be used to request a rotation of the generated
+ * credentials.  A rotation is performed each time the value changes.
+ */
+
+const RotateCredentialsAnnotation = "ibm.com/rotate-credentials"
+
+
+/*
+ * The directory into which the secret holding the certificate issued by
+ * cert-manager is mounted, along with the files within the secret which hold
+ * the combined certificate and private key, and the certificate of the
+ * issuing CA.  The CA certificate is not provided by every issuer.
+ */
+
+const TLSMountPath = "/var/isvd/tls"
+const TLSKeyFile   = "tls-combined.pem"
+const TLSCAFile    = "ca.crt"
+
+/*
+ * The annotation which records the revision of the certificate which has
+ * been mounted into a pod, so that the pod can be restarted when the
+ * certificate is renewed.
+ */
+
+const TLSRevisionAnnotation = "ibm.com/tls-revision"
 
 /*****************************************************************************/
 
@@ -50,6 +101,32 @@ func GetProxyConfigMapName(name string) (string) {
 
 /*****************************************************************************/
 
+/*
+ * The following function is used to generate the name of the secret which
+ * holds the credentials which have been generated by the operator.
+ */
+
+func GetCredentialsSecretName(name string, secretName string) (string) {
+	if secretName != "" {
+		return secretName
+	}
+
+	return strings.ToLower(fmt.Sprintf("%s-credentials", name))
+}
+
+/*****************************************************************************/
+
+/*
+ * The following function is used to generate the name of the certificate,
+ * and the corresponding secret, which is requested for a service.
+ */
+
+func GetCertificateName(name string) (string) {
+	return strings.ToLower(fmt.Sprintf("%s-tls", name))
+}
+
+/*****************************************************************************/
+
 /*
  * Construct and return a list of labels for the deployment.
  */
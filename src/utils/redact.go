@@ -0,0 +1,379 @@
+/* vi: set ts=4 sw=4 noexpandtab : */
+
+/*
+ * Copyright contributors to the IBM Security Verify Directory Operator project
+ */
+
+package utils
+
+/*
+ * This file contains the functions which are used to redact sensitive
+ * information (e.g. passwords, keys) from the data which is logged by the
+ * operator.
+ */
+
+/*****************************************************************************/
+
+import (
+	appsv1  "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1  "k8s.io/api/core/v1"
+
+	"encoding/json"
+	"strings"
+	"sync"
+
+	"github.com/go-yaml/yaml"
+)
+
+/*****************************************************************************/
+
+/*
+ * Some constants...
+ */
+
+const RedactedValue = "XXX"
+
+/*
+ * The minimum length of a secret value which will be tracked.  Shorter values
+ * (e.g. a port number which has been stored in a secret) would cause too
+ * much unrelated log data to be masked.
+ */
+
+const minSecretValueLen = 4
+
+/*
+ * The names of the configuration entries whose values are always sensitive.
+ */
+
+var sensitiveKeys = map[string]bool {
+	"pwd":       true,
+	"key":       true,
+	"key-stash": true,
+	"password":  true,
+}
+
+/*
+ * The values which have been resolved from a Kubernetes secret, or from a
+ * sensitive configuration entry.  Any occurrence of these values within
+ * logged data will be masked.
+ */
+
+var secretValues sync.Map
+
+/*****************************************************************************/
+
+/*
+ * The following function is used to register a value which has been obtained
+ * from a Kubernetes secret, or from a sensitive configuration entry, so that
+ * it is never written to the log.
+ */
+
+func RegisterSecretValue(value string) {
+	if len(value) >= minSecretValueLen {
+		secretValues.Store(value, true)
+	}
+}
+
+/*****************************************************************************/
+
+/*
+ * The following function is used to determine whether the specified
+ * configuration key (e.g. general.admin.pwd) holds sensitive data.
+ */
+
+func IsSensitiveKey(name string) bool {
+	name = strings.ToLower(name)
+
+	if idx := strings.LastIndex(name, "."); idx != -1 {
+		name = name[idx+1:]
+	}
+
+	return sensitiveKeys[name]
+}
+
+/*****************************************************************************/
+
+/*
+ * The following function is used to determine whether the specified
+ * environment variable (e.g. LDAP_ADMIN_PWD) holds sensitive data.
+ */
+
+func isSensitiveEnv(name string) bool {
+	name = strings.ToLower(name)
+
+	if idx := strings.LastIndex(name, "_"); idx != -1 {
+		name = name[idx+1:]
+	}
+
+	return IsSensitiveKey(name)
+}
+
+/*****************************************************************************/
+
+/*
+ * The following function is used to determine whether the specified logging
+ * parameter name refers to sensitive data.  This is a little stricter than
+ * IsSensitiveKey as parameters such as 'ConfigMap.Key' refer to the name of
+ * a key, and not the key itself.
+ */
+
+func isSensitiveParam(name string) bool {
+	name = strings.ToLower(name)
+
+	if name == "license.key" || name == "key-stash" {
+		return true
+	}
+
+	return IsSensitiveKey(name) && ! strings.HasSuffix(name, "key")
+}
+
+/*****************************************************************************/
+
+/*
+ * The following function is used to redact a list of logging parameters
+ * (name/value pairs).  The redaction of each value is deferred until the
+ * value is actually written to the log.
+ */
+
+func RedactLogParams(params []interface{}) []interface{} {
+	for idx := 1; idx < len(params); idx += 2 {
+		name, _ := params[idx-1].(string)
+
+		if isSensitiveParam(name) {
+			params[idx] = RedactedValue
+		} else {
+			params[idx] = redactable{ value: params[idx] }
+		}
+	}
+
+	return params
+}
+
+/*****************************************************************************/
+
+/*
+ * The redactable type wraps a logged value so that the value is only
+ * redacted when the log entry is actually going to be written.
+ */
+
+type redactable struct {
+	value interface{}
+}
+
+func (r redactable) MarshalLog() interface{} {
+	return Redact(r.value)
+}
+
+/*****************************************************************************/
+
+/*
+ * The following function will return a copy of the specified value with all
+ * sensitive data masked.
+ */
+
+func Redact(value interface{}) interface{} {
+	switch x := value.(type) {
+
+		case string:
+			return redactString(x)
+
+		case map[string]interface{}, []interface{}:
+			return redactYaml(x, "")
+
+		case *corev1.ConfigMap:
+			if x == nil {
+				return x
+			}
+
+			cm := x.DeepCopy()
+
+			for key, data := range cm.Data {
+				cm.Data[key] = redactString(data)
+			}
+
+			for key, _ := range cm.BinaryData {
+				cm.BinaryData[key] = []byte(RedactedValue)
+			}
+
+			return cm
+
+		case *corev1.Secret:
+			if x == nil {
+				return x
+			}
+
+			secret := x.DeepCopy()
+
+			for key, _ := range secret.Data {
+				secret.Data[key] = []byte(RedactedValue)
+			}
+
+			for key, _ := range secret.StringData {
+				secret.StringData[key] = RedactedValue
+			}
+
+			return secret
+
+		case *corev1.Pod:
+			if x == nil {
+				return x
+			}
+
+			pod := x.DeepCopy()
+
+			redactPodSpec(&pod.Spec)
+
+			return pod
+
+		case *batchv1.Job:
+			if x == nil {
+				return x
+			}
+
+			job := x.DeepCopy()
+
+			redactPodSpec(&job.Spec.Template.Spec)
+
+			return job
+
+		case *appsv1.Deployment:
+			if x == nil {
+				return x
+			}
+
+			dep := x.DeepCopy()
+
+			redactPodSpec(&dep.Spec.Template.Spec)
+
+			return dep
+	}
+
+	return value
+}
+
+/*****************************************************************************/
+
+/*
+ * The following function is used to redact a string.  Any secret values are
+ * masked, and if the string contains a YAML or JSON document the sensitive
+ * entries within the document are masked.  A multi-line string which cannot
+ * be parsed (e.g. a malformed configuration document) is masked entirely, as
+ * we have no way of locating the sensitive entries within it.
+ */
+
+func redactString(value string) string {
+	secretValues.Range(func(key, _ interface{}) bool {
+		value = strings.ReplaceAll(value, key.(string), RedactedValue)
+
+		return true
+	})
+
+	if ! strings.ContainsAny(value, ":\n") {
+		return value
+	}
+
+	var body interface{}
+
+	if err := yaml.Unmarshal([]byte(value), &body); err != nil {
+		if strings.Contains(strings.TrimSpace(value), "\n") {
+			return RedactedValue
+		}
+
+		return value
+	}
+
+	body = ConvertYaml(body)
+
+	switch body.(type) {
+		case map[string]interface{}, []interface{}:
+		default:
+			return value
+	}
+
+	body = redactYaml(body, "")
+
+	var data []byte
+	var err  error
+
+	if strings.HasPrefix(strings.TrimSpace(value), "{") {
+		data, err = json.Marshal(body)
+	} else {
+		data, err = yaml.Marshal(body)
+	}
+
+	if err != nil {
+		return RedactedValue
+	}
+
+	return string(data)
+}
+
+/*****************************************************************************/
+
+/*
+ * The following function will return a copy of the parsed YAML with the
+ * sensitive entries masked.
+ */
+
+func redactYaml(value interface{}, name string) interface{} {
+	if IsSensitiveKey(name) {
+		switch value.(type) {
+			case map[string]interface{}, []interface{}:
+			default:
+				return RedactedValue
+		}
+	}
+
+	switch x := value.(type) {
+
+		case map[string]interface{}:
+			m2 := make(map[string]interface{}, len(x))
+
+			for k, v := range x {
+				m2[k] = redactYaml(v, k)
+			}
+
+			return m2
+
+		case []interface{}:
+			s2 := make([]interface{}, len(x))
+
+			for i, v := range x {
+				s2[i] = redactYaml(v, name)
+			}
+
+			return s2
+
+		case string:
+			return redactString(x)
+	}
+
+	return value
+}
+
+/*****************************************************************************/
+
+/*
+ * The following function is used to mask the sensitive environment variables
+ * in a pod specification.
+ */
+
+func redactPodSpec(spec *corev1.PodSpec) {
+	containers := [][]corev1.Container { spec.InitContainers, spec.Containers }
+
+	for _, list := range containers {
+		for cidx, _ := range list {
+			for eidx, env := range list[cidx].Env {
+				if IsSensitiveKey(env.Name) || isSensitiveEnv(env.Name) {
+					list[cidx].Env[eidx].Value = RedactedValue
+				} else {
+					list[cidx].Env[eidx].Value = redactString(env.Value)
+				}
+			}
+		}
+	}
+}
+
+/*****************************************************************************/
+
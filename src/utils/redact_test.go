@@ -0,0 +1,168 @@
+/* vi: set ts=4 sw=4 noexpandtab : */
+
+/*
+ * Copyright contributors to the IBM Security Verify Directory Operator project
+ */
+
+package utils
+
+/*
+ * This file contains the tests for the redaction of sensitive information
+ * from the logged data.
+ */
+
+/*****************************************************************************/
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/go-logr/logr"
+)
+
+/*****************************************************************************/
+
+/*
+ * Test the identification of the sensitive configuration keys.
+ */
+
+func TestIsSensitiveKey(t *testing.T) {
+	tests := []struct {
+		name      string
+		sensitive bool
+	} {
+		{ "general.admin.pwd",                     true  },
+		{ "server.replication.admin.pwd",          true  },
+		{ "general.key-stash",                     true  },
+		{ "general.license.key",                   true  },
+		{ "keyfile.keys[0].key",                   true  },
+		{ "password",                              true  },
+		{ "General.Admin.PWD",                     true  },
+		{ "general.admin.dn",                      false },
+		{ "general.ports.ldap",                    false },
+		{ "pwd-file",                              false },
+		{ "",                                      false },
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if sensitive := IsSensitiveKey(test.name);
+								sensitive != test.sensitive {
+				t.Errorf("Expected %t, got %t", test.sensitive, sensitive)
+			}
+		})
+	}
+}
+
+/*****************************************************************************/
+
+/*
+ * Test the redaction of the logging parameters.  The parameters which refer
+ * to sensitive data are masked straight away, whereas the remaining
+ * parameters are only redacted when they are written to the log.
+ */
+
+func TestRedactLogParams(t *testing.T) {
+	RegisterSecretValue("log-passw0rd")
+
+	tests := []struct {
+		name     string
+		value    interface{}
+		expected interface{}
+	} {
+		{ "Admin.Pwd",      "passw0rd",             RedactedValue       },
+		{ "License.Key",    "license",              RedactedValue       },
+		{ "Key-Stash",      "stash",                RedactedValue       },
+		{ "ConfigMap.Key",  "config.yaml",          "config.yaml"       },
+		{ "PVC.Name",       "replica-1",            "replica-1"         },
+		{ "Error",          "bind failed, log-passw0rd",
+										"bind failed, " + RedactedValue    },
+		{ "Port",           9389,                   9389                },
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			params := RedactLogParams([]interface{}{ test.name, test.value })
+
+			if len(params) != 2 || params[0] != test.name {
+				t.Fatalf("The parameter names were modified: %v", params)
+			}
+
+			value := params[1]
+
+			if marshaler, ok := value.(logr.Marshaler); ok {
+				value = marshaler.MarshalLog()
+			}
+
+			if value != test.expected {
+				t.Errorf("Expected %v, got %v", test.expected, value)
+			}
+		})
+	}
+}
+
+/*****************************************************************************/
+
+/*
+ * Test the redaction of the sensitive entries within a YAML document.
+ */
+
+func TestRedactYamlString(t *testing.T) {
+	data := "general:\n" +
+			"  admin:\n" +
+			"    dn: cn=root\n" +
+			"    pwd: passw0rd\n" +
+			"  key-stash: stash\n"
+
+	redacted, ok := Redact(data).(string)
+
+	if ! ok {
+		t.Fatalf("A string was not returned.")
+	}
+
+	if strings.Contains(redacted, "passw0rd") ||
+							strings.Contains(redacted, ": stash") {
+		t.Errorf("The sensitive entries were not redacted: %s", redacted)
+	}
+
+	if ! strings.Contains(redacted, "cn=root") {
+		t.Errorf("The non-sensitive entries were redacted: %s", redacted)
+	}
+}
+
+/*****************************************************************************/
+
+/*
+ * Test the redaction of a malformed YAML document, which must be masked
+ * entirely as the sensitive entries cannot be located.
+ */
+
+func TestRedactMalformedYamlString(t *testing.T) {
+	tests := []struct {
+		name     string
+		value    string
+		expected string
+	} {
+		{
+			name:     "malformed document",
+			value:    "general:\n  admin:\n    pwd: passw0rd\n   key-stash: [",
+			expected: RedactedValue,
+		},
+		{
+			name:     "single line",
+			value:    "bind failed: [",
+			expected: "bind failed: [",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if redacted := Redact(test.value); redacted != test.expected {
+				t.Errorf("Expected %v, got %v", test.expected, redacted)
+			}
+		})
+	}
+}
+
+/*****************************************************************************/
+
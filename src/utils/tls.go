@@ -0,0 +1,148 @@
+/* vi: set ts=4 sw=4 noexpandtab : */
+
+/*
+ * Copyright contributors to the IBM Security Verify Directory Operator project
+ */
+
+package utils
+
+/*
+ * This file contains the functions which are used to construct the TLS
+ * configuration for the LDAP connections which are initiated by the
+ * operator.
+ */
+
+/*****************************************************************************/
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+)
+
+/*****************************************************************************/
+
+/*
+ * The following function will return the list of PEM encoded CA certificates
+ * which are used to verify the certificates presented by the proxy and
+ * the replicas.  If a CA bundle has been specified it will be used,
+ * otherwise the trusted certificates from the proxy configuration are used,
+ * along with the CA which issued the managed proxy certificate.
+ */
+
+func GetTrustedCertificates(
+			body       interface{},
+			caBundle   string,
+			managedCA  string,
+			rctx       *ResolveContext) (certs []string, err error) {
+
+	/*
+	 * Use the CA bundle if one has been specified.
+	 */
+
+	if caBundle != "" {
+		var entry interface{}
+
+		entry, err = ResolveEntry(caBundle, rctx)
+
+		if err != nil {
+			err = errors.New(fmt.Sprintf(
+					"The CA bundle cannot be resolved.  %s", err.Error()))
+
+			return
+		}
+
+		certs = append(certs, fmt.Sprintf("%v", entry))
+
+		return
+	}
+
+	/*
+	 * Add the trusted certificates from the proxy configuration.  The CA
+	 * of the managed certificates is only available within the proxy
+	 * container and so it is retrieved directly from the certificate
+	 * secret instead.  Not every issuer provides the CA certificate, and so
+	 * the CA certificate is optional.
+	 */
+
+	trusted, err := GetYamlValue(body,
+				[]string{"keyfile", "trusted-certificates"}, false, rctx)
+
+	if err != nil {
+		return
+	}
+
+	list, _ := trusted.([]interface{})
+
+	for _, item := range list {
+		value, ok := item.(string)
+
+		if ! ok || value == fmt.Sprintf(
+							"file:%s/%s", TLSMountPath, TLSCAFile) {
+			continue
+		}
+
+		var entry interface{}
+
+		entry, err = ResolveEntry(value, rctx)
+
+		if err != nil {
+			err = errors.New(fmt.Sprintf("The keyfile.trusted-certificates " +
+					"configuration entry cannot be resolved.  %s", err.Error()))
+
+			return
+		}
+
+		certs = append(certs, fmt.Sprintf("%v", entry))
+	}
+
+	if managedCA != "" {
+		var entry interface{}
+
+		entry, err = resolveSecret(rctx.Namespace, managedCA, TLSCAFile, true)
+
+		if err != nil {
+			return
+		}
+
+		if entry != nil {
+			certs = append(certs, fmt.Sprintf("%v", entry))
+		}
+	}
+
+	return
+}
+
+/*****************************************************************************/
+
+/*
+ * The following function is used to construct the TLS configuration which
+ * will verify the certificate presented by the server against the supplied
+ * CA certificates and the server name.
+ */
+
+func NewTLSConfig(serverName string, certs []string) (*tls.Config, error) {
+	pool  := x509.NewCertPool()
+	added := false
+
+	for _, cert := range certs {
+		if pool.AppendCertsFromPEM([]byte(cert)) {
+			added = true
+		}
+	}
+
+	if ! added {
+		return nil, errors.New(fmt.Sprintf("No CA certificates are " +
+				"available to verify the certificate of %s.", serverName))
+	}
+
+	return &tls.Config{
+		RootCAs:    pool,
+		ServerName: serverName,
+		MinVersion: tls.VersionTLS12,
+	}, nil
+}
+
+/*****************************************************************************/
+
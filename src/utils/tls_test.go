@@ -0,0 +1,203 @@
+/* vi: set ts=4 sw=4 noexpandtab : */
+
+/*
+ * Copyright contributors to the IBM Security Verify Directory Operator project
+ */
+
+package utils
+
+/*
+ * This file contains the tests for the construction of the TLS
+ * configuration.
+ */
+
+/*****************************************************************************/
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+/*****************************************************************************/
+
+/*
+ * The following function will generate a self-signed CA certificate, in
+ * PEM format.
+ */
+
+func newTestCertificate(t *testing.T) string {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{ CommonName: "isvd-ca" },
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+
+	der, err := x509.CreateCertificate(
+						rand.Reader, template, template, &key.PublicKey, key)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return string(pem.EncodeToMemory(
+						&pem.Block{ Type: "CERTIFICATE", Bytes: der }))
+}
+
+/*****************************************************************************/
+
+/*
+ * Test the construction of the TLS configuration.
+ */
+
+func TestNewTLSConfig(t *testing.T) {
+	cert := newTestCertificate(t)
+
+	tests := []struct {
+		name  string
+		certs []string
+		valid bool
+	} {
+		{ "certificate",               []string{ cert },              true  },
+		{ "invalid and valid",         []string{ "invalid", cert },   true  },
+		{ "invalid certificate",       []string{ "invalid" },         false },
+		{ "no certificates",           nil,                           false },
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config, err := NewTLSConfig("isvd-replica-1", test.certs)
+
+			if ! test.valid {
+				if err == nil {
+					t.Errorf("An error was not returned.")
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("An unexpected error was returned: %s", err.Error())
+			}
+
+			if config.ServerName != "isvd-replica-1" ||
+						config.MinVersion != tls.VersionTLS12 ||
+						config.RootCAs == nil ||
+						config.InsecureSkipVerify {
+				t.Errorf("The TLS configuration is incorrect: %+v", config)
+			}
+		})
+	}
+}
+
+/*****************************************************************************/
+
+/*
+ * Test the retrieval of the trusted certificates.  The CA of the managed
+ * certificate is optional, as it is not provided by every issuer.
+ */
+
+func TestGetTrustedCertificates(t *testing.T) {
+	withCA := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "isvd-proxy-tls",
+			Namespace: "default",
+		},
+		Data: map[string][]byte{
+			"tls.crt": []byte("proxy-cert"),
+			TLSCAFile: []byte("managed-ca"),
+		},
+	}
+
+	withoutCA := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "isvd-other-tls",
+			Namespace: "default",
+		},
+		Data: map[string][]byte{
+			"tls.crt": []byte("other-cert"),
+		},
+	}
+
+	previous := K8sClient
+	K8sClient = fake.NewClientBuilder().WithObjects(withCA, withoutCA).Build()
+
+	t.Cleanup(func() {
+		K8sClient = previous
+	})
+
+	rctx := &ResolveContext{ Namespace: "default" }
+
+	body := map[string]interface{} {
+		"keyfile": map[string]interface{} {
+			"trusted-certificates": []interface{} {
+				"proxy-trusted",
+				"file:" + TLSMountPath + "/" + TLSCAFile,
+			},
+		},
+	}
+
+	tests := []struct {
+		name      string
+		caBundle  string
+		managedCA string
+		expected  []string
+	} {
+		{ "managed CA",    "",          "isvd-proxy-tls",
+						[]string{ "proxy-trusted", "managed-ca" }    },
+		{ "no managed CA", "",          "isvd-other-tls",
+						[]string{ "proxy-trusted" }                  },
+		{ "missing secret", "",         "isvd-missing-tls",
+						[]string{ "proxy-trusted" }                  },
+		{ "unmanaged",     "",          "",
+						[]string{ "proxy-trusted" }                  },
+		{ "CA bundle",     "bundle",    "isvd-proxy-tls",
+						[]string{ "bundle" }                         },
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			certs, err := GetTrustedCertificates(
+							body, test.caBundle, test.managedCA, rctx)
+
+			if err != nil {
+				t.Fatalf("An unexpected error was returned: %s", err.Error())
+			}
+
+			if len(certs) != len(test.expected) {
+				t.Fatalf("Expected %v, got %v", test.expected, certs)
+			}
+
+			for idx, cert := range certs {
+				if cert != test.expected[idx] {
+					t.Errorf("Expected %v, got %v", test.expected, certs)
+				}
+			}
+		})
+	}
+}
+
+/*****************************************************************************/
+
@@ -17,9 +17,16 @@ import (
 	corev1 "k8s.io/api/core/v1"
 
 	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
 	"regexp"
+	"sort"
+	"strconv"
 	"strings"
 
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+
     "sigs.k8s.io/controller-runtime/pkg/client"
 )
 
@@ -64,14 +71,31 @@ func ConvertYaml(
 /*****************************************************************************/
 
 /*
- * Retrieve the value of the specified YAML.
+ * The following structure contains the information which is required to
+ * resolve a configuration entry.  This includes the namespace which holds
+ * any referenced secrets and ConfigMaps, along with the environment which
+ * will be made available to the containers.
+ */
+
+type ResolveContext struct {
+	Namespace string
+	Env       []corev1.EnvVar
+	EnvFrom   []corev1.EnvFromSource
+}
+
+/*****************************************************************************/
+
+/*
+ * Retrieve the value of the specified YAML.  A nil value will be returned if
+ * the entry does not exist, and an error will be returned if the entry 
+ * exists but could not be resolved.
  */
 
 func GetYamlValue(
-					i         interface{},
-					key       []string,
-					resolve   bool,
-					namespace string) interface{} {
+					i       interface{},
+					key     []string,
+					resolve bool,
+					rctx    *ResolveContext) (interface{}, error) {
 
 	/*
 	 * The first thing to do is cast the yaml to the correct type.
@@ -80,7 +104,7 @@ func GetYamlValue(
 	v, ok := i.(map[string]interface{}) 
 
 	if !ok {
-		return nil
+		return nil, nil
 	}
 
 	/*
@@ -90,7 +114,7 @@ func GetYamlValue(
 	entry, ok := v[key[0]]
 
 	if !ok {
-		return nil
+		return nil, nil
 	}
 
 	/*
@@ -101,9 +125,9 @@ func GetYamlValue(
 
 	if len(key) == 1 {
 		if resolve {
-			return ResolveEntry(entry, namespace)
+			return ResolveNamedEntry(key[0], entry, rctx)
 		} else {
-			return entry
+			return entry, nil
 		}
 	}
 
@@ -112,49 +136,537 @@ func GetYamlValue(
 	 * again, moving to the next key.
 	 */
 
-	return GetYamlValue(entry, key[1:], resolve, namespace)
+	return GetYamlValue(entry, key[1:], resolve, rctx)
+}
+
+/*****************************************************************************/
+
+/*
+ * Convert the specified YAML entry into an integer.  Resolved entries are
+ * always returned as strings and so we need to handle integers which have
+ * been supplied as a string.
+ */
+
+func GetYamlInt(entry interface{}) (int, bool) {
+	switch x := entry.(type) {
+		case int:
+			return x, true
+
+		case string:
+			value, err := strconv.Atoi(strings.TrimSpace(x))
+
+			return value, err == nil
+	}
+
+	return 0, false
 }
 
+/*****************************************************************************/
+
+/*
+ * Resolve the specified YAML entry.  The supported formats are the same as
+ * those supported by the Verify Directory images:
+ *    secret:<name>/<key>
+ *    configmap:<name>/<key>
+ *    env:<name>
+ *    B64:<base64 encoded value>
+ *
+ * Any other entry is returned unchanged.
+ */
+
+func ResolveEntry(
+				entry interface{}, 
+				rctx  *ResolveContext) (interface{}, error) {
+	return resolveEntry("", entry, rctx)
+}
 
 /*****************************************************************************/
 
 /*
- * Resolve the specified YAML entry.
+ * Resolve the specified YAML entry.  The name of the entry, if known, is
+ * used when reporting an invalid entry.  The entry itself is never included
+ * in the error as it may hold sensitive data.
  */
 
-func ResolveEntry(entry interface{}, namespace string) interface{} {
+func resolveEntry(
+				name  string,
+				entry interface{}, 
+				rctx  *ResolveContext) (interface{}, error) {
 
 	unresolved, ok := entry.(string)
 
-	if ok {
-		if strings.HasPrefix(unresolved, "secret:") {
-			entry = nil
+	if !ok {
+		return entry, nil
+	}
+
+	switch {
+		case strings.HasPrefix(unresolved, "secret:"):
+			name, key, err := splitReference(unresolved, "secret:")
+
+			if err != nil {
+				return nil, err
+			}
+
+			return resolveSecret(rctx.Namespace, name, key, false)
+
+		case strings.HasPrefix(unresolved, "configmap:"):
+			name, key, err := splitReference(unresolved, "configmap:")
+
+			if err != nil {
+				return nil, err
+			}
+
+			return resolveConfigMap(rctx.Namespace, name, key, false)
+
+		case strings.HasPrefix(unresolved, "env:"):
+			return resolveEnv(rctx, strings.TrimPrefix(unresolved, "env:"))
+
+		case strings.HasPrefix(unresolved, "B64:"):
+			value, err := base64.StdEncoding.DecodeString(
+								strings.TrimPrefix(unresolved, "B64:"))
+
+			if err != nil {
+				if name == "" {
+					return nil, errors.New(fmt.Sprintf("A base64 encoded " +
+						"configuration entry is invalid: %s", err.Error()))
+				}
+
+				return nil, errors.New(fmt.Sprintf("The base64 encoded " +
+					"configuration entry, %s, is invalid: %s", 
+					name, err.Error()))
+			}
+
+			return string(value), nil
+	}
+
+	return entry, nil
+}
+
+/*****************************************************************************/
+
+/*
+ * Resolve the specified named YAML entry.  If the name of the entry (e.g.
+ * general.admin.pwd) indicates that the entry holds sensitive data the
+ * resolved value is registered so that it is never written to the log.  This
+ * is required as only the values which are obtained from a secret are
+ * otherwise registered, and a B64, ConfigMap or environment entry can hold
+ * sensitive data just as easily.
+ */
+
+func ResolveNamedEntry(
+				name  string,
+				entry interface{}, 
+				rctx  *ResolveContext) (interface{}, error) {
+
+	value, err := resolveEntry(name, entry, rctx)
+
+	if err == nil && value != nil && IsSensitiveKey(name) {
+		RegisterSecretValue(fmt.Sprintf("%v", value))
+	}
+
+	return value, err
+}
+
+/*****************************************************************************/
+
+/*
+ * The following function will return an environment variable which can be 
+ * used to pass the specified configuration entry to a container.  Secret and
+ * ConfigMap references are passed by reference, and so the resolved value
+ * is not added to the container definition.
+ */
+
+func GetEnvVar(name string, entry string) (env corev1.EnvVar, err error) {
+	env.Name = name
+
+	switch {
+		case strings.HasPrefix(entry, "secret:"):
+			var secretName, key string
+
+			secretName, key, err = splitReference(entry, "secret:")
+
+			env.ValueFrom = &corev1.EnvVarSource {
+				SecretKeyRef: &corev1.SecretKeySelector {
+					LocalObjectReference: corev1.LocalObjectReference{
+						Name: secretName,
+					},
+					Key: key,
+				},
+			}
+
+		case strings.HasPrefix(entry, "configmap:"):
+			var configMapName, key string
+
+			configMapName, key, err = splitReference(entry, "configmap:")
+
+			env.ValueFrom = &corev1.EnvVarSource {
+				ConfigMapKeyRef: &corev1.ConfigMapKeySelector {
+					LocalObjectReference: corev1.LocalObjectReference{
+						Name: configMapName,
+					},
+					Key: key,
+				},
+			}
+
+		case strings.HasPrefix(entry, "env:"):
+			env.Value = fmt.Sprintf("$(%s)", strings.TrimPrefix(entry, "env:"))
 
-			expr  := "secret:(.[^/]*)/(.*)"
-			re    := regexp.MustCompile(expr)
-			match := re.FindStringSubmatch(unresolved)
+		default:
+			var value interface{}
 
-			if len(match) == 3 {
-				secret := &corev1.Secret{}
-				err    := K8sClient.Get(context.TODO(), client.ObjectKey{
-								Namespace: namespace,
-								Name:      match[1],
-							}, secret)
+			value, err = ResolveEntry(entry, nil)
 
-				if err == nil {
-					value, ok := secret.Data[match[2]]
+			if err == nil {
+				env.Value = fmt.Sprintf("%v", value)
 
-					if ok {
-						entry = string(value)
-					}
+				if isSensitiveEnv(name) {
+					RegisterSecretValue(env.Value)
 				}
 			}
+	}
+
+	return
+}
+
+/*****************************************************************************/
+
+/*
+ * Split a reference of the form <prefix><name>/<key> into the name and key.
+ */
+
+func splitReference(
+				reference string, 
+				prefix    string) (name string, key string, err error) {
+
+	re    := regexp.MustCompile(fmt.Sprintf("^%s(.[^/]*)/(.+)$", prefix))
+	match := re.FindStringSubmatch(reference)
+
+	if len(match) != 3 {
+		err = errors.New(fmt.Sprintf(
+				"The configuration entry, %s, is incorrect.  The entry " +
+				"should be of the format: %s<name>/<key>", reference, prefix))
+
+		return
+	}
+
+	return match[1], match[2], nil
+}
+
+/*****************************************************************************/
+
+/*
+ * Retrieve the value of a key from the specified secret.  If the secret is
+ * optional a missing secret or key will result in a nil value being 
+ * returned.
+ */
+
+func resolveSecret(
+				namespace string,
+				name      string, 
+				key       string,
+				optional  bool) (interface{}, error) {
+
+	secret := &corev1.Secret{}
+	err    := K8sClient.Get(context.TODO(), client.ObjectKey{
+						Namespace: namespace,
+						Name:      name,
+					}, secret)
+
+	if err != nil {
+		if k8serrors.IsNotFound(err) {
+			if optional {
+				return nil, nil
+			}
+
+			err = errors.New(
+					fmt.Sprintf("The secret, %s, doesn't exist!", name))
+		}
+
+		return nil, err
+	}
+
+	value, ok := secret.Data[key]
+
+	if !ok {
+		if optional {
+			return nil, nil
 		}
 
+		return nil, errors.New(fmt.Sprintf(
+					"The secret, %s, does not contain the %s key!", name, key))
 	}
 
-	return entry
+	RegisterSecretValue(string(value))
+
+	return string(value), nil
 }
 
 /*****************************************************************************/
 
+/*
+ * Retrieve the value of a key from the specified ConfigMap.  If the ConfigMap
+ * is optional a missing ConfigMap or key will result in a nil value being
+ * returned.
+ */
+
+func resolveConfigMap(
+				namespace string,
+				name      string, 
+				key       string,
+				optional  bool) (interface{}, error) {
+
+	cm  := &corev1.ConfigMap{}
+	err := K8sClient.Get(context.TODO(), client.ObjectKey{
+						Namespace: namespace,
+						Name:      name,
+					}, cm)
+
+	if err != nil {
+		if k8serrors.IsNotFound(err) {
+			if optional {
+				return nil, nil
+			}
+
+			err = errors.New(
+					fmt.Sprintf("The ConfigMap, %s, doesn't exist!", name))
+		}
+
+		return nil, err
+	}
+
+	if value, ok := cm.Data[key]; ok {
+		return value, nil
+	}
+
+	if value, ok := cm.BinaryData[key]; ok {
+		return string(value), nil
+	}
+
+	if optional {
+		return nil, nil
+	}
+
+	return nil, errors.New(fmt.Sprintf(
+				"The ConfigMap, %s, does not contain the %s key!", name, key))
+}
+
+/*****************************************************************************/
+
+/*
+ * Resolve the specified environment variable.  The environment is the same
+ * as that which will be made available to the containers, and so values 
+ * defined by an Env entry take precedence over those obtained from the 
+ * EnvFrom sources.  When a variable exists in multiple EnvFrom sources the 
+ * last source takes precedence.
+ */
+
+func resolveEnv(rctx *ResolveContext, name string) (interface{}, error) {
+
+	/*
+	 * Check the explicitly defined environment variables.
+	 */
+
+	for idx := len(rctx.Env) - 1; idx >= 0; idx-- {
+		env := rctx.Env[idx]
+
+		if env.Name != name {
+			continue
+		}
+
+		if env.ValueFrom == nil {
+			return env.Value, nil
+		}
+
+		var value interface{}
+		var err   error
+
+		if ref := env.ValueFrom.SecretKeyRef; ref != nil {
+			value, err = resolveSecret(rctx.Namespace, 
+						ref.Name, ref.Key, isOptional(ref.Optional))
+		} else if ref := env.ValueFrom.ConfigMapKeyRef; ref != nil {
+			value, err = resolveConfigMap(rctx.Namespace, 
+						ref.Name, ref.Key, isOptional(ref.Optional))
+		} else {
+			return nil, errors.New(fmt.Sprintf(
+					"The environment variable, %s, uses a value source which " +
+					"cannot be resolved by the operator.", name))
+		}
+
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf(
+					"Failed to resolve the environment variable, %s: %s", 
+					name, err.Error()))
+		}
+
+		/*
+		 * An optional value source which doesn't exist results in an
+		 * empty environment variable.
+		 */
+
+		if value == nil {
+			value = ""
+		}
+
+		return value, nil
+	}
+
+	/*
+	 * Check each of the EnvFrom sources.
+	 */
+
+	for idx := len(rctx.EnvFrom) - 1; idx >= 0; idx-- {
+		source := rctx.EnvFrom[idx]
+
+		if ! strings.HasPrefix(name, source.Prefix) {
+			continue
+		}
+
+		key := strings.TrimPrefix(name, source.Prefix)
+
+		var value interface{}
+		var err   error
+
+		if ref := source.SecretRef; ref != nil {
+			value, err = resolveSecret(rctx.Namespace, 
+						ref.Name, key, true)
+
+			if err == nil && value == nil && ! isOptional(ref.Optional) {
+				err = validateSecretExists(rctx.Namespace, ref.Name)
+			}
+		} else if ref := source.ConfigMapRef; ref != nil {
+			value, err = resolveConfigMap(rctx.Namespace, 
+						ref.Name, key, true)
+
+			if err == nil && value == nil && ! isOptional(ref.Optional) {
+				err = validateConfigMapExists(rctx.Namespace, ref.Name)
+			}
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		if value != nil {
+			return value, nil
+		}
+	}
+
+	return nil, errors.New(fmt.Sprintf(
+				"The environment variable, %s, is not defined.", name))
+}
+
+/*****************************************************************************/
+
+/*
+ * Check that the specified secret exists.
+ */
+
+func validateSecretExists(namespace string, name string) error {
+	err := K8sClient.Get(context.TODO(), client.ObjectKey{
+						Namespace: namespace,
+						Name:      name,
+					}, &corev1.Secret{})
+
+	if k8serrors.IsNotFound(err) {
+		err = errors.New(fmt.Sprintf("The secret, %s, doesn't exist!", name))
+	}
+
+	return err
+}
+
+/*****************************************************************************/
+
+/*
+ * Check that the specified ConfigMap exists.
+ */
+
+func validateConfigMapExists(namespace string, name string) error {
+	err := K8sClient.Get(context.TODO(), client.ObjectKey{
+						Namespace: namespace,
+						Name:      name,
+					}, &corev1.ConfigMap{})
+
+	if k8serrors.IsNotFound(err) {
+		err = errors.New(
+					fmt.Sprintf("The ConfigMap, %s, doesn't exist!", name))
+	}
+
+	return err
+}
+
+/*****************************************************************************/
+
+/*
+ * Determine whether a reference has been marked as optional.
+ */
+
+func isOptional(optional *bool) bool {
+	return optional != nil && *optional
+}
+
+/*****************************************************************************/
+
+/*
+ * The following function is used to validate that every secret reference 
+ * (i.e. secret:<name>/<key>) within the parsed YAML can be resolved.  An 
+ * error, which identifies the configuration entry along with the missing 
+ * secret and key, is returned for the first reference which cannot be 
+ * resolved.
+ */
+
+func ValidateSecretReferences(i interface{}, rctx *ResolveContext) error {
+	return validateSecretReferences(i, "", rctx)
+}
+
+func validateSecretReferences(
+				i    interface{}, 
+				path string, 
+				rctx *ResolveContext) error {
+
+	switch x := i.(type) {
+
+		case map[string]interface{}:
+			keys := make([]string, 0, len(x))
+
+			for k, _ := range x {
+				keys = append(keys, k)
+			}
+
+			sort.Strings(keys)
+
+			for _, k := range keys {
+				v    := x[k]
+				name := k
+
+				if path != "" {
+					name = fmt.Sprintf("%s.%s", path, k)
+				}
+
+				if err := validateSecretReferences(v, name, rctx); err != nil {
+					return err
+				}
+			}
+
+		case []interface{}:
+			for idx, v := range x {
+				name := fmt.Sprintf("%s[%d]", path, idx)
+
+				if err := validateSecretReferences(v, name, rctx); err != nil {
+					return err
+				}
+			}
+
+		case string:
+			if strings.HasPrefix(x, "secret:") {
+				if _, err := ResolveEntry(x, rctx); err != nil {
+					return errors.New(fmt.Sprintf(
+						"The %s configuration entry cannot be resolved. %s",
+						path, err.Error()))
+				}
+			}
+	}
+
+	return nil
+}
+
+/*****************************************************************************/
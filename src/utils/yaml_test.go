@@ -0,0 +1,403 @@
+/* vi: set ts=4 sw=4 noexpandtab : */
+
+/*
+ * Copyright contributors to the IBM Security Verify Directory Operator project
+ */
+
+package utils
+
+/*
+ * This file contains the tests for the resolution and validation of the
+ * configuration entries.
+ */
+
+/*****************************************************************************/
+
+import (
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"strings"
+	"testing"
+
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+/*****************************************************************************/
+
+/*
+ * The following function will initialise the Kubernetes client with a fake
+ * client which contains a test secret and ConfigMap, and will return the
+ * context which is used to resolve the configuration entries.
+ */
+
+func newResolveTestContext(t *testing.T) (rctx *ResolveContext) {
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "isvd-secret",
+			Namespace: "default",
+		},
+		Data: map[string][]byte{
+			"admin_password": []byte("secret-passw0rd"),
+			"LDAP_PWD":       []byte("env-passw0rd"),
+		},
+	}
+
+	cm := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "isvd-config",
+			Namespace: "default",
+		},
+		Data: map[string]string{
+			"suffix": "o=sample",
+		},
+		BinaryData: map[string][]byte{
+			"binary": []byte("binary-value"),
+		},
+	}
+
+	previous := K8sClient
+	K8sClient = fake.NewClientBuilder().WithObjects(secret, cm).Build()
+
+	t.Cleanup(func() {
+		K8sClient = previous
+	})
+
+	optional := true
+
+	rctx = &ResolveContext{
+		Namespace: "default",
+		Env:       []corev1.EnvVar{
+			{ Name: "PLAIN",  Value: "plain-value" },
+			{ Name: "PLAIN",  Value: "last-value"  },
+			{
+				Name: "FROM_SECRET",
+				ValueFrom: &corev1.EnvVarSource{
+					SecretKeyRef: &corev1.SecretKeySelector{
+						LocalObjectReference: corev1.LocalObjectReference{
+							Name: "isvd-secret",
+						},
+						Key: "admin_password",
+					},
+				},
+			},
+			{
+				Name: "OPTIONAL",
+				ValueFrom: &corev1.EnvVarSource{
+					ConfigMapKeyRef: &corev1.ConfigMapKeySelector{
+						LocalObjectReference: corev1.LocalObjectReference{
+							Name: "missing",
+						},
+						Key:      "key",
+						Optional: &optional,
+					},
+				},
+			},
+			{
+				Name: "FIELD",
+				ValueFrom: &corev1.EnvVarSource{
+					FieldRef: &corev1.ObjectFieldSelector{
+						FieldPath: "metadata.name",
+					},
+				},
+			},
+		},
+		EnvFrom:   []corev1.EnvFromSource{
+			{
+				Prefix:    "ISVD_",
+				SecretRef: &corev1.SecretEnvSource{
+					LocalObjectReference: corev1.LocalObjectReference{
+						Name: "isvd-secret",
+					},
+				},
+			},
+			{
+				ConfigMapRef: &corev1.ConfigMapEnvSource{
+					LocalObjectReference: corev1.LocalObjectReference{
+						Name: "missing",
+					},
+					Optional: &optional,
+				},
+			},
+		},
+	}
+
+	return
+}
+
+/*****************************************************************************/
+
+/*
+ * Test the resolution of a configuration entry.
+ */
+
+func TestResolveEntry(t *testing.T) {
+	rctx := newResolveTestContext(t)
+
+	tests := []struct {
+		name     string
+		entry    interface{}
+		expected interface{}
+		err      string
+	} {
+		{
+			name:     "plain string",
+			entry:    "cn=root",
+			expected: "cn=root",
+		},
+		{
+			name:     "integer",
+			entry:    9389,
+			expected: 9389,
+		},
+		{
+			name:     "base64",
+			entry:    "B64:cGFzc3cwcmQ=",
+			expected: "passw0rd",
+		},
+		{
+			name:  "invalid base64",
+			entry: "B64:!!!",
+			err:   "A base64 encoded configuration entry is invalid",
+		},
+		{
+			name:     "secret",
+			entry:    "secret:isvd-secret/admin_password",
+			expected: "secret-passw0rd",
+		},
+		{
+			name:  "missing secret",
+			entry: "secret:missing/admin_password",
+			err:   "The secret, missing, doesn't exist!",
+		},
+		{
+			name:  "missing secret key",
+			entry: "secret:isvd-secret/missing",
+			err:   "does not contain the missing key",
+		},
+		{
+			name:  "invalid secret reference",
+			entry: "secret:isvd-secret",
+			err:   "should be of the format: secret:<name>/<key>",
+		},
+		{
+			name:     "ConfigMap",
+			entry:    "configmap:isvd-config/suffix",
+			expected: "o=sample",
+		},
+		{
+			name:     "binary ConfigMap",
+			entry:    "configmap:isvd-config/binary",
+			expected: "binary-value",
+		},
+		{
+			name:  "missing ConfigMap",
+			entry: "configmap:missing/suffix",
+			err:   "The ConfigMap, missing, doesn't exist!",
+		},
+		{
+			name:     "environment value",
+			entry:    "env:PLAIN",
+			expected: "last-value",
+		},
+		{
+			name:     "environment secret",
+			entry:    "env:FROM_SECRET",
+			expected: "secret-passw0rd",
+		},
+		{
+			name:     "optional environment value",
+			entry:    "env:OPTIONAL",
+			expected: "",
+		},
+		{
+			name:     "environment source",
+			entry:    "env:ISVD_LDAP_PWD",
+			expected: "env-passw0rd",
+		},
+		{
+			name:  "unsupported environment source",
+			entry: "env:FIELD",
+			err:   "uses a value source which cannot be resolved",
+		},
+		{
+			name:  "undefined environment variable",
+			entry: "env:UNKNOWN",
+			err:   "The environment variable, UNKNOWN, is not defined.",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			value, err := ResolveEntry(test.entry, rctx)
+
+			if test.err != "" {
+				if err == nil || ! strings.Contains(err.Error(), test.err) {
+					t.Errorf("Expected an error containing '%s', got: %v",
+							test.err, err)
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("An unexpected error was returned: %s", err.Error())
+			}
+
+			if value != test.expected {
+				t.Errorf("Expected %v, got %v", test.expected, value)
+			}
+		})
+	}
+}
+
+/*****************************************************************************/
+
+/*
+ * Test the splitting of a secret or ConfigMap reference.
+ */
+
+func TestSplitReference(t *testing.T) {
+	tests := []struct {
+		reference string
+		prefix    string
+		name      string
+		key       string
+		valid     bool
+	} {
+		{ "secret:name/key",        "secret:",    "name", "key",     true  },
+		{ "secret:name/dir/key",    "secret:",    "name", "dir/key", true  },
+		{ "configmap:name/key",     "configmap:", "name", "key",     true  },
+		{ "secret:name",            "secret:",    "",     "",        false },
+		{ "secret:name/",           "secret:",    "",     "",        false },
+		{ "secret:/key",            "secret:",    "",     "",        false },
+		{ "configmap:name/key",     "secret:",    "",     "",        false },
+	}
+
+	for _, test := range tests {
+		t.Run(test.reference, func(t *testing.T) {
+			name, key, err := splitReference(test.reference, test.prefix)
+
+			if (err == nil) != test.valid {
+				t.Fatalf("Expected valid=%t, got error: %v", test.valid, err)
+			}
+
+			if name != test.name || key != test.key {
+				t.Errorf("Expected %s/%s, got %s/%s",
+						test.name, test.key, name, key)
+			}
+		})
+	}
+}
+
+/*****************************************************************************/
+
+/*
+ * Test that an invalid named entry is reported using the name of the entry,
+ * and not the entry itself, as the entry may hold sensitive data.
+ */
+
+func TestResolveNamedEntryError(t *testing.T) {
+	_, err := ResolveNamedEntry("general.admin.pwd", "B64:passw0rd!", nil)
+
+	if err == nil {
+		t.Fatalf("An error was not returned.")
+	}
+
+	if ! strings.Contains(err.Error(), "general.admin.pwd") {
+		t.Errorf("The name of the entry was not reported: %s", err.Error())
+	}
+
+	if strings.Contains(err.Error(), "passw0rd") {
+		t.Errorf("The entry was included in the error: %s", err.Error())
+	}
+}
+
+/*****************************************************************************/
+
+/*
+ * Test the validation of the secret references within the configuration.
+ */
+
+func TestValidateSecretReferences(t *testing.T) {
+	rctx := newResolveTestContext(t)
+
+	tests := []struct {
+		name string
+		body interface{}
+		err  string
+	} {
+		{
+			name: "valid",
+			body: map[string]interface{}{
+				"general": map[string]interface{}{
+					"admin": map[string]interface{}{
+						"pwd": "secret:isvd-secret/admin_password",
+					},
+					"ports": map[string]interface{}{
+						"ldap": 9389,
+					},
+				},
+			},
+		},
+		{
+			name: "other references are ignored",
+			body: map[string]interface{}{
+				"suffix": "configmap:missing/suffix",
+				"key":    "env:UNKNOWN",
+			},
+		},
+		{
+			name: "missing secret",
+			body: map[string]interface{}{
+				"general": map[string]interface{}{
+					"admin": map[string]interface{}{
+						"pwd": "secret:missing/admin_password",
+					},
+				},
+			},
+			err: "The general.admin.pwd configuration entry cannot be " +
+					"resolved. The secret, missing, doesn't exist!",
+		},
+		{
+			name: "missing key within a list",
+			body: map[string]interface{}{
+				"keyfile": map[string]interface{}{
+					"keys": []interface{}{
+						map[string]interface{}{
+							"key": "secret:isvd-secret/admin_password",
+						},
+						map[string]interface{}{
+							"key": "secret:isvd-secret/server_key",
+						},
+					},
+				},
+			},
+			err: "The keyfile.keys[1].key configuration entry cannot be " +
+					"resolved.",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := ValidateSecretReferences(test.body, rctx)
+
+			if test.err == "" {
+				if err != nil {
+					t.Errorf("An unexpected error was returned: %s",
+							err.Error())
+				}
+
+				return
+			}
+
+			if err == nil || ! strings.Contains(err.Error(), test.err) {
+				t.Errorf("Expected an error containing '%s', got: %v",
+						test.err, err)
+			}
+		})
+	}
+}
+
+/*****************************************************************************/
+